@@ -0,0 +1,80 @@
+package elgamalcrypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"math/big"
+	"testing"
+)
+
+// TestCryptoLayer encrypts and decrypts values and the cells of a table held in memory with the
+// functions which do not touch a database, the only ones of the builds with the tag nosql:
+//
+//	go test -tags nosql
+func TestCryptoLayer(t *testing.T) {
+	if err := SelfTest(); err != nil {
+		t.Fatalf("Self test failed: %s", err)
+	}
+
+	pub, priv, _ := SetKeys(rand.Reader)
+	cypher, err := pub.Encrypt([]byte("message"), rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if m, err := priv.Decrypt(cypher); err != nil || !bytes.Equal(m, []byte("message")) {
+		t.Errorf("The message was decrypted to %q (%v)", m, err)
+	}
+	point, err := pub.EncryptPoint([]byte{0x01, 0x2c}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption as a point failed: %s", err)
+	}
+	if v, err := priv.DecryptPoint(point, 16); err != nil || v.Int64() != 300 {
+		t.Errorf("The point was decrypted to %v (%v)", v, err)
+	}
+
+	// A table of keys made in memory, whose keys are shared between the key holders
+	r := big.NewInt(0x7e57ab1e)
+	keys := TableKeys{
+		ti:   TableInfo{name: "staff", nCol: 3, colNames: []string{"id", "name", "grade"}, colTypes: []string{"BIGINT", "TEXT", "INTEGER"}, commands: []byte{0, 1, 2}},
+		R:    map[interface{}]*big.Int{int64(7): r},
+		Priv: map[string]PrivateKey{"name": priv},
+	}
+	_, keys.Priv["grade"], _ = SetKeys(rand.Reader)
+	cells := make(map[string][]byte)
+	for col, v := range map[string]interface{}{"name": "Alice", "grade": int64(30)} {
+		colPub := PublicKey{Curve: myCurve, Y: baseMultB(keys.Priv[col][0])}
+		mode := byte(1)
+		if col == "grade" {
+			mode = 2
+		}
+		if cells[col], err = EncryptValue(colPub, v, mode, r); err != nil {
+			t.Fatalf("Encryption of %s failed: %s", col, err)
+		}
+	}
+	// The shares of SetKeys are those of the key holders: any two of them decrypt the row
+	points := make(map[byte]map[string]CPoint)
+	for _, num := range []byte{1, 2, 3} {
+		part, err := keys.ExtractPart(num)
+		if err != nil {
+			t.Fatalf("Extraction of the part %d failed: %s", num, err)
+		}
+		points[num] = make(map[string]CPoint)
+		for col := range cells {
+			points[num][col] = part.GiveKeyPoint(NewCoord(col, int64(7)))
+		}
+	}
+	for _, pair := range [][2]byte{{1, 2}, {1, 3}, {2, 3}} {
+		colKeys := make(map[string]map[int]CPoint)
+		for col := range cells {
+			colKeys[col] = map[int]CPoint{int(pair[0]): points[pair[0]][col], int(pair[1]): points[pair[1]][col]}
+		}
+		s, err := CombineColumnKeys(colKeys)
+		if err != nil {
+			t.Fatalf("The keys were not rebuilt from the holders %v: %s", pair, err)
+		}
+		values, err := DecryptRow(cells, keys.ti, s)
+		if err != nil || values["name"] != "Alice" || values["grade"] != int64(30) {
+			t.Errorf("The row was decrypted with the holders %v to %v (%v)", pair, values, err)
+		}
+	}
+}
@@ -1,29 +1,282 @@
 package elgamalcrypto
 
 import (
-	"database/sql"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-// DecyptoOne Data allows the decryption of a single data encoded in a table
-// We suppose that the row sent contains only the data
-func DecryptOneData(row sql.Row, ti TableInfo, colNum int, keyParts map[int]CPoint) (result []byte) {
-	sKey := calculateDecryptionKey(keyParts)
-	var data []byte
-	err := row.Scan(&data)
-	checkErr(err)
-	switch ti.commands[colNum] {
-	case 1:
-		result = decryptFromHash(data, sKey)
-	case 2:
-		result = decryptFromPoint(PointFromBytes(data), sKey, ti.colTypes[colNum])
+// encodePlain encodes the value v of an unencrypted cell of type colType read from the database
+// the way the values are encoded before their encryption, once converted to the type given by
+// decodeValue.
+func encodePlain(v interface{}, colType string) ([]byte, error) {
+	if v == nil {
+		return nil, fmt.Errorf("%w in the cell", ErrNullValue)
 	}
-	return
+	switch newValue(colType).(type) {
+	case *string:
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+	case *int64:
+		switch n := v.(type) {
+		case int:
+			v = int64(n)
+		case int32:
+			v = int64(n)
+		}
+	case *bool:
+		b, err := boolOf(v)
+		if err != nil {
+			return nil, err
+		}
+		v = b
+	case *Numeric:
+		n, err := numericOf(v)
+		if err != nil {
+			return nil, err
+		}
+		v = n
+	}
+	return GetBytes(v), nil
+}
+
+// DecryptRow decrypts the encrypted cells of a row of the table, given by the names of their
+// columns, with the decryption keys of the cells given by keys, see CombineColumnKeys.
+// The cells are decrypted in parallel by at most MAX_ROUTINES routines, the columns encrypted as
+// points on the same number of bytes sharing a single Solver. The values are returned with the
+// Go type of their column, see decodeValue.
+func DecryptRow(row map[string][]byte, ti TableInfo, keys map[string]CPoint) (map[string]interface{}, error) {
+	return DecryptRowContext(context.Background(), row, ti, keys)
+}
+
+// DecryptRowContext is DecryptRow with a context, the discrete logarithms of the point cells being
+// abandoned with the error of ctx when ctx is done.
+func DecryptRowContext(ctx context.Context, row map[string][]byte, ti TableInfo, keys map[string]CPoint) (map[string]interface{}, error) {
+	index := make(map[string]int, ti.nCol)
+	for j, c := range ti.colNames {
+		index[c] = j
+	}
+	// solvers gives the solver shared by the point columns of each number of bytes
+	solvers := make(map[uint64]*Solver)
+	defer func() {
+		for _, sv := range solvers {
+			sv.Close()
+		}
+	}()
+	for col := range row {
+		j, ok := index[col]
+		if !ok || ti.commands[j] == 0 {
+			return nil, fmt.Errorf("%w: %s in table %s", ErrNotEncryptedColumn, col, ti.name)
+		}
+		if _, ok = keys[col]; !ok {
+			return nil, fmt.Errorf("no decryption key for the column %s", col)
+		}
+		if ti.commands[j] != 2 {
+			continue
+		}
+		bytesNumber, err := pointBytesNumber(ti.colTypes[j])
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", col, err)
+		}
+		if _, ok = solvers[bytesNumber]; !ok {
+			sv, err := NewSolver(ctx, bytesNumber)
+			if err != nil {
+				return nil, err
+			}
+			solvers[bytesNumber] = sv
+		}
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	values := make(map[string]interface{}, len(row))
+	cols := make(chan string)
+	var wg sync.WaitGroup
+	for k := 0; k < MAX_ROUTINES; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for col := range cols {
+				v, err := decryptCell(ctx, row[col], ti, index[col], keys[col], solvers)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("column %s: %w", col, err)
+				}
+				values[col] = v
+				mu.Unlock()
+			}
+		}()
+	}
+	for col := range row {
+		cols <- col
+	}
+	close(cols)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return values, nil
+}
+
+// DecryptRowOrdered decrypts a whole row of the encrypted table, its cells being given in the
+// order of the columns of the table, and returns its values in the same order with the Go type of
+// their column, see decodeValue, as they were before EncryptTable. The encrypted cells are
+// decrypted by DecryptRow with the keys of their columns, while the cells of the unencrypted
+// columns hold the text of their value, as given by the drivers, see plainValue. A nil cell is
+// NULL and gives nil.
+func DecryptRowOrdered(cells [][]byte, ti TableInfo, keys map[string]CPoint) ([]interface{}, error) {
+	return DecryptRowOrderedContext(context.Background(), cells, ti, keys)
+}
+
+// DecryptRowOrderedContext is DecryptRowOrdered with a context, see DecryptRowContext.
+func DecryptRowOrderedContext(ctx context.Context, cells [][]byte, ti TableInfo, keys map[string]CPoint) ([]interface{}, error) {
+	if len(cells) != int(ti.nCol) || len(ti.commands) < len(cells) {
+		return nil, fmt.Errorf("%d cells given for the %d columns of table %s", len(cells), ti.nCol, ti.name)
+	}
+	values := make([]interface{}, len(cells))
+	encrypted := make(map[string][]byte)
+	for j, cell := range cells {
+		switch {
+		case cell == nil:
+		case ti.commands[j] == 0:
+			v, err := plainValue(cell, ti.colTypes[j])
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", ti.colNames[j], err)
+			}
+			values[j] = v
+		default:
+			encrypted[ti.colNames[j]] = cell
+		}
+	}
+	decrypted, err := DecryptRowContext(ctx, encrypted, ti, keys)
+	if err != nil {
+		return nil, err
+	}
+	for j, col := range ti.colNames {
+		if v, ok := decrypted[col]; ok {
+			values[j] = v
+		}
+	}
+	return values, nil
+}
+
+// Layouts of the dates and times read as text from the unencrypted columns
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999Z07", "2006-01-02 15:04:05.999999999", "2006-01-02", "15:04:05.999999999"}
+
+// plainValue converts the text of the value of an unencrypted cell of type colType into the Go
+// type given by decodeValue to the values of its column
+func plainValue(cell []byte, colType string) (interface{}, error) {
+	text := string(cell)
+	switch newValue(colType).(type) {
+	case *int64:
+		return strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+	case *float64:
+		return strconv.ParseFloat(strings.TrimSpace(text), 64)
+	case *bool:
+		return boolOf(cell)
+	case *Numeric:
+		return numericOf(cell)
+	case *[]byte:
+		return append([]byte(nil), cell...), nil
+	case *time.Time:
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, text); err == nil {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("cannot read a date from %q", text)
+	}
+	return text, nil
+}
+
+// decryptCell decrypts the cell of the column j with the key s and decodes its value, the
+// points being solved with the solver of their number of bytes
+func decryptCell(ctx context.Context, cell []byte, ti TableInfo, j int, s CPoint, solvers map[uint64]*Solver) (interface{}, error) {
+	var m []byte
+	if err := ti.checkCellVersion(cell, ti.commands[j]); err != nil {
+		return nil, err
+	}
+	var err error
+	if ti.commands[j] == 2 {
+		bytesNumber, _ := pointBytesNumber(ti.colTypes[j])
+		m, err = decryptPointCell(ctx, solvers[bytesNumber], cell, s, ti.colTypes[j])
+	} else {
+		m, err = decryptFromHash(cell, s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeValue(m, ti.colTypes[j])
 }
 
-// DecryptCalculatedDataColumn allows the data consumer to decrypt a data from a query
-// We suppose that the rows sent contains couples of primary keys - data
+// decodeValue decodes a decrypted value, encoded by GetBytes, into the type given by the
+// database drivers to the values of a column of type colType: int64 for the integers, float64
+// for the real numbers, bool, time.Time for the dates, []byte for the binary data and JSON,
+// Numeric for the numbers of fixed precision, and string otherwise.
+func decodeValue(m []byte, colType string) (interface{}, error) {
+	v := newValue(colType)
+	if err := gob.NewDecoder(bytes.NewReader(m)).Decode(v); err != nil {
+		if isNumericType(colType) {
+			return decodeOldNumeric(m)
+		}
+		// The cells encrypted from the raw bytes of the driver hold the text of their value, see
+		// EncryptOptions.RawBytes
+		var text string
+		if gob.NewDecoder(bytes.NewReader(m)).Decode(&text) == nil {
+			return plainValue([]byte(text), colType)
+		}
+		return nil, err
+	}
+	return reflect.ValueOf(v).Elem().Interface(), nil
+}
 
-func DecryptCalculatedDataColumn(rows sql.Rows, ti TableInfo, colNum int, keyParts map[int]CPoint) (result []byte) {
-	// TODO
+// decodeOldNumeric decodes the NUMERIC cells encrypted before Numeric, which hold the gob
+// encoding of the value given by the driver, text or float64, and the cells encrypted from the text
+// of the raw bytes of the driver, see EncryptOptions.RawBytes
+func decodeOldNumeric(m []byte) (interface{}, error) {
+	var old interface{}
+	for _, v := range []interface{}{new([]byte), new(string), new(float64)} {
+		if err := gob.NewDecoder(bytes.NewReader(m)).Decode(v); err == nil {
+			old = reflect.ValueOf(v).Elem().Interface()
+			break
+		}
+	}
+	if old == nil {
+		return nil, errors.New("the cell does not hold a decimal")
+	}
+	return numericOf(old)
+}
+
+// newValue returns a pointer to a new value of the type decoded by decodeValue for colType
+func newValue(colType string) (v interface{}) {
+	switch colType {
+	case "BIGINT", "INT8", "BIGSERIAL", "SERIAL8", "INTEGER", "INT", "INT4", "SERIAL", "SERIAL4", "SMALLINT", "INT2":
+		v = new(int64)
+	case "DOUBLE PRECISION", "FLOAT8", "REAL", "FLOAT4":
+		v = new(float64)
+	case "BOOLEAN", "BOOL":
+		v = new(bool)
+	case "BYTEA", "VARBIT", "BLOB", "JSON":
+		v = new([]byte)
+	case "DATE":
+		v = new(time.Time)
+	default:
+		switch {
+		case isNumericType(colType):
+			v = new(Numeric)
+		case strings.HasPrefix(colType, "TIME"):
+			v = new(time.Time)
+		default:
+			v = new(string)
+		}
+	}
 	return
 }
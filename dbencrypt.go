@@ -5,9 +5,8 @@
 package elgamalcrypto
 
 import (
-	"crypto/rand"
-	"database/sql"
-	"errors"
+	"fmt"
+	"io"
 	"math/big"
 )
 
@@ -16,36 +15,149 @@ import (
  *
  */
 
-// EncryptDatabase will encrypt all the tables of a database
-func EncryptDatabase(dbSource, dbDest *sql.DB, tableNames []string, commands map[string][]byte) (keysDB map[string]TableKeys) {
-	keysDB = make(map[string]TableKeys)
-	for _, name := range tableNames {
-		keysDB[name] = EncryptTable(dbSource, dbDest, name, commands[name], rand.Reader)
-	}
-	return keysDB
-}
-
-// ExtractPart returns the partial key table used by one of the key holders
+// ExtractPart returns the partial key table used by the key holder of the share index num: 1, 2
+// or 3 for the shares of Priv, or any of the indices of the shares made by ShareKeys. The index is
+// kept as the number of the key holder, which is the abscissa at which its key points are
+// interpolated by CombineColumnKeys.
 func (arr TableKeys) ExtractPart(num byte) (part PartTableKey, err error) {
-	if (num != 1) && (num != 2) && (num != 3) {
-		err = errors.New("Numéro de partie à extraire non valide.")
+	if num == 0 || (arr.Shares == nil && num > 3) {
+		err = fmt.Errorf("%w %d", ErrInvalidShareIndex, num)
 		return
 	}
 
 	part.keyHolder = num
 	part.ti = arr.ti
 	part.R = make(map[interface{}]*big.Int, len(arr.R))
+	// The r values are copied so that the part can be zeroized without touching arr
 	for k, v := range arr.R {
-		part.R[k] = v
+		part.R[k] = new(big.Int).Set(v)
 	}
 
 	part.PrivPart = make(map[string]*big.Int)
 	for k, v := range arr.Priv {
-		part.PrivPart[k] = new(big.Int).SetBytes(v[num])
+		var share []byte
+		if arr.Shares != nil {
+			share = arr.Shares[k][num]
+		} else {
+			share = v[num]
+		}
+		// An empty share would silently give a zero partial key, which breaks
+		// the decryption of the whole column further down the line.
+		if len(share) == 0 {
+			err = fmt.Errorf("%w %d: the private key of column %s has no such share", ErrInvalidShareIndex, num, k)
+			return PartTableKey{}, err
+		}
+		if arr.Shares == nil && !sharesOnLine(v) {
+			return PartTableKey{}, fmt.Errorf("%w: column %s", ErrLegacyShares, k)
+		}
+		part.PrivPart[k] = new(big.Int).SetBytes(share)
 	}
 	return
 }
 
+// sharesOnLine tells if the shares 1 to 3 of priv are the values at 1, 2 and 3 modulo N of a
+// polynomial of degree 1 whose value at 0 is the key, as made by SetKeys: each pair of them must
+// give the key back. The missing shares are left out.
+func sharesOnLine(priv PrivateKey) bool {
+	key := new(big.Int).SetBytes(priv[0])
+	for i := 1; i < len(priv); i++ {
+		for j := i + 1; j < len(priv); j++ {
+			if len(priv[i]) == 0 || len(priv[j]) == 0 {
+				continue
+			}
+			s := combineShares(map[int][]byte{i: priv[i], j: priv[j]})
+			if new(big.Int).SetBytes(s).Cmp(key) != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// combineShares rebuilds a scalar shared modulo N from the shares of some holders, by their
+// indices, by Lagrange interpolation at 0
+func combineShares(shares map[int][]byte) []byte {
+	holders := make([]int, 0, len(shares))
+	for i := range shares {
+		holders = append(holders, i)
+	}
+	s := new(big.Int)
+	for i, lambda := range LagrangeCoefficients(holders) {
+		s.Add(s, lambda.Mul(lambda, new(big.Int).SetBytes(shares[i])))
+	}
+	return s.Mod(s, N).Bytes()
+}
+
+// ExportColumnKey returns the private key of the column col alone, for a consumer allowed to
+// decrypt the whole column without the interaction of the key holders: with the r values of the
+// rows, given by R, the key of the cell of each row is PrivateKey.CellKey(r). Only the private
+// scalar is returned, the shares of the key holders are left out, and the keys of the other
+// columns, which are independent, are not revealed: the r values of the table of keys are shared
+// by all the columns of a row, but they cannot decrypt anything without the keys.
+// Exporting a key bypasses the key holders for good. Whoever holds the key and the r values can
+// decrypt every cell of the column, at any time and without leaving a trace, and the key cannot
+// be revoked: the only way to withdraw the access is to encrypt the column again under a new
+// key, see RekeyCell. It must therefore only be given to a consumer allowed to see the whole
+// column in clear.
+func (arr TableKeys) ExportColumnKey(col string) (PrivateKey, error) {
+	priv, ok := arr.Priv[col]
+	if !ok {
+		return PrivateKey{}, fmt.Errorf("%w: %s in table %s", ErrNotEncryptedColumn, col, arr.ti.name)
+	}
+	if len(priv[0]) == 0 {
+		return PrivateKey{}, fmt.Errorf("the private key of column %s is missing", col)
+	}
+	return PrivateKey{append([]byte{}, priv[0]...)}, nil
+}
+
+// EncryptedRow associates a row of an encrypted table, by its index in the order in which the
+// rows were read and encrypted, to the key of its primary key in R, see CompositeKey, and to the
+// r value with which its cells were encrypted
+type EncryptedRow struct {
+	Index uint64
+	Key   interface{}
+	R     *big.Int
+}
+
+// EncryptedRows returns the rows of the table in the order in which EncryptTable encrypted them,
+// each one with its primary key and its r value, so that the cells of the encrypted table can be
+// addressed explicitly instead of relying on the order of the rows, for GiveKeyPoint or the
+// homomorphic operations for instance. The indices are those of RowError, the rows skipped with
+// SkipFailedRows being kept. The order is only known by the table of keys returned by the
+// encryption: nil is returned for a table of keys read from a file, whose rows have no order.
+func (arr TableKeys) EncryptedRows() []EncryptedRow {
+	if arr.order == nil {
+		return nil
+	}
+	rows := make([]EncryptedRow, len(arr.order))
+	for i, key := range arr.order {
+		rows[i] = EncryptedRow{Index: uint64(i), Key: key, R: arr.R[key]}
+	}
+	return rows
+}
+
+// ShareKeys returns the table of keys whose private keys are shared between holders key holders,
+// any threshold of them being needed to rebuild a decryption key. The share of index k, from 1 to
+// holders, is the value at k modulo the order of the curve of a random polynomial of degree
+// threshold-1 whose value at 0 is the private key, so that the key points of the holders are
+// combined by CombineColumnKeys. The parts of the holders are then extracted by ExtractPart.
+func (arr TableKeys) ShareKeys(threshold, holders byte, random io.Reader) (shared TableKeys, err error) {
+	if threshold < KEY_THRESHOLD || holders < threshold {
+		return shared, fmt.Errorf("invalid sharing of the keys, %d of %d", threshold, holders)
+	}
+	if random, err = checkedRandom(random); err != nil {
+		return
+	}
+	shared = arr
+	shared.Shares = make(map[string]map[byte][]byte, len(arr.Priv))
+	for col, priv := range arr.Priv {
+		if shared.Shares[col], err = shareScalar(new(big.Int).SetBytes(priv[0]), N, threshold, holders, random); err != nil {
+			return TableKeys{}, fmt.Errorf("%w: %v", ErrRandomSource, err)
+		}
+	}
+	return shared, nil
+}
+
 /*
 
 // Find the data to send to the server
@@ -1,48 +1,266 @@
 package elgamalcrypto
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha512"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"math/big"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Decrypt is a simple decryption function of a message in the form of a cypher,
-// knowing the private key
-func (priv *PrivateKey) Decrypt(cypher Cypher) (msg []byte) {
-	DC := cypher.C.multB(priv[0])
-	DCHash := sha512.Sum512(append(DC.x.Bytes(), DC.y.Bytes()...))
+// knowing the private key. ErrInvalidPoint is returned if the point C of the cypher
+// is not on the curve, ErrAuthentication if its data is authenticated, see sealHashData, with a
+// tag which does not match, and an error wrapping ErrMessageTooLong if the data of the cypher is
+// longer than MaxMessageLength. The data without tag of the cyphers of the older versions is
+// decrypted as well.
+func (priv *PrivateKey) Decrypt(cypher Cypher) (msg []byte, err error) {
+	return priv.DecryptOn(myCurve, cypher)
+}
 
-	msg = make([]byte, len(cypher.Data))
-	for i, v := range cypher.Data {
-		msg[i] = v ^ DCHash[i%BytesNumber]
+// DecryptOn is Decrypt for the keys generated on the given curve, see CreateKeysOn
+func (priv *PrivateKey) DecryptOn(curve elliptic.Curve, cypher Cypher) (msg []byte, err error) {
+	if cypher.C.x == nil || cypher.C.y == nil || !curve.Params().IsOnCurve(cypher.C.x, cypher.C.y) {
+		return nil, ErrInvalidPoint
 	}
-	return
+	var DC CPoint
+	DC.x, DC.y = curve.Params().ScalarMult(cypher.C.x, cypher.C.y, priv[0])
+	return decryptFromHash(cypher.Data, DC)
+}
+
+// CellKey returns the key r⋅Y of a cell encrypted with r under the public key of priv, which
+// decrypts the cell without the key holders, see TableKeys.ExportColumnKey
+func (priv *PrivateKey) CellKey(r *big.Int) CPoint {
+	return baseMult(r).multB(priv[0])
+}
+
+// DecryptPoint decrypts a cypher whose message was encoded as a point, knowing the private key.
+// The message, read as a big endian integer, must be lower than 2^maxBits, see DecodeFromPoint
+// for the cost of the search. ErrInvalidPoint is returned if the cypher holds a point which is
+// not on the curve and ErrPointOutOfRange if the message is not in the range.
+func (priv *PrivateKey) DecryptPoint(c CypherPoint, maxBits uint64) (*big.Int, error) {
+	if err := validatePoint(c.C); err != nil {
+		return nil, err
+	}
+	d, err := pointFromShortBytes(c.Data[:])
+	if err != nil {
+		return nil, err
+	}
+	m, err := DecodeFromPoint(d.subC(c.C.multB(priv[0])), maxBits)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetUint64(m), nil
 }
 
 // calculateDecryptionKey will calculate the key to decrypt a value encoded
-// in any way from the keys sent by the key holders
+// in any way from the keys sent by the key holders, keyParts giving the point of each holder by
+// its share index. The key is the value at 0 of the polynomial taking these points at the
+// indices of the holders, found by Lagrange interpolation.
 func calculateDecryptionKey(keyParts map[int]CPoint) (s CPoint) {
-	// The lambda variables are the interpolation constants used in the case
-	// of a degree 1 polynomial given by two points on its curve
+	holders := make([]int, 0, len(keyParts))
+	for i := range keyParts {
+		holders = append(holders, i)
+	}
+	s = pointZero
+	for i, lambda := range LagrangeCoefficients(holders) {
+		s = addC(s, keyParts[i].mult(lambda))
+	}
+	return
+}
 
-	lambda1 := big.NewInt(3)
-	lambda2 := big.NewInt(-3)
-	lambda3 := big.NewInt(1)
+// LagrangeCoefficients returns the coefficient of each holder in the interpolation at 0 of a
+// polynomial from its values at the indices of the holders, λ_i = Π j / (j - i) over the other
+// holders j. The coefficients are computed in GF(N), the field of the scalars of the curve, and
+// given between 0 and N-1, a negative coefficient such as -3 being given as N-3, so that the
+// multiples of the points by them are right. The indices must be distinct and not multiples of N.
+func LagrangeCoefficients(holders []int) map[int]*big.Int {
+	coeffs := make(map[int]*big.Int, len(holders))
+	for _, i := range holders {
+		lambda := big.NewInt(1)
+		for _, j := range holders {
+			if j == i {
+				continue
+			}
+			den := new(big.Int).Mod(big.NewInt(int64(j-i)), N)
+			den.ModInverse(den, N)
+			lambda.Mul(lambda, big.NewInt(int64(j)))
+			lambda.Mul(lambda, den)
+			lambda.Mod(lambda, N)
+		}
+		coeffs[i] = lambda
+	}
+	return coeffs
+}
 
-	c1, ok1 := keyParts[1]
-	c2, ok2 := keyParts[2]
-	c3, ok3 := keyParts[3]
+// CombineColumnKeys rebuilds the decryption key of each column from the points contributed by the
+// key holders, contributions giving for each column the point of each holder by its number.
+// The points are the values at the numbers of the holders of a polynomial of degree
+// KEY_THRESHOLD-1 whose value at 0 is the key, which is found by Lagrange interpolation.
+// An error is returned if fewer than KEY_THRESHOLD holders contributed to a column, or if a
+// number or a point is invalid.
+// All the points contributed are interpolated, so that the key does not depend on the order in
+// which they come: when more holders than needed contributed, the key is the same whichever of
+// them are used as long as their points are right, but a single wrong point gives a wrong key.
+// CombineColumnKeysFrom uses only the holders chosen instead.
+func CombineColumnKeys(contributions map[string]map[int]CPoint) (map[string]CPoint, error) {
+	return CombineColumnKeysFrom(contributions)
+}
 
-	switch {
-	case ok1 && ok2:
-		s = addC(c1.mult(lambda1), c2.mult(lambda2))
-	case ok2 && ok3:
-		s = addC(c2.mult(lambda2), c3.mult(lambda3))
-	case ok3 && ok1:
-		s = addC(c3.mult(lambda3), c1.mult(lambda1))
+// CombineColumnKeysFrom is CombineColumnKeys with the points of the given holders only, which
+// must all have contributed to every column, the points of the other holders being ignored.
+// The data seller can thus designate in advance the holders which take part in the decryption,
+// such as the pair 1 and 3, and leave the redundant ones out, for instance when the key rebuilt
+// from all the points fails VerifyColumnKey. Without holders, all the points are used.
+// At least KEY_THRESHOLD distinct holders must be given.
+func CombineColumnKeysFrom(contributions map[string]map[int]CPoint, holders ...int) (map[string]CPoint, error) {
+	if len(holders) > 0 {
+		seen := make(map[int]bool, len(holders))
+		for _, i := range holders {
+			if seen[i] {
+				return nil, fmt.Errorf("key holder %d is given twice", i)
+			}
+			seen[i] = true
+		}
+		if len(holders) < KEY_THRESHOLD {
+			return nil, fmt.Errorf("%d key holders chosen, %d are needed", len(holders), KEY_THRESHOLD)
+		}
+		chosen := make(map[string]map[int]CPoint, len(contributions))
+		for col, parts := range contributions {
+			chosen[col] = make(map[int]CPoint, len(holders))
+			for _, i := range holders {
+				pt, ok := parts[i]
+				if !ok {
+					return nil, fmt.Errorf("column %s: key holder %d did not contribute", col, i)
+				}
+				chosen[col][i] = pt
+			}
+		}
+		contributions = chosen
 	}
-	return
+	keys := make(map[string]CPoint, len(contributions))
+	for col, parts := range contributions {
+		s, err := combineKeyParts(parts)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", col, err)
+		}
+		keys[col] = s
+	}
+	return keys, nil
+}
+
+// CombineCalculationKeys rebuilds the key Σ coeffs[c]⋅s_c of a linear combination of cells from
+// the points given by the key holders with GiveKeyCalculation, contributions giving the point of
+// each holder by its number. The points are interpolated like by CombineColumnKeys, with the
+// Lagrange coefficients of the holders modulo N, and the key is subtracted from the combination
+// of the data points of the cells to get the point of the combination of the messages, see
+// DecryptLinearCombination. An error is returned if fewer than KEY_THRESHOLD holders contributed,
+// or if a number or a point is invalid.
+func CombineCalculationKeys(contributions map[int]CPoint) (CPoint, error) {
+	return combineKeyParts(contributions)
+}
+
+// combineKeyParts checks the points of the key holders, by their numbers, and interpolates them
+// into the key, see calculateDecryptionKey
+func combineKeyParts(parts map[int]CPoint) (CPoint, error) {
+	if len(parts) < KEY_THRESHOLD {
+		return CPoint{}, fmt.Errorf("%d key holders contributed, %d are needed", len(parts), KEY_THRESHOLD)
+	}
+	for i, pt := range parts {
+		if i <= 0 || i > 255 {
+			return CPoint{}, fmt.Errorf("%w %d", ErrInvalidShareIndex, i)
+		}
+		if err := validatePoint(pt); err != nil {
+			return CPoint{}, fmt.Errorf("key holder %d: %w", i, err)
+		}
+	}
+	return calculateDecryptionKey(parts), nil
+}
+
+// VerifyColumnKey checks that the key s of a cell, rebuilt by CombineColumnKeys, is the key r⋅Y
+// of the cell encrypted with r under the public key pub, and returns ErrKeyMismatch otherwise.
+// A wrong key would only give garbage, or make the search of a discrete logarithm run through
+// the whole range, so that it is worth checking it first when r is known.
+func VerifyColumnKey(s CPoint, r *big.Int, pub PublicKey) error {
+	if err := validatePoint(s); err != nil {
+		return err
+	}
+	if !s.Equal(pub.Y.mult(r)) {
+		return ErrKeyMismatch
+	}
+	return nil
+}
+
+// VerifyKeyPoint checks that the point pt given by a key holder for a cell encrypted with r is
+// r⋅V, V being the verifier s_k⋅g of its share returned by SetKeys, and returns ErrKeyMismatch
+// otherwise. It tells which of the key holders gave a wrong point.
+func VerifyKeyPoint(pt CPoint, r *big.Int, verifier CPoint) error {
+	if err := validatePoint(pt); err != nil {
+		return err
+	}
+	if !pt.Equal(verifier.mult(r)) {
+		return ErrKeyMismatch
+	}
+	return nil
+}
+
+// SimulateDecryption runs in memory the whole decryption of the cell of the column col in the
+// row of the given primary key, see CompositeKey, encrypted as ciphertext: the parts of the key
+// holders 1 and 3 are extracted from keys, each holder gives its key point for the cell, the
+// points are combined by CombineColumnKeys, the key is checked by VerifyColumnKey and the cell is
+// decrypted according to the command of its column. It documents the decryption flow and allows
+// it to be tested without a database.
+func SimulateDecryption(keys TableKeys, primaryKey interface{}, col string, ciphertext []byte, colType string) ([]byte, error) {
+	j := -1
+	for k, name := range keys.ti.colNames {
+		if name == col {
+			j = k
+		}
+	}
+	if j < 0 || keys.ti.commands[j] == 0 {
+		return nil, fmt.Errorf("%w: %s in table %s", ErrNotEncryptedColumn, col, keys.ti.name)
+	}
+
+	c := coord{primaryKey, col}
+	parts := make(map[int]CPoint)
+	for _, num := range []byte{1, 3} {
+		part, err := keys.ExtractPart(num)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := part.R[primaryKey]; !ok {
+			return nil, fmt.Errorf("no r for the row %v", primaryKey)
+		}
+		parts[int(num)] = part.GiveKeyPoint(c)
+	}
+	colKeys, err := CombineColumnKeys(map[string]map[int]CPoint{col: parts})
+	if err != nil {
+		return nil, err
+	}
+	pub := PublicKey{Curve: myCurve, Y: baseMultB(keys.Priv[col][0])}
+	if err = VerifyColumnKey(colKeys[col], keys.R[primaryKey], pub); err != nil {
+		return nil, err
+	}
+
+	if err = keys.ti.checkCellVersion(ciphertext, keys.ti.commands[j]); err != nil {
+		return nil, err
+	}
+	if keys.ti.commands[j] != 2 {
+		return decryptFromHash(ciphertext, colKeys[col])
+	}
+	return decryptPointCell(context.Background(), nil, ciphertext, colKeys[col], colType)
 }
 
 /*
@@ -90,19 +308,312 @@ func sumPoints(db *sql.DB, ti TableInfo, coeffs map[coord]*big.Int) (sum CPoint)
 // decryptFromPoint will decrypt a data encoded as a point, knowing the key s
 // corresponding to it, which is the result of the interpolation between the
 // partial keys.
+// Only the column types accepted by pointBytesNumber can be decrypted, the discrete
+// logarithm of larger values being out of reach of the solvers.
+// The discrete logarithm is solved with sv, which must be a solver for the type of the column,
+// or from scratch if sv is nil. Its search is abandoned with the error of ctx when ctx is done.
+func decryptFromPoint(ctx context.Context, sv *Solver, p, s CPoint, colType string) ([]byte, error) {
+	if err := validatePoint(p); err != nil {
+		return nil, err
+	}
+	bytesNumber, err := pointBytesNumber(colType)
+	if err != nil {
+		return nil, err
+	}
+	if sv == nil {
+		sv = &Solver{bytesNumber: bytesNumber}
+	} else if sv.bytesNumber != bytesNumber {
+		return nil, fmt.Errorf("the solver is made for values on %d bytes, not the %d bytes of type %s", sv.bytesNumber, bytesNumber, colType)
+	}
+	return sv.decrypt(ctx, p, s)
+}
+
+// decryptPointCell decrypts a point encrypted cell of a column of type colType with the key s like
+// decryptFromPoint, whatever its version. The value of a cell with the compact encoding of
+// compactValue is solved on the bytes of its type, see compactBytesNumber, with sv if it is a
+// solver of this width and from scratch otherwise, and is returned gob encoded like the values of
+// the other cells.
+func decryptPointCell(ctx context.Context, sv *Solver, cell []byte, s CPoint, colType string) ([]byte, error) {
+	p, err := pointFromCell(cell)
+	if err != nil {
+		return nil, err
+	}
+	if CellVersion(cell, 2) != CELL_COMPACT {
+		return decryptFromPoint(ctx, sv, p, s, colType)
+	}
+	bytesNumber, ok := compactBytesNumber(colType)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s has no compact encoding", ErrUnsupportedColumnType, colType)
+	}
+	if err = validatePoint(p); err != nil {
+		return nil, err
+	}
+	if sv == nil || sv.bytesNumber != bytesNumber {
+		sv = &Solver{bytesNumber: bytesNumber}
+	}
+	m, err := sv.decrypt(ctx, p, s)
+	if err != nil {
+		return nil, err
+	}
+	x := new(big.Int).SetBytes(m)
+	if colType == "BOOLEAN" || colType == "BOOL" {
+		if x.Cmp(Big1) > 0 {
+			return nil, fmt.Errorf("the compact boolean is %v instead of 0 or 1", x)
+		}
+		return GetBytes(x.Sign() != 0), nil
+	}
+	return GetBytes(x.Int64()), nil
+}
+
+// Solver solves the discrete logarithms of the values encoded on a given number of bytes. When
+// the baby step giant step algorithm is used and its table fits in BSGSTableLimit, the table is
+// built once by NewSolver and shared by all the logarithms, until Close frees it.
+// The table is complete before NewSolver returns and only read afterwards, so that a Solver can
+// be used by several routines at once, like the decryptions of DecryptRow. It may be closed while
+// they run: the logarithms already started end with the table they took, and the next ones return
+// ErrSolverClosed.
+type Solver struct {
+	bytesNumber uint64
+	m           uint64
+	// mu guards hL2 and closed, which Close writes while the logarithms read them
+	mu     sync.RWMutex
+	hL2    map[ShortPoint]uint64
+	closed bool
+}
 
-func decryptFromPoint(p, s CPoint, colType string) []byte {
-	q := p.subC(s)
-	bytesNumber := uint64(8)
-	switch colType {
-	case "INTEGER", "INT", "INT4", "SERIAL", "SERIAL4", "SMALLINT", "INT2", "REAL", "FLOAT4":
-		bytesNumber = 4
+// NewSolver prepares the resolution of the discrete logarithms of values encoded on bytesNumber
+// bytes. The construction of the table is abandoned with the error of ctx when ctx is done.
+func NewSolver(ctx context.Context, bytesNumber uint64) (sv *Solver, err error) {
+	sv = &Solver{bytesNumber: bytesNumber}
+	if chooseSolver(bytesNumber) == SOLVER_BSGS {
+		sv.m = uint64(1 << (bytesNumber * 4))
+		if sv.hL2, err = loadhL2Range(ctx, 0, sv.m); err != nil {
+			return nil, err
+		}
 	}
-	return kangaroo(q, bytesNumber).Bytes()
+	return
 }
 
-// decryptFromPoint will decrypt a data encoded with a hash function
-func decryptFromHash(d []byte, s CPoint) (m []byte) {
+// newColumnSolver prepares the decryption of the points of a column of the given type
+func newColumnSolver(ctx context.Context, colType string) (*Solver, error) {
+	bytesNumber, err := pointBytesNumber(colType)
+	if err != nil {
+		return nil, err
+	}
+	return NewSolver(ctx, bytesNumber)
+}
+
+// DiscreteLog solves the equation pt = x⋅g like DiscreteLogContext, with the table of the
+// solver if it has one. ErrSolverClosed is returned once the solver is closed.
+// When the cache of SetDiscreteLogCache is enabled, the logarithms already solved are taken from
+// it instead of being solved again.
+func (sv *Solver) DiscreteLog(ctx context.Context, pt CPoint) (*big.Int, error) {
+	hL2, err := sv.table()
+	if err != nil {
+		return nil, err
+	}
+	sp, err := shortForm(pt, false)
+	cached := err == nil
+	if cached {
+		if x, ok := dlogCache.get(sp); ok {
+			if uint64(x.BitLen()) > sv.bytesNumber*8 {
+				return nil, ErrPointOutOfRange
+			}
+			return x, nil
+		}
+	}
+	x, err := sv.solve(ctx, pt, hL2)
+	if err == nil && cached {
+		dlogCache.put(sp, x)
+	}
+	return x, err
+}
+
+// table returns the table of the solver, nil if it has none, or ErrSolverClosed once it is closed
+func (sv *Solver) table() (map[ShortPoint]uint64, error) {
+	sv.mu.RLock()
+	defer sv.mu.RUnlock()
+	if sv.closed {
+		return nil, ErrSolverClosed
+	}
+	return sv.hL2, nil
+}
+
+// solve solves the equation pt = x⋅g for DiscreteLog with the table hL2 of the solver, without
+// the cache
+func (sv *Solver) solve(ctx context.Context, pt CPoint, hL2 map[ShortPoint]uint64) (*big.Int, error) {
+	if hL2 == nil {
+		return DiscreteLogContext(ctx, pt, sv.bytesNumber)
+	}
+	pow, found, err := bsgsBlock(ctx, pt, sv.m, hL2)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrPointOutOfRange
+	}
+	return new(big.Int).SetUint64(pow), nil
+}
+
+// logCache is a cache of the discrete logarithms by the short form of their points, which keeps
+// the size logarithms used the most recently. A size of 0 disables it.
+type logCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[ShortPoint]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+// logEntry is an element of the list of a logCache, the most recent being at the front
+type logEntry struct {
+	sp ShortPoint
+	x  *big.Int
+}
+
+// dlogCache is the cache of Solver.DiscreteLog, see SetDiscreteLogCache
+var dlogCache logCache
+
+// SetDiscreteLogCache makes Solver.DiscreteLog, used by the decryption of the cells encrypted as
+// points, keep the last size discrete logarithms it solved, so that the cells of the same value,
+// frequent in the columns of few distinct values, are decrypted at once after the first one. The
+// cache is emptied, and a size of 0, the default, disables it. The cache holds the plaintexts of
+// the cells decrypted, which therefore stay in memory until they leave it.
+func SetDiscreteLogCache(size int) {
+	dlogCache.mu.Lock()
+	defer dlogCache.mu.Unlock()
+	if size < 0 {
+		size = 0
+	}
+	dlogCache.size = size
+	dlogCache.order = list.New()
+	dlogCache.entries = make(map[ShortPoint]*list.Element)
+	dlogCache.hits, dlogCache.misses = 0, 0
+}
+
+// DiscreteLogCacheStats returns the number of discrete logarithms found in the cache of
+// SetDiscreteLogCache and the number of those which had to be solved since it was set
+func DiscreteLogCacheStats() (hits, misses uint64) {
+	dlogCache.mu.Lock()
+	defer dlogCache.mu.Unlock()
+	return dlogCache.hits, dlogCache.misses
+}
+
+// get returns a copy of the logarithm of sp if it is in the cache
+func (c *logCache) get(sp ShortPoint) (*big.Int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size == 0 {
+		return nil, false
+	}
+	e, ok := c.entries[sp]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(e)
+	return new(big.Int).Set(e.Value.(logEntry).x), true
+}
+
+// put adds the logarithm x of sp to the cache, removing the one used the least recently if the
+// cache is full
+func (c *logCache) put(sp ShortPoint, x *big.Int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size == 0 {
+		return
+	}
+	if e, ok := c.entries[sp]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[sp] = c.order.PushFront(logEntry{sp, new(big.Int).Set(x)})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(logEntry).sp)
+	}
+}
+
+// Close frees the table of the solver, which can no longer be used afterwards. The logarithms
+// being solved keep the table until they end.
+func (sv *Solver) Close() error {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	sv.hL2 = nil
+	sv.closed = true
+	return nil
+}
+
+// decrypt decrypts the point p with the key s like decryptFromPoint. The value found is encoded
+// again as a point and compared to p - s, so that a wrong result of the solver is returned as
+// ErrWrongDiscreteLog instead of a corrupted value.
+func (sv *Solver) decrypt(ctx context.Context, p, s CPoint) ([]byte, error) {
+	pt := p.subC(s)
+	m, err := sv.DiscreteLog(ctx, pt)
+	if err != nil {
+		return nil, err
+	}
+	if !baseMult(m).equalC(pt) {
+		return nil, fmt.Errorf("%w: %v", ErrWrongDiscreteLog, m)
+	}
+	return m.Bytes(), nil
+}
+
+// CellVersion returns the format version of an encrypted cell of the given mode (1 for the
+// hash encryption, 2 for the encryption as a point), or 0 if the cell cannot be read.
+// The cells without header are of version CELL_V1.
+func CellVersion(cell []byte, mode byte) byte {
+	switch mode {
+	case 1:
+		if isAuthenticatedCell(cell) {
+			return cell[1]
+		}
+		return CELL_V1
+	case 2:
+		switch {
+		case len(cell) == SHORT_POINT_LENGTH:
+			return CELL_V1
+		case len(cell) == len(authHeader)+SHORT_POINT_LENGTH && cell[0] == CELL_MAGIC:
+			return cell[1]
+		}
+	}
+	return 0
+}
+
+// pointFromCell reads the point stored in a point encrypted cell, whatever its version
+func pointFromCell(cell []byte) (p CPoint, err error) {
+	switch v := CellVersion(cell, 2); v {
+	case CELL_V1:
+		return pointFromShortBytes(cell)
+	case CELL_V2, CELL_COMPACT:
+		return pointFromShortBytes(cell[len(authHeader):])
+	default:
+		return p, fmt.Errorf("unknown format of point cell (version %d, %d bytes)", v, len(cell))
+	}
+}
+
+// decryptFromHash will decrypt a data encoded with a hash function.
+// The cells of version 2 are authenticated before being decrypted,
+// the cells of version 1, without header, are decrypted as they are.
+// The data longer than MaxMessageLength is refused with an error wrapping ErrMessageTooLong.
+func decryptFromHash(d []byte, s CPoint) (m []byte, err error) {
+	switch v := CellVersion(d, 1); v {
+	case CELL_V1:
+	case CELL_V2:
+		body := d[:len(d)-authTagLength]
+		if !hmac.Equal(authTag(body, s), d[len(body):]) {
+			return nil, ErrAuthentication
+		}
+		d = body[len(authHeader):]
+	default:
+		return nil, fmt.Errorf("unknown version %d of hash cell", v)
+	}
+	if err = checkMessageLength(len(d)); err != nil {
+		return nil, err
+	}
 	m = make([]byte, len(d))
 	sHash := sha512.Sum512(append(s.x.Bytes(), s.y.Bytes()...))
 	for k, v := range d {
@@ -111,12 +622,311 @@ func decryptFromHash(d []byte, s CPoint) (m []byte) {
 	return
 }
 
+// streamDecrypter is the io.Reader returned by NewStreamDecrypter. The last authTagLength bytes
+// read from r are kept in buf until the end of the stream, as they may be the integrity tag.
+type streamDecrypter struct {
+	r   io.Reader
+	ks  *keystream
+	mac hash.Hash
+	buf []byte
+	eof bool
+	err error
+}
+
+// DecryptPrimaryKey decrypts a primary key encrypted by EncryptPrimaryKey with secret and returns
+// its value with the Go type of the column of type colType, see decodeValue. ErrAuthentication is
+// returned if the key was not encrypted with this secret or was altered.
+func DecryptPrimaryKey(secret []byte, cell string, colType string) (interface{}, error) {
+	if !strings.HasPrefix(cell, PK_PREFIX) {
+		return nil, errors.New("the value is not an encrypted primary key")
+	}
+	b, err := hex.DecodeString(cell[len(PK_PREFIX):])
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < pkTagLength {
+		return nil, ErrAuthentication
+	}
+	tag := b[:pkTagLength]
+	m := make([]byte, len(b)-pkTagLength)
+	newPKKeystream(secret, tag).xor(m, b[pkTagLength:])
+	if !hmac.Equal(pkTag(secret, m), tag) {
+		return nil, ErrAuthentication
+	}
+	return decodeValue(m, colType)
+}
+
+// NewStreamDecrypter decrypts with the key s a value encrypted by NewStreamEncrypter and read
+// from r, by chunks so that the memory used does not depend on the length of the value.
+// The integrity tag can only be checked at the end of the stream: the last Read returns
+// ErrAuthentication instead of io.EOF if the stream was modified or truncated, in which case
+// the data read so far must be discarded.
+func NewStreamDecrypter(r io.Reader, s CPoint) (io.Reader, error) {
+	if err := validatePoint(s); err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(streamHeader))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading the stream header: %w", err)
+	}
+	if !bytes.Equal(header, streamHeader) {
+		return nil, errors.New("the data is not an encrypted stream")
+	}
+	sd := &streamDecrypter{r: r, ks: newKeystream(s), mac: newCellMac(s), buf: make([]byte, 0, streamChunkSize+authTagLength)}
+	sd.mac.Write(header)
+	return sd, nil
+}
+
+func (sd *streamDecrypter) Read(p []byte) (int, error) {
+	if sd.err != nil {
+		return 0, sd.err
+	}
+	for len(sd.buf) <= authTagLength && !sd.eof {
+		n, err := sd.r.Read(sd.buf[len(sd.buf):cap(sd.buf)])
+		sd.buf = sd.buf[:len(sd.buf)+n]
+		if err == io.EOF {
+			sd.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if len(sd.buf) < authTagLength {
+		sd.err = ErrAuthentication
+		return 0, sd.err
+	}
+	n := len(sd.buf) - authTagLength
+	if len(p) < n {
+		n = len(p)
+	}
+	if n == 0 && len(p) > 0 {
+		// Only the tag is left: the stream is over
+		if hmac.Equal(sd.mac.Sum(nil), sd.buf) {
+			sd.err = io.EOF
+		} else {
+			sd.err = ErrAuthentication
+		}
+		return 0, sd.err
+	}
+	sd.mac.Write(sd.buf[:n])
+	sd.ks.xor(p[:n], sd.buf[:n])
+	sd.buf = append(sd.buf[:0], sd.buf[n:]...)
+	return n, nil
+}
+
 /**********************************************************************************************
  *
  * Fonctions resolving the discrete logarithm problem
  *
  **********************************************************************************************/
 
+// Algorithms available to solve the discrete logarithm
+const (
+	SOLVER_BSGS = iota
+	SOLVER_KANGAROO
+)
+
+// Number of times each discrete logarithm is timed by CalibrateSolvers
+const CALIBRATION_TRIALS = 3
+
+// SolverRoutines is the number of routines launched in parallel by the discrete logarithm solvers.
+// It is read between 1 and 255, see solverRoutines.
+var SolverRoutines = MAX_ROUTINES
+
+// solverRoutines returns SolverRoutines brought between 1 and 255, the number of routines of the
+// baby step giant step algorithm being counted on a byte
+func solverRoutines() int {
+	switch {
+	case SolverRoutines < 1:
+		return 1
+	case SolverRoutines > 255:
+		return 255
+	}
+	return SolverRoutines
+}
+
+// BSGSTableLimit is the maximum number of entries of the table built by the baby step giant step
+// algorithm, 2^(4⋅bytesNumber) for values encoded on bytesNumber bytes. Each entry takes several
+// tens of bytes in memory. Above this limit, DiscreteLog uses the kangaroo algorithm instead, which
+// needs almost no memory but is much slower. When babyStepGiantStep is called directly with a larger
+// table, the table is built and searched in blocks of BSGSTableLimit entries, the giant steps being
+// run again for each block.
+var BSGSTableLimit uint64 = 1 << 20
+
+// chooseSolver returns the algorithm used by DiscreteLog for values encoded on bytesNumber bytes.
+// The kangaroo algorithm is used when the table of the baby step giant step algorithm would not fit
+// in BSGSTableLimit. Otherwise the faster algorithm according to the calibration in use, see
+// CalibrateSolvers, is chosen, and the baby step giant step algorithm without calibration, as it is
+// the faster one at every width in the benchmarks.
+func chooseSolver(bytesNumber uint64) int {
+	if (bytesNumber*4 >= 64) || (uint64(1)<<(bytesNumber*4) > BSGSTableLimit) {
+		return SOLVER_KANGAROO
+	}
+	calibrationMu.RLock()
+	defer calibrationMu.RUnlock()
+	if solverCalibration != nil {
+		return solverCalibration.Faster(bytesNumber)
+	}
+	return SOLVER_BSGS
+}
+
+// Numbers of bytes of the values whose discrete logarithms are timed by CalibrateSolvers: those
+// of the booleans and the SMALLINT with the compact encoding, and of the other columns encrypted
+// as points, see pointBytesNumber
+var CalibrationBytes = []uint64{1, 2, 4}
+
+// Calibration gives the times measured by CalibrateSolvers for each algorithm, by number of bytes
+// of the values solved. It can be saved with SaveCalibration to be reused by the next runs of the
+// program with UseCalibration.
+type Calibration struct {
+	Bytes    []uint64
+	BSGS     []time.Duration
+	Kangaroo []time.Duration
+}
+
+// solverCalibration, when it is not nil, is the calibration used by chooseSolver
+var (
+	calibrationMu     sync.RWMutex
+	solverCalibration *Calibration
+)
+
+// Faster returns the algorithm which was the faster one for the values on bytesNumber bytes, or on
+// the largest number of bytes measured below it, or the smallest one measured.
+func (c Calibration) Faster(bytesNumber uint64) int {
+	k := -1
+	for i, b := range c.Bytes {
+		if b <= bytesNumber && (k < 0 || b > c.Bytes[k]) {
+			k = i
+		}
+	}
+	if k < 0 {
+		for i, b := range c.Bytes {
+			if k < 0 || b < c.Bytes[k] {
+				k = i
+			}
+		}
+	}
+	if k >= 0 && c.Kangaroo[k] < c.BSGS[k] {
+		return SOLVER_KANGAROO
+	}
+	return SOLVER_BSGS
+}
+
+// UseCalibration makes DiscreteLog choose its algorithm according to c, within the memory limit
+// BSGSTableLimit
+func UseCalibration(c Calibration) error {
+	if len(c.BSGS) != len(c.Bytes) || len(c.Kangaroo) != len(c.Bytes) {
+		return errors.New("the calibration does not give the times of both algorithms for each number of bytes")
+	}
+	calibrationMu.Lock()
+	solverCalibration = &c
+	calibrationMu.Unlock()
+	return nil
+}
+
+// CalibrateSolvers measures on the current machine the time taken by the baby step giant step and
+// the kangaroo algorithms to solve the discrete logarithms of random values on each of the numbers
+// of bytes CalibrationBytes, and makes DiscreteLog use the faster one, see UseCalibration.
+// The best of CALIBRATION_TRIALS trials is kept for each measure. A trial of the kangaroo
+// algorithm is stopped once it takes longer than the best trial of the baby step giant step
+// algorithm, as it is then known to be the slower one, and its time is the time it ran. The
+// measures are abandoned with the error of ctx when ctx is done.
+func CalibrateSolvers(ctx context.Context) (c Calibration, err error) {
+	for _, bytesNumber := range CalibrationBytes {
+		if bytesNumber == 0 || bytesNumber > KANGAROO_MAX_BYTES {
+			return c, fmt.Errorf("cannot calibrate the solvers on %d bytes", bytesNumber)
+		}
+		var best [2]time.Duration
+		for trial := 0; trial < CALIBRATION_TRIALS; trial++ {
+			x, err := rand.Int(rand.Reader, new(big.Int).Lsh(Big1, uint(8*bytesNumber)))
+			if err != nil {
+				return c, err
+			}
+			pt := baseMult(x)
+			for method := range best {
+				start := time.Now()
+				var found *big.Int
+				if method == SOLVER_BSGS {
+					var pow uint64
+					pow, _, err = bsgsSearch(ctx, pt, uint64(1)<<(bytesNumber*4))
+					found = new(big.Int).SetUint64(pow)
+				} else {
+					kctx, cancel := context.WithTimeout(ctx, best[SOLVER_BSGS])
+					found, err = kangaroo(kctx, pt, bytesNumber)
+					cancel()
+					if err != nil && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+						// Slower than the baby step giant step algorithm
+						found, err = x, nil
+					}
+				}
+				if err != nil {
+					return c, err
+				}
+				if found.Cmp(x) != 0 {
+					return c, fmt.Errorf("solver %d found %v instead of %v", method, found, x)
+				}
+				if d := time.Since(start); trial == 0 || d < best[method] {
+					best[method] = d
+				}
+			}
+		}
+		c.Bytes = append(c.Bytes, bytesNumber)
+		c.BSGS = append(c.BSGS, best[SOLVER_BSGS])
+		c.Kangaroo = append(c.Kangaroo, best[SOLVER_KANGAROO])
+	}
+	return c, UseCalibration(c)
+}
+
+// DiscreteLog solves the equation pt = x⋅g where x is encoded on bytesNumber bytes,
+// with the algorithm chosen by chooseSolver.
+func DiscreteLog(pt CPoint, bytesNumber uint64) *big.Int {
+	x, err := DiscreteLogContext(context.Background(), pt, bytesNumber)
+	checkErr(err)
+	return x
+}
+
+// DiscreteLogContext is DiscreteLog with a context: the search is abandoned with the error
+// of ctx, such as context.DeadlineExceeded, when ctx is done. It returns ErrPointOutOfRange
+// if the baby step giant step algorithm searched the whole range without success.
+func DiscreteLogContext(ctx context.Context, pt CPoint, bytesNumber uint64) (*big.Int, error) {
+	if chooseSolver(bytesNumber) == SOLVER_BSGS {
+		pow, found, err := bsgsSearch(ctx, pt, uint64(1<<(bytesNumber*4)))
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, ErrPointOutOfRange
+		}
+		return new(big.Int).SetUint64(pow), nil
+	}
+	return kangaroo(ctx, pt, bytesNumber)
+}
+
+// DecodeFromPoint finds the value encoded by EncodeToPoint, which must be lower than 2^maxBits.
+// The baby step giant step algorithm is used, which takes a time and a memory proportional to
+// 2^(maxBits/2): a table of 2^(maxBits/2) points is built, each entry taking several tens of bytes.
+// maxBits is therefore limited by BSGSTableLimit, to 40 bits with the default limit, and a
+// 40-bit value takes in the order of twenty seconds to be found. ErrPointOutOfRange is returned
+// if the point encodes no value in the range, which is only known once the whole range is searched.
+func DecodeFromPoint(pt CPoint, maxBits uint64) (uint64, error) {
+	if maxBits == 0 || maxBits > 64 {
+		return 0, fmt.Errorf("the number of bits must be between 1 and 64, not %d", maxBits)
+	}
+	m := uint64(1) << ((maxBits + 1) / 2)
+	if m > BSGSTableLimit {
+		return 0, fmt.Errorf("%d bits would need a table of more than %d points, see BSGSTableLimit", maxBits, BSGSTableLimit)
+	}
+	if !pt.IsIdentity() {
+		if err := validatePoint(pt); err != nil {
+			return 0, err
+		}
+	}
+	value, found, _ := bsgsSearch(context.Background(), pt, m)
+	if !found || (maxBits < 64 && value>>maxBits != 0) {
+		return 0, ErrPointOutOfRange
+	}
+	return value, nil
+}
+
 // rhoPollard resolves the equation pt = x⋅g where x belongs to Z/NZ
 // It is therefore not suitable when we are able to restrict the interval
 // on which x is present.
@@ -157,7 +967,7 @@ func rhoPollard(pt CPoint) (pow *big.Int, err error) {
 		if Xi.equalC(X2i) {
 			r1.Sub(Bi, B2i)
 			if r1.Cmp(Big0) == 0 {
-				return Big0, errors.New("r1 zero value failure")
+				return Big0, fmt.Errorf("%w: the collision of the rho algorithm gives no solution", ErrDiscreteLogNotFound)
 			}
 			r1.ModInverse(r1, P)
 			r2.Sub(A2i, Ai)
@@ -168,21 +978,51 @@ func rhoPollard(pt CPoint) (pow *big.Int, err error) {
 	return
 }
 
+// kangarooJumpBits returns the number k of jump sizes used by kangaroo, the jumps being the powers
+// of two 2^0, ..., 2^(k-1). The interval searched has a width of N², and the method of Pollard
+// requires a mean jump close to N/2: a kangaroo then crosses half of the interval in its N jumps,
+// and its jumps are short enough for the wild one to land on the path of a tamed one. With jumps
+// up to the width of the interval instead, the kangaroos leap past each other.
+func kangarooJumpBits(N uint64) uint64 {
+	k := uint64(1)
+	// The mean of the k jumps is (2^k - 1) / k
+	for k < 63 && (uint64(1)<<k-1)/k < N/2 {
+		k++
+	}
+	return k
+}
+
+// kangarooStarts returns the starting points of the nRoutines tamed kangaroos searching a value
+// on bytesNumber bytes, spread evenly over [0;2^(8⋅bytesNumber)[. They are computed with big
+// integers, as 2^(8⋅bytesNumber) does not fit on 64 bits for 8 bytes.
+func kangarooStarts(bytesNumber, nRoutines uint64) []*big.Int {
+	firstPoint := new(big.Int).Lsh(Big1, uint(8*bytesNumber))
+	firstPoint.Div(firstPoint, new(big.Int).SetUint64(nRoutines))
+	starts := make([]*big.Int, nRoutines)
+	for k := range starts {
+		starts[k] = new(big.Int).Mul(firstPoint, big.NewInt(int64(k)))
+	}
+	return starts
+}
+
 // kangaroo is the implementation of the lambda method of Pollard, also known
 // as kangaroo because it can be seen as the story of two kangaroos,
 // one tamed and the other wild, the first trying to catch the second.
 // The function solves the equation pt = x⋅g where x belongs to [0;max] with max < N
+// The search is abandoned with the error of ctx when ctx is done.
+// The values on more than KANGAROO_MAX_BYTES bytes are refused.
 
-func kangaroo(pt CPoint, bytesNumber uint64) *big.Int {
-	nRoutines := uint64(4)
+func kangaroo(ctx context.Context, pt CPoint, bytesNumber uint64) (*big.Int, error) {
+	if bytesNumber > KANGAROO_MAX_BYTES {
+		return nil, fmt.Errorf("the kangaroo algorithm searches values on at most %d bytes, not %d", KANGAROO_MAX_BYTES, bytesNumber)
+	}
+	nRoutines := uint64(solverRoutines())
 	// N describes the length of the second string we are building
 	N := uint64(1 << (bytesNumber * 4))
 	// Smaj is the smallest majorant of S (set of integers) not belonging to S
-	Smaj := new(big.Int).SetUint64(bytesNumber * 8)
-	// firstpoint is the starting point of the first tamed routine.
-	// The starting points of the other routines will be multiples of it
-
-	firstPoint := new(big.Int).SetUint64(N * N / nRoutines)
+	Smaj := new(big.Int).SetUint64(kangarooJumpBits(N))
+	// starts are the starting points of the tamed routines, the multiples of the first one
+	starts := kangarooStarts(bytesNumber, nRoutines)
 	// T is the array that stores the arrival points of each of the tamed kangaroos launched
 	T := make([]CPoint, nRoutines)
 	// dTPlis is an array that stores the distances traveled by each of the wild kangaroos
@@ -190,11 +1030,9 @@ func kangaroo(pt CPoint, bytesNumber uint64) *big.Int {
 
 	dTPlus := make([]*big.Int, nRoutines)
 
-	cFound := make(chan *big.Int)
+	cFound := make(chan *big.Int, nRoutines)
 	cLim := make(chan bool, nRoutines)
 
-	fmt.Printf("début kangaroo, N = %d\n", N)
-
 	/* Pseudo-random function f : C → S with S a set of integers */
 	s := func(q CPoint) *big.Int {
 		i := new(big.Int).Mod(q.x, Smaj)
@@ -215,9 +1053,12 @@ func kangaroo(pt CPoint, bytesNumber uint64) *big.Int {
 		var si *big.Int
 		var siG CPoint
 		var dTame = big.NewInt(0)
-		basePointBig := new(big.Int).Mul(firstPoint, big.NewInt(int64(num)))
+		basePointBig := starts[num]
 		Tame := baseMult(basePointBig)
 		for i := uint64(0); i < N; i++ {
+			if i%1024 == 0 && ctx.Err() != nil {
+				return
+			}
 			si = s(Tame)
 			dTame.Add(dTame, si)
 			siG = baseMult(si)
@@ -228,7 +1069,9 @@ func kangaroo(pt CPoint, bytesNumber uint64) *big.Int {
 		cLim <- true
 	}
 
-	pursueWild := true
+	// stop ends the wild routines once the search is over: it is set by the deferred function
+	// while they read it, so it is accessed atomically
+	var stop int32
 
 	// runningWild is the routine used for the travel of the wild kangaroos
 	runningWild := func(k uint64) {
@@ -238,7 +1081,7 @@ func kangaroo(pt CPoint, bytesNumber uint64) *big.Int {
 		var dWPlus, si *big.Int
 		var found bool
 		var num int
-		for pursueWild {
+		for atomic.LoadInt32(&stop) == 0 {
 			bigOffset.SetUint64(offset)
 			Wild = addC(pt, baseMult(bigOffset))
 			found, num = isInT(Wild)
@@ -251,6 +1094,9 @@ func kangaroo(pt CPoint, bytesNumber uint64) *big.Int {
 			siG = baseMult(si)
 
 			for i := uint64(0); i < N; i++ {
+				if i%1024 == 0 && (ctx.Err() != nil || atomic.LoadInt32(&stop) != 0) {
+					return
+				}
 				Wild = addC(Wild, siG) // W_i+1 = W_i + si⋅G
 				found, num = isInT(Wild)
 				if found {
@@ -263,7 +1109,6 @@ func kangaroo(pt CPoint, bytesNumber uint64) *big.Int {
 				siG = baseMult(si)
 			}
 			offset += nRoutines
-			fmt.Println("Wild not caught")
 		}
 	}
 
@@ -271,75 +1116,138 @@ func kangaroo(pt CPoint, bytesNumber uint64) *big.Int {
 		go runningTamed(k)
 	}
 	for k := uint64(0); k < nRoutines; k++ {
-		_ = <-cLim
+		select {
+		case <-cLim:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 
-	fmt.Println("tamed finished")
-
 	for k := uint64(0); k < nRoutines; k++ {
 		go runningWild(k)
 	}
-	pow := <-cFound
-	pursueWild = false
-	return pow
+	defer atomic.StoreInt32(&stop, 1)
+	select {
+	case pow := <-cFound:
+		return pow, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 // loadL2mpa will load in memory or create the hashmap used for the baby step giant step algorithm.
 func loadhL2(m uint64) (hL2 map[ShortPoint]uint64) {
-	hL2 = make(map[ShortPoint]uint64)
-	pt := pointZero
-	for i := uint64(0); i < m; i++ {
-		//pt = baseMult(big.NewInt(int64(i)))
-		hL2[GetShortOf(pt)] = i
-		//fmt.Printf("added %s : %d\n", pt.String(), i)
+	hL2, _ = loadhL2Range(context.Background(), 0, m)
+	return
+}
+
+// loadhL2Range creates the hashmap of the points j⋅g for j in [from;to[, a block of the table
+// used by the baby step giant step algorithm.
+// The table is only returned once complete and is never written afterwards: the routines of
+// bsgsBlock, and the decryptions sharing the table of a Solver, read it concurrently without lock,
+// which is only safe as long as no routine writes it. A table built lazily or read from a file must
+// therefore also be complete before it is handed to them.
+func loadhL2Range(ctx context.Context, from, to uint64) (hL2 map[ShortPoint]uint64, err error) {
+	hL2 = make(map[ShortPoint]uint64, to-from)
+	pt := baseMult(new(big.Int).SetUint64(from))
+	for i := from; i < to; i++ {
+		if (i-from)%1024 == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		hL2[shortOf(pt)] = i
 		pt = addC(pt, G)
 	}
-	fmt.Println("Load finished")
 	return
 }
 
 // babyStepGiantStep allows to compute the discrete logarithm with a guaranteed complexity in the square root
 // of the maximum of the considered interval. To simplify things, rather than giving the maximum of the interval
 // as a parameter, we send the number of bytes on which the value to find is encoded
+// It panics with ErrPointOutOfRange if the value is not on bytesNumber bytes.
 func babyStepGiantStep(pt0 CPoint, bytesNumber uint64) uint64 {
-	// ms is the square root of the maximum of the considered interval
-	m := uint64(1 << (bytesNumber * 4))
-	fmt.Printf("m = %d\n", m)
+	pow, found, _ := bsgsSearch(context.Background(), pt0, uint64(1<<(bytesNumber*4)))
+	if !found {
+		checkErr(ErrPointOutOfRange)
+	}
+	return pow
+}
+
+// bsgsSearch is the baby step giant step algorithm looking for x in [0;m²[ such that pt0 = x⋅g.
+// found is false if there is no such x. The table of the baby steps is built by blocks of at most
+// BSGSTableLimit entries, which bounds the memory used at the expense of running the giant steps
+// once per block. The search is abandoned with the error of ctx when ctx is done.
+func bsgsSearch(ctx context.Context, pt0 CPoint, m uint64) (pow uint64, found bool, err error) {
+	block := BSGSTableLimit
+	if block == 0 || block > m {
+		block = m
+	}
+	for from := uint64(0); from < m; from += block {
+		to := from + block
+		if to > m || to < from {
+			to = m
+		}
+		hL2, err := loadhL2Range(ctx, from, to)
+		if err != nil {
+			return 0, false, err
+		}
+		if pow, found, err = bsgsBlock(ctx, pt0, m, hL2); found || err != nil {
+			return pow, found, err
+		}
+	}
+	return 0, false, nil
+}
+
+// bsgsBlock runs the giant steps of the baby step giant step algorithm over [0;m²[ with a block
+// hL2 of the table of the baby steps. It only finds the values x whose remainder x mod m is in hL2.
+// The block is read by SolverRoutines routines at once and must not be written during the search,
+// see loadhL2Range.
+func bsgsBlock(ctx context.Context, pt0 CPoint, m uint64, hL2 map[ShortPoint]uint64) (pow uint64, found bool, err error) {
 	// mg is the point m⋅g
 	mg := baseMult(new(big.Int).SetUint64(m))
-	// L2 is the list [0⋅g; 1⋅g; 2⋅g; ... ; (m-1)⋅g] and hL2 is the hashmap associated
-	var hL2 = loadhL2(m)
 
-	nRoutines := byte(MAX_ROUTINES)
-	cPow := make(chan uint64)
-	pursue := true
+	nRoutines := byte(solverRoutines())
+	cPow := make(chan uint64, nRoutines)
+	// cDone receives a value from each routine that has finished its part without success
+	cDone := make(chan bool, nRoutines)
+	// stop tells the routines to give up once the search is over: it is written by this routine
+	// while they read it, so it is accessed atomically
+	var stop int32
 
 	findPow := func(k byte) {
 		var j uint64
 		var found bool
 		rmg := mg.multB([]byte{nRoutines})
 		pt1 := pt0.subC(mg.multB([]byte{k}))
-		for i := uint64(k); (i < m) && pursue; i += uint64(nRoutines) {
+		for i := uint64(k); (i < m) && atomic.LoadInt32(&stop) == 0; i += uint64(nRoutines) {
 
 			/*
 			* The following line tests the presence of the point pt1 obtained in the base map.
 			* It has to be changed if we want to keep the precalculated base in line.
 			 */
 
-			if j, found = hL2[GetShortOf(pt1)]; found {
-				fmt.Printf("found %d\n", i*m+j)
+			if j, found = hL2[shortOf(pt1)]; found {
 				cPow <- i*m + j
+				return
 			}
 			pt1 = pt1.subC(rmg)
 		}
+		cDone <- true
 	}
 
 	for k := byte(0); k < nRoutines; k++ {
 		go findPow(k)
 	}
 
-	pow := <-cPow
-	pursue = false
-
-	return pow
+	defer atomic.StoreInt32(&stop, 1)
+	for failed := byte(0); failed < nRoutines; {
+		select {
+		case pow = <-cPow:
+			return pow, true, nil
+		case <-cDone:
+			failed++
+		case <-ctx.Done():
+			return 0, false, ctx.Err()
+		}
+	}
+	return 0, false, nil
 }
@@ -1,16 +1,40 @@
+//go:build !nosql
+
 package elgamalcrypto
 
 import (
 	"bytes"
+	"context"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	mr "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
-	"github.com/codahale/sss"
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 const testText = "They met me in the day of success: and I have" +
@@ -59,8 +83,16 @@ func TestED1(t *testing.T) {
 	testEncryptDecryptHash(t, 1, []byte("hello"))
 }
 
-// Test of the encryption/decryption algorithm with a long text
+// Test of the encryption/decryption algorithm with a long text, which Encrypt refuses as the
+// bytes of the hash would be used twice
 func TestED2(t *testing.T) {
+	pub, _, _ := SetKeys(rand.Reader)
+	if _, err := pub.Encrypt([]byte(testText), rand.Reader); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("Expected ErrMessageTooLong from Encrypt, got %v", err)
+	}
+	if _, err := pub.Encrypt([]byte(testText[:BytesNumber]), rand.Reader); err != nil {
+		t.Errorf("A message of the length of the hash was refused: %s", err)
+	}
 	testEncryptDecryptHash(t, 2, []byte(testText))
 }
 
@@ -75,31 +107,33 @@ func testEncryptDecryptHash(t *testing.T, testNumber int, message []byte) {
 	fmt.Printf("\nTest 2, start of subtest %d\n", testNumber)
 
 	pub, priv, _ := SetKeys(rand.Reader)
-	cypher := pub.basicEncryptHash(message, rand.Reader)
+	cypher, err := pub.encrypt(message, rand.Reader)
+	checkErr(err)
 
-	result := priv.Decrypt(cypher)
-	if !bytes.Equal(result, message) {
+	result, err := priv.Decrypt(cypher)
+	if err != nil || !bytes.Equal(result, message) {
 		t.Errorf("Decryption failed, got: '% x', want: '% x\n", result, message)
 	} else {
 		fmt.Printf("Decryption %d success\n", testNumber)
 	}
 }
 
-// We test if the SSS part of the SetKeys function is working properly
+// We test if the SSS part of the SetKeys function is working properly: any two shares give the
+// private key back, and the shares are accepted by ExtractPart
 func TestSetKeys(t *testing.T) {
 	fmt.Println("\nStarting test 3")
 	_, priv, _ := SetKeys(rand.Reader)
-	shares := map[byte][]byte{
-		1: priv[1],
-		2: priv[2],
+	for _, pair := range [][2]int{{1, 2}, {1, 3}, {2, 3}} {
+		shares := map[int][]byte{pair[0]: priv[pair[0]], pair[1]: priv[pair[1]]}
+		priv0found := combineShares(shares)
+		if new(big.Int).SetBytes(priv0found).Cmp(new(big.Int).SetBytes(priv[0])) != 0 {
+			t.Errorf("Conversion from the shares %v failed, got %x, wanted %x", pair, priv0found, priv[0])
+		}
 	}
-	priv0found := sss.Combine(shares)
-
-	if !bytes.Equal(priv[0], priv0found) {
-		t.Errorf("Conversion failed, got %x, wanted %x", priv0found, priv[0])
-	} else {
-		fmt.Println("Conversion success")
+	if !sharesOnLine(priv) {
+		t.Error("the shares of SetKeys are refused by ExtractPart")
 	}
+	fmt.Println("Conversion success")
 }
 
 // TestShort will test the conversion and re-conversion of the curve points in shortened form
@@ -110,7 +144,7 @@ func TestShort(t *testing.T) {
 	pt := baseMult(a)
 	fmt.Printf("Donnée d'origine : x = (%x, %x)\n", pt.x, pt.y)
 
-	s := GetShortOf(pt)
+	s := shortOf(pt)
 	fmt.Printf("Donnée raccourcie : s = %x\n", s)
 
 	pt2 := PointFromShort(s)
@@ -130,7 +164,8 @@ func muteTestEncryptTable(t *testing.T) {
 	defer db1.Close()
 
 	commands := []byte{0, 0, 1, 1, 1, 1, 2}
-	_ = EncryptTable(db1, db1, "user_details", commands, rand.Reader)
+	_, err = EncryptTable(db1, db1, "user_details", commands, rand.Reader)
+	checkErr(err)
 }
 
 func TestZero(t *testing.T) {
@@ -143,7 +178,8 @@ func TestKangaroo(t *testing.T) {
 	fmt.Println("\nStarting test 6 : kangaroo small integer")
 	BigSmth := big.NewInt(4194967296) // < 2**(4*8)
 	pt := baseMult(BigSmth)
-	pow := kangaroo(pt, 4)
+	pow, err := kangaroo(context.Background(), pt, 4)
+	checkErr(err)
 	if pow.Cmp(BigSmth) == 0 {
 		fmt.Println("Pollard succed")
 	} else {
@@ -151,6 +187,51 @@ func TestKangaroo(t *testing.T) {
 	}
 }
 
+// TestKangarooStarts checks the starting points of the tamed kangaroos at the largest width, where
+// 2^(8⋅bytesNumber) overflows 64 bits. Solving a value on 8 bytes takes 2^32 jumps per kangaroo,
+// so the solving itself is checked at smaller widths by TestKangarooSuccessRate.
+func TestKangarooStarts(t *testing.T) {
+	for _, width := range []uint64{2, KANGAROO_MAX_BYTES} {
+		starts := kangarooStarts(width, 4)
+		max := new(big.Int).Lsh(Big1, uint(8*width))
+		step := new(big.Int).Rsh(max, 2)
+		for k, start := range starts {
+			if want := new(big.Int).Mul(step, big.NewInt(int64(k))); start.Cmp(want) != 0 {
+				t.Errorf("Width %d: the tamed kangaroo %d starts at %d instead of %d", width, k, start, want)
+			}
+			if start.Cmp(max) >= 0 {
+				t.Errorf("Width %d: the tamed kangaroo %d starts at %d, beyond the range", width, k, start)
+			}
+		}
+	}
+
+	if _, err := kangaroo(context.Background(), G, KANGAROO_MAX_BYTES+1); err == nil {
+		t.Errorf("A width above KANGAROO_MAX_BYTES should be refused")
+	}
+}
+
+// TestKangarooSuccessRate solves the discrete logarithm of many random values with the kangaroo
+// algorithm, each within a time limit, and checks that nearly all of them are found
+func TestKangarooSuccessRate(t *testing.T) {
+	// trials gives the number of values solved for each width
+	for width, trials := range map[uint64]int{2: 40, 3: 10} {
+		found := 0
+		for i := 0; i < trials; i++ {
+			x, _ := rand.Int(rand.Reader, new(big.Int).Lsh(Big1, uint(8*width)))
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			pow, err := kangaroo(ctx, baseMult(x), width)
+			cancel()
+			if err == nil && pow.Cmp(x) == 0 {
+				found++
+			}
+		}
+		t.Logf("%d bytes: %d/%d values found", width, found, trials)
+		if found < trials*9/10 {
+			t.Errorf("Only %d of %d values on %d bytes were found", found, trials, width)
+		}
+	}
+}
+
 func TestBSGS(t *testing.T) {
 	fmt.Println("\nStarting test 7 : BSGS 5 bytes")
 	smth := uint64(1099511327776)
@@ -172,9 +253,11 @@ func muteTestDouble(t *testing.T) {
 	pub, priv, _ := SetKeys(rand.Reader)
 	aBytes := BytesFromFloat32(a)
 	fmt.Printf("float sous forme de bytes : % x\n", aBytes)
-	cypher := pub.basicEncryptPoint(aBytes, rand.Reader)
+	cypher, err := pub.EncryptPoint(aBytes, rand.Reader)
+	checkErr(err)
 
-	result := decryptFromPoint(PointFromShort(cypher.Data), cypher.C.multB(priv[0]), "REAL")
+	result, err := decryptFromPoint(context.Background(), nil, PointFromShort(cypher.Data), cypher.C.multB(priv[0]), "REAL")
+	checkErr(err)
 	a2 := Float32frombytes(result)
 	if a2 != a {
 		t.Errorf("Decryption failed")
@@ -194,16 +277,4381 @@ func muteTestDoubleAddition(t *testing.T) {
 	aBytes := BytesFromFloat32(a)
 	bBytes := BytesFromFloat32(b)
 
-	cyphA := pubA.basicEncryptPoint(aBytes, rand.Reader)
-	cyphB := pubB.basicEncryptPoint(bBytes, rand.Reader)
+	cyphA, err := pubA.EncryptPoint(aBytes, rand.Reader)
+	checkErr(err)
+	cyphB, err := pubB.EncryptPoint(bBytes, rand.Reader)
+	checkErr(err)
 
 	pt := addC(PointFromShort(cyphA.Data), PointFromShort(cyphB.Data))
 	ptKey := addC(cyphA.C.multB(privA[0]), cyphB.C.multB(privB[0]))
 
-	result := Float32frombytes(decryptFromPoint(pt, ptKey, "REAL"))
+	resBytes, err := decryptFromPoint(context.Background(), nil, pt, ptKey, "REAL")
+	checkErr(err)
+	result := Float32frombytes(resBytes)
 	if result != a+b {
 		t.Errorf("Decryption failed")
 	} else {
 		fmt.Printf("Decryption success\n")
 	}
 }
+
+// TestExtractPartMissingShare checks that a table of keys with an empty share
+// is rejected instead of producing a zero partial key
+func TestExtractPartMissingShare(t *testing.T) {
+	_, priv, _ := SetKeys(rand.Reader)
+	broken := priv
+	broken[2] = nil
+
+	keys := TableKeys{
+		R:    map[interface{}]*big.Int{int64(1): big.NewInt(5)},
+		Priv: map[string]PrivateKey{"name": priv, "salary": broken},
+	}
+
+	if _, err := keys.ExtractPart(1); err != nil {
+		t.Errorf("Extraction of part 1 failed: %s", err)
+	}
+	if _, err := keys.ExtractPart(2); err == nil {
+		t.Errorf("Extraction of part 2 should have failed on column salary")
+	}
+	if _, err := keys.ExtractPart(4); err == nil {
+		t.Errorf("Extraction of part 4 should have failed")
+	}
+
+	// shares made byte by byte in GF(256), which cannot be interpolated modulo N
+	legacy := priv
+	legacy[2] = append([]byte{}, priv[2]...)
+	legacy[2][0] ^= 1
+	keys.Priv = map[string]PrivateKey{"name": legacy}
+	if _, err := keys.ExtractPart(1); !errors.Is(err, ErrLegacyShares) {
+		t.Errorf("Extraction of legacy shares gave %v, want ErrLegacyShares", err)
+	}
+}
+
+// TestEncryptMissingTable checks that the encryption of a table which does not exist returns the
+// error of the database instead of panicking
+func TestEncryptMissingTable(t *testing.T) {
+	db, _ := newFakeDB(t)
+	if _, err := EncryptTable(db, db, "ghosts", []byte{0, 1}, rand.Reader); err == nil {
+		t.Errorf("EncryptTable should fail on a missing table")
+	}
+	if _, err := EncryptTableToWriter(db, "ghosts", []byte{0, 1}, rand.Reader, io.Discard, OUTPUT_CSV); err == nil {
+		t.Errorf("EncryptTableToWriter should fail on a missing table")
+	}
+	if _, err := Plan(db, "ghosts", []byte{0, 1}); err == nil {
+		t.Errorf("Plan should fail on a missing table")
+	}
+}
+
+// TestEncryptTableUnsupportedType checks that an unencrypted column of unknown type
+// makes the encryption fail unless the bytea fallback is requested
+func TestEncryptTableUnsupportedType(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("hosts", []string{"id", "addr"}, []string{"BIGINT", "INET"},
+		[]driver.Value{int64(1), "10.0.0.1"},
+		[]driver.Value{int64(2), "10.0.0.2"})
+
+	_, err := EncryptTable(db, db, "hosts", []byte{0, 0}, rand.Reader)
+	if err == nil || !strings.Contains(err.Error(), "INET") || !strings.Contains(err.Error(), "addr") {
+		t.Errorf("Expected an error about column addr of type INET, got %v", err)
+	}
+	if fdb.table("hosts_encrypted") != nil {
+		t.Errorf("The destination table should not have been created")
+	}
+
+	_, err = EncryptTableWithOptions(db, db, "hosts", []byte{0, 0}, rand.Reader, EncryptOptions{ByteaFallback: true})
+	if err != nil {
+		t.Fatalf("Encryption with fallback failed: %s", err)
+	}
+	if dest := fdb.table("hosts_encrypted"); dest == nil || len(dest.rows) != 2 {
+		t.Errorf("The destination table does not contain the 2 rows")
+	}
+}
+
+// TestEncryptColumn encrypts a slice of integers held in memory and decrypts each of them
+func TestEncryptColumn(t *testing.T) {
+	pub, priv, _ := SetKeys(rand.Reader)
+	vals := []interface{}{int64(0), int64(42), int64(-7), int64(123456789)}
+
+	cyphers, rs, err := pub.EncryptColumn(vals, 1, rand.Reader)
+	if err != nil {
+		t.Fatalf("Hash encryption failed: %s", err)
+	}
+	for i, c := range cyphers {
+		if !c.C.equalC(baseMult(rs[i])) {
+			t.Errorf("Cypher %d does not correspond to its r", i)
+		}
+		var v int64
+		m, err := priv.Decrypt(c)
+		checkErr(err)
+		err = gob.NewDecoder(bytes.NewReader(m)).Decode(&v)
+		if err != nil || v != vals[i].(int64) {
+			t.Errorf("Decryption of value %d failed, got %d (%v)", i, v, err)
+		}
+	}
+	// The data is authenticated like the cells of the tables
+	if CellVersion(cyphers[0].Data, 1) != CELL_V2 {
+		t.Errorf("The cypher is of version %d instead of %d", CellVersion(cyphers[0].Data, 1), CELL_V2)
+	}
+	cyphers[0].Data[len(authHeader)] ^= 1
+	if _, err = priv.Decrypt(cyphers[0]); err != ErrAuthentication {
+		t.Errorf("A modified cypher should fail authentication, got %v", err)
+	}
+
+	// In point mode, the discrete logarithm gives back the encoded value
+	cyphers, _, err = pub.EncryptColumn(vals[:2], 2, rand.Reader)
+	if err != nil {
+		t.Fatalf("Point encryption failed: %s", err)
+	}
+	for i, c := range cyphers {
+		q := PointFromBytes(c.Data).subC(c.C.multB(priv[0]))
+		want := new(big.Int).SetBytes(GetBytes(vals[i])).Uint64()
+		if got := babyStepGiantStep(q, 4); got != want {
+			t.Errorf("Decryption of point %d failed, got %d, want %d", i, got, want)
+		}
+	}
+
+	if _, _, err = pub.EncryptColumn(vals, 3, rand.Reader); err == nil {
+		t.Errorf("Mode 3 should have been rejected")
+	}
+	for _, mode := range []byte{1, 2} {
+		if _, _, err = pub.EncryptColumn([]interface{}{int64(1), nil}, mode, rand.Reader); !errors.Is(err, ErrNullValue) || !strings.Contains(err.Error(), "value 1") {
+			t.Errorf("Mode %d: a nil value should be refused with ErrNullValue, got %v", mode, err)
+		}
+	}
+}
+
+// TestEncryptTableStream collects the rows emitted by the streaming encryption
+func TestEncryptTableStream(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("accounts", []string{"id", "owner", "balance"}, []string{"BIGINT", "TEXT", "BIGINT"},
+		[]driver.Value{int64(10), "alice", int64(100)},
+		[]driver.Value{int64(20), "bob", int64(200)},
+		[]driver.Value{int64(30), "carol", int64(300)})
+
+	var indexes []uint64
+	var rows [][]string
+	keys, err := EncryptTableStream(db, "accounts", []byte{0, 1, 1}, rand.Reader, func(i uint64, cells []string) error {
+		indexes = append(indexes, i)
+		rows = append(rows, cells)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Streaming encryption failed: %s", err)
+	}
+	if len(rows) != 3 || len(keys.R) != 3 {
+		t.Fatalf("Expected 3 rows and 3 r values, got %d and %d", len(rows), len(keys.R))
+	}
+	for i, cells := range rows {
+		if indexes[i] != uint64(i) {
+			t.Errorf("Row %d emitted with index %d", i, indexes[i])
+		}
+		if len(cells) != 3 {
+			t.Errorf("Row %d has %d cells", i, len(cells))
+		}
+		if want := fmt.Sprint((i + 1) * 10); cells[0] != want {
+			t.Errorf("Row %d has primary key %s, want %s", i, cells[0], want)
+		}
+	}
+	if fdb.table("accounts_encrypted") != nil {
+		t.Errorf("No destination table should have been created")
+	}
+
+	// An error of the callback is returned
+	_, err = EncryptTableStream(db, "accounts", []byte{0, 1, 1}, rand.Reader, func(i uint64, cells []string) error {
+		return fmt.Errorf("sink full at row %d", i)
+	})
+	if err == nil || err.Error() != "sink full at row 0" {
+		t.Errorf("Expected the error of the callback, got %v", err)
+	}
+}
+
+// TestEncryptTableToWriter encrypts a table into CSV, by rows then by columns, and checks the
+// dimensions of the output and that the encrypted cells are decodable hexadecimal
+func TestEncryptTableToWriter(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("accounts", []string{"id", "owner", "balance"}, []string{"BIGINT", "TEXT", "INTEGER"},
+		[]driver.Value{int64(10), "alice", int64(1)},
+		[]driver.Value{int64(20), "bob", int64(2)},
+		[]driver.Value{int64(30), "carol", int64(3)})
+
+	var buf bytes.Buffer
+	keys, err := EncryptTableToWriter(db, "accounts", []byte{0, 1, 2}, rand.Reader, &buf, OUTPUT_CSV)
+	if err != nil {
+		t.Fatalf("Encryption to CSV failed: %s", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("The output is not CSV: %s", err)
+	}
+	if len(records) != 4 || strings.Join(records[0], ",") != "id,owner,balance" {
+		t.Fatalf("Expected a header and 3 rows, got %v", records)
+	}
+	for i, rec := range records[1:] {
+		if len(rec) != 3 {
+			t.Fatalf("Row %d has %d fields", i, len(rec))
+		}
+		if want := fmt.Sprint((i + 1) * 10); rec[0] != want {
+			t.Errorf("Row %d has primary key %s, want %s", i, rec[0], want)
+		}
+		for _, f := range rec[1:] {
+			if _, err := hex.DecodeString(f); err != nil || f == "" {
+				t.Errorf("Row %d has the encrypted cell %q which is not hexadecimal", i, f)
+			}
+		}
+	}
+	if len(keys.R) != 3 || fdb.table("accounts_encrypted") != nil {
+		t.Errorf("Expected 3 r values and no destination table, got %d r values", len(keys.R))
+	}
+
+	buf.Reset()
+	if _, err = EncryptTableToWriter(db, "accounts", []byte{0, 1, 2}, rand.Reader, &buf, OUTPUT_COLUMNS); err != nil {
+		t.Fatalf("Encryption by columns failed: %s", err)
+	}
+	if records, err = csv.NewReader(&buf).ReadAll(); err != nil || len(records) != 3 {
+		t.Fatalf("Expected 3 columns, got %v (%v)", records, err)
+	}
+	for j, rec := range records {
+		if len(rec) != 4 || rec[0] != []string{"id", "owner", "balance"}[j] {
+			t.Errorf("Column %d is %v", j, rec)
+		}
+	}
+	if strings.Join(records[0][1:], ",") != "10,20,30" {
+		t.Errorf("The primary keys are %v", records[0][1:])
+	}
+
+	if _, err = EncryptTableToWriter(db, "accounts", []byte{0, 1, 2}, rand.Reader, &buf, OutputFormat(7)); err == nil {
+		t.Errorf("An unknown format should have been rejected")
+	}
+
+	// The NULL cells are empty fields while the empty texts are quoted, as COPY ... CSV reads them
+	fdb.addTable("notes", []string{"id", "note", "body"}, []string{"BIGINT", "TEXT", "TEXT"},
+		[]driver.Value{int64(1), nil, "a"}, []driver.Value{int64(2), "", "b, c"})
+	buf.Reset()
+	if _, err = EncryptTableToWriter(db, "notes", []byte{0, 0, 0}, rand.Reader, &buf, OUTPUT_CSV); err != nil {
+		t.Fatalf("Encryption to CSV failed: %s", err)
+	}
+	if want := "id,note,body\n1,,a\n2,\"\",\"b, c\"\n"; buf.String() != want {
+		t.Errorf("The CSV is %q, want %q", buf.String(), want)
+	}
+	if _, err = csvFields([]interface{}{int64(1), time.Now()}); err == nil {
+		t.Errorf("A cell without CSV field should be refused")
+	}
+}
+
+// TestResumeEncryption interrupts the encryption of a table by a crash of the destination
+// database after a few rows, resumes it from its checkpoint and decrypts the whole table
+func TestResumeEncryption(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	var rows [][]driver.Value
+	for i := int64(0); i < 12; i++ {
+		rows = append(rows, []driver.Value{i, fmt.Sprintf("name %d", i), i % 7})
+	}
+	fdb.addTable("people", []string{"id", "name", "grade"}, []string{"BIGINT", "TEXT", "INTEGER"}, rows...)
+	inserts := 0
+	fdb.failExec = func(query string) error {
+		if strings.HasPrefix(query, "INSERT") {
+			if inserts++; inserts > 5 {
+				return errors.New("connection lost")
+			}
+		}
+		return nil
+	}
+	checkpoint := t.TempDir() + "/checkpoint"
+	opts := EncryptOptions{Checkpoint: checkpoint}
+	if _, err := EncryptTableWithOptions(db, db, "people", []byte{0, 1, 2}, rand.Reader, opts); err == nil {
+		t.Fatalf("The encryption should have been interrupted")
+	}
+	if n := len(fdb.table("people_encrypted").rows); n != 5 {
+		t.Fatalf("%d rows were inserted before the crash instead of 5", n)
+	}
+	recorded, err := LoadTableKeys(checkpoint)
+	checkErr(err)
+
+	fdb.failExec = nil
+	opts.Resume = true
+	keys, err := EncryptTableWithOptions(db, db, "people", []byte{0, 1, 2}, rand.Reader, opts)
+	if err != nil {
+		t.Fatalf("The encryption was not resumed: %s", err)
+	}
+	if !bytes.Equal(keys.Priv["name"][0], recorded.Priv["name"][0]) || keys.R[int64(3)].Cmp(recorded.R[int64(3)]) != 0 {
+		t.Errorf("The keys changed when the encryption was resumed")
+	}
+	enc := fdb.table("people_encrypted").rows
+	if len(enc) != 12 {
+		t.Fatalf("The encrypted table has %d rows instead of 12", len(enc))
+	}
+	seen := make(map[int64]bool)
+	for _, row := range enc {
+		id := row[0].(int64)
+		if seen[id] {
+			t.Errorf("The row %d was inserted twice", id)
+		}
+		seen[id] = true
+		r := keys.R[id]
+		colKeys := map[string]CPoint{"name": baseMult(r).multB(keys.Priv["name"][0]), "grade": baseMult(r).multB(keys.Priv["grade"][0])}
+		values, err := DecryptRow(map[string][]byte{"name": row[1].([]byte), "grade": row[2].([]byte)}, keys.ti, colKeys)
+		if err != nil || values["name"] != fmt.Sprintf("name %d", id) || values["grade"] != id%7 {
+			t.Errorf("The row %d was decrypted to %v (%v)", id, values, err)
+		}
+	}
+
+	if _, err = EncryptTableWithOptions(db, db, "people", []byte{0, 1, 1}, rand.Reader, opts); err == nil {
+		t.Errorf("A checkpoint should not resume the encryption with other commands")
+	}
+}
+
+// TestSkipFailedRows encrypts a table into a database which refuses every third insertion
+func TestSkipFailedRows(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	var rows [][]driver.Value
+	for i := int64(0); i < 10; i++ {
+		rows = append(rows, []driver.Value{i, fmt.Sprintf("name %d", i)})
+	}
+	fdb.addTable("people", []string{"id", "name"}, []string{"BIGINT", "TEXT"}, rows...)
+	inserts := 0
+	fdb.failExec = func(query string) error {
+		if !strings.HasPrefix(query, "INSERT") {
+			return nil
+		}
+		inserts++
+		if inserts%3 == 0 {
+			return errors.New("disk full")
+		}
+		return nil
+	}
+
+	keys, err := EncryptTableWithOptions(db, db, "people", []byte{0, 1}, rand.Reader, EncryptOptions{SkipFailedRows: true})
+	var failures InsertErrors
+	if !errors.As(err, &failures) {
+		t.Fatalf("Expected the failed insertions, got %v", err)
+	}
+	if len(failures) != 3 {
+		t.Fatalf("Expected 3 failed rows, got %d", len(failures))
+	}
+	for k, f := range failures {
+		if f.Row != uint64(3*k+2) || f.Err.Error() != "disk full" {
+			t.Errorf("Unexpected failure %v", f)
+		}
+	}
+	if n := len(fdb.table("people_encrypted").rows); n != 7 {
+		t.Errorf("Expected 7 rows inserted, got %d", n)
+	}
+	if len(keys.R) != 10 {
+		t.Errorf("Expected 10 r values, got %d", len(keys.R))
+	}
+
+	// Without the option the encryption stops at the first failure
+	inserts = 0
+	_, err = EncryptTable(db, db, "people", []byte{0, 1}, rand.Reader)
+	if err == nil || err.Error() != "disk full" {
+		t.Errorf("Expected the error of the insertion, got %v", err)
+	}
+	if n := len(fdb.table("people_encrypted").rows); n != 2 {
+		t.Errorf("Expected 2 rows inserted before the failure, got %d", n)
+	}
+}
+
+// TestEncryptCopy encrypts a table with COPY and checks that it gives the same table as the
+// insertions, including for the text which would have to be escaped in a literal, the columns
+// of the COPY being quoted
+func TestEncryptCopy(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("people", []string{"id", "name", "score", "active", "city"}, []string{"BIGINT", "TEXT", "REAL", "BOOLEAN", "TEXT"},
+		[]driver.Value{int64(1), "O'Brien", 0.5, true, "Dublin"},
+		[]driver.Value{int64(2), "Smith", 2.25, false, "Leeds"})
+
+	_, err := EncryptTableWithOptions(db, db, "people", []byte{0, 0, 0, 0, 1}, rand.Reader, EncryptOptions{DestName: "inserted"})
+	checkErr(err)
+	fdb.execs = nil
+	copied, err := EncryptTableWithOptions(db, db, "people", []byte{0, 0, 0, 0, 1}, rand.Reader, EncryptOptions{DestName: "copied", Copy: true})
+	if err != nil {
+		t.Fatalf("Encryption with COPY failed: %s", err)
+	}
+	quoted := false
+	for _, q := range fdb.execs {
+		if strings.HasPrefix(q, "INSERT") {
+			t.Fatalf("The rows were inserted instead of copied: %s", q)
+		}
+		quoted = quoted || q == `COPY "copied" ("id", "name", "score", "active", "city") FROM STDIN`
+	}
+	if !quoted {
+		t.Errorf("The columns of the COPY were not quoted: %v", fdb.execs)
+	}
+
+	want, got := fdb.table(`"inserted"`).rows, fdb.table(`"copied"`).rows
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 rows copied, got %d", len(got))
+	}
+	for i, row := range got {
+		if !reflect.DeepEqual(row[:4], want[i][:4]) {
+			t.Errorf("Row %d was copied as %v instead of %v", i, row[:4], want[i][:4])
+		}
+		s := baseMult(copied.R[row[0]]).multB(copied.Priv["city"][0])
+		m, err := decryptFromHash(row[4].([]byte), s)
+		if err == nil {
+			_, err = decodeValue(m, "TEXT")
+		}
+		if err != nil {
+			t.Errorf("The city of row %d failed to decrypt: %s", i, err)
+		}
+	}
+
+	opts := EncryptOptions{DestName: "copied", Copy: true, SkipFailedRows: true}
+	if _, err = EncryptTableWithOptions(db, db, "people", []byte{0, 0, 0, 0, 1}, rand.Reader, opts); err == nil {
+		t.Errorf("COPY should not accept to skip the failed rows")
+	}
+}
+
+// TestEncryptRowCount encrypts a table with a number of rows given by the caller, lower and
+// greater than the real one, and checks that all the rows are encrypted without counting them
+func TestEncryptRowCount(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	var rows [][]driver.Value
+	for i := int64(0); i < 5; i++ {
+		rows = append(rows, []driver.Value{i, fmt.Sprintf("name %d", i)})
+	}
+	fdb.addTable("people", []string{"id", "name"}, []string{"BIGINT", "TEXT"}, rows...)
+
+	for _, count := range []uint64{2, 50} {
+		fdb.queries = nil
+		keys, err := EncryptTableWithOptions(db, db, "people", []byte{0, 1}, rand.Reader, EncryptOptions{RowCount: count})
+		if err != nil {
+			t.Fatalf("Encryption with %d rows announced failed: %s", count, err)
+		}
+		for _, q := range fdb.queries {
+			if strings.HasPrefix(q, "SELECT COUNT") {
+				t.Errorf("The rows were counted: %s", q)
+			}
+		}
+		enc := fdb.table("people_encrypted").rows
+		if len(enc) != 5 || len(keys.R) != 5 || keys.ti.nRows != 5 {
+			t.Fatalf("With %d rows announced, %d rows encrypted for %d r values and %d rows in the keys",
+				count, len(enc), len(keys.R), keys.ti.nRows)
+		}
+		for i, row := range enc {
+			s := baseMult(keys.R[row[0]]).multB(keys.Priv["name"][0])
+			m, err := decryptFromHash(row[1].([]byte), s)
+			var v interface{}
+			if err == nil {
+				v, err = decodeValue(m, "TEXT")
+			}
+			if err != nil || v != fmt.Sprintf("name %d", i) {
+				t.Errorf("Row %d decrypted to %v (%v)", i, v, err)
+			}
+		}
+	}
+}
+
+// TestEncryptRowDrift changes the source table while it is read and checks that the encryption
+// stops with an error instead of misaligning the r values or waiting forever
+func TestEncryptRowDrift(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	var rows [][]driver.Value
+	for i := int64(0); i < 5; i++ {
+		rows = append(rows, []driver.Value{i, fmt.Sprintf("name %d", i)})
+	}
+
+	// The columns are read before the primary key used to generate the r values
+	changes := map[string]func(tab *fakeTable){
+		"a column with fewer rows": func(tab *fakeTable) {
+			if len(fdb.queries) == 2 {
+				tab.rows = tab.rows[:4]
+			}
+		},
+		"fewer rows than r values": func(tab *fakeTable) {
+			if len(fdb.queries) == 3 {
+				tab.rows = append(tab.rows, []driver.Value{int64(5), "name 5"})
+			}
+		},
+		"more rows than r values": func(tab *fakeTable) {
+			if len(fdb.queries) == 3 {
+				tab.rows = tab.rows[1:]
+			}
+		},
+	}
+	for name, change := range changes {
+		fdb.addTable("people", []string{"id", "name"}, []string{"BIGINT", "TEXT"}, rows...)
+		checks := -1
+		fdb.onQuery = func(query string) {
+			// Only the queries reading the rows are counted, which come after the count of the rows
+			// and the check of the primary keys
+			switch {
+			case strings.HasPrefix(query, "SELECT COUNT"):
+				checks, fdb.queries = 1, nil
+			case checks > 0:
+				checks, fdb.queries = 0, nil
+			case checks == 0:
+				change(fdb.tables["people"])
+			}
+		}
+
+		done := make(chan error)
+		go func() {
+			_, err := EncryptTable(db, db, "people", []byte{0, 1}, rand.Reader)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("With %s the encryption should fail", name)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("With %s the encryption does not end", name)
+		}
+	}
+}
+
+// TestUUIDPrimaryKey encrypts a table whose primary key and an encrypted column are UUIDs, given
+// by the driver as text and as bytes, and decrypts a row found by its UUID
+func TestUUIDPrimaryKey(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	const id1, id2 = "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	raw2, _ := hex.DecodeString(strings.ReplaceAll(id2, "-", ""))
+	fdb.addTable("devices", []string{"id", "name", "token"}, []string{"UUID", "TEXT", "UUID"},
+		[]driver.Value{[]byte(strings.ToUpper(id1)), "phone", raw2},
+		[]driver.Value{raw2, "laptop", []byte(id1)})
+
+	keys, err := EncryptTable(db, db, "devices", []byte{0, 1, 1}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	for _, id := range []string{id1, id2} {
+		if _, ok := keys.R[id]; !ok {
+			t.Errorf("No r for the row %s", id)
+		}
+	}
+	if ids := fdb.table("devices_encrypted").rows; ids[0][0] != id1 || ids[1][0] != id2 {
+		t.Errorf("The UUIDs were copied as %v and %v", ids[0][0], ids[1][0])
+	}
+
+	r := baseMult(keys.R[id2])
+	for j, want := range map[int]string{1: "laptop", 2: id1} {
+		col := keys.ti.colNames[j]
+		row := db.QueryRow(fmt.Sprintf("SELECT %s FROM devices_encrypted WHERE id = $1;", col), id2)
+		sKey := r.multB(keys.Priv[col][0])
+		keyParts := map[int]CPoint{1: sKey, 3: sKey}
+		m, err := DecryptOneData(context.Background(), *row, keys.ti, j, keyParts)
+		var v interface{}
+		if err == nil {
+			v, err = decodeValue(m, keys.ti.colTypes[j])
+		}
+		if err != nil || v != want {
+			t.Errorf("Column %s of the row %s decrypted to %v (%v), want %s", col, id2, v, err, want)
+		}
+	}
+}
+
+// TestAppendRows encrypts a table, appends two new rows and decrypts them
+func TestAppendRows(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("orders", []string{"id", "item"}, []string{"BIGINT", "TEXT"},
+		[]driver.Value{int64(1), "pen"},
+		[]driver.Value{int64(2), "ink"})
+
+	keys, err := EncryptTable(db, db, "orders", []byte{0, 1}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+
+	src := fdb.table("orders")
+	src.rows = append(src.rows, []driver.Value{int64(3), "paper"}, []driver.Value{int64(4), "stapler"})
+	err = AppendRows(db, db, keys.ti, keys, []interface{}{int64(3), int64(4)}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Append failed: %s", err)
+	}
+
+	dest := fdb.table("orders_encrypted")
+	if len(dest.rows) != 4 || len(keys.R) != 4 {
+		t.Fatalf("Expected 4 encrypted rows and r values, got %d and %d", len(dest.rows), len(keys.R))
+	}
+	for i, want := range []string{"paper", "stapler"} {
+		row := dest.rows[2+i]
+		s := baseMult(keys.R[row[0]]).multB(keys.Priv["item"][0])
+		m, err := decryptFromHash(row[1].([]byte), s)
+		if err != nil {
+			t.Fatalf("Appended row %d failed to decrypt: %s", i, err)
+		}
+		var got string
+		err = gob.NewDecoder(bytes.NewReader(m)).Decode(&got)
+		if err != nil || got != want {
+			t.Errorf("Appended row %d decrypted to %q (%v), want %q", i, got, err, want)
+		}
+	}
+
+	if err = AppendRows(db, db, keys.ti, keys, []interface{}{int64(3)}, rand.Reader); err == nil {
+		t.Errorf("Appending an already encrypted row should fail")
+	}
+}
+
+// TestAppendRowsDestination appends a row to a table encrypted under another name and re-blinds
+// it, the description of the source table not knowing the name of the encrypted table
+func TestAppendRowsDestination(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("orders", []string{"id", "item"}, []string{"BIGINT", "TEXT"}, []driver.Value{int64(1), "pen"})
+	keys, err := EncryptTableWithOptions(db, db, "orders", []byte{0, 1}, rand.Reader, EncryptOptions{DestName: "orders_v2"})
+	checkErr(err)
+
+	src := fdb.table("orders")
+	src.rows = append(src.rows, []driver.Value{int64(2), "ink"})
+	ti, err := tableInfoFromDB(db, "orders", 0, 1)
+	checkErr(err)
+	if err = AppendRows(db, db, ti, keys, []interface{}{int64(2)}, rand.Reader); err != nil {
+		t.Fatalf("Append failed: %s", err)
+	}
+	dest := fdb.table(`"orders_v2"`)
+	if len(dest.rows) != 2 || fdb.table("orders_encrypted") != nil {
+		t.Fatalf("The row was not appended to the encrypted table")
+	}
+	old := dest.rows[1][1].([]byte)
+
+	newKeys, err := ReblindTable(db, ti, keys, rand.Reader)
+	if err != nil {
+		t.Fatalf("Re-blinding failed: %s", err)
+	}
+	row := dest.rows[1]
+	if bytes.Equal(row[1].([]byte), old) {
+		t.Errorf("The appended cell was not re-blinded")
+	}
+	s := baseMult(newKeys.R[row[0]]).multB(keys.Priv["item"][0])
+	m, err := decryptFromHash(row[1].([]byte), s)
+	checkErr(err)
+	var got string
+	if err = gob.NewDecoder(bytes.NewReader(m)).Decode(&got); err != nil || got != "ink" {
+		t.Errorf("The appended row decrypted to %q (%v)", got, err)
+	}
+}
+
+// TestAppendRowsSettings appends rows with the settings of the encryption recorded in the keys: the
+// compact encoding of the points, reloaded from the file of keys, and the primary keys encrypted
+// with a secret, and checks that a NULL or too large value is refused
+func TestAppendRowsSettings(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("stock", []string{"id", "qty"}, []string{"BIGINT", "INTEGER"}, []driver.Value{int64(1), int64(5)})
+	keys, err := EncryptTableWithOptions(db, db, "stock", []byte{0, 2}, rand.Reader, EncryptOptions{CompactPoints: true})
+	checkErr(err)
+	file := t.TempDir() + "/stock.keys"
+	checkErr(keys.StockTableKeys(file))
+	keys, err = LoadTableKeys(file)
+	checkErr(err)
+
+	src := fdb.table("stock")
+	src.rows = append(src.rows, []driver.Value{int64(2), int64(7)}, []driver.Value{int64(3), nil}, []driver.Value{int64(4), int64(1) << 40})
+	ti, err := tableInfoFromDB(db, "stock", 0, 2)
+	checkErr(err)
+	if err = AppendRows(db, db, ti, keys, []interface{}{int64(2)}, rand.Reader); err != nil {
+		t.Fatalf("Append failed: %s", err)
+	}
+	dest := fdb.table("stock_encrypted")
+	if cell := dest.rows[1][1].([]byte); CellVersion(cell, 2) != CELL_COMPACT {
+		t.Errorf("The appended cell does not have the compact encoding")
+	}
+	coeffs := map[Coord]*big.Int{NewCoord("qty", int64(1)): Big1, NewCoord("qty", int64(2)): Big1}
+	holderPoints := make([]CPoint, 3)
+	for _, num := range []byte{1, 2} {
+		part, err := keys.ExtractPart(num)
+		checkErr(err)
+		holderPoints[num-1] = part.GiveKeyCalculation(coeffs)
+	}
+	if sum, err := DecryptLinearCombination(db, keys.Info(), coeffs, holderPoints); err != nil || sum.Int64() != 12 {
+		t.Errorf("The sum of the quantities is %v (%v), want 12", sum, err)
+	}
+	if err = AppendRows(db, db, ti, keys, []interface{}{int64(3)}, rand.Reader); !errors.Is(err, ErrNullValue) {
+		t.Errorf("A NULL value should be refused with ErrNullValue, got %v", err)
+	}
+	if err = AppendRows(db, db, ti, keys, []interface{}{int64(4)}, rand.Reader); !errors.Is(err, ErrPointOutOfRange) {
+		t.Errorf("A value out of the range of its column should be refused with ErrPointOutOfRange, got %v", err)
+	}
+	if len(dest.rows) != 2 || len(keys.R) != 2 {
+		t.Errorf("The refused rows were appended: %d rows and %d r values", len(dest.rows), len(keys.R))
+	}
+
+	fdb.addTable("staff", []string{"id", "name"}, []string{"BIGINT", "TEXT"}, []driver.Value{int64(7), "Alice"})
+	secret := []byte("secret of the primary keys")
+	opts := EncryptOptions{PrimaryKeySecret: secret}
+	keys, err = EncryptTableWithOptions(db, db, "staff", []byte{0, 1}, rand.Reader, opts)
+	checkErr(err)
+	fdb.table("staff").rows = append(fdb.table("staff").rows, []driver.Value{int64(8), "Bob"})
+	if err = AppendRows(db, db, keys.ti, keys, []interface{}{int64(8)}, rand.Reader); err == nil {
+		t.Errorf("A table whose primary keys are encrypted should not be appended to without the secret")
+	}
+	if err = AppendRowsWithOptions(db, db, keys.ti, keys, []interface{}{int64(8)}, rand.Reader, opts); err != nil {
+		t.Fatalf("Append failed: %s", err)
+	}
+	id := EncryptPrimaryKey(secret, int64(8))
+	row := fdb.table("staff_encrypted").rows[1]
+	r, ok := keys.R[id]
+	if row[0] != id || !ok {
+		t.Fatalf("The appended row has the primary key %v, and the r values are not keyed by %s", row[0], id)
+	}
+	s := baseMult(r).multB(keys.Priv["name"][0])
+	values, err := DecryptRow(map[string][]byte{"name": row[1].([]byte)}, keys.ti, map[string]CPoint{"name": s})
+	if err != nil || values["name"] != "Bob" {
+		t.Errorf("The appended row was decrypted to %v (%v)", values, err)
+	}
+}
+
+// TestReblindTable re-blinds an encrypted table and decrypts its cells with the new r values
+func TestReblindTable(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("orders", []string{"id", "item", "qty"}, []string{"BIGINT", "TEXT", "SMALLINT"},
+		[]driver.Value{int64(1), "pen", int64(12)},
+		[]driver.Value{int64(2), "ink", int64(-3)})
+
+	keys, err := EncryptTable(db, db, "orders", []byte{0, 1, 2}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	dest := fdb.table("orders_encrypted")
+	old := make([][]driver.Value, len(dest.rows))
+	for i, row := range dest.rows {
+		old[i] = append([]driver.Value{}, row...)
+	}
+
+	newKeys, err := ReblindTable(db, keys.ti, keys, rand.Reader)
+	if err != nil {
+		t.Fatalf("Re-blinding failed: %s", err)
+	}
+	if len(newKeys.R) != 2 {
+		t.Fatalf("Expected 2 new r values, got %d", len(newKeys.R))
+	}
+
+	want := map[int64][]interface{}{1: {"pen", int64(12)}, 2: {"ink", int64(-3)}}
+	for i, row := range dest.rows {
+		id := row[0].(int64)
+		if newKeys.R[id].Cmp(keys.R[id]) == 0 {
+			t.Errorf("Row %d kept its r value", id)
+		}
+		for j := 1; j < 3; j++ {
+			if bytes.Equal(row[j].([]byte), old[i][j].([]byte)) {
+				t.Errorf("The cell (%d, %d) was not re-blinded", id, j)
+			}
+		}
+		r := baseMult(newKeys.R[id])
+		values, err := DecryptRow(map[string][]byte{"item": row[1].([]byte), "qty": row[2].([]byte)},
+			keys.ti, map[string]CPoint{"item": r.multB(keys.Priv["item"][0]), "qty": r.multB(keys.Priv["qty"][0])})
+		if err != nil {
+			t.Fatalf("Row %d failed to decrypt: %s", id, err)
+		}
+		if values["item"] != want[id][0] || values["qty"] != want[id][1] {
+			t.Errorf("Row %d decrypted to %v, want %v", id, values, want[id])
+		}
+	}
+}
+
+// TestHashCellAuthentication checks that a tampered hash encrypted cell is detected
+// and that the cells written without integrity tag can still be decrypted
+func TestHashCellAuthentication(t *testing.T) {
+	s := baseMult(big.NewInt(123456789))
+	msg := []byte("confidential salary")
+
+	cell := sealHashData(msg, s)
+	m, err := decryptFromHash(cell, s)
+	if err != nil || !bytes.Equal(m, msg) {
+		t.Fatalf("Decryption of the authenticated cell failed, got %q (%v)", m, err)
+	}
+
+	// We flip a bit of the encoded data and of the tag
+	for _, k := range []int{len(authHeader), len(cell) - 1} {
+		tampered := append([]byte{}, cell...)
+		tampered[k] ^= 0x01
+		if _, err = decryptFromHash(tampered, s); err != ErrAuthentication {
+			t.Errorf("Flipping byte %d should give an authentication error, got %v", k, err)
+		}
+	}
+	if _, err = decryptFromHash(cell, baseMult(Big2)); err != ErrAuthentication {
+		t.Errorf("Decryption with a wrong key should fail authentication, got %v", err)
+	}
+
+	legacy := hashData(msg, s)
+	if m, err = decryptFromHash(legacy, s); err != nil || !bytes.Equal(m, msg) {
+		t.Errorf("Decryption of a cell without tag failed, got %q (%v)", m, err)
+	}
+}
+
+// TestDefaultCommandsPrimaryKey encrypts without commands a table whose primary key is not its first
+// column: the primary key is copied in clear and the first column is encrypted
+func TestDefaultCommandsPrimaryKey(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"name", "id", "grade"}, []string{"TEXT", "BIGINT", "INTEGER"},
+		[]driver.Value{"Alice", int64(7), int64(30)})
+	keys, err := EncryptTableWithOptions(db, db, "staff", nil, rand.Reader, EncryptOptions{PrimaryKey: []string{"id"}})
+	checkErr(err)
+	if got := keys.Info().Commands(); !reflect.DeepEqual(got, []byte{1, 0, 1}) {
+		t.Errorf("The default commands are %v instead of [1 0 1]", got)
+	}
+	row := fdb.table("staff_encrypted").rows[0]
+	if _, encrypted := row[0].([]byte); !encrypted || row[1] != int64(7) {
+		t.Errorf("The row was copied as %v", row)
+	}
+}
+
+// TestCompositePrimaryKey encrypts a table whose primary key is made of two columns
+func TestCompositePrimaryKey(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("sales", []string{"amount", "region", "num"}, []string{"TEXT", "TEXT", "BIGINT"},
+		[]driver.Value{"100", "eu", int64(1)},
+		[]driver.Value{"200", "us", int64(1)},
+		[]driver.Value{"300", "eu", int64(2)})
+
+	opts := EncryptOptions{PrimaryKey: []string{"region", "num"}}
+	keys, err := EncryptTableWithOptions(db, db, "sales", []byte{1, 0, 0}, rand.Reader, opts)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if len(keys.R) != 3 {
+		t.Fatalf("Expected 3 r values, got %d", len(keys.R))
+	}
+
+	c := NewCoord("amount", "us", int64(1))
+	r, ok := keys.R[c.i]
+	if !ok {
+		t.Fatalf("No r for the row (us, 1)")
+	}
+	part, err := keys.ExtractPart(1)
+	checkErr(err)
+	want := baseMult(new(big.Int).Mul(r, part.PrivPart["amount"]))
+	if !part.GiveKeyPoint(c).equalC(want) {
+		t.Errorf("The key point of the row (us, 1) is wrong")
+	}
+
+	// The row (us, 1) is the second one of the encrypted table
+	cell := fdb.table("sales_encrypted").rows[1][0].([]byte)
+	m, err := decryptFromHash(cell, baseMult(r).multB(keys.Priv["amount"][0]))
+	var amount string
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(m)).Decode(&amount)
+	}
+	if err != nil || amount != "200" {
+		t.Errorf("Decryption of the row (us, 1) gave %q (%v)", amount, err)
+	}
+
+	// Rows are appended by giving the values of both columns
+	fdb.table("sales").rows = append(fdb.table("sales").rows, []driver.Value{"400", "us", int64(2)})
+	err = AppendRows(db, db, keys.ti, keys, []interface{}{[]interface{}{"us", int64(2)}}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Append failed: %s", err)
+	}
+	if _, ok = keys.R[CompositeKey("us", int64(2))]; !ok {
+		t.Errorf("No r for the appended row (us, 2)")
+	}
+
+	opts.PrimaryKey = []string{"region", "missing"}
+	if _, err = EncryptTableWithOptions(db, db, "sales", []byte{1, 0, 0}, rand.Reader, opts); err == nil {
+		t.Errorf("An unknown primary key column should be rejected")
+	}
+}
+
+// TestEncryptWhere encrypts only the rows of a table matching a condition
+func TestEncryptWhere(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("orders", []string{"num", "amount", "tenant"}, []string{"BIGINT", "TEXT", "TEXT"},
+		[]driver.Value{int64(1), "100", "acme"},
+		[]driver.Value{int64(2), "200", "globex"},
+		[]driver.Value{int64(3), "300", "acme"})
+
+	opts := EncryptOptions{Where: "tenant = $1", WhereArgs: []interface{}{"acme"}}
+	keys, err := EncryptTableWithOptions(db, db, "orders", []byte{0, 1, 0}, rand.Reader, opts)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if keys.ti.nRows != 2 || len(keys.R) != 2 {
+		t.Fatalf("Expected 2 rows and r values, got %d and %d", keys.ti.nRows, len(keys.R))
+	}
+	if _, ok := keys.R[int64(2)]; ok {
+		t.Errorf("The row 2 does not match the condition but has an r value")
+	}
+	enc := fdb.table("orders_encrypted").rows
+	if len(enc) != 2 {
+		t.Fatalf("Expected 2 encrypted rows, got %d", len(enc))
+	}
+
+	// The row 3 is the second one of the encrypted table
+	r, ok := keys.R[int64(3)]
+	if !ok {
+		t.Fatalf("No r for the row 3")
+	}
+	m, err := decryptFromHash(enc[1][1].([]byte), baseMult(r).multB(keys.Priv["amount"][0]))
+	var amount string
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(m)).Decode(&amount)
+	}
+	if err != nil || amount != "300" {
+		t.Errorf("Decryption of the row 3 gave %q (%v)", amount, err)
+	}
+}
+
+// TestEncryptDestination encrypts a table into a destination table of another schema and name
+func TestEncryptDestination(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("people", []string{"id", "name"}, []string{"BIGINT", "TEXT"},
+		[]driver.Value{int64(1), "Alice"},
+		[]driver.Value{int64(2), "Bob"})
+
+	opts := EncryptOptions{DestSchema: "archive", DestName: "People_v2"}
+	if _, err := EncryptTableWithOptions(db, db, "people", []byte{0, 1}, rand.Reader, opts); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	dest := `"archive"."People_v2"`
+	for _, stmt := range fdb.execs {
+		if strings.Contains(stmt, "_encrypted") {
+			t.Errorf("The default destination was used in %q", stmt)
+		}
+	}
+	if tab := fdb.table(dest); tab == nil || len(tab.rows) != 2 {
+		t.Fatalf("The table %s was not filled", dest)
+	}
+
+	names := map[string]string{
+		`"archive"."people_encrypted"`: EncryptOptions{DestSchema: "archive"}.destination("public.people"),
+		`"a""b"`:                       EncryptOptions{DestName: `a"b`}.destination("people"),
+		"people_encrypted":             EncryptOptions{}.destination("people"),
+	}
+	for want, got := range names {
+		if got != want {
+			t.Errorf("Destination %s instead of %s", got, want)
+		}
+	}
+}
+
+// TestEncryptDatabase checks that the public keys returned for each table correspond to its
+// private keys
+func TestEncryptDatabase(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("people", []string{"id", "name"}, []string{"BIGINT", "TEXT"},
+		[]driver.Value{int64(1), "Alice"})
+	fdb.addTable("staff", []string{"id", "salary", "grade"}, []string{"BIGINT", "INTEGER", "TEXT"},
+		[]driver.Value{int64(1), int64(30), "A"})
+	commands := map[string][]byte{"people": {0, 1}, "staff": {0, 2, 1}}
+
+	keysDB, pubsDB, err := EncryptDatabase(db, db, []string{"people", "staff"}, commands)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	for name, keys := range keysDB {
+		pubs := pubsDB[name]
+		if len(pubs) != len(keys.Priv) {
+			t.Errorf("Table %s: %d public keys for %d private keys", name, len(pubs), len(keys.Priv))
+		}
+		for col, priv := range keys.Priv {
+			pub, ok := pubs[col]
+			if !ok || !pub.Y.Equal(baseMultB(priv[0])) {
+				t.Errorf("The public key of %s.%s does not match its private key", name, col)
+			}
+		}
+	}
+}
+
+// TestSplitTableName checks the parsing of schema qualified and quoted table names
+func TestSplitTableName(t *testing.T) {
+	cases := []struct{ name, schema, table string }{
+		{"users", "", "users"},
+		{"Analytics.Users", "analytics", "users"},
+		{`"Analytics"."User.Data"`, "Analytics", "User.Data"},
+		{`public."say ""hi"""`, "public", `say "hi"`},
+	}
+	for _, c := range cases {
+		schema, table := splitTableName(c.name)
+		if schema != c.schema || table != c.table {
+			t.Errorf("splitTableName(%s) = (%q, %q), want (%q, %q)", c.name, schema, table, c.schema, c.table)
+		}
+	}
+}
+
+// TestTableInfoSchema reads the information of three tables of the same name in different schemas,
+// the one named without schema being in the current schema
+func TestTableInfoSchema(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("analytics.users", []string{"id", "score"}, []string{"BIGINT", "DOUBLE PRECISION"},
+		[]driver.Value{int64(1), 0.5})
+	fdb.addTable("crm.users", []string{"id", "name", "active"}, []string{"BIGINT", "TEXT", "BOOLEAN"},
+		[]driver.Value{int64(1), "alice", true})
+
+	ti, err := tableInfoFromDB(db, "analytics.users")
+	checkErr(err)
+	if strings.Join(ti.colTypes, ",") != "BIGINT,DOUBLE PRECISION" {
+		t.Errorf("Wrong types for analytics.users: %v", ti.colTypes)
+	}
+	ti, err = tableInfoFromDB(db, "crm.users")
+	checkErr(err)
+	if strings.Join(ti.colTypes, ",") != "BIGINT,TEXT,BOOLEAN" {
+		t.Errorf("Wrong types for crm.users: %v", ti.colTypes)
+	}
+
+	fdb.addTable("users", []string{"id", "email"}, []string{"BIGINT", "TEXT"}, []driver.Value{int64(1), "a@b.c"})
+	ti, err = tableInfoFromDB(db, "users")
+	checkErr(err)
+	if strings.Join(ti.colNames, ",") != "id,email" || strings.Join(ti.colTypes, ",") != "BIGINT,TEXT" {
+		t.Errorf("Wrong columns for users: %v %v", ti.colNames, ti.colTypes)
+	}
+}
+
+// TestTableInfoColumnOrder checks that the types are aligned with the columns
+// of a table which are not defined in alphabetical order
+func TestTableInfoColumnOrder(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("events", []string{"zone", "id", "weight", "at"}, []string{"TEXT", "BIGINT", "REAL", "BOOLEAN"},
+		[]driver.Value{"eu", int64(1), 1.5, true})
+
+	ti, err := tableInfoFromDB(db, "events")
+	checkErr(err)
+	want := map[string]string{"zone": "TEXT", "id": "BIGINT", "weight": "REAL", "at": "BOOLEAN"}
+	for j, c := range ti.colNames {
+		if ti.colTypes[j] != want[c] {
+			t.Errorf("Column %s has type %s, want %s", c, ti.colTypes[j], want[c])
+		}
+	}
+}
+
+// solverWidths are the widths, in bytes, of the values used by the benchmarks of the solvers
+var solverWidths = []uint64{2, 4, 5, 6}
+
+func BenchmarkEncryptHash(b *testing.B) {
+	pub, _, _ := SetKeys(rand.Reader)
+	msg := []byte(testText)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pub.encrypt(msg, rand.Reader)
+	}
+}
+
+func BenchmarkEncryptPoint(b *testing.B) {
+	pub, _, _ := SetKeys(rand.Reader)
+	msg := BytesFromFloat32(12.5)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := pub.EncryptPoint(msg, rand.Reader)
+		checkErr(err)
+	}
+}
+
+func BenchmarkBSGS(b *testing.B) {
+	for _, width := range solverWidths {
+		b.Run(fmt.Sprintf("%dbytes", width), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				x, _ := rand.Int(rand.Reader, new(big.Int).Lsh(Big1, uint(8*width)))
+				babyStepGiantStep(baseMult(x), width)
+			}
+		})
+	}
+}
+
+func BenchmarkKangaroo(b *testing.B) {
+	for _, width := range solverWidths {
+		b.Run(fmt.Sprintf("%dbytes", width), func(b *testing.B) {
+			if width > 4 {
+				b.Skip("the kangaroo algorithm takes several minutes above 4 bytes")
+			}
+			for i := 0; i < b.N; i++ {
+				x, _ := rand.Int(rand.Reader, new(big.Int).Lsh(Big1, uint(8*width)))
+				kangaroo(context.Background(), baseMult(x), width)
+			}
+		})
+	}
+}
+
+func BenchmarkEncryptTable(b *testing.B) {
+	db, fdb := newFakeDB(b)
+	rows := make([][]driver.Value, 100)
+	for i := range rows {
+		rows[i] = []driver.Value{int64(i), fmt.Sprintf("name %d", i), int64(i * i)}
+	}
+	fdb.addTable("bench", []string{"id", "name", "score"}, []string{"BIGINT", "TEXT", "BIGINT"}, rows...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := EncryptTable(db, db, "bench", []byte{0, 1, 2}, rand.Reader)
+		checkErr(err)
+	}
+}
+
+// BenchmarkBufferDepth encrypts a table of 1000 rows with a column encrypted as points, the
+// slowest one, for several depths of the buffers of the encryption pipeline. With the in-memory
+// fake database the reading never lags behind and the depths give the same times within the
+// noise: the gain of a deeper buffer is expected with the latency of a real database.
+func BenchmarkBufferDepth(b *testing.B) {
+	db, fdb := newFakeDB(b)
+	rows := make([][]driver.Value, 1000)
+	for i := range rows {
+		rows[i] = []driver.Value{int64(i), int64(i % 64)}
+	}
+	fdb.addTable("bench", []string{"id", "score"}, []string{"BIGINT", "INTEGER"}, rows...)
+	for _, depth := range []int{1, 2, 8, 64} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := EncryptTableWithOptions(db, db, "bench", []byte{0, 2}, rand.Reader, EncryptOptions{BufferDepth: depth})
+				checkErr(err)
+			}
+		})
+	}
+}
+
+// BenchmarkCopy compares the insertion of 500k rows with one INSERT per row and with COPY on a
+// Postgres server, the columns being copied so that only the ingestion is measured
+func BenchmarkCopy(b *testing.B) {
+	db, err := sql.Open("postgres", fmt.Sprintf("user=%s password=%s dbname=postgres sslmode=%s", DB_USER, DB_PASSWORD, DB_SSLMODE))
+	checkErr(err)
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		b.Skipf("no Postgres server: %s", err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS bench_copy;")
+	checkErr(err)
+	_, err = db.Exec("CREATE TABLE bench_copy AS SELECT i::BIGINT AS id, 'name ' || i AS name FROM generate_series(1, 500000) AS i;")
+	checkErr(err)
+	defer db.Exec("DROP TABLE IF EXISTS bench_copy, bench_copy_encrypted;")
+
+	for _, opts := range []EncryptOptions{{}, {Copy: true}} {
+		name := "insert"
+		if opts.Copy {
+			name = "copy"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := EncryptTableWithOptions(db, db, "bench_copy", []byte{0, 0}, rand.Reader, opts)
+				checkErr(err)
+			}
+		})
+	}
+}
+
+// TestSolverCrossover checks that both algorithms solve the widths where they both finish, and
+// that chooseSolver takes the one given by the calibration in use, or the baby step giant step
+// algorithm without calibration, unless its table does not fit in BSGSTableLimit. The decision is
+// checked instead of the times, which depend on the load of the machine.
+func TestSolverCrossover(t *testing.T) {
+	for _, width := range []uint64{1, 2} {
+		x, _ := rand.Int(rand.Reader, new(big.Int).Lsh(Big1, uint(8*width)))
+		pt := baseMult(x)
+		resBSGS := babyStepGiantStep(pt, width)
+		resKangaroo, err := kangaroo(context.Background(), pt, width)
+		checkErr(err)
+		if resBSGS != x.Uint64() || resKangaroo.Cmp(x) != 0 {
+			t.Fatalf("Wrong logarithm at %d bytes: %d and %d for %d", width, resBSGS, resKangaroo, x)
+		}
+	}
+
+	calibrationMu.Lock()
+	saved := solverCalibration
+	solverCalibration = nil
+	calibrationMu.Unlock()
+	defer func() {
+		calibrationMu.Lock()
+		solverCalibration = saved
+		calibrationMu.Unlock()
+	}()
+
+	// The table of the baby step giant step algorithm on 6 bytes has 2^24 points
+	want := map[uint64]int{1: SOLVER_BSGS, 2: SOLVER_BSGS, 3: SOLVER_BSGS, 6: SOLVER_KANGAROO, 16: SOLVER_KANGAROO}
+	for width, solver := range want {
+		if got := chooseSolver(width); got != solver {
+			t.Errorf("Without calibration, %d bytes are solved by %d instead of %d", width, got, solver)
+		}
+	}
+
+	// The kangaroo algorithm is faster from 2 bytes according to the calibration
+	checkErr(UseCalibration(Calibration{
+		Bytes:    []uint64{1, 2},
+		BSGS:     []time.Duration{time.Millisecond, 5 * time.Millisecond},
+		Kangaroo: []time.Duration{2 * time.Millisecond, 3 * time.Millisecond},
+	}))
+	want = map[uint64]int{1: SOLVER_BSGS, 2: SOLVER_KANGAROO, 3: SOLVER_KANGAROO, 6: SOLVER_KANGAROO}
+	for width, solver := range want {
+		if got := chooseSolver(width); got != solver {
+			t.Errorf("With the calibration, %d bytes are solved by %d instead of %d", width, got, solver)
+		}
+	}
+
+	// The calibration does not lift the memory limit
+	checkErr(UseCalibration(Calibration{
+		Bytes:    []uint64{1},
+		BSGS:     []time.Duration{time.Millisecond},
+		Kangaroo: []time.Duration{time.Second},
+	}))
+	if got := chooseSolver(6); got != SOLVER_KANGAROO {
+		t.Errorf("The table on 6 bytes does not fit, but %d was chosen", got)
+	}
+}
+
+// TestEncryptPointRange checks that a message too large to be decrypted is rejected
+func TestEncryptPointRange(t *testing.T) {
+	pub, _, _ := SetKeys(rand.Reader)
+	if _, err := pub.EncryptPoint([]byte{0, 0, 1, 2, 3, 4, 5, 6}, rand.Reader); err != nil {
+		t.Errorf("A 6 bytes message with leading zeros was rejected: %s", err)
+	}
+	if _, err := pub.EncryptPoint([]byte{1, 2, 3, 4, 5, 6, 7}, rand.Reader); err == nil {
+		t.Errorf("A 7 bytes message was accepted")
+	}
+	if _, _, err := pub.EncryptColumn([]interface{}{testText}, 2, rand.Reader); err == nil {
+		t.Errorf("A long text was accepted in point mode")
+	}
+}
+
+// TestRekeyColumn rekeys a column from the key A to the key B and decrypts it with B
+func TestRekeyColumn(t *testing.T) {
+	pubA, _, _ := SetKeys(rand.Reader)
+	pubB, privB, _ := SetKeys(rand.Reader)
+	vals := []interface{}{int64(17), int64(42)}
+
+	for _, mode := range []byte{1, 2} {
+		cyphers, rs, err := pubA.EncryptColumn(vals, mode, rand.Reader)
+		checkErr(err)
+		cells := make([][]byte, len(cyphers))
+		for i, c := range cyphers {
+			cells[i] = c.Data
+		}
+		if mode == 1 {
+			// The second cell carries an integrity tag
+			cells[1] = sealHashData(GetBytes(vals[1]), pubA.Y.mult(rs[1]))
+		}
+
+		rekeyed, err := RekeyColumn(cells, mode, rs, pubA, pubB)
+		if err != nil {
+			t.Fatalf("Rekey in mode %d failed: %s", mode, err)
+		}
+		for i, cell := range rekeyed {
+			sB := cyphers[i].C.multB(privB[0])
+			want := GetBytes(vals[i])
+			if mode == 1 {
+				m, err := decryptFromHash(cell, sB)
+				if err != nil || !bytes.Equal(m, want) {
+					t.Errorf("Hash cell %d decrypted to % x (%v) under B", i, m, err)
+				}
+			} else {
+				p, err := pointFromCell(cell)
+				checkErr(err)
+				got := babyStepGiantStep(p.subC(sB), 4)
+				if got != new(big.Int).SetBytes(want).Uint64() {
+					t.Errorf("Point cell %d decrypted to %d under B", i, got)
+				}
+			}
+		}
+	}
+
+	// A tampered cell is not rekeyed
+	r := big.NewInt(99)
+	cell := sealHashData([]byte("abc"), pubA.Y.mult(r))
+	cell[len(authHeader)] ^= 1
+	if _, err := RekeyCell(cell, 1, r, pubA, pubB); err != ErrAuthentication {
+		t.Errorf("Expected an authentication error, got %v", err)
+	}
+}
+
+// TestEquality checks the exported comparisons of points and cyphers
+func TestEquality(t *testing.T) {
+	a, b := baseMult(big.NewInt(5)), baseMult(big.NewInt(7))
+	if !a.Equal(baseMult(big.NewInt(5))) || a.Equal(b) {
+		t.Error("Point equality is wrong")
+	}
+	if !pointZero.IsIdentity() || !(CPoint{}).IsIdentity() || a.IsIdentity() {
+		t.Error("Identity detection is wrong")
+	}
+	if !pointZero.Equal(CPoint{}) || !a.subC(a).Equal(CPoint{}) || a.Equal(CPoint{}) {
+		t.Error("Both representations of the identity should be equal")
+	}
+
+	c := Cypher{a, []byte{1, 2, 3}}
+	if !c.Equal(Cypher{baseMult(big.NewInt(5)), []byte{1, 2, 3}}) || c.Equal(Cypher{a, []byte{1, 2}}) || c.Equal(Cypher{b, c.Data}) {
+		t.Error("Cypher equality is wrong")
+	}
+	cp := CypherPoint{a, shortOf(b)}
+	if !cp.Equal(CypherPoint{a, shortOf(b)}) || cp.Equal(CypherPoint{a, shortOf(a)}) || cp.Equal(CypherPoint{b, cp.Data}) {
+		t.Error("CypherPoint equality is wrong")
+	}
+}
+
+// TestTransferBool feeds the different representations of booleans returned by the drivers
+func TestTransferBool(t *testing.T) {
+	cases := []struct {
+		val  interface{}
+		want string
+	}{
+		{true, "TRUE"}, {false, "FALSE"},
+		{int64(1), "TRUE"}, {int64(0), "FALSE"},
+		{[]byte("t"), "TRUE"}, {[]byte("f"), "FALSE"},
+		{"true", "TRUE"}, {"false", "FALSE"},
+		{nil, "NULL"},
+	}
+	for _, c := range cases {
+		if got := sqlLiteral(DIALECT_POSTGRES, transferOne(transferBool, c.val)); got != c.want {
+			t.Errorf("%#v was transferred as %s instead of %s", c.val, got, c.want)
+		}
+	}
+	if _, isErr := transferOne(transferBool, "maybe").(error); !isErr {
+		t.Errorf("A malformed boolean should be sent as an error")
+	}
+
+	// The NULLs of the columns of fixed types are copied, and a malformed boolean fails its row
+	// instead of the process
+	db, fdb := newFakeDB(t)
+	fdb.addTable("flags", []string{"id", "on", "n", "doc"}, []string{"BIGINT", "BOOLEAN", "INTEGER", "JSON"},
+		[]driver.Value{int64(1), nil, nil, nil}, []driver.Value{int64(2), true, int64(3), `{"a":1}`})
+	if _, err := EncryptTable(db, db, "flags", []byte{0, 0, 0, 0}, rand.Reader); err != nil {
+		t.Fatalf("Encryption with NULLs failed: %s", err)
+	}
+	if row := fdb.table("flags_encrypted").rows[0]; row[1] != nil || row[2] != nil || row[3] != nil {
+		t.Errorf("The NULLs were copied as %v", row)
+	}
+	fdb.addTable("bad", []string{"id", "on"}, []string{"BIGINT", "BOOLEAN"}, []driver.Value{int64(1), "maybe"})
+	if _, err := EncryptTable(db, db, "bad", []byte{0, 0}, rand.Reader); err == nil {
+		t.Errorf("A malformed boolean should fail the encryption")
+	}
+}
+
+// TestTransferBinary copies a BYTEA column of arbitrary bytes and checks that the copy is exact
+func TestTransferBinary(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	blobs := [][]byte{{0x00, 0xff, '\'', 0x5c, 0x0a}, {}, bytes.Repeat([]byte{0xde, 0xad}, 100)}
+	var rows [][]driver.Value
+	for i, b := range blobs {
+		rows = append(rows, []driver.Value{int64(i), b})
+	}
+	rows = append(rows, []driver.Value{int64(len(blobs)), nil})
+	fdb.addTable("files", []string{"id", "content"}, []string{"BIGINT", "BYTEA"}, rows...)
+
+	_, err := EncryptTable(db, db, "files", []byte{0, 0}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	dest := fdb.table("files_encrypted").rows
+	for i, row := range dest[:len(blobs)] {
+		if got, ok := row[1].([]byte); !ok || !bytes.Equal(got, blobs[i]) {
+			t.Errorf("Row %d was copied as % x instead of % x", i, row[1], blobs[i])
+		}
+	}
+	if v := dest[len(blobs)][1]; v != nil {
+		t.Errorf("NULL was copied as %v", v)
+	}
+}
+
+// TestPointColumnTypes checks that the columns whose values take 8 bytes are neither
+// encrypted nor decrypted as points
+func TestPointColumnTypes(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("accounts", []string{"id", "balance"}, []string{"INTEGER", "BIGINT"},
+		[]driver.Value{int64(1), int64(10)})
+
+	_, err := EncryptTable(db, db, "accounts", []byte{0, 2}, rand.Reader)
+	if err == nil || !strings.Contains(err.Error(), "balance") || !strings.Contains(err.Error(), "BIGINT") {
+		t.Errorf("Expected an error about column balance of type BIGINT, got %v", err)
+	}
+	if fdb.table("accounts_encrypted") != nil {
+		t.Errorf("The destination table should not have been created")
+	}
+	if _, err = EncryptTable(db, db, "accounts", []byte{2, 1}, rand.Reader); err != nil {
+		t.Errorf("An INTEGER column should be encrypted as a point: %v", err)
+	}
+
+	pub, priv, _ := SetKeys(rand.Reader)
+	cypher, err := pub.EncryptPoint([]byte{42}, rand.Reader)
+	checkErr(err)
+	s := cypher.C.multB(priv[0])
+	if _, err = decryptFromPoint(context.Background(), nil, PointFromShort(cypher.Data), s, "DOUBLE PRECISION"); err == nil {
+		t.Errorf("A DOUBLE PRECISION point should not be decrypted")
+	}
+	m, err := decryptFromPoint(context.Background(), nil, PointFromShort(cypher.Data), s, "INTEGER")
+	if err != nil || !bytes.Equal(m, []byte{42}) {
+		t.Errorf("INTEGER point decrypted to % x (%v)", m, err)
+	}
+}
+
+// TestFeasiblePointEncryption checks which column types may be encrypted as points
+func TestFeasiblePointEncryption(t *testing.T) {
+	feasible := map[string]bool{
+		"BOOLEAN":          true,
+		"SMALLINT":         true,
+		"INTEGER":          true,
+		"REAL":             true,
+		"BIGINT":           false,
+		"DOUBLE PRECISION": false,
+		"NUMERIC":          false,
+		"TEXT":             false,
+	}
+	for colType, want := range feasible {
+		maxBits, ok := FeasiblePointEncryption(colType)
+		if ok != want || (ok && maxBits != 32) || (!ok && maxBits != 0) {
+			t.Errorf("Type %s gave %d bits and %t", colType, maxBits, ok)
+		}
+	}
+
+	db, fdb := newFakeDB(t)
+	fdb.addTable("flags", []string{"id", "active"}, []string{"BIGINT", "BOOLEAN"},
+		[]driver.Value{int64(1), true})
+	if _, err := EncryptTable(db, db, "flags", []byte{0, 2}, rand.Reader); err != nil {
+		t.Errorf("A BOOLEAN column should be encrypted as a point: %v", err)
+	}
+	if _, err := EncryptTable(db, db, "flags", []byte{2, 0}, rand.Reader); err == nil {
+		t.Errorf("A BIGINT column should not be encrypted as a point")
+	}
+}
+
+// TestKeyHolderHandler fetches key points from two key holders served over HTTP and
+// checks that they combine like the points computed locally
+func TestKeyHolderHandler(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "salary"}, []string{"BIGINT", "INTEGER"},
+		[]driver.Value{int64(1), int64(30)},
+		[]driver.Value{int64(2), int64(40)})
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 2}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+
+	local := make(map[int]CPoint)
+	remote := make(map[int]CPoint)
+	localSum := make(map[int]CPoint)
+	remoteSum := make(map[int]CPoint)
+	c1, c2 := NewCoord("salary", int64(1)), NewCoord("salary", int64(2))
+	coeffs := map[coord]*big.Int{c1: big.NewInt(2), c2: big.NewInt(3)}
+	for _, num := range []byte{1, 2} {
+		part, err := keys.ExtractPart(num)
+		checkErr(err)
+		srv := httptest.NewServer(NewKeyHolderHandler(part))
+		defer srv.Close()
+		client := KeyHolderClient{URL: srv.URL}
+
+		pt, holder, err := client.KeyPoint(c1)
+		if err != nil || holder != num {
+			t.Fatalf("Key holder %d answered %d (%v)", num, holder, err)
+		}
+		remote[int(holder)], local[int(num)] = pt, part.GiveKeyPoint(c1)
+		pt, _, err = client.KeyCalculation(coeffs)
+		if err != nil {
+			t.Fatalf("Calculation key of holder %d failed: %s", num, err)
+		}
+		remoteSum[int(num)], localSum[int(num)] = pt, part.GiveKeyCalculation(coeffs)
+
+		if _, _, err = client.KeyPoint(NewCoord("id", int64(1))); err == nil {
+			t.Errorf("A key point of an unencrypted column should be refused")
+		}
+		if _, _, err = client.KeyPoint(NewCoord("salary", int64(3))); err == nil {
+			t.Errorf("A key point of an unknown row should be refused")
+		}
+		if resp, err := http.Get(srv.URL); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("A GET request should be refused")
+		}
+	}
+	if !calculateDecryptionKey(remote).Equal(calculateDecryptionKey(local)) {
+		t.Errorf("The key points served do not combine like the local ones")
+	}
+	if !calculateDecryptionKey(remoteSum).Equal(calculateDecryptionKey(localSum)) {
+		t.Errorf("The calculation keys served do not combine like the local ones")
+	}
+}
+
+// TestCombineColumnKeys rebuilds the keys of three columns of a row from the points of two key
+// holders, given by their parts of the keys of the table, and decrypts the cells with them
+func TestCombineColumnKeys(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("people", []string{"id", "name", "city", "job"}, []string{"BIGINT", "TEXT", "TEXT", "TEXT"},
+		[]driver.Value{int64(1), "Alice", "Paris", "baker"})
+	keys, err := EncryptTable(db, db, "people", []byte{0, 1, 1, 1}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	r := keys.R[int64(1)]
+	cols := []string{"name", "city", "job"}
+
+	contributions := make(map[string]map[int]CPoint)
+	for _, col := range cols {
+		contributions[col] = make(map[int]CPoint)
+	}
+	for _, num := range []byte{1, 3} {
+		part, err := keys.ExtractPart(num)
+		checkErr(err)
+		for _, col := range cols {
+			contributions[col][int(num)] = baseMult(r).mult(part.PrivPart[col])
+		}
+	}
+	colKeys, err := CombineColumnKeys(contributions)
+	if err != nil {
+		t.Fatalf("Combination failed: %s", err)
+	}
+
+	row := fdb.table("people_encrypted").rows[0]
+	for j, want := range []string{"Alice", "Paris", "baker"} {
+		col := cols[j]
+		m, err := decryptFromHash(row[j+1].([]byte), colKeys[col])
+		var v string
+		if err == nil {
+			err = gob.NewDecoder(bytes.NewReader(m)).Decode(&v)
+		}
+		if err != nil || v != want {
+			t.Errorf("Column %s decrypted to %q (%v)", col, v, err)
+		}
+	}
+
+	delete(contributions["city"], 3)
+	if _, err = CombineColumnKeys(contributions); err == nil {
+		t.Errorf("A column with a single contribution should be rejected")
+	}
+}
+
+// TestCellVersions decodes cells of version 1, written without header, and of version 2
+func TestCellVersions(t *testing.T) {
+	s := baseMult(big.NewInt(987654321))
+	msg := []byte{42}
+
+	v1 := hashData(msg, s)
+	v2 := sealHashData(msg, s)
+	for _, cell := range [][]byte{v1, v2} {
+		m, err := decryptFromHash(cell, s)
+		if err != nil || !bytes.Equal(m, msg) {
+			t.Errorf("Hash cell of version %d decrypted to % x (%v)", CellVersion(cell, 1), m, err)
+		}
+	}
+
+	sp, err := pointData(msg, s)
+	checkErr(err)
+	for _, cell := range [][]byte{sp[:], pointCell(sp)} {
+		p, err := pointFromCell(cell)
+		if err != nil {
+			t.Fatalf("Point cell of version %d cannot be read: %s", CellVersion(cell, 2), err)
+		}
+		m, err := decryptFromPoint(context.Background(), nil, p, s, "INTEGER")
+		if err != nil || !bytes.Equal(m, msg) {
+			t.Errorf("Point cell of version %d decrypted to % x (%v)", CellVersion(cell, 2), m, err)
+		}
+	}
+	if CellVersion(v1, 1) != CELL_V1 || CellVersion(v2, 1) != CELL_V2 || CellVersion(sp[:], 2) != CELL_V1 || CellVersion(pointCell(sp), 2) != CELL_V2 {
+		t.Errorf("Wrong versions detected")
+	}
+	if _, err := pointFromCell(sp[:20]); err == nil {
+		t.Errorf("A truncated point cell should be refused")
+	}
+}
+
+// TestCellDowngrade strips the cells of version 2 of a table of their header and their tag, which
+// passes them for cells of version 1, and checks that they are refused for a table encrypted by the
+// current version, also once its keys are stored and reloaded
+func TestCellDowngrade(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "name", "salary"}, []string{"BIGINT", "TEXT", "INTEGER"},
+		[]driver.Value{int64(1), "Alice", int64(30)})
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 1, 2}, rand.Reader)
+	checkErr(err)
+	row := fdb.table("staff_encrypted").rows[0]
+	name, salary := row[1].([]byte), row[2].([]byte)
+	stripped := map[string][]byte{
+		"name":   name[len(authHeader) : len(name)-authTagLength],
+		"salary": salary[len(authHeader):],
+	}
+	colKeys := make(map[string]CPoint)
+	for _, col := range []string{"name", "salary"} {
+		colKeys[col] = baseMult(keys.R[int64(1)]).multB(keys.Priv[col][0])
+	}
+
+	if _, err = DecryptRow(map[string][]byte{"name": name, "salary": salary}, keys.Info(), colKeys); err != nil {
+		t.Fatalf("The cells of version 2 failed to decrypt: %s", err)
+	}
+	for col, cell := range stripped {
+		if _, err = DecryptRow(map[string][]byte{col: cell}, keys.Info(), colKeys); !errors.Is(err, ErrCellDowngrade) {
+			t.Errorf("Column %s: expected ErrCellDowngrade, got %v", col, err)
+		}
+	}
+	file := t.TempDir() + "/staff.keys"
+	checkErr(keys.StockTableKeys(file))
+	loaded, err := LoadTableKeys(file)
+	checkErr(err)
+	if _, err = DecryptRow(stripped, loaded.Info(), colKeys); !errors.Is(err, ErrCellDowngrade) {
+		t.Errorf("The reloaded keys accept the stripped cells: %v", err)
+	}
+
+	// The tables of keys of the versions before accept the cells of version 1
+	ti := keys.Info()
+	ti.RequireCellVersion(0)
+	values, err := DecryptRow(stripped, ti, colKeys)
+	if err != nil || values["name"] != "Alice" || values["salary"] != int64(30) {
+		t.Errorf("The cells of version 1 were decrypted to %v (%v)", values, err)
+	}
+}
+
+// TestKeysFileVersions stores a table of keys and reads it back, and reads a file of version 1
+func TestKeysFileVersions(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "salary"}, []string{"BIGINT", "INTEGER"},
+		[]driver.Value{int64(1), int64(30)},
+		[]driver.Value{int64(2), int64(40)})
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 2}, rand.Reader)
+	checkErr(err)
+
+	name := t.TempDir() + "/keys"
+	if err = keys.StockTableKeys(name); err != nil {
+		t.Fatalf("Storage failed: %s", err)
+	}
+	loaded, err := LoadTableKeys(name)
+	if err != nil {
+		t.Fatalf("Loading failed: %s", err)
+	}
+	if loaded.ti.name != "staff" || len(loaded.R) != 2 || loaded.R[int64(2)].Cmp(keys.R[int64(2)]) != 0 ||
+		!bytes.Equal(loaded.Priv["salary"][1], keys.Priv["salary"][1]) {
+		t.Errorf("The keys read differ from the keys stored")
+	}
+
+	old := t.TempDir() + "/old"
+	checkErr(os.WriteFile(old, []byte(`{"Priv":{"salary":["AQI=","","",""]}}`), 0600))
+	loaded, err = LoadTableKeys(old)
+	if err == nil || !bytes.Equal(loaded.Priv["salary"][0], []byte{1, 2}) {
+		t.Errorf("A file of version 1 should give its private keys and an error, got %v", err)
+	}
+}
+
+// boundedWriter records the largest of the writes made to it
+type boundedWriter struct {
+	bytes.Buffer
+	largest int
+}
+
+func (w *boundedWriter) Write(p []byte) (int, error) {
+	if len(p) > w.largest {
+		w.largest = len(p)
+	}
+	return w.Buffer.Write(p)
+}
+
+// TestEncodeTableKeys stores and reloads the keys of a large table, written row by row, and reads
+// a file of keys of version 2
+func TestEncodeTableKeys(t *testing.T) {
+	_, priv, _ := SetKeys(rand.Reader)
+	keys := TableKeys{
+		ti:   TableInfo{name: "big", nRows: 100000, nCol: 2, colNames: []string{"id", "v"}, colTypes: []string{"BIGINT", "INTEGER"}, commands: []byte{0, 2}},
+		R:    make(map[interface{}]*big.Int),
+		Priv: map[string]PrivateKey{"v": priv},
+	}
+	for k := int64(0); k < 100000; k++ {
+		r, _ := rand.Int(rand.Reader, N)
+		keys.R[k] = r
+	}
+	keys.R["text"] = big.NewInt(1)
+	keys.R[time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)] = big.NewInt(2)
+	keys.R[1.5] = big.NewInt(3)
+
+	var w boundedWriter
+	if err := keys.EncodeTableKeys(&w); err != nil {
+		t.Fatalf("Encoding failed: %s", err)
+	}
+	if w.largest > keysFileBuffer {
+		t.Errorf("A write of %d bytes was made, more than the buffer of %d bytes", w.largest, keysFileBuffer)
+	}
+	loaded, err := DecodeTableKeys(&w)
+	if err != nil {
+		t.Fatalf("Decoding failed: %s", err)
+	}
+	if loaded.ti.name != "big" || len(loaded.R) != len(keys.R) || !bytes.Equal(loaded.Priv["v"][0], priv[0]) {
+		t.Fatalf("The keys read differ from the keys stored")
+	}
+	for k, r := range keys.R {
+		if loaded.R[k] == nil || loaded.R[k].Cmp(r) != 0 {
+			t.Fatalf("Wrong r value for the row %v", k)
+		}
+	}
+	if err = (TableKeys{R: map[interface{}]*big.Int{int32(1): Big1}}).EncodeTableKeys(io.Discard); err == nil {
+		t.Errorf("A key of type int32 should not be stored")
+	}
+
+	var v2 bytes.Buffer
+	v2.Write(keysFileMagic)
+	v2.WriteByte(KEYS_FILE_V2)
+	checkErr(gob.NewEncoder(&v2).Encode(storedTableKeys{Name: "old", Rows: []storedR{{int64(7), Big2}}}))
+	loaded, err = DecodeTableKeys(&v2)
+	if err != nil || loaded.ti.name != "old" || loaded.R[int64(7)].Cmp(Big2) != 0 {
+		t.Errorf("A file of version 2 was not read (%v)", err)
+	}
+}
+
+// TestBaseTable compares the multiples of g computed with the precomputed table to baseMultB
+func TestBaseTable(t *testing.T) {
+	bt := newBaseTable(4)
+	for _, k := range [][]byte{{0}, {1}, {0xff, 0x01}, N.Bytes(), new(big.Int).Add(N, Big2).Bytes()} {
+		if !bt.mult(k).Equal(baseMultB(k)) {
+			t.Errorf("Wrong multiple of g for % x", k)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		k := make([]byte, 28)
+		rand.Read(k)
+		if !bt.mult(k).Equal(baseMultB(k)) {
+			t.Errorf("Wrong multiple of g for % x", k)
+		}
+	}
+}
+
+// BenchmarkSetTableKeys generates the keys of a table of 20 encrypted columns with and without
+// the precomputed table of multiples of g
+func BenchmarkSetTableKeys(b *testing.B) {
+	db, fdb := newFakeDB(b)
+	var cols, types []string
+	var row []driver.Value
+	for j := 0; j < 20; j++ {
+		cols = append(cols, fmt.Sprintf("c%d", j))
+		types = append(types, "INTEGER")
+		row = append(row, int64(j))
+	}
+	fdb.addTable("wide", cols, types, row)
+	commands := bytes.Repeat([]byte{1}, 20)
+	ti, err := tableInfoFromDB(db, "wide", commands...)
+	checkErr(err)
+
+	defer func(w uint) { BaseTableWindow = w }(BaseTableWindow)
+	for _, w := range []uint{0, 4, 8} {
+		b.Run(fmt.Sprintf("window=%d", w), func(b *testing.B) {
+			BaseTableWindow = w
+			for i := 0; i < b.N; i++ {
+				if _, _, _, err := SetTableKeys(db, ti, rand.Reader); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestEncodeDecodePoint round-trips values through EncodeToPoint and DecodeFromPoint
+func TestEncodeDecodePoint(t *testing.T) {
+	for _, v := range []uint64{0, 1, 42, 65535, 1<<20 - 1} {
+		got, err := DecodeFromPoint(EncodeToPoint(v), 20)
+		if err != nil || got != v {
+			t.Errorf("%d decoded to %d (%v)", v, got, err)
+		}
+	}
+	// The sum of the points encodes the sum of the values
+	got, err := DecodeFromPoint(addC(EncodeToPoint(300), EncodeToPoint(700)), 16)
+	if err != nil || got != 1000 {
+		t.Errorf("The sum decoded to %d (%v)", got, err)
+	}
+
+	// 2^15 is found by the search on 16 bits, 2^15 + 1 on 15 bits only after the check of the range
+	for _, v := range []uint64{1 << 16, 1<<15 + 1} {
+		if _, err := DecodeFromPoint(EncodeToPoint(v), 15); err != ErrPointOutOfRange {
+			t.Errorf("Decoding %d on 15 bits should be out of range, got %v", v, err)
+		}
+	}
+	if _, err := DecodeFromPoint(EncodeToPoint(1), 64); err == nil {
+		t.Errorf("A search on 64 bits should be refused")
+	}
+}
+
+// TestPlan checks the plan of the encryption of a sample table and that the destination is untouched
+func TestPlan(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "name", "salary"}, []string{"BIGINT", "TEXT", "INTEGER"},
+		[]driver.Value{int64(1), "ann", int64(30)},
+		[]driver.Value{int64(2), "bob", int64(40)},
+		[]driver.Value{int64(3), "cid", int64(50)})
+
+	plan, err := Plan(db, "staff", []byte{0, 1, 2})
+	if err != nil {
+		t.Fatalf("Plan failed: %s", err)
+	}
+	want := []ColumnPlan{
+		{"id", "BIGINT", "BIGINT", 0},
+		{"name", "TEXT", "BYTEA", 1},
+		{"salary", "INTEGER", "BYTEA", 2},
+	}
+	if fmt.Sprint(plan.Columns) != fmt.Sprint(want) {
+		t.Errorf("Columns planned %v, want %v", plan.Columns, want)
+	}
+	if plan.NewName != "staff_encrypted" || plan.PointCells != 3 || plan.Table.nRows != 3 {
+		t.Errorf("Wrong plan %+v", plan)
+	}
+	if len(plan.Statements) != 2 || !strings.Contains(plan.Statements[1], "salary BYTEA") {
+		t.Errorf("Wrong statements %q", plan.Statements)
+	}
+	if len(fdb.execs) != 0 || fdb.table("staff_encrypted") != nil {
+		t.Errorf("The plan should not execute anything")
+	}
+
+	if _, err = Plan(db, "staff", []byte{0, 2, 0}); err == nil {
+		t.Errorf("A TEXT column encrypted as a point should be refused")
+	}
+}
+
+// TestDefaultCommands checks that without commands every column but the primary key is encrypted
+func TestDefaultCommands(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "name", "salary"}, []string{"BIGINT", "TEXT", "INTEGER"},
+		[]driver.Value{int64(1), "ann", int64(30)})
+
+	ti, err := tableInfoFromDB(db, "staff")
+	checkErr(err)
+	if !bytes.Equal(ti.commands, []byte{0, 1, 1}) {
+		t.Errorf("Default commands are %v, want [0 1 1]", ti.commands)
+	}
+}
+
+// TestBSGSBlocks solves discrete logarithms with a table of baby steps larger than BSGSTableLimit
+func TestBSGSBlocks(t *testing.T) {
+	defer func(limit uint64) { BSGSTableLimit = limit }(BSGSTableLimit)
+
+	// 2 bytes searched with 16 blocks, the remainders of the values modulo 256 being the first
+	// and the last entries of each block
+	BSGSTableLimit = 16
+	for b := uint64(0); b < 16; b++ {
+		for _, x := range []uint64{(200-b)*256 + 16*b, (100+b)*256 + 16*b + 15} {
+			if got := babyStepGiantStep(EncodeToPoint(x), 2); got != x {
+				t.Errorf("Found %d on 2 bytes with blocks, want %d in block %d", got, x, b)
+			}
+		}
+	}
+	if _, found, _ := bsgsSearch(context.Background(), EncodeToPoint(1<<16), 1<<8); found {
+		t.Errorf("A value out of range should not be found")
+	}
+
+	// A 6-byte value with at most 2^14 points in memory instead of 2^24
+	BSGSTableLimit = 1 << 14
+	want := uint64(1<<40 + 12345)
+	if got := babyStepGiantStep(EncodeToPoint(want), 6); got != want {
+		t.Errorf("Found %d on 6 bytes with blocks, want %d", got, want)
+	}
+
+	// 3 bytes searched with 16 blocks of 2^8 points, the value being in the block 9
+	BSGSTableLimit = 1 << 8
+	want = 3000<<12 + 9<<8 + 100
+	if got := babyStepGiantStep(EncodeToPoint(want), 3); got != want {
+		t.Errorf("Found %d on 3 bytes with blocks, want %d", got, want)
+	}
+}
+
+// TestBSGSParallelLookups runs many searches at once against a table freshly built, each of them
+// reading it from SolverRoutines routines, and a Solver shared by several routines. It checks the
+// concurrent reads of the table with go test -race -run TestBSGSParallelLookups.
+func TestBSGSParallelLookups(t *testing.T) {
+	const m = 1 << 8
+	hL2, err := loadhL2Range(context.Background(), 0, m)
+	checkErr(err)
+	sv, err := NewSolver(context.Background(), 2)
+	checkErr(err)
+	defer sv.Close()
+
+	var wg sync.WaitGroup
+	for k := 0; k < 16; k++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := mr.New(mr.NewSource(seed))
+			for i := 0; i < 10; i++ {
+				x := uint64(rnd.Intn(m * m))
+				if pow, found, err := bsgsBlock(context.Background(), EncodeToPoint(x), m, hL2); err != nil || !found || pow != x {
+					t.Errorf("Found %d (%t, %v) instead of %d", pow, found, err, x)
+				}
+				if pow, err := sv.DiscreteLog(context.Background(), EncodeToPoint(x)); err != nil || pow.Uint64() != x {
+					t.Errorf("The solver found %v (%v) instead of %d", pow, err, x)
+				}
+			}
+		}(int64(k))
+	}
+	wg.Wait()
+}
+
+// TestSolverRoutinesBounds solves logarithms with the baby step giant step and kangaroo algorithms
+// with SolverRoutines at 0 and beyond 255, which are read as 1 and 255
+func TestSolverRoutinesBounds(t *testing.T) {
+	defer func(n int) { SolverRoutines = n }(SolverRoutines)
+	const m = 1 << 8
+	hL2, err := loadhL2Range(context.Background(), 0, m)
+	checkErr(err)
+	for _, n := range []int{0, -3, 300} {
+		SolverRoutines = n
+		x := uint64(m*m - 5)
+		if pow, found, err := bsgsBlock(context.Background(), EncodeToPoint(x), m, hL2); err != nil || !found || pow != x {
+			t.Errorf("SolverRoutines = %d: the baby step giant step found %d (%t, %v) instead of %d", n, pow, found, err, x)
+		}
+		if pow, err := kangaroo(context.Background(), EncodeToPoint(x), 2); err != nil || pow.Uint64() != x {
+			t.Errorf("SolverRoutines = %d: the kangaroo found %v (%v) instead of %d", n, pow, err, x)
+		}
+	}
+}
+
+// TestDecryptTimeout decrypts a point which is not in the range of its column with a short deadline
+func TestDecryptTimeout(t *testing.T) {
+	// The value does not fit on 4 bytes: it would be searched in vain on the whole range
+	p := EncodeToPoint(1 << 40)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := decryptFromPoint(ctx, nil, p, pointZero, "INTEGER"); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("The decryption took %s after the deadline", d)
+	}
+
+	// Without deadline the whole range is searched
+	if _, err := DiscreteLogContext(context.Background(), p, 2); err != ErrPointOutOfRange {
+		t.Errorf("Expected the point to be out of range, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := kangaroo(ctx, p, 4); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to be exceeded in kangaroo, got %v", err)
+	}
+}
+
+// TestDecryptColumn decrypts a column of 100 integers encrypted as points
+func TestDecryptColumn(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	var rows [][]driver.Value
+	for i := int64(0); i < 100; i++ {
+		// The gob encoding of the integers below 64 fits on the 4 bytes searched for an INTEGER
+		rows = append(rows, []driver.Value{i, i % 64})
+	}
+	fdb.addTable("staff", []string{"id", "salary"}, []string{"BIGINT", "INTEGER"}, rows...)
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 2}, rand.Reader)
+	checkErr(err)
+
+	// calculateDecryptionKey gives c for the parts (c1, c3) = (c, c), a constant polynomial,
+	// which allows the full key of each cell to be used here
+	keyParts := make(map[interface{}]map[int]CPoint)
+	for k, r := range keys.R {
+		sKey := baseMult(r).multB(keys.Priv["salary"][0])
+		keyParts[k] = map[int]CPoint{1: sKey, 3: sKey}
+	}
+
+	res, err := db.Query("SELECT id, salary FROM staff_encrypted;")
+	checkErr(err)
+	defer res.Close()
+	results, err := DecryptColumn(context.Background(), res, keys.ti, 1, keyParts)
+	if err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	if len(results) != 100 {
+		t.Fatalf("%d cells decrypted instead of 100", len(results))
+	}
+	for i, m := range results {
+		var v int64
+		if err = gob.NewDecoder(bytes.NewReader(m)).Decode(&v); err != nil || v != int64(i%64) {
+			t.Errorf("Row %d decrypted to %d (%v)", i, v, err)
+		}
+	}
+}
+
+// TestWrongDiscreteLog injects a wrong discrete logarithm through the cache and checks that the
+// decryption of the point refuses it
+func TestWrongDiscreteLog(t *testing.T) {
+	defer SetDiscreteLogCache(0)
+	pub, priv, _ := SetKeys(rand.Reader)
+	c, err := pub.EncryptPoint([]byte{0x12}, rand.Reader)
+	checkErr(err)
+	s := c.C.multB(priv[0])
+	d := PointFromShort(c.Data)
+	m, err := decryptFromPoint(context.Background(), nil, d, s, "SMALLINT")
+	if err != nil || !bytes.Equal(m, []byte{0x12}) {
+		t.Fatalf("Decryption failed: % x (%v)", m, err)
+	}
+
+	SetDiscreteLogCache(1)
+	sp, err := GetShortOf(d.subC(s))
+	checkErr(err)
+	dlogCache.put(sp, big.NewInt(0x13))
+	if _, err = decryptFromPoint(context.Background(), nil, d, s, "SMALLINT"); !errors.Is(err, ErrWrongDiscreteLog) {
+		t.Errorf("A wrong discrete logarithm should give ErrWrongDiscreteLog, got %v", err)
+	}
+}
+
+// TestDiscreteLogCache decrypts a column of 200 cells taking 5 distinct values and checks that
+// each value is solved only once with the cache, and that the cache stays within its size
+func TestDiscreteLogCache(t *testing.T) {
+	defer SetDiscreteLogCache(0)
+	db, fdb := newFakeDB(t)
+	var rows [][]driver.Value
+	for i := int64(0); i < 200; i++ {
+		rows = append(rows, []driver.Value{i, 10 + i%5})
+	}
+	fdb.addTable("staff", []string{"id", "grade"}, []string{"BIGINT", "INTEGER"}, rows...)
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 2}, rand.Reader)
+	checkErr(err)
+	keyParts := make(map[interface{}]map[int]CPoint)
+	for k, r := range keys.R {
+		sKey := baseMult(r).multB(keys.Priv["grade"][0])
+		keyParts[k] = map[int]CPoint{1: sKey, 3: sKey}
+	}
+	decrypt := func() {
+		res, err := db.Query("SELECT id, grade FROM staff_encrypted;")
+		checkErr(err)
+		defer res.Close()
+		results, err := DecryptColumn(context.Background(), res, keys.ti, 1, keyParts)
+		if err != nil {
+			t.Fatalf("Decryption failed: %s", err)
+		}
+		for i, m := range results {
+			var v int64
+			if err = gob.NewDecoder(bytes.NewReader(m)).Decode(&v); err != nil || v != 10+int64(i%5) {
+				t.Errorf("Row %d decrypted to %d (%v)", i, v, err)
+			}
+		}
+	}
+
+	SetDiscreteLogCache(8)
+	decrypt()
+	if hits, misses := DiscreteLogCacheStats(); hits != 195 || misses != 5 {
+		t.Errorf("%d logarithms solved and %d found in the cache, want 5 and 195", misses, hits)
+	}
+	// The 5 values in turn never stay in a cache of 2 logarithms
+	SetDiscreteLogCache(2)
+	decrypt()
+	if hits, misses := DiscreteLogCacheStats(); hits != 0 || misses != 200 {
+		t.Errorf("%d logarithms solved and %d found in the cache of 2, want 200 and 0", misses, hits)
+	}
+	if n := dlogCache.order.Len(); n != 2 {
+		t.Errorf("The cache holds %d logarithms instead of 2", n)
+	}
+}
+
+// TestDecryptOneData decrypts a single cell of each command and checks that an unknown command
+// gives an error
+func TestDecryptOneData(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("orders", []string{"id", "buyer", "item", "qty"}, []string{"BIGINT", "TEXT", "TEXT", "INTEGER"},
+		[]driver.Value{int64(1), "alice", "pen", int64(12)})
+	keys, err := EncryptTable(db, db, "orders", []byte{0, 0, 1, 2}, rand.Reader)
+	checkErr(err)
+
+	ctx := context.Background()
+	r := baseMult(keys.R[int64(1)])
+	want := []interface{}{int64(1), "alice", "pen", int64(12)}
+	for j, col := range keys.ti.colNames {
+		// See TestDecryptColumn for the key parts giving the full key of the cell
+		var keyParts map[int]CPoint
+		if keys.ti.commands[j] != 0 {
+			sKey := r.multB(keys.Priv[col][0])
+			keyParts = map[int]CPoint{1: sKey, 3: sKey}
+		}
+		row := db.QueryRow(fmt.Sprintf("SELECT %s FROM orders_encrypted WHERE id = $1;", col), int64(1))
+		m, err := DecryptOneData(ctx, *row, keys.ti, j, keyParts)
+		if err != nil {
+			t.Fatalf("Column %s failed to decrypt: %s", col, err)
+		}
+		if v, err := decodeValue(m, keys.ti.colTypes[j]); err != nil || v != want[j] {
+			t.Errorf("Column %s decrypted to %v (%v), want %v", col, v, err, want[j])
+		}
+	}
+
+	ti := keys.ti
+	ti.commands = []byte{0, 0, 1, 7}
+	row := db.QueryRow("SELECT qty FROM orders_encrypted WHERE id = $1;", int64(1))
+	if _, err = DecryptOneData(ctx, *row, ti, 3, nil); err == nil {
+		t.Errorf("An unknown command should give an error")
+	}
+	row = db.QueryRow("SELECT qty FROM orders_encrypted WHERE id = $1;", int64(1))
+	if _, err = DecryptOneData(ctx, *row, ti, 4, nil); err == nil {
+		t.Errorf("A column out of the table should give an error")
+	}
+}
+
+// TestSimulateDecryption decrypts a hash encrypted cell and a point encrypted cell through the
+// parts of two key holders, without database
+func TestSimulateDecryption(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "name", "salary"}, []string{"BIGINT", "TEXT", "INTEGER"},
+		[]driver.Value{int64(1), "Alice", int64(30)})
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 1, 2}, rand.Reader)
+	checkErr(err)
+
+	row := fdb.table("staff_encrypted").rows[0]
+	for j, want := range []interface{}{"Alice", int64(30)} {
+		col, colType := keys.ti.colNames[j+1], keys.ti.colTypes[j+1]
+		m, err := SimulateDecryption(keys, int64(1), col, row[j+1].([]byte), colType)
+		if err != nil {
+			t.Fatalf("Column %s failed to decrypt: %s", col, err)
+		}
+		if v, err := decodeValue(m, colType); err != nil || v != want {
+			t.Errorf("Column %s decrypted to %v (%v), want %v", col, v, err, want)
+		}
+	}
+
+	if _, err = SimulateDecryption(keys, int64(1), "id", row[1].([]byte), "BIGINT"); err == nil {
+		t.Errorf("The decryption of an unencrypted column should fail")
+	}
+	if _, err = SimulateDecryption(keys, int64(2), "name", row[1].([]byte), "TEXT"); err == nil {
+		t.Errorf("The decryption of an unknown row should fail")
+	}
+}
+
+// TestVerifyColumnKey checks that a wrong point given by a key holder is detected by the
+// verifiers, and that SimulateDecryption fails before searching a discrete logarithm
+func TestVerifyColumnKey(t *testing.T) {
+	pub, priv, _, err := GenerateColumnKeys(rand.Reader)
+	checkErr(err)
+	a, _ := rand.Int(rand.Reader, N)
+	s := new(big.Int).SetBytes(priv[0])
+	verifiers := make(map[int]CPoint)
+	shares := make(map[int]*big.Int)
+	for num := 1; num <= 3; num++ {
+		share := new(big.Int).Add(s, new(big.Int).Mul(a, big.NewInt(int64(num))))
+		shares[num] = share.Mod(share, N)
+		verifiers[num] = baseMult(shares[num])
+	}
+
+	r, _ := rand.Int(rand.Reader, N)
+	parts := map[int]CPoint{1: baseMult(r).mult(shares[1]), 3: baseMult(r).mult(shares[3])}
+	for num, pt := range parts {
+		if err = VerifyKeyPoint(pt, r, verifiers[num]); err != nil {
+			t.Errorf("The point of holder %d should be accepted: %v", num, err)
+		}
+	}
+	colKeys, err := CombineColumnKeys(map[string]map[int]CPoint{"c": parts})
+	checkErr(err)
+	if err = VerifyColumnKey(colKeys["c"], r, pub); err != nil {
+		t.Errorf("The combined key should be accepted: %v", err)
+	}
+
+	parts[3] = baseMult(r).mult(shares[2])
+	if err = VerifyKeyPoint(parts[3], r, verifiers[3]); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("Expected ErrKeyMismatch for the wrong point, got %v", err)
+	}
+	colKeys, err = CombineColumnKeys(map[string]map[int]CPoint{"c": parts})
+	checkErr(err)
+	if err = VerifyColumnKey(colKeys["c"], r, pub); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("Expected ErrKeyMismatch for the wrong key, got %v", err)
+	}
+
+	// The share of holder 3 is wrong, so that the key of the point column is wrong. The shares of
+	// Priv are checked by ExtractPart, those of ShareKeys are not.
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "salary"}, []string{"BIGINT", "INTEGER"},
+		[]driver.Value{int64(1), int64(30)})
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 2}, rand.Reader)
+	checkErr(err)
+	wrong := keys.Priv["salary"]
+	wrong[3] = priv[0]
+	keys.Priv["salary"] = wrong
+	if _, err = SimulateDecryption(keys, int64(1), "salary", nil, "INTEGER"); !errors.Is(err, ErrLegacyShares) {
+		t.Errorf("Expected ErrLegacyShares, got %v", err)
+	}
+	keys, err = keys.ShareKeys(2, 3, rand.Reader)
+	checkErr(err)
+	keys.Shares["salary"][3] = priv[0]
+	row := fdb.table("staff_encrypted").rows[0]
+	start := time.Now()
+	if _, err = SimulateDecryption(keys, int64(1), "salary", row[1].([]byte), "INTEGER"); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("Expected ErrKeyMismatch, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("The verification took %v", d)
+	}
+}
+
+// TestStreamEncryption streams a value of 10 MB through NewStreamEncrypter and
+// NewStreamDecrypter and compares the checksums of the plaintexts
+func TestStreamEncryption(t *testing.T) {
+	pub, priv, _, err := GenerateColumnKeys(rand.Reader)
+	checkErr(err)
+	r, _ := rand.Int(rand.Reader, N)
+	s := baseMult(r).multB(priv[0])
+
+	const size = 10 << 20
+	pr, pw := io.Pipe()
+	sumIn := sha256.New()
+	go func() {
+		enc, err := NewStreamEncrypter(pw, pub, r)
+		if err == nil {
+			_, err = io.Copy(enc, io.TeeReader(io.LimitReader(rand.Reader, size), sumIn))
+		}
+		if err == nil {
+			err = enc.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	dec, err := NewStreamDecrypter(pr, s)
+	checkErr(err)
+	sumOut := sha256.New()
+	n, err := io.Copy(sumOut, dec)
+	if err != nil || n != size {
+		t.Fatalf("Decrypted %d bytes: %v", n, err)
+	}
+	if !bytes.Equal(sumIn.Sum(nil), sumOut.Sum(nil)) {
+		t.Errorf("The checksums of the plaintexts differ")
+	}
+
+	var buf bytes.Buffer
+	enc, err := NewStreamEncrypter(&buf, pub, r)
+	checkErr(err)
+	enc.Write([]byte(testText))
+	checkErr(enc.Close())
+	sealed := buf.Bytes()
+	if bytes.Contains(sealed, []byte(testText[:BytesNumber])) {
+		t.Errorf("The plaintext appears in the stream")
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(streamHeader)+100] ^= 1
+	for name, data := range map[string][]byte{"tampered": tampered, "truncated": sealed[:len(sealed)-1]} {
+		dec, err := NewStreamDecrypter(bytes.NewReader(data), s)
+		checkErr(err)
+		if _, err = io.ReadAll(dec); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("Expected ErrAuthentication for the %s stream, got %v", name, err)
+		}
+	}
+}
+
+// TestShareKeys shares the keys of a table between 5 key holders, 3 of them being needed, and
+// decrypts a cell from the key points of the holders 2, 4 and 5
+func TestShareKeys(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "salary"}, []string{"BIGINT", "INTEGER"},
+		[]driver.Value{int64(1), int64(30)})
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 2}, rand.Reader)
+	checkErr(err)
+	if _, err = keys.ShareKeys(3, 2, rand.Reader); err == nil {
+		t.Errorf("A sharing 3 of 2 should be refused")
+	}
+	shared, err := keys.ShareKeys(3, 5, rand.Reader)
+	checkErr(err)
+
+	c := NewCoord("salary", int64(1))
+	parts := make(map[int]CPoint)
+	for _, num := range []byte{2, 4, 5} {
+		part, err := shared.ExtractPart(num)
+		if err != nil {
+			t.Fatalf("Extraction of part %d failed: %s", num, err)
+		}
+		if part.keyHolder != num {
+			t.Errorf("The part %d is held by the holder %d", num, part.keyHolder)
+		}
+		parts[int(num)] = part.GiveKeyPoint(c)
+	}
+	for _, num := range []byte{0, 6} {
+		if _, err = shared.ExtractPart(num); err == nil {
+			t.Errorf("Extraction of part %d should have failed", num)
+		}
+	}
+
+	pub := PublicKey{Curve: myCurve, Y: baseMultB(keys.Priv["salary"][0])}
+	colKeys, err := CombineColumnKeys(map[string]map[int]CPoint{"salary": parts})
+	checkErr(err)
+	if err = VerifyColumnKey(colKeys["salary"], keys.R[int64(1)], pub); err != nil {
+		t.Fatalf("The key rebuilt from the holders 2, 4 and 5 is wrong: %v", err)
+	}
+	row := db.QueryRow("SELECT salary FROM staff_encrypted WHERE id = $1;", int64(1))
+	m, err := DecryptOneData(context.Background(), *row, keys.ti, 1, parts)
+	checkErr(err)
+	if v, err := decodeValue(m, "INTEGER"); err != nil || v != int64(30) {
+		t.Errorf("The cell decrypted to %v (%v)", v, err)
+	}
+
+	// Two points of a polynomial of degree 2 do not give the key
+	delete(parts, 5)
+	colKeys, err = CombineColumnKeys(map[string]map[int]CPoint{"salary": parts})
+	checkErr(err)
+	if err = VerifyColumnKey(colKeys["salary"], keys.R[int64(1)], pub); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("Expected ErrKeyMismatch with two holders, got %v", err)
+	}
+}
+
+// TestCalibrateSolvers runs the calibration of the solvers on the widths of the columns and checks
+// that DiscreteLog then chooses the baby step giant step algorithm on 4 bytes, and that the
+// calibration can be saved and reloaded
+func TestCalibrateSolvers(t *testing.T) {
+	defer func() { solverCalibration = nil }()
+	c, err := CalibrateSolvers(context.Background())
+	if err != nil {
+		t.Fatalf("Calibration failed: %s", err)
+	}
+	t.Logf("Calibration: %+v", c)
+	// The widths solved for the columns are measured, 4 bytes for INTEGER and REAL included
+	for _, width := range []uint64{1, 2, 4} {
+		k := -1
+		for i, b := range c.Bytes {
+			if b == width {
+				k = i
+			}
+		}
+		if k < 0 {
+			t.Fatalf("The width of %d bytes was not measured: %v", width, c.Bytes)
+		}
+		// On 4 bytes the baby step giant step algorithm is many times faster, while a kangaroo
+		// may be lucky on fewer bytes
+		if got := chooseSolver(width); width == 4 && got != SOLVER_BSGS {
+			t.Errorf("Solver %d chosen on %d bytes, BSGS took %v and kangaroo %v", got, width, c.BSGS[k], c.Kangaroo[k])
+		}
+		// The trials of the kangaroo algorithm are stopped once they are slower
+		if c.Kangaroo[k] > 2*c.BSGS[k]+100*time.Millisecond {
+			t.Errorf("The kangaroo algorithm on %d bytes ran for %v after the %v of BSGS", width, c.Kangaroo[k], c.BSGS[k])
+		}
+	}
+
+	name := t.TempDir() + "/calibration.json"
+	checkErr(SaveCalibration(c, name))
+	solverCalibration = nil
+	loaded, err := LoadCalibration(name)
+	if err != nil || !reflect.DeepEqual(loaded, c) || solverCalibration == nil {
+		t.Errorf("The calibration was reloaded as %v (%v)", loaded, err)
+	}
+
+	checkErr(UseCalibration(Calibration{Bytes: []uint64{2, 3}, BSGS: []time.Duration{1, 5}, Kangaroo: []time.Duration{2, 4}}))
+	for b, want := range map[uint64]int{1: SOLVER_BSGS, 2: SOLVER_BSGS, 3: SOLVER_KANGAROO, 5: SOLVER_KANGAROO} {
+		if got := chooseSolver(b); got != want {
+			t.Errorf("Solver %d chosen on %d bytes instead of %d", got, b, want)
+		}
+	}
+	if err = UseCalibration(Calibration{Bytes: []uint64{2}}); err == nil {
+		t.Errorf("A calibration without times should be refused")
+	}
+}
+
+// TestHexLiteral checks the binary literals written for each dialect
+func TestHexLiteral(t *testing.T) {
+	b := []byte{0x00, 0x27, 0x5c, 0xff}
+	for dialect, want := range map[int]string{
+		DIALECT_POSTGRES: "decode('00275cff', 'hex')",
+		DIALECT_SQLITE:   "x'00275cff'",
+		DIALECT_MYSQL:    "x'00275cff'",
+	} {
+		if got := hexLiteral(dialect, b); got != want {
+			t.Errorf("Dialect %d: got %s, want %s", dialect, got, want)
+		}
+		if got := sqlLiteral(dialect, b); got != want {
+			t.Errorf("Dialect %d: the cell was written %s, want %s", dialect, got, want)
+		}
+	}
+	if got := hexLiteral(DIALECT_SQLITE, nil); got != "x''" {
+		t.Errorf("The empty value was written %s", got)
+	}
+}
+
+// TestColumnModes checks that the modes reported for the columns are the commands of the encryption
+func TestColumnModes(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "name", "salary"}, []string{"BIGINT", "TEXT", "INTEGER"},
+		[]driver.Value{int64(1), "Alice", int64(30)})
+	commands := []byte{0, 1, 2}
+	keys, err := EncryptTable(db, db, "staff", commands, rand.Reader)
+	checkErr(err)
+
+	want := map[string]byte{"id": 0, "name": 1, "salary": 2}
+	if modes := keys.ColumnModes(); !reflect.DeepEqual(modes, want) {
+		t.Errorf("The modes are %v, want %v", modes, want)
+	}
+	ti := keys.Info()
+	if ti.Name() != "staff" || !bytes.Equal(ti.Commands(), commands) || !reflect.DeepEqual(ti.PrimaryKey(), []string{"id"}) {
+		t.Errorf("Wrong description of the table: %s %v %v", ti.Name(), ti.Commands(), ti.PrimaryKey())
+	}
+	if !reflect.DeepEqual(ti.ColumnNames(), []string{"id", "name", "salary"}) || !reflect.DeepEqual(ti.ColumnTypes(), []string{"BIGINT", "TEXT", "INTEGER"}) {
+		t.Errorf("Wrong columns: %v %v", ti.ColumnNames(), ti.ColumnTypes())
+	}
+	ti.Commands()[1] = 0
+	if keys.ColumnModes()["name"] != 1 {
+		t.Errorf("The commands of the table were modified through Commands")
+	}
+}
+
+// sqlStateError is an error of the server carrying its SQLSTATE code, like the ones of pq
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "server error " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+// TestEncryptRetry encrypts a table from a database whose first queries fail on a lost
+// connection and whose first insertions are refused by the server for lack of connections, and
+// checks that a logical error is not retried, nor an insertion interrupted by a lost connection,
+// which may have been executed
+func TestEncryptRetry(t *testing.T) {
+	defer func(p RetryPolicy) { DBRetry = p }(DBRetry)
+	DBRetry = RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+
+	db, fdb := newFakeDB(t)
+	fdb.addTable("people", []string{"id", "name"}, []string{"BIGINT", "TEXT"},
+		[]driver.Value{int64(1), "Alice"}, []driver.Value{int64(2), "Bob"})
+	lost := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	queries, inserts := 0, 0
+	fdb.failQuery = func(query string) error {
+		if queries++; queries <= 2 {
+			return lost
+		}
+		return nil
+	}
+	fdb.failExec = func(query string) error {
+		if !strings.HasPrefix(query, "INSERT") {
+			return nil
+		}
+		if inserts++; inserts <= 2 {
+			return sqlStateError("53300")
+		}
+		return nil
+	}
+	if _, err := EncryptTable(db, db, "people", []byte{0, 1}, rand.Reader); err != nil {
+		t.Fatalf("The encryption failed despite the retries: %s", err)
+	}
+	if n := len(fdb.table("people_encrypted").rows); n != 2 {
+		t.Errorf("Expected 2 rows inserted, got %d", n)
+	}
+
+	for _, fail := range []error{errors.New("value too long for type"), lost} {
+		inserts = 0
+		fdb.failExec = func(query string) error {
+			if !strings.HasPrefix(query, "INSERT") {
+				return nil
+			}
+			inserts++
+			return fail
+		}
+		if _, err := EncryptTable(db, db, "people", []byte{0, 1}, rand.Reader); !errors.Is(err, fail) || inserts != 1 {
+			t.Errorf("Expected a single attempt and the error %v, got %d attempts (%v)", fail, inserts, err)
+		}
+	}
+	inserts = 0
+	fdb.failExec = func(query string) error {
+		if strings.HasPrefix(query, "INSERT") {
+			inserts++
+			return sqlStateError("57P03")
+		}
+		return nil
+	}
+	if _, err := EncryptTable(db, db, "people", []byte{0, 1}, rand.Reader); !errors.Is(err, sqlStateError("57P03")) || inserts != 3 {
+		t.Errorf("Expected %d attempts and the error of the server, got %d attempts (%v)", 3, inserts, err)
+	}
+	if isUnexecuted(lost) || !isUnexecuted(driver.ErrBadConn) || isUnexecuted(sqlStateError("23505")) {
+		t.Errorf("Wrong classification of the errors of an insertion")
+	}
+}
+
+// TestDecryptLinearCombination decrypts 2⋅a + 3⋅b - c, a and b being two cells of the same
+// column in different rows and c a cell of another column, and checks that the cells without the
+// compact encoding are refused
+func TestDecryptLinearCombination(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("stock", []string{"id", "qty", "price"}, []string{"BIGINT", "INTEGER", "INTEGER"},
+		[]driver.Value{int64(1), int64(5), int64(9)}, []driver.Value{int64(2), int64(7), int64(4)})
+	keys, err := EncryptTableWithOptions(db, db, "stock", []byte{0, 2, 2}, rand.Reader, EncryptOptions{CompactPoints: true})
+	checkErr(err)
+
+	coeffs := map[Coord]*big.Int{
+		NewCoord("qty", int64(1)):   big.NewInt(2),
+		NewCoord("qty", int64(2)):   big.NewInt(3),
+		NewCoord("price", int64(1)): big.NewInt(-1),
+	}
+	// The holder 2 does not answer
+	holderPoints := make([]CPoint, 3)
+	for _, num := range []byte{1, 3} {
+		part, err := keys.ExtractPart(num)
+		checkErr(err)
+		holderPoints[num-1] = part.GiveKeyCalculation(coeffs)
+	}
+
+	got, err := DecryptLinearCombination(db, keys.Info(), coeffs, holderPoints)
+	if err != nil {
+		t.Fatalf("Decryption of the combination failed: %s", err)
+	}
+	if got.Int64() != 2*5+3*7-9 {
+		t.Errorf("The combination decrypted to %v, want %d", got, 2*5+3*7-9)
+	}
+
+	coeffs[NewCoord("qty", int64(3))] = big.NewInt(1)
+	if _, err = DecryptLinearCombination(db, keys.Info(), coeffs, holderPoints); err == nil {
+		t.Errorf("A combination of a missing cell should fail")
+	}
+	if _, err = DecryptLinearCombination(db, keys.Info(), map[coord]*big.Int{NewCoord("id", int64(1)): big.NewInt(1)}, holderPoints); err == nil {
+		t.Errorf("A combination of an unencrypted column should fail")
+	}
+	if _, err = DecryptLinearCombination(db, keys.Info(), coeffs, holderPoints[:1]); err == nil {
+		t.Errorf("A single key holder should not be enough")
+	}
+
+	// The messages of the cells without the compact encoding are the gob encodings of the values
+	delete(coeffs, NewCoord("qty", int64(3)))
+	keys, err = EncryptTable(db, db, "stock", []byte{0, 2, 2}, rand.Reader)
+	checkErr(err)
+	keyParts := make(map[int]CPoint)
+	for _, num := range []byte{1, 3} {
+		part, err := keys.ExtractPart(num)
+		checkErr(err)
+		keyParts[int(num)] = part.GiveKeyCalculation(coeffs)
+	}
+	if _, err = DecryptLinearCombinationContext(context.Background(), db, keys.Info(), coeffs, keyParts); !errors.Is(err, ErrNotCompact) {
+		t.Errorf("Expected ErrNotCompact, got %v", err)
+	}
+}
+
+// TestCombineCalculationKeys combines the data points of a linear combination of cells without
+// database and decrypts it with the key rebuilt from the answers of two key holders
+func TestCombineCalculationKeys(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("stock", []string{"id", "qty", "price"}, []string{"BIGINT", "INTEGER", "INTEGER"},
+		[]driver.Value{int64(1), int64(5), int64(9)}, []driver.Value{int64(2), int64(7), int64(4)})
+	// The compact encoding makes the messages the values themselves
+	keys, err := EncryptTableWithOptions(db, db, "stock", []byte{0, 2, 2}, rand.Reader, EncryptOptions{CompactPoints: true})
+	checkErr(err)
+
+	// 2⋅qty_1 + 3⋅qty_2 + price_2 = 10 + 21 + 4
+	coeffs := map[coord]*big.Int{
+		NewCoord("qty", int64(1)):   big.NewInt(2),
+		NewCoord("qty", int64(2)):   big.NewInt(3),
+		NewCoord("price", int64(2)): big.NewInt(1),
+	}
+	d := pointZero
+	for _, row := range fdb.table("stock_encrypted").rows {
+		for j, col := range []string{"qty", "price"} {
+			coeff, ok := coeffs[NewCoord(col, row[0])]
+			if !ok {
+				continue
+			}
+			p, err := pointFromCell(row[j+1].([]byte))
+			checkErr(err)
+			d = addC(d, p.mult(coeff))
+		}
+	}
+	parts := make(map[int]CPoint)
+	for _, num := range []byte{2, 3} {
+		part, err := keys.ExtractPart(num)
+		checkErr(err)
+		parts[int(num)] = part.GiveKeyCalculation(coeffs)
+	}
+	s, err := CombineCalculationKeys(parts)
+	if err != nil {
+		t.Fatalf("The key of the combination was not rebuilt: %s", err)
+	}
+	if v, err := DiscreteLogContext(context.Background(), d.subC(s), 1); err != nil || v.Int64() != 35 {
+		t.Errorf("The combination was decrypted to %v (%v), want 35", v, err)
+	}
+
+	delete(parts, 3)
+	if _, err = CombineCalculationKeys(parts); err == nil {
+		t.Errorf("A single key holder cannot rebuild the key")
+	}
+	parts[0] = G
+	if _, err = CombineCalculationKeys(parts); !errors.Is(err, ErrInvalidShareIndex) {
+		t.Errorf("Expected ErrInvalidShareIndex, got %v", err)
+	}
+	delete(parts, 0)
+	parts[1] = CPoint{new(big.Int).Set(G.x), big.NewInt(1)}
+	if _, err = CombineCalculationKeys(parts); !errors.Is(err, ErrInvalidPoint) {
+		t.Errorf("Expected ErrInvalidPoint, got %v", err)
+	}
+}
+
+// TestDecryptLinearCombinationBits sums the cells of 1000 SMALLINT values, whose sum does not fit
+// on the 2 bytes of the type, and decrypts it with the width of the sum
+func TestDecryptLinearCombinationBits(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	rows := make([][]driver.Value, 1000)
+	coeffs := make(map[coord]*big.Int, len(rows))
+	var want int64
+	for k := range rows {
+		v := int64(100 + k%60)
+		rows[k] = []driver.Value{int64(k), v}
+		coeffs[NewCoord("qty", int64(k))] = Big1
+		want += v
+	}
+	fdb.addTable("stock", []string{"id", "qty"}, []string{"BIGINT", "SMALLINT"}, rows...)
+	// The compact encoding makes the messages the values themselves
+	keys, err := EncryptTableWithOptions(db, db, "stock", []byte{0, 2}, rand.Reader, EncryptOptions{CompactPoints: true})
+	checkErr(err)
+	keyParts := make(map[int]CPoint)
+	for _, num := range []byte{1, 3} {
+		part, err := keys.ExtractPart(num)
+		checkErr(err)
+		keyParts[int(num)] = part.GiveKeyCalculation(coeffs)
+	}
+	if want <= 0xFFFF {
+		t.Fatalf("The sum should not fit on the 2 bytes of a SMALLINT")
+	}
+
+	if _, err = DecryptLinearCombinationBits(context.Background(), db, keys.Info(), coeffs, keyParts, 16); !errors.Is(err, ErrPointOutOfRange) {
+		t.Errorf("The sum should be out of the range of a SMALLINT, got %v", err)
+	}
+	got, err := DecryptLinearCombinationBits(context.Background(), db, keys.Info(), coeffs, keyParts, uint64(big.NewInt(want).BitLen()))
+	if err != nil {
+		t.Fatalf("Decryption of the sum failed: %s", err)
+	}
+	if got.Int64() != want {
+		t.Errorf("The sum decrypted to %v, want %d", got, want)
+	}
+	if _, err = DecryptLinearCombinationBits(context.Background(), db, keys.Info(), coeffs, keyParts, 65); err == nil {
+		t.Errorf("A width of more than 64 bits should be refused")
+	}
+}
+
+// TestKeysOnCurves generates keys on P224 and P256 in the same test and checks that each pair
+// encrypts and decrypts on its own curve only
+func TestKeysOnCurves(t *testing.T) {
+	message := []byte(testText[:100])
+	cyphers := make(map[string]Cypher)
+	privs := make(map[string]PrivateKey)
+	curves := []elliptic.Curve{elliptic.P224(), elliptic.P256()}
+	for _, curve := range curves {
+		name := curve.Params().Name
+		pub, priv, verifiers := SetKeysOn(curve, rand.Reader)
+		if pub.Curve != curve || !curve.IsOnCurve(pub.Y.x, pub.Y.y) {
+			t.Fatalf("The public key is not on %s", name)
+		}
+		for i, v := range verifiers {
+			if !curve.IsOnCurve(v.x, v.y) {
+				t.Errorf("The verifier %d is not on %s", i, name)
+			}
+		}
+		cypher, err := pub.encrypt(message, rand.Reader)
+		checkErr(err)
+		m, err := priv.DecryptOn(curve, cypher)
+		if err != nil || !bytes.Equal(m, message) {
+			t.Errorf("Decryption on %s failed: %v", name, err)
+		}
+		cyphers[name], privs[name] = cypher, priv
+	}
+	if _, err := (&PrivateKey{}).DecryptOn(elliptic.P224(), cyphers["P-256"]); err != ErrInvalidPoint {
+		t.Errorf("A cypher of P-256 should be refused on P-224, got %v", err)
+	}
+	p256 := privs["P-256"]
+	if _, err := p256.Decrypt(cyphers["P-256"]); err != ErrInvalidPoint {
+		t.Errorf("Decrypt works on the curve of the package, got %v", err)
+	}
+
+	pub, priv0, err := CreateKeysOn(elliptic.P256(), rand.Reader)
+	checkErr(err)
+	if x, y := elliptic.P256().ScalarBaseMult(priv0); x.Cmp(pub.Y.x) != 0 || y.Cmp(pub.Y.y) != 0 {
+		t.Errorf("The public key of CreateKeysOn does not match its private key")
+	}
+}
+
+// TestEncryptEmptyTable encrypts a table without rows, a table made of its primary key only and
+// a table without columns
+func TestEncryptEmptyTable(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("empty", []string{"id", "name", "salary"}, []string{"BIGINT", "TEXT", "INTEGER"})
+	keys, err := EncryptTable(db, db, "empty", []byte{0, 1, 2}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption of the empty table failed: %s", err)
+	}
+	if tab := fdb.table("empty_encrypted"); tab == nil || len(tab.rows) != 0 || len(tab.cols) != 3 {
+		t.Errorf("The encrypted table is %v", tab)
+	}
+	if keys.ti.nRows != 0 || len(keys.R) != 0 || len(keys.Priv) != 2 {
+		t.Errorf("Wrong table of keys: %d rows, %d r values, %d private keys", keys.ti.nRows, len(keys.R), len(keys.Priv))
+	}
+	emitted := 0
+	if _, err = EncryptTableStream(db, "empty", []byte{0, 1, 2}, rand.Reader, func(uint64, []string) error {
+		emitted++
+		return nil
+	}); err != nil || emitted != 0 {
+		t.Errorf("The stream of the empty table gave %d rows (%v)", emitted, err)
+	}
+
+	fdb.addTable("ids", []string{"id"}, []string{"BIGINT"}, []driver.Value{int64(1)}, []driver.Value{int64(2)})
+	keys, err = EncryptTable(db, db, "ids", []byte{0}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption of the table of ids failed: %s", err)
+	}
+	if rows := fdb.table("ids_encrypted").rows; len(rows) != 2 || rows[0][0] != int64(1) || rows[1][0] != int64(2) {
+		t.Errorf("The ids were copied as %v", rows)
+	}
+	if len(keys.R) != 2 || len(keys.Priv) != 0 {
+		t.Errorf("Wrong table of keys: %d r values, %d private keys", len(keys.R), len(keys.Priv))
+	}
+
+	fdb.addTable("nothing", nil, nil)
+	if _, err = EncryptTable(db, db, "nothing", nil, rand.Reader); err == nil {
+		t.Errorf("The encryption of a table without columns should fail")
+	}
+	if fdb.table("nothing_encrypted") != nil {
+		t.Errorf("An encrypted table was created for the table without columns")
+	}
+}
+
+// TestZeroize checks that the private keys and the parts of the key holders are overwritten
+// with zeros, without touching the table of keys the parts were extracted from
+func TestZeroize(t *testing.T) {
+	_, priv, _ := SetKeys(rand.Reader)
+	shares := priv
+	priv.Zeroize()
+	for i, share := range shares {
+		if len(share) == 0 {
+			t.Fatalf("The share %d is empty", i)
+		}
+		for _, b := range share {
+			if b != 0 {
+				t.Errorf("The share %d was not zeroized: %x", i, share)
+				break
+			}
+		}
+	}
+
+	keys := TableKeys{
+		R:    map[interface{}]*big.Int{int64(1): big.NewInt(12345)},
+		Priv: map[string]PrivateKey{"salary": {[]byte{1}, []byte{2}, []byte{3}, []byte{4}}},
+	}
+	part, err := keys.ExtractPart(2)
+	checkErr(err)
+	s, r := part.PrivPart["salary"], part.R[int64(1)]
+	words := s.Bits()
+	part.Zeroize()
+	if s.Sign() != 0 || r.Sign() != 0 || words[0] != 0 {
+		t.Errorf("The part was not zeroized: s = %v, r = %v", s, r)
+	}
+	if keys.R[int64(1)].Int64() != 12345 || keys.Priv["salary"][2][0] != 3 {
+		t.Errorf("Zeroizing the part modified the table of keys")
+	}
+}
+
+// TestDecryptHashCellFromHolders decrypts a hash encrypted cell read from the encrypted table
+// with the key points served by two key holders, which only hold their parts, and checks that
+// a handler with Authorize refuses the requests without the expected header
+func TestDecryptHashCellFromHolders(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "name"}, []string{"BIGINT", "TEXT"},
+		[]driver.Value{int64(1), "Alice"}, []driver.Value{int64(2), "Bob"})
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 1}, rand.Reader)
+	checkErr(err)
+
+	clients := make(map[byte]KeyHolderClient)
+	for _, num := range []byte{2, 3} {
+		part, err := keys.ExtractPart(num)
+		checkErr(err)
+		srv := httptest.NewServer(NewKeyHolderHandler(part))
+		defer srv.Close()
+		clients[num] = KeyHolderClient{URL: srv.URL}
+	}
+
+	ti := keys.Info()
+	for id, want := range map[int64]string{1: "Alice", 2: "Bob"} {
+		parts := make(map[int]CPoint)
+		for num, client := range clients {
+			pt, holder, err := client.KeyPoint(NewCoord("name", id))
+			if err != nil || holder != num {
+				t.Fatalf("Key holder %d answered %d (%v)", num, holder, err)
+			}
+			parts[int(holder)] = pt
+		}
+		row := db.QueryRow("SELECT name FROM staff_encrypted WHERE id = $1;", id)
+		m, err := DecryptOneData(context.Background(), *row, ti, 1, parts)
+		if err != nil {
+			t.Fatalf("Row %d failed to decrypt: %s", id, err)
+		}
+		if v, err := decodeValue(m, "TEXT"); err != nil || v != want {
+			t.Errorf("Row %d decrypted to %v (%v), want %s", id, v, err, want)
+		}
+	}
+
+	// A handler with Authorize refuses the requests without the expected header
+	part, err := keys.ExtractPart(2)
+	checkErr(err)
+	h := NewKeyHolderHandler(part)
+	h.Authorize = func(req *http.Request) error {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			return errors.New("wrong token")
+		}
+		return nil
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	client := KeyHolderClient{URL: srv.URL}
+	if _, _, err = client.KeyPoint(NewCoord("name", int64(1))); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("A request without token should be refused, got %v", err)
+	}
+	client.Header = http.Header{"Authorization": {"Bearer secret"}}
+	if _, holder, err := client.KeyPoint(NewCoord("name", int64(1))); err != nil || holder != 2 {
+		t.Errorf("Key holder 2 answered %d (%v)", holder, err)
+	}
+}
+
+// TestGatherHolderPoints decrypts a cell with the key points of two key holders gathered while the
+// third one does not answer, and checks that a single answer is not enough
+func TestGatherHolderPoints(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "name"}, []string{"BIGINT", "TEXT"}, []driver.Value{int64(1), "Alice"})
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 1}, rand.Reader)
+	checkErr(err)
+
+	cell := NewCoord("name", int64(1))
+	var holders []HolderClient
+	for _, num := range []byte{1, 2} {
+		part, err := keys.ExtractPart(num)
+		checkErr(err)
+		srv := httptest.NewServer(NewKeyHolderHandler(part))
+		defer srv.Close()
+		holders = append(holders, KeyHolderClient{URL: srv.URL}.ForCell(cell))
+	}
+	// The third key holder hangs until the request is cancelled
+	offline := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The cancellation of the request is only seen by the server once the body is read
+		io.Copy(io.Discard, req.Body)
+		select {
+		case <-req.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer offline.Close()
+	holders = append([]HolderClient{KeyHolderClient{URL: offline.URL}.ForCell(cell)}, holders...)
+
+	start := time.Now()
+	parts, err := GatherHolderPoints(holders, 2, 5*time.Second)
+	if err != nil || len(parts) != 2 {
+		t.Fatalf("Expected the points of 2 holders, got %v (%v)", parts, err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("The points were gathered after %s instead of the answers of the two holders", d)
+	}
+	row := db.QueryRow("SELECT name FROM staff_encrypted WHERE id = $1;", int64(1))
+	m, err := DecryptOneData(context.Background(), *row, keys.Info(), 1, parts)
+	if err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	if v, err := decodeValue(m, "TEXT"); err != nil || v != "Alice" {
+		t.Errorf("Decrypted to %v (%v)", v, err)
+	}
+
+	// Three points are asked for: the two answers are returned at the timeout
+	if parts, err = GatherHolderPoints(holders, 3, 200*time.Millisecond); err != nil || len(parts) != 2 {
+		t.Errorf("Expected the points of 2 holders at the timeout, got %v (%v)", parts, err)
+	}
+	failing := HolderFunc(func(context.Context) (CPoint, byte, error) {
+		return CPoint{}, 0, errors.New("connection refused")
+	})
+	if _, err = GatherHolderPoints([]HolderClient{holders[0], holders[1], failing}, 2, 200*time.Millisecond); !errors.Is(err, ErrTooFewHolders) {
+		t.Errorf("Expected ErrTooFewHolders with a single answer, got %v", err)
+	}
+	if _, err = GatherHolderPoints([]HolderClient{holders[1], holders[1]}, 2, time.Second); !errors.Is(err, ErrTooFewHolders) {
+		t.Errorf("Expected ErrTooFewHolders with the same holder twice, got %v", err)
+	}
+	if _, err = GatherHolderPoints(holders, 1, time.Second); err == nil {
+		t.Errorf("A single point cannot rebuild a key")
+	}
+}
+
+// TestBufferDepth encrypts a table with the smallest buffers and deep ones
+func TestBufferDepth(t *testing.T) {
+	if d := (EncryptOptions{}).bufferDepth(); d != DEFAULT_BUFFER_DEPTH {
+		t.Errorf("The default depth is %d", d)
+	}
+	db, fdb := newFakeDB(t)
+	var rows [][]driver.Value
+	for i := int64(0); i < 50; i++ {
+		rows = append(rows, []driver.Value{i, fmt.Sprintf("name %d", i)})
+	}
+	fdb.addTable("people", []string{"id", "name"}, []string{"BIGINT", "TEXT"}, rows...)
+	for _, depth := range []int{1, 64} {
+		keys, err := EncryptTableWithOptions(db, db, "people", []byte{0, 1}, rand.Reader, EncryptOptions{BufferDepth: depth})
+		if err != nil {
+			t.Fatalf("Encryption with buffers of %d failed: %s", depth, err)
+		}
+		if n := len(fdb.table("people_encrypted").rows); n != 50 || len(keys.R) != 50 {
+			t.Errorf("Buffers of %d: %d rows inserted and %d r values", depth, n, len(keys.R))
+		}
+	}
+}
+
+// TestEncryptNumeric encrypts NUMERIC(40,15) values and checks that they are decrypted to the
+// same decimal digit for digit, and that the unencrypted ones are copied exactly
+func TestEncryptNumeric(t *testing.T) {
+	values := []string{"1234567890123456789012345.123456789012345", "-0.000000000000100", "7.000000000000000"}
+	db, fdb := newFakeDB(t)
+	var rows [][]driver.Value
+	for i, v := range values {
+		rows = append(rows, []driver.Value{int64(i), []byte(v), []byte(v)})
+	}
+	fdb.addTable("amounts", []string{"id", "secret", "public"}, []string{"BIGINT", "NUMERIC(40,15)", "NUMERIC(40,15)"}, rows...)
+	keys, err := EncryptTable(db, db, "amounts", []byte{0, 1, 0}, rand.Reader)
+	checkErr(err)
+
+	enc := fdb.table("amounts_encrypted").rows
+	for i, want := range values {
+		s := baseMult(keys.R[int64(i)]).multB(keys.Priv["secret"][0])
+		m, err := decryptFromHash(enc[i][1].([]byte), s)
+		checkErr(err)
+		v, err := decodeValue(m, "NUMERIC(40,15)")
+		if err != nil {
+			t.Fatalf("Row %d failed to decode: %s", i, err)
+		}
+		if n, ok := v.(Numeric); !ok || n.String() != want {
+			t.Errorf("Row %d decrypted to %v, want %s", i, v, want)
+		}
+		if enc[i][2] != want {
+			t.Errorf("Row %d was copied as %v, want %s", i, enc[i][2], want)
+		}
+	}
+
+	if n, err := numericOf(2.5); err != nil || n.String() != "2.5" {
+		t.Errorf("The float 2.5 gave %v (%v)", n, err)
+	}
+	for _, bad := range []string{"", "NaN", "1.2.3", "1e5"} {
+		if _, err := ParseNumeric(bad); err == nil {
+			t.Errorf("%q should not be parsed as a decimal", bad)
+		}
+	}
+	if v, err := decodeValue(GetBytes([]byte("3.10")), "NUMERIC"); err != nil || v.(Numeric).String() != "3.10" {
+		t.Errorf("The cell of the previous format decoded to %v (%v)", v, err)
+	}
+}
+
+// TestErrorKinds checks that the errors of the package can be told apart with errors.Is
+func TestErrorKinds(t *testing.T) {
+	x := big.NewInt(1)
+	for {
+		if _, err := YFromX(x); err != nil {
+			if !errors.Is(err, ErrInvalidPoint) {
+				t.Errorf("YFromX: %v is not ErrInvalidPoint", err)
+			}
+			break
+		}
+		x.Add(x, Big1)
+	}
+
+	_, priv, _ := SetKeys(rand.Reader)
+	keys := TableKeys{
+		ti:   TableInfo{name: "t", nCol: 1, colNames: []string{"name"}, colTypes: []string{"TEXT"}, commands: []byte{0}},
+		R:    map[interface{}]*big.Int{int64(1): big.NewInt(5)},
+		Priv: map[string]PrivateKey{"name": priv},
+	}
+	if _, err := keys.ExtractPart(0); !errors.Is(err, ErrInvalidShareIndex) {
+		t.Errorf("ExtractPart(0): %v is not ErrInvalidShareIndex", err)
+	}
+	if _, err := CombineColumnKeys(map[string]map[int]CPoint{"c": {0: G, 1: G}}); !errors.Is(err, ErrInvalidShareIndex) {
+		t.Errorf("CombineColumnKeys: %v is not ErrInvalidShareIndex", err)
+	}
+
+	if _, err := DecodeFromPoint(baseMult(big.NewInt(1<<20)), 8); !errors.Is(err, ErrPointOutOfRange) {
+		t.Errorf("DecodeFromPoint: %v is not ErrPointOutOfRange", err)
+	}
+
+	if _, err := pointBytesNumber("BIGINT"); !errors.Is(err, ErrUnsupportedColumnType) {
+		t.Errorf("pointBytesNumber: %v is not ErrUnsupportedColumnType", err)
+	}
+	if _, err := transferFunction("GEOMETRY", false); !errors.Is(err, ErrUnsupportedColumnType) {
+		t.Errorf("transferFunction: %v is not ErrUnsupportedColumnType", err)
+	}
+	ti := TableInfo{name: "t", nCol: 2, colNames: []string{"id", "shape"}, colTypes: []string{"BIGINT", "GEOMETRY"}, commands: []byte{2, 0}}
+	if _, err := checkTransfers(ti, EncryptOptions{}); !errors.Is(err, ErrUnsupportedColumnType) {
+		t.Errorf("checkTransfers of a point: %v is not ErrUnsupportedColumnType", err)
+	}
+	ti.commands[0] = 0
+	if _, err := checkTransfers(ti, EncryptOptions{}); !errors.Is(err, ErrUnsupportedColumnType) {
+		t.Errorf("checkTransfers of a copy: %v is not ErrUnsupportedColumnType", err)
+	}
+
+	if _, err := SimulateDecryption(keys, int64(1), "name", nil, "TEXT"); !errors.Is(err, ErrNotEncryptedColumn) {
+		t.Errorf("SimulateDecryption: %v is not ErrNotEncryptedColumn", err)
+	}
+
+	pub, _, _ := SetKeys(rand.Reader)
+	if _, err := EncryptValue(pub, nil, 1, big.NewInt(5)); !errors.Is(err, ErrNullValue) {
+		t.Errorf("EncryptValue: %v is not ErrNullValue", err)
+	}
+	if _, _, err := pub.EncryptColumn([]interface{}{bytes.Repeat([]byte{0xff}, 64)}, 2, rand.Reader); !errors.Is(err, ErrPointOutOfRange) {
+		t.Errorf("EncryptColumn: %v is not ErrPointOutOfRange", err)
+	}
+}
+
+// TestEncryptWithR encrypts two values with the same r under two keys, decrypts the sum of
+// their data points with the sum of the private keys, and aligns the r values of two tables
+func TestEncryptWithR(t *testing.T) {
+	pubA, privA, _ := SetKeys(rand.Reader)
+	pubB, privB, _ := SetKeys(rand.Reader)
+	r := big.NewInt(123456789)
+
+	cA, err := pubA.EncryptPointWithR([]byte{0x12, 0x34}, r)
+	checkErr(err)
+	cB, err := pubB.EncryptPointWithR([]byte{0x56}, r)
+	checkErr(err)
+	if !cA.C.equalC(cB.C) {
+		t.Fatalf("The cyphers made with the same r do not share C")
+	}
+	sum := new(big.Int).Add(new(big.Int).SetBytes(privA[0]), new(big.Int).SetBytes(privB[0]))
+	sum.Mod(sum, N)
+	pt := addC(PointFromShort(cA.Data), PointFromShort(cB.Data)).subC(cA.C.multB(sum.Bytes()))
+	if v, err := DecodeFromPoint(pt, 16); err != nil || v != 0x1234+0x56 {
+		t.Errorf("The sum decrypted to %d (%v), want %d", v, err, 0x1234+0x56)
+	}
+
+	hA, err := pubA.EncryptHashWithR([]byte("hello"), r)
+	checkErr(err)
+	if !hA.C.equalC(cA.C) {
+		t.Errorf("The hash cypher made with the same r does not share C")
+	}
+	if m, err := privA.Decrypt(hA); err != nil || string(m) != "hello" {
+		t.Errorf("Decryption of the hash cypher failed: %v", err)
+	}
+	for _, bad := range []*big.Int{nil, Big0, N} {
+		if _, err := pubA.EncryptPointWithR([]byte{1}, bad); err == nil {
+			t.Errorf("Encryption with r = %v should fail", bad)
+		}
+		if _, err := pubA.EncryptHashWithR([]byte{1}, bad); err == nil {
+			t.Errorf("Encryption with r = %v should fail", bad)
+		}
+	}
+
+	db, fdb := newFakeDB(t)
+	fdb.addTable("stock", []string{"id", "qty"}, []string{"BIGINT", "INTEGER"},
+		[]driver.Value{int64(1), int64(5)}, []driver.Value{int64(2), int64(7)})
+	keys, err := EncryptTable(db, db, "stock", []byte{0, 2}, rand.Reader)
+	checkErr(err)
+	given := map[interface{}]*big.Int{int64(1): keys.R[int64(1)]}
+	again, err := EncryptTableWithOptions(db, db, "stock", []byte{0, 2}, rand.Reader, EncryptOptions{DestName: "stock_again", R: given})
+	checkErr(err)
+	if again.R[int64(1)].Cmp(keys.R[int64(1)]) != 0 {
+		t.Errorf("The r given for row 1 was not used")
+	}
+	if again.R[int64(2)].Cmp(keys.R[int64(2)]) == 0 {
+		t.Errorf("The r of row 2 should be random")
+	}
+	given[int64(2)] = N
+	if _, err = EncryptTableWithOptions(db, db, "stock", []byte{0, 2}, rand.Reader, EncryptOptions{DestName: "stock_again", R: given}); err == nil {
+		t.Errorf("An r out of range should fail")
+	}
+}
+
+// TestEncryptedRows pairs each row of the encrypted table with its primary key and its r value
+func TestEncryptedRows(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"code", "salary"}, []string{"TEXT", "INTEGER"},
+		[]driver.Value{"x", int64(30)},
+		[]driver.Value{"b", int64(40)},
+		[]driver.Value{"m", int64(50)})
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 2}, rand.Reader)
+	checkErr(err)
+
+	rows := keys.EncryptedRows()
+	enc := fdb.table("staff_encrypted").rows
+	if len(rows) != len(enc) {
+		t.Fatalf("%d rows given for the %d rows of the encrypted table", len(rows), len(enc))
+	}
+	for i, row := range rows {
+		cell := enc[row.Index][1].([]byte)
+		if row.Index != uint64(i) || row.Key != enc[row.Index][0] || row.R != keys.R[row.Key] {
+			t.Errorf("The row %d is paired with %v", i, row)
+			continue
+		}
+		s := baseMult(row.R).multB(keys.Priv["salary"][0])
+		values, err := DecryptRow(map[string][]byte{"salary": cell}, keys.ti, map[string]CPoint{"salary": s})
+		if want := 30 + 10*int64(i); err != nil || values["salary"] != want {
+			t.Errorf("The row %d was decrypted to %v instead of %d (%v)", i, values, want, err)
+		}
+	}
+
+	name := t.TempDir() + "/keys"
+	checkErr(keys.StockTableKeys(name))
+	loaded, err := LoadTableKeys(name)
+	checkErr(err)
+	if loaded.EncryptedRows() != nil {
+		t.Errorf("The order of the rows should not be known from a file of keys")
+	}
+}
+
+// TestExportColumnKey decrypts a column with its exported key and checks that the other columns
+// cannot be decrypted with it
+func TestExportColumnKey(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "name", "salary", "grade"}, []string{"BIGINT", "TEXT", "TEXT", "INTEGER"},
+		[]driver.Value{int64(1), "Alice", "3000", int64(4)}, []driver.Value{int64(2), "Bob", "4500", int64(6)})
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 1, 1, 2}, rand.Reader)
+	checkErr(err)
+	priv, err := keys.ExportColumnKey("name")
+	checkErr(err)
+	if priv[1] != nil || priv[2] != nil || priv[3] != nil {
+		t.Errorf("The shares of the key holders should not be exported")
+	}
+
+	names := []string{"Alice", "Bob"}
+	for k, enc := range fdb.table("staff_encrypted").rows {
+		s := priv.CellKey(keys.R[enc[0]])
+		values, err := DecryptRow(map[string][]byte{"name": enc[1].([]byte)}, keys.ti, map[string]CPoint{"name": s})
+		if err != nil || values["name"] != names[k] {
+			t.Errorf("Row %d: the name was decrypted to %v (%v)", k, values["name"], err)
+		}
+		if _, err = DecryptRow(map[string][]byte{"salary": enc[2].([]byte)}, keys.ti, map[string]CPoint{"salary": s}); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("Row %d: the salary should not be decrypted with the key of name, got %v", k, err)
+		}
+	}
+
+	if _, err = keys.ExportColumnKey("id"); !errors.Is(err, ErrNotEncryptedColumn) {
+		t.Errorf("The export of an unencrypted column should fail, got %v", err)
+	}
+}
+
+// TestEncryptArrayColumn copies a column of text arrays and checks that the arrays keep their type
+// and their elements
+func TestEncryptArrayColumn(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	tags := `{"a b",c,NULL,"quote\"d"}`
+	fdb.addTable("posts", []string{"id", "tags", "body"}, []string{"BIGINT", "TEXT[]", "TEXT"},
+		[]driver.Value{int64(1), []byte(tags), "hello"}, []driver.Value{int64(2), nil, "world"})
+	keys, err := EncryptTable(db, db, "posts", []byte{0, 0, 1}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if typ := keys.Info().ColumnTypes()[1]; typ != "TEXT[]" {
+		t.Errorf("The type of the array column was read as %s", typ)
+	}
+	created := false
+	for _, stmt := range fdb.execs {
+		created = created || strings.Contains(stmt, "CREATE TABLE IF NOT EXISTS posts_encrypted (id BIGINT, tags TEXT[], ")
+	}
+	if !created {
+		t.Errorf("The array column was not created with its type: %v", fdb.execs)
+	}
+	rows := fdb.table("posts_encrypted").rows
+	if rows[0][1] != tags || rows[1][1] != nil {
+		t.Errorf("The arrays were copied as %v and %v", rows[0][1], rows[1][1])
+	}
+	if lit := sqlLiteral(DIALECT_POSTGRES, transferOne(transferArray, []byte(tags))); lit != "'"+tags+"'" {
+		t.Errorf("The array was written as the literal %s", lit)
+	}
+	if _, isErr := transferOne(transferArray, []int64{1, 2}).(error); !isErr {
+		t.Errorf("A value which is not the text of an array should be refused")
+	}
+}
+
+// TestEncryptUserDefinedColumn copies a column of a composite type and a column of an enumeration
+// as their text literals, the encrypted table being created with the types of the source table
+func TestEncryptUserDefinedColumn(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	point := `(1,"a b")`
+	fdb.addTable("shapes", []string{"id", "origin", "Mood"}, []string{"BIGINT", `"Point2D"`, `"mood"`},
+		[]driver.Value{int64(1), []byte(point), []byte("happy")}, []driver.Value{int64(2), nil, []byte("sad")})
+	keys, err := EncryptTable(db, db, "shapes", []byte{0, 0, 0}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if types := keys.Info().ColumnTypes(); types[1] != `"Point2D"` || types[2] != `"mood"` {
+		t.Errorf("The types defined by the user were read as %v", types)
+	}
+	created := false
+	for _, stmt := range fdb.execs {
+		created = created || strings.Contains(stmt, `CREATE TABLE IF NOT EXISTS shapes_encrypted (id BIGINT, origin "Point2D", Mood "mood")`)
+	}
+	if !created {
+		t.Errorf("The columns were not created with their types: %v", fdb.execs)
+	}
+	rows := fdb.table("shapes_encrypted").rows
+	if rows[0][1] != point || rows[0][2] != "happy" || rows[1][1] != nil || rows[1][2] != "sad" {
+		t.Errorf("The values were copied as %v", rows)
+	}
+}
+
+// TestSelfTest runs the self test on the default configuration, then on a curve whose parameter b
+// is broken
+func TestSelfTest(t *testing.T) {
+	if err := SelfTest(); err != nil {
+		t.Fatalf("The self test failed: %s", err)
+	}
+
+	saved := myCurve
+	defer func() { myCurve = saved }()
+	params := *saved.Params()
+	params.B = new(big.Int).Add(params.B, Big1)
+	myCurve = &params
+	err := SelfTest()
+	var failures SelfTestErrors
+	if !errors.As(err, &failures) {
+		t.Fatalf("The self test should fail on a broken curve, got %v", err)
+	}
+	failed := make(map[string]bool)
+	for _, f := range failures {
+		failed[f.Check] = true
+	}
+	if !failed["curve"] || !failed["short points"] {
+		t.Errorf("The checks of the curve and of the short points should fail: %s", err)
+	}
+}
+
+// TestEncryptFromMap encrypts with public keys taken directly from a map, as SetTableKeys returns
+// them, which the value receivers of the encryption methods allow
+func TestEncryptFromMap(t *testing.T) {
+	pubs := make(map[string]PublicKey)
+	privs := make(map[string]PrivateKey)
+	for _, col := range []string{"name", "grade"} {
+		pubs[col], privs[col], _ = SetKeys(rand.Reader)
+	}
+
+	cypher, err := pubs["name"].Encrypt([]byte("Alice"), rand.Reader)
+	checkErr(err)
+	priv := privs["name"]
+	if m, err := priv.Decrypt(cypher); err != nil || string(m) != "Alice" {
+		t.Errorf("Decryption of the name failed: %v", err)
+	}
+	point, err := pubs["grade"].EncryptPoint([]byte{30}, rand.Reader)
+	checkErr(err)
+	priv = privs["grade"]
+	if v, err := priv.DecryptPoint(point, 8); err != nil || v.Int64() != 30 {
+		t.Errorf("Decryption of the grade failed: %v", err)
+	}
+	if _, _, err = pubs["grade"].EncryptColumn([]interface{}{int64(1), int64(2)}, 2, rand.Reader); err != nil {
+		t.Errorf("Encryption of a column failed: %v", err)
+	}
+}
+
+// TestDuplicatePrimaryKey encrypts a table whose designated primary key is not unique, which must
+// be refused without creating the encrypted table
+func TestDuplicatePrimaryKey(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "dept", "salary"}, []string{"BIGINT", "TEXT", "INTEGER"},
+		[]driver.Value{int64(1), "sales", int64(30)},
+		[]driver.Value{int64(2), "it", int64(40)},
+		[]driver.Value{int64(3), "sales", int64(50)})
+	_, err := EncryptTableWithOptions(db, db, "staff", []byte{0, 0, 2}, rand.Reader, EncryptOptions{PrimaryKey: []string{"dept"}})
+	if !errors.Is(err, ErrDuplicatePrimaryKey) || !strings.Contains(err.Error(), "dept") {
+		t.Errorf("A primary key with duplicates should be refused with its column, got %v", err)
+	}
+	if fdb.table("staff_encrypted") != nil {
+		t.Errorf("The encrypted table was created despite the duplicated primary key")
+	}
+	ti, err := tableInfoFromDB(db, "staff", 0, 0, 2)
+	checkErr(err)
+	checkErr(ti.setPrimaryKey("dept"))
+	if _, _, _, err = SetTableKeys(db, ti, rand.Reader); !errors.Is(err, ErrDuplicatePrimaryKey) {
+		t.Errorf("SetTableKeys should return ErrDuplicatePrimaryKey, got %v", err)
+	}
+	if _, err = EncryptTable(db, db, "staff", []byte{0, 0, 2}, rand.Reader); err != nil {
+		t.Errorf("The unique column id should be accepted as primary key: %v", err)
+	}
+}
+
+// TestPublicBundle serializes the bundle of the public keys of an encrypted table and encrypts
+// with it a value of a query, which gives the cell of the table and decrypts with the keys
+func TestPublicBundle(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "name", "grade"}, []string{"BIGINT", "TEXT", "INTEGER"},
+		[]driver.Value{int64(7), "Alice", int64(30)})
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 1, 2}, rand.Reader)
+	checkErr(err)
+	bundle, err := keys.PublicBundle()
+	if err != nil {
+		t.Fatalf("The bundle was not made: %s", err)
+	}
+	data, err := json.Marshal(bundle)
+	checkErr(err)
+	var received PublicBundle
+	checkErr(json.Unmarshal(data, &received))
+
+	r := keys.R[int64(7)]
+	enc := fdb.table("staff_encrypted").rows[0]
+	for j, col := range []string{"name", "grade"} {
+		pub, err := received.PublicKey(col)
+		if err != nil {
+			t.Fatalf("No public key for %s: %s", col, err)
+		}
+		v := []interface{}{"Alice", int64(30)}[j]
+		cell, err := EncryptValue(pub, v, byte(j+1), r)
+		checkErr(err)
+		if !bytes.Equal(cell, enc[j+1].([]byte)) {
+			t.Errorf("The value of %s encrypted with the bundle differs from the cell of the table", col)
+		}
+		s := baseMult(r).multB(keys.Priv[col][0])
+		values, err := DecryptRow(map[string][]byte{col: cell}, keys.ti, map[string]CPoint{col: s})
+		if err != nil || values[col] != v {
+			t.Errorf("The value of %s was decrypted to %v (%v)", col, values, err)
+		}
+	}
+	if _, err = received.PublicKey("id"); !errors.Is(err, ErrNotEncryptedColumn) {
+		t.Errorf("An unencrypted column should have no public key, got %v", err)
+	}
+	received.Version = 2
+	if _, err = received.PublicKey("name"); err == nil {
+		t.Errorf("A bundle of an unknown version should be refused")
+	}
+}
+
+// TestManifest encrypts a table, drops it and decrypts the encrypted table from the manifest and
+// the keys saved in files
+func TestManifest(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"name", "id", "grade"}, []string{"TEXT", "BIGINT", "INTEGER"},
+		[]driver.Value{"Alice", int64(7), int64(30)}, []driver.Value{"Bob", int64(8), int64(45)})
+	opts := EncryptOptions{PrimaryKey: []string{"id"}, DestName: "staff_v2", CompactPoints: true}
+	keys, err := EncryptTableWithOptions(db, db, "staff", []byte{1, 0, 2}, rand.Reader, opts)
+	checkErr(err)
+	dir := t.TempDir()
+	checkErr(SaveManifest(keys.Manifest(), dir+"/staff.manifest"))
+	checkErr(keys.StockTableKeys(dir + "/staff.keys"))
+	fdb.mu.Lock()
+	delete(fdb.tables, "staff")
+	fdb.mu.Unlock()
+
+	m, err := LoadManifest(dir + "/staff.manifest")
+	checkErr(err)
+	ti, err := m.TableInfo()
+	checkErr(err)
+	loaded, err := LoadTableKeys(dir + "/staff.keys")
+	checkErr(err)
+	if ti.Name() != "staff" || !reflect.DeepEqual(ti.PrimaryKey(), []string{"id"}) || !reflect.DeepEqual(ti.Commands(), []byte{1, 0, 2}) {
+		t.Fatalf("The manifest gave the table %s with the primary key %v and the commands %v", ti.Name(), ti.PrimaryKey(), ti.Commands())
+	}
+	if m.EncryptedTable != `"staff_v2"` || m.Dialect != "postgres" || ti.EncryptedName() != `"staff_v2"` || loaded.Info().EncryptedName() != `"staff_v2"` {
+		t.Errorf("The encrypted table was recorded as %s (%s) in the manifest and %s in the keys", m.EncryptedTable, m.Dialect, loaded.Info().EncryptedName())
+	}
+
+	want := map[int64]map[string]interface{}{
+		7: {"name": "Alice", "grade": int64(30)},
+		8: {"name": "Bob", "grade": int64(45)},
+	}
+	for _, enc := range fdb.table(`"staff_v2"`).rows {
+		r := loaded.R[enc[1]]
+		colKeys := map[string]CPoint{
+			"name":  baseMult(r).multB(loaded.Priv["name"][0]),
+			"grade": baseMult(r).multB(loaded.Priv["grade"][0]),
+		}
+		values, err := DecryptRow(map[string][]byte{"name": enc[0].([]byte), "grade": enc[2].([]byte)}, ti, colKeys)
+		if err != nil {
+			t.Fatalf("Decryption of row %v failed: %s", enc[1], err)
+		}
+		if !reflect.DeepEqual(values, want[enc[1].(int64)]) {
+			t.Errorf("Row %v was decrypted to %v", enc[1], values)
+		}
+		// The manifest requires the version of the cells written, so that a cell stripped of its
+		// header and its tag does not pass for a cell of version 1
+		name := enc[0].([]byte)
+		stripped := name[len(authHeader) : len(name)-authTagLength]
+		if _, err = DecryptRow(map[string][]byte{"name": stripped}, ti, colKeys); !errors.Is(err, ErrCellDowngrade) {
+			t.Errorf("Row %v: expected ErrCellDowngrade for a stripped cell, got %v", enc[1], err)
+		}
+	}
+	// The linear combinations read the cells in the table named by the manifest
+	coeffs := map[coord]*big.Int{NewCoord("grade", int64(7)): Big1, NewCoord("grade", int64(8)): Big1}
+	holderPoints := make([]CPoint, 3)
+	for _, num := range []byte{1, 2} {
+		part, err := loaded.ExtractPart(num)
+		checkErr(err)
+		holderPoints[num-1] = part.GiveKeyCalculation(coeffs)
+	}
+	if sum, err := DecryptLinearCombination(db, ti, coeffs, holderPoints); err != nil || sum.Int64() != 75 {
+		t.Errorf("The sum of the grades is %v (%v), want 75", sum, err)
+	}
+
+	old := m
+	old.Version = 1
+	if ti, err = old.TableInfo(); err != nil || ti.minCellVersion != 0 {
+		t.Errorf("A manifest of version 1 should accept the cells of any version, got %d (%v)", ti.minCellVersion, err)
+	}
+	m.Dialect = "oracle"
+	if _, err = m.TableInfo(); err == nil {
+		t.Errorf("A manifest of an unknown dialect should be refused")
+	}
+	m.Dialect = "postgres"
+	m.Curve = "P-256"
+	if _, err = m.TableInfo(); err == nil {
+		t.Errorf("A manifest on another curve should be refused")
+	}
+	m.Curve, m.Version = myCurve.Params().Name, MANIFEST_VERSION+1
+	if _, err = m.TableInfo(); err == nil {
+		t.Errorf("A manifest of an unknown version should be refused")
+	}
+}
+
+// TestTransferFloat32 copies REAL values given by the drivers in several forms, among which a
+// decimal just below the middle of two float32 that is rounded to the wrong one through a float64
+func TestTransferFloat32(t *testing.T) {
+	// 1 + 3⋅2^-24 is the middle of 1 + 2^-23 and 1 + 2^-22
+	below := "1.000000178813934326171874"
+	f64, _ := strconv.ParseFloat(below, 64)
+	if float32(f64) == float32(1+1.0/(1<<23)) {
+		t.Fatalf("The decimal should be rounded to the wrong float32 through a float64")
+	}
+
+	cases := []struct {
+		val  interface{}
+		want string
+	}{
+		{[]byte(below), "1.0000001"},
+		{below, "1.0000001"},
+		{float32(0.1), "0.1"},
+		{float64(float32(0.1)), "0.1"},
+		{float64(-2.5), "-2.5"},
+		{int64(3), "3"},
+		{nil, "NULL"},
+	}
+	for _, c := range cases {
+		if lit := sqlLiteral(DIALECT_POSTGRES, transferOne(transferFloat32, c.val)); lit != c.want {
+			t.Errorf("The REAL %v (%T) was written as %s instead of %s", c.val, c.val, lit, c.want)
+		}
+	}
+
+	db, fdb := newFakeDB(t)
+	fdb.addTable("measures", []string{"id", "value"}, []string{"BIGINT", "REAL"},
+		[]driver.Value{int64(1), []byte(below)}, []driver.Value{int64(2), float64(float32(0.1))})
+	_, err := EncryptTable(db, db, "measures", []byte{0, 0}, rand.Reader)
+	checkErr(err)
+	// The literals are read back as float64 by the fake database, like a REAL by most drivers
+	rows := fdb.table("measures_encrypted").rows
+	if float32(rows[0][1].(float64)) != float32(1+1.0/(1<<23)) || float32(rows[1][1].(float64)) != float32(0.1) {
+		t.Errorf("The REAL values were copied as %v and %v", rows[0][1], rows[1][1])
+	}
+
+	// A malformed REAL fails the encryption instead of the process
+	fdb.addTable("bad", []string{"id", "value"}, []string{"BIGINT", "REAL"}, []driver.Value{int64(1), "1.2.3"})
+	if _, err = EncryptTable(db, db, "bad", []byte{0, 0}, rand.Reader); err == nil {
+		t.Errorf("A malformed REAL should fail the encryption")
+	}
+}
+
+// TestNegativeScalars multiplies points by negative scalars, which must not lose their sign
+func TestNegativeScalars(t *testing.T) {
+	x, _ := rand.Int(rand.Reader, N)
+	p := baseMult(x)
+	if !p.mult(big.NewInt(-1)).equalC(p.negC()) {
+		t.Errorf("-1⋅p is not -p")
+	}
+	if !baseMult(big.NewInt(-1)).equalC(G.negC()) {
+		t.Errorf("-1⋅g is not -g")
+	}
+	if !G.mult(new(big.Int).Neg(x)).equalC(p.negC()) || !baseMult(new(big.Int).Neg(x)).equalC(p.negC()) {
+		t.Errorf("-x⋅g is not the opposite of x⋅g")
+	}
+}
+
+// TestLagrangeCoefficients rebuilds a key shared 3 of 3 from the points of its holders, whose
+// coefficients 3, -3 and 1 must be taken modulo N
+func TestLagrangeCoefficients(t *testing.T) {
+	want := map[int]*big.Int{1: big.NewInt(3), 2: new(big.Int).Sub(N, big.NewInt(3)), 3: big.NewInt(1)}
+	if coeffs := LagrangeCoefficients([]int{1, 2, 3}); !reflect.DeepEqual(coeffs, want) {
+		t.Errorf("Coefficients %v instead of %v", coeffs, want)
+	}
+	if !G.mult(big.NewInt(-3)).equalC(G.mult(big.NewInt(3)).negC()) {
+		t.Errorf("-3⋅g is not the opposite of 3⋅g")
+	}
+
+	// f(x) = priv0 + a1⋅x + a2⋅x², the holder i receiving f(i)⋅G
+	poly := make([]*big.Int, 3)
+	for k := range poly {
+		poly[k], _ = rand.Int(rand.Reader, N)
+	}
+	keyParts := make(map[int]CPoint)
+	for i := 1; i <= 3; i++ {
+		x := big.NewInt(int64(i))
+		f := new(big.Int).Mul(poly[2], x)
+		f.Add(f, poly[1]).Mul(f, x).Add(f, poly[0]).Mod(f, N)
+		keyParts[i] = baseMult(f)
+	}
+	if !calculateDecryptionKey(keyParts).equalC(baseMult(poly[0])) {
+		t.Errorf("The key rebuilt from the points of the holders is not priv0⋅g")
+	}
+}
+
+// TestCombineColumnKeysFrom gives the points of the three holders of a key shared 2 of 3 and
+// rebuilds it from all of them, from a chosen pair, and from the pair left once a wrong point
+// is given by the holder 2
+func TestCombineColumnKeysFrom(t *testing.T) {
+	pub, priv, _ := SetKeys(rand.Reader)
+	r := big.NewInt(987654321)
+	keys := TableKeys{R: map[interface{}]*big.Int{int64(1): r}, Priv: map[string]PrivateKey{"c": priv}}
+	parts := make(map[int]CPoint)
+	for _, num := range []byte{1, 2, 3} {
+		part, err := keys.ExtractPart(num)
+		checkErr(err)
+		parts[int(num)] = baseMult(r).mult(part.PrivPart["c"])
+	}
+	contributions := map[string]map[int]CPoint{"c": parts}
+
+	s, err := CombineColumnKeys(contributions)
+	if err != nil || VerifyColumnKey(s["c"], r, pub) != nil {
+		t.Errorf("The key rebuilt from the three holders is wrong (%v)", err)
+	}
+	s, err = CombineColumnKeysFrom(contributions, 1, 3)
+	if err != nil || VerifyColumnKey(s["c"], r, pub) != nil {
+		t.Errorf("The key rebuilt from the holders 1 and 3 is wrong (%v)", err)
+	}
+
+	parts[2] = G
+	s, err = CombineColumnKeys(contributions)
+	if err != nil || !errors.Is(VerifyColumnKey(s["c"], r, pub), ErrKeyMismatch) {
+		t.Errorf("The wrong point of the holder 2 should give a wrong key (%v)", err)
+	}
+	s, err = CombineColumnKeysFrom(contributions, 1, 3)
+	if err != nil || VerifyColumnKey(s["c"], r, pub) != nil {
+		t.Errorf("The key rebuilt from the holders 1 and 3 should ignore the holder 2 (%v)", err)
+	}
+
+	for _, holders := range [][]int{{1}, {1, 1}, {1, 4}} {
+		if _, err = CombineColumnKeysFrom(contributions, holders...); err == nil {
+			t.Errorf("The holders %v should be refused", holders)
+		}
+	}
+}
+
+// TestEncryptPrimaryKey encrypts the primary keys of two tables with the same secret, joins them
+// on their encrypted keys, and finds and decrypts a row from its primary key in clear
+func TestEncryptPrimaryKey(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "name"}, []string{"BIGINT", "TEXT"},
+		[]driver.Value{int64(7), "Alice"}, []driver.Value{int64(8), "Bob"})
+	fdb.addTable("bonus", []string{"id", "amount"}, []string{"BIGINT", "INTEGER"},
+		[]driver.Value{int64(8), int64(30)})
+	secret := []byte("secret of the primary keys")
+	opts := EncryptOptions{PrimaryKeySecret: secret}
+	keys, err := EncryptTableWithOptions(db, db, "staff", []byte{0, 1}, rand.Reader, opts)
+	checkErr(err)
+	_, err = EncryptTableWithOptions(db, db, "bonus", []byte{0, 2}, rand.Reader, opts)
+	checkErr(err)
+
+	created := false
+	for _, stmt := range fdb.execs {
+		created = created || strings.Contains(stmt, "CREATE TABLE IF NOT EXISTS staff_encrypted (id TEXT, ")
+	}
+	if !created {
+		t.Errorf("The encrypted primary key should be created as TEXT: %v", fdb.execs)
+	}
+	bonusID := fdb.table("bonus_encrypted").rows[0][0]
+	joined := false
+	for _, row := range fdb.table("staff_encrypted").rows {
+		if !strings.HasPrefix(row[0].(string), PK_PREFIX) {
+			t.Errorf("The primary key %v is not encrypted", row[0])
+		}
+		joined = joined || row[0] == bonusID
+	}
+	if !joined {
+		t.Errorf("The tables cannot be joined on their encrypted primary keys")
+	}
+
+	// The row of id 8 is found and decrypted from its id in clear
+	id := EncryptPrimaryKey(secret, int64(8))
+	if id != bonusID {
+		t.Errorf("The encryption of the primary key is not deterministic")
+	}
+	r, ok := keys.R[id]
+	if !ok {
+		t.Fatalf("The map R is not keyed by the encrypted primary keys")
+	}
+	var cell []byte
+	for _, row := range fdb.table("staff_encrypted").rows {
+		if row[0] == id {
+			cell = row[1].([]byte)
+		}
+	}
+	s := baseMult(r).multB(keys.Priv["name"][0])
+	values, err := DecryptRow(map[string][]byte{"name": cell}, keys.ti, map[string]CPoint{"name": s})
+	if err != nil || values["name"] != "Bob" {
+		t.Errorf("The row of id 8 was decrypted to %v (%v)", values, err)
+	}
+	if v, err := DecryptPrimaryKey(secret, id, "BIGINT"); err != nil || v != int64(8) {
+		t.Errorf("The primary key was decrypted to %v (%v)", v, err)
+	}
+	if _, err = DecryptPrimaryKey([]byte("another secret"), id, "BIGINT"); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("A primary key decrypted with another secret should fail authentication, got %v", err)
+	}
+	if keys.ti.pkSecret != nil {
+		t.Errorf("The secret of the primary keys should not be kept in the table of keys")
+	}
+}
+
+// TestEncryptTablePointRange checks that an integer whose gob encoding would not be found back by the
+// solver of its column is rejected at encryption, unless it has the compact encoding
+func TestEncryptTablePointRange(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("stock", []string{"id", "qty"}, []string{"BIGINT", "INTEGER"}, []driver.Value{int64(1), int64(100)})
+	if len(GetBytes(int64(100))) <= 4 {
+		t.Fatalf("The gob encoding of 100 should take more than 4 bytes")
+	}
+	if _, err := EncryptTable(db, db, "stock", []byte{0, 2}, rand.Reader); !errors.Is(err, ErrPointOutOfRange) {
+		t.Errorf("Expected ErrPointOutOfRange, got %v", err)
+	}
+	keys, err := EncryptTableWithOptions(db, db, "stock", []byte{0, 2}, rand.Reader, EncryptOptions{CompactPoints: true})
+	if err != nil {
+		t.Fatalf("Encryption with the compact encoding failed: %s", err)
+	}
+	cell := fdb.table("stock_encrypted").rows[0][1].([]byte)
+	s := baseMult(keys.R[int64(1)]).multB(keys.Priv["qty"][0])
+	values, err := DecryptRow(map[string][]byte{"qty": cell}, keys.ti, map[string]CPoint{"qty": s})
+	if err != nil || values["qty"] != int64(100) {
+		t.Errorf("The cell was decrypted to %v (%v)", values, err)
+	}
+}
+
+// TestCompactPoints encrypts booleans and small integers as points with their compact encoding
+// and decrypts the booleans with a solver on a single byte
+func TestCompactPoints(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "active", "level"}, []string{"BIGINT", "BOOLEAN", "SMALLINT"},
+		[]driver.Value{int64(1), true, int64(300)},
+		[]driver.Value{int64(2), false, int64(-4)})
+	keys, err := EncryptTableWithOptions(db, db, "staff", []byte{0, 2, 2}, rand.Reader, EncryptOptions{CompactPoints: true})
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+
+	sv, err := NewSolver(context.Background(), 1)
+	checkErr(err)
+	defer sv.Close()
+	want := map[int64][]interface{}{1: {true, int64(300)}, 2: {false, int64(-4)}}
+	for _, row := range fdb.table("staff_encrypted").rows {
+		id := row[0].(int64)
+		r := keys.R[id]
+		active, level := row[1].([]byte), row[2].([]byte)
+		if CellVersion(active, 2) != CELL_COMPACT {
+			t.Errorf("The boolean of the row %d does not have the compact encoding", id)
+		}
+		// The negative integers keep the gob encoding
+		if compact := CellVersion(level, 2) == CELL_COMPACT; compact != (id == 1) {
+			t.Errorf("The integer of the row %d has the compact encoding: %t", id, compact)
+		}
+
+		s := baseMult(r).multB(keys.Priv["active"][0])
+		m, err := decryptPointCell(context.Background(), sv, active, s, "BOOLEAN")
+		if err != nil {
+			t.Fatalf("Decryption of the boolean of the row %d failed: %s", id, err)
+		}
+		if v, err := decodeValue(m, "BOOLEAN"); err != nil || v != want[id][0] {
+			t.Errorf("The boolean of the row %d was decrypted to %v (%v)", id, v, err)
+		}
+
+		colKeys := map[string]CPoint{"active": s, "level": baseMult(r).multB(keys.Priv["level"][0])}
+		values, err := DecryptRow(map[string][]byte{"active": active, "level": level}, keys.ti, colKeys)
+		if err != nil || values["active"] != want[id][0] || values["level"] != want[id][1] {
+			t.Errorf("The row %d was decrypted to %v (%v)", id, values, err)
+		}
+	}
+
+	// The column mixes both encodings, so that its sum is not the sum of the values
+	combine := func(coeffs map[coord]*big.Int) (*big.Int, error) {
+		holderPoints := make([]CPoint, 2)
+		for _, num := range []byte{1, 2} {
+			part, err := keys.ExtractPart(num)
+			checkErr(err)
+			holderPoints[num-1] = part.GiveKeyCalculation(coeffs)
+		}
+		return DecryptLinearCombination(db, keys.Info(), coeffs, holderPoints)
+	}
+	if _, err = combine(map[coord]*big.Int{NewCoord("level", int64(1)): Big1, NewCoord("level", int64(2)): Big1}); !errors.Is(err, ErrNotCompact) {
+		t.Errorf("Expected ErrNotCompact for the mixed column, got %v", err)
+	}
+	if v, err := combine(map[coord]*big.Int{NewCoord("level", int64(1)): Big1}); err != nil || v.Int64() != 300 {
+		t.Errorf("The compact cell alone was decrypted to %v (%v)", v, err)
+	}
+}
+
+// TestRawBytes encrypts and copies a NUMERIC and a BIGINT scanned as raw bytes and checks that
+// their values come back digit for digit
+func TestRawBytes(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("ledger", []string{"id", "amount", "total", "fee", "qty"}, []string{"BIGINT", "NUMERIC(30,6)", "BIGINT", "NUMERIC(30,6)", "INTEGER"},
+		[]driver.Value{int64(1), "12345678901234567890.123450", int64(9007199254740993), "0.000010", int64(12)})
+	keys, err := EncryptTableWithOptions(db, db, "ledger", []byte{0, 1, 1, 0, 2}, rand.Reader, EncryptOptions{RawBytes: true})
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+
+	// The unencrypted columns are copied as their text, converted back by the database
+	row := fdb.table("ledger_encrypted").rows[0]
+	if row[0] != "1" || row[3] != "0.000010" {
+		t.Errorf("The unencrypted cells were copied as %#v and %#v", row[0], row[3])
+	}
+	cells := make(map[string][]byte)
+	colKeys := make(map[string]CPoint)
+	for _, j := range []int{1, 2, 4} {
+		col := keys.ti.colNames[j]
+		cells[col] = row[j].([]byte)
+		colKeys[col] = baseMult(keys.R[int64(1)]).multB(keys.Priv[col][0])
+	}
+	values, err := DecryptRow(cells, keys.ti, colKeys)
+	if err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	if n, ok := values["amount"].(Numeric); !ok || n.String() != "12345678901234567890.123450" {
+		t.Errorf("The NUMERIC was decrypted to %v", values["amount"])
+	}
+	if values["total"] != int64(9007199254740993) || values["qty"] != int64(12) {
+		t.Errorf("The integers were decrypted to %v and %v", values["total"], values["qty"])
+	}
+}
+
+// TestEncryptValue encrypts values with keys generated without database and decrypts them with
+// the private key
+func TestEncryptValue(t *testing.T) {
+	pub, priv, verifiers, err := GenerateColumnKeys(rand.Reader)
+	if err != nil || len(verifiers) != 3 {
+		t.Fatalf("Generation of the keys failed: %v", err)
+	}
+	if _, _, _, err = GenerateColumnKeys(&failingReader{0}); !errors.Is(err, ErrRandomSource) {
+		t.Errorf("Expected ErrRandomSource, got %v", err)
+	}
+
+	cases := []struct {
+		val     interface{}
+		mode    byte
+		colType string
+	}{
+		{"confidential", 1, "TEXT"},
+		{int64(42), 2, "INTEGER"},
+	}
+	for _, c := range cases {
+		r, _ := rand.Int(rand.Reader, N)
+		cell, err := EncryptValue(pub, c.val, c.mode, r)
+		if err != nil {
+			t.Fatalf("Encryption of %v failed: %s", c.val, err)
+		}
+
+		s := baseMult(r).multB(priv[0])
+		var m []byte
+		if c.mode == 1 {
+			m, err = decryptFromHash(cell, s)
+		} else {
+			var p CPoint
+			if p, err = pointFromCell(cell); err == nil {
+				m, err = decryptFromPoint(context.Background(), nil, p, s, c.colType)
+			}
+		}
+		var v interface{}
+		if err == nil {
+			v, err = decodeValue(m, c.colType)
+		}
+		if err != nil || v != c.val {
+			t.Errorf("%v was decrypted to %v (%v)", c.val, v, err)
+		}
+	}
+
+	if _, err = EncryptValue(pub, "value", 0, Big2); err == nil {
+		t.Errorf("Mode 0 should be refused")
+	}
+	if _, err = EncryptValue(pub, "value", 1, Big0); err == nil {
+		t.Errorf("A zero r should be refused")
+	}
+	if _, err = EncryptValue(pub, strings.Repeat("x", 10), 2, Big2); err == nil {
+		t.Errorf("A value too long for a point should be refused")
+	}
+}
+
+// TestMaxMessageLength checks that the messages longer than MaxMessageLength are refused by the
+// encryption and the decryption with the hash function
+func TestMaxMessageLength(t *testing.T) {
+	defer func(max int) { MaxMessageLength = max }(MaxMessageLength)
+	MaxMessageLength = 64
+	pub, priv, _ := SetKeys(rand.Reader)
+
+	cypher, err := pub.encrypt(make([]byte, 64), rand.Reader)
+	if err != nil {
+		t.Fatalf("A message of the maximum length was refused: %s", err)
+	}
+	if _, err = priv.Decrypt(cypher); err != nil {
+		t.Errorf("A cypher of the maximum length was refused: %s", err)
+	}
+	if _, err = pub.encrypt(make([]byte, 65), rand.Reader); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("Expected ErrMessageTooLong from Encrypt, got %v", err)
+	}
+	cypher.Data = make([]byte, 65)
+	if _, err = priv.Decrypt(cypher); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("Expected ErrMessageTooLong from Decrypt, got %v", err)
+	}
+	if _, err = EncryptValue(pub, strings.Repeat("x", 100), 1, Big2); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("Expected ErrMessageTooLong from EncryptValue, got %v", err)
+	}
+
+	db, fdb := newFakeDB(t)
+	fdb.addTable("notes", []string{"id", "body"}, []string{"BIGINT", "TEXT"},
+		[]driver.Value{int64(1), "short"},
+		[]driver.Value{int64(2), strings.Repeat("x", 100)})
+	if _, err = EncryptTable(db, db, "notes", []byte{0, 1}, rand.Reader); err == nil || !strings.Contains(err.Error(), "row 1") {
+		t.Errorf("Expected the encryption of the long row to fail, got %v", err)
+	}
+	if n := len(fdb.table("notes_encrypted").rows); n != 1 {
+		t.Errorf("Expected the row before the long one to be inserted, got %d rows", n)
+	}
+}
+
+// TestInvalidPoints checks that the points off the curve are rejected before being multiplied
+func TestInvalidPoints(t *testing.T) {
+	pub, priv, _ := SetKeys(rand.Reader)
+	cypher, err := pub.Encrypt([]byte("secret"), rand.Reader)
+	checkErr(err)
+	cypher.C = CPoint{cypher.C.x, new(big.Int).Add(cypher.C.y, Big1)}
+	if _, err := priv.Decrypt(cypher); err != ErrInvalidPoint {
+		t.Errorf("Expected the point to be rejected, got %v", err)
+	}
+	if _, err := priv.Decrypt(Cypher{C: CPoint{}, Data: []byte{1}}); err != ErrInvalidPoint {
+		t.Errorf("Expected the empty point to be rejected, got %v", err)
+	}
+
+	off := CPoint{big.NewInt(1), big.NewInt(2)}
+	if _, err := decryptFromPoint(context.Background(), nil, off, G, "INTEGER"); err != ErrInvalidPoint {
+		t.Errorf("Expected the point to be rejected by decryptFromPoint, got %v", err)
+	}
+	if _, err := DecodeFromPoint(off, 8); err != ErrInvalidPoint {
+		t.Errorf("Expected the point to be rejected by DecodeFromPoint, got %v", err)
+	}
+
+	// An abscissa larger than P cannot come from a point of the curve
+	cell := make([]byte, SHORT_POINT_LENGTH)
+	for k := range cell[1:] {
+		cell[1+k] = 0xff
+	}
+	if _, err := pointFromCell(cell); err == nil {
+		t.Errorf("Expected the cell to be rejected")
+	}
+}
+
+// TestTransferText copies text columns containing quotes, unicode and trailing spaces
+func TestTransferText(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	rows := [][]driver.Value{
+		{int64(1), "it's the 'end'", "ab    ", "l'été "},
+		{int64(2), "日本語  ", "''''''", "tab\there"},
+		{int64(3), "", "x     ", nil},
+	}
+	fdb.addTable("notes", []string{"id", "body", "code", "label"},
+		[]string{"BIGINT", "TEXT", "CHARACTER(6)", "CHARACTER VARYING(20)"}, rows...)
+
+	if _, err := EncryptTable(db, db, "notes", []byte{0, 0, 0, 0}, rand.Reader); err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	dest := fdb.table("notes_encrypted")
+	if !reflect.DeepEqual(dest.rows, rows) {
+		t.Errorf("Rows copied %q, want %q", dest.rows, rows)
+	}
+	if want := []string{"BIGINT", "TEXT", "CHARACTER(6)", "CHARACTER VARYING(20)"}; !reflect.DeepEqual(dest.types, want) {
+		t.Errorf("Types of the copy %q, want %q", dest.types, want)
+	}
+	// A value of another type, such as an integer of a column of SQLite with the TEXT affinity, is
+	// an error instead of a panic
+	if _, isErr := transferOne(transferString, int64(12)).(error); !isErr {
+		t.Errorf("An integer should not be copied as a text value")
+	}
+}
+
+// failingReader returns an error after n bytes
+type failingReader struct {
+	n int
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if fr.n <= 0 {
+		return 0, errors.New("device unplugged")
+	}
+	if len(p) > fr.n {
+		p = p[:fr.n]
+	}
+	fr.n -= len(p)
+	return len(p), nil
+}
+
+// TestRandomSource checks that the broken random sources are reported with ErrRandomSource
+func TestRandomSource(t *testing.T) {
+	for name, random := range map[string]io.Reader{
+		"failing":   &failingReader{0},
+		"short":     &failingReader{40},
+		"zeros":     bytes.NewReader(make([]byte, 1024)),
+		"repeating": bytes.NewReader(bytes.Repeat([]byte("0123456789abcdef0123456789abcdef"), 4)),
+	} {
+		if _, _, err := CreateKeys(random); !errors.Is(err, ErrRandomSource) {
+			t.Errorf("%s source: expected ErrRandomSource, got %v", name, err)
+		}
+	}
+
+	// The source passes the health test but fails while the key is generated
+	if _, _, err := CreateKeys(io.MultiReader(io.LimitReader(rand.Reader, 64), &failingReader{0})); !errors.Is(err, ErrRandomSource) {
+		t.Errorf("Expected ErrRandomSource after the health test, got %v", err)
+	}
+	pub, _, _ := SetKeys(rand.Reader)
+	if _, _, err := pub.EncryptColumn([]interface{}{int64(1)}, 1, &failingReader{0}); !errors.Is(err, ErrRandomSource) {
+		t.Errorf("Expected ErrRandomSource from EncryptColumn, got %v", err)
+	}
+	if _, _, err := CreateKeys(rand.Reader); err != nil {
+		t.Errorf("Key generation failed with crypto/rand: %s", err)
+	}
+}
+
+// TestRandScalar checks that the random scalars are never zero, that a zero drawn is drawn again
+// instead of being replaced by 2, at most MAX_ZERO_DRAWS-1 times, and that each value below a small
+// order comes from a single draw. The draws are scripted, so that the test is deterministic.
+func TestRandScalar(t *testing.T) {
+	// scripted returns a source giving the scalars of draws in this order, each on the bytes that
+	// rand.Int reads for the bound n
+	scripted := func(n *big.Int, draws ...int64) io.Reader {
+		var b []byte
+		for _, v := range draws {
+			b = append(b, big.NewInt(v).FillBytes(make([]byte, (n.BitLen()+7)/8))...)
+		}
+		return bytes.NewReader(b)
+	}
+	zeros := make([]int64, MAX_ZERO_DRAWS)
+
+	// MAX_ZERO_DRAWS-1 zeros are drawn again, the next value being returned as it is
+	r, err := randScalar(scripted(N, append(zeros[1:], 7)...))
+	if err != nil || r.Int64() != 7 {
+		t.Errorf("%d zeros then 7 gave %v (%v)", MAX_ZERO_DRAWS-1, r, err)
+	}
+	if _, err = randScalar(scripted(N, append(zeros, 7)...)); !errors.Is(err, ErrRandomSource) {
+		t.Errorf("Expected ErrRandomSource after %d zeros, got %v", MAX_ZERO_DRAWS, err)
+	}
+	pub, _, _ := SetKeys(rand.Reader)
+	if _, err = pub.EncryptPoint([]byte{1}, bytes.NewReader(make([]byte, 1024))); !errors.Is(err, ErrRandomSource) {
+		t.Errorf("Expected ErrRandomSource from EncryptPoint, got %v", err)
+	}
+
+	// Each value between 1 and n-1 comes from a single draw, while a zero is drawn again instead
+	// of being replaced by a fixed value, which would then be twice as likely as the others
+	five := big.NewInt(5)
+	for v := int64(1); v < 5; v++ {
+		if r, err := randScalarBelow(scripted(five, v), five); err != nil || r.Int64() != v {
+			t.Errorf("The draw %d gave %v (%v)", v, r, err)
+		}
+		if r, err := randScalarBelow(scripted(five, 0, 0, v), five); err != nil || r.Int64() != v {
+			t.Errorf("Two zeros then %d gave %v (%v)", v, r, err)
+		}
+	}
+}
+
+// TestDecryptPoint encrypts a float as a point and decrypts it with DecryptPoint
+func TestDecryptPoint(t *testing.T) {
+	a := mr.Float32() * 100
+	pub, priv, _ := SetKeys(rand.Reader)
+	cypher, err := pub.EncryptPoint(BytesFromFloat32(a), rand.Reader)
+	checkErr(err)
+
+	m, err := priv.DecryptPoint(cypher, 32)
+	if err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	if got := Float32frombytes(m.FillBytes(make([]byte, 4))); got != a {
+		t.Errorf("Decrypted %f, want %f", got, a)
+	}
+
+	// With another private key the message is not found in the range
+	_, other, _ := SetKeys(rand.Reader)
+	if _, err = other.DecryptPoint(cypher, 16); err != ErrPointOutOfRange {
+		t.Errorf("Expected the point to be out of range, got %v", err)
+	}
+	cypher.C = CPoint{big.NewInt(1), big.NewInt(1)}
+	if _, err = priv.DecryptPoint(cypher, 32); err != ErrInvalidPoint {
+		t.Errorf("Expected the point to be rejected, got %v", err)
+	}
+}
+
+// TestPublicKeyJSON publishes the public keys of a table as JSON and encrypts with the keys read back
+func TestPublicKeyJSON(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "name", "salary"}, []string{"BIGINT", "TEXT", "INTEGER"},
+		[]driver.Value{int64(1), "ann", int64(30)})
+	ti, err := tableInfoFromDB(db, "staff", 0, 1, 2)
+	checkErr(err)
+	pubs, keys, _, err := SetTableKeys(db, ti, rand.Reader)
+	checkErr(err)
+
+	data, err := json.Marshal(pubs)
+	if err != nil {
+		t.Fatalf("Marshaling failed: %s", err)
+	}
+	var read map[string]PublicKey
+	if err = json.Unmarshal(data, &read); err != nil {
+		t.Fatalf("Unmarshaling failed: %s", err)
+	}
+	if len(read) != 2 {
+		t.Fatalf("%d keys read instead of 2", len(read))
+	}
+	for col, pub := range read {
+		if !pub.Y.Equal(pubs[col].Y) {
+			t.Errorf("The key of column %s changed", col)
+		}
+		cypher, err := pub.Encrypt([]byte("hello"), rand.Reader)
+		checkErr(err)
+		priv := keys.Priv[col]
+		if m, err := priv.Decrypt(cypher); err != nil || string(m) != "hello" {
+			t.Errorf("Decryption with the key of column %s read back gave %q (%v)", col, m, err)
+		}
+	}
+
+	var pub PublicKey
+	if err = json.Unmarshal([]byte(`{"curve":"P-256","y":"02"}`), &pub); err == nil {
+		t.Errorf("A key on another curve should be refused")
+	}
+	if err = json.Unmarshal([]byte(`{"curve":"P-224","y":"02ffffffffffffffffffffffffffffffffffffffffffffffffffffffff"}`), &pub); err != ErrInvalidPoint {
+		t.Errorf("A point off the curve should be refused, got %v", err)
+	}
+}
+
+// TestShortOfBounds checks the abscissas at the limits of the short form
+func TestShortOfBounds(t *testing.T) {
+	max := new(big.Int).Sub(P, Big1)
+	sp, err := GetShortOf(CPoint{max, Big1})
+	if err != nil || !bytes.Equal(sp[1:], max.FillBytes(make([]byte, SHORT_POINT_LENGTH-1))) {
+		t.Errorf("The abscissa p-1 gave % x (%v)", sp, err)
+	}
+	for _, x := range []*big.Int{P, new(big.Int).Lsh(Big1, 8*SHORT_POINT_LENGTH), big.NewInt(-1)} {
+		if _, err = GetShortOf(CPoint{x, Big1}); err == nil {
+			t.Errorf("The abscissa %x should be refused", x)
+		}
+	}
+}
+
+// TestShortPointParity cross-checks the short form with the parity of the ordinate against the
+// compressed form of elliptic, and reads the points of each form whatever the setting
+func TestShortPointParity(t *testing.T) {
+	ShortPointParity = true
+	defer func() { ShortPointParity = false }()
+	for i := 0; i < 20; i++ {
+		k, _ := rand.Int(rand.Reader, N)
+		pt := baseMult(k)
+		sp, err := GetShortOf(pt)
+		checkErr(err)
+		compressed := elliptic.MarshalCompressed(myCurve, pt.x, pt.y)
+		if !bytes.Equal(compressed, sp[:]) {
+			t.Fatalf("The short form % x does not match the compressed form % x", sp, compressed)
+		}
+		if err = checkShortPoint(pt, sp); err != nil {
+			t.Fatalf("The short form % x was refused: %v", sp, err)
+		}
+
+		x, y := elliptic.UnmarshalCompressed(myCurve, compressed)
+		if p := PointFromShort(sp); !p.Equal(CPoint{x, y}) || !p.Equal(pt) {
+			t.Fatalf("The short form % x gave %s instead of %s", sp, p, pt)
+		}
+		if shortOf(pt)[0] > 1 {
+			t.Fatalf("The short form of the tables should not depend on ShortPointParity")
+		}
+	}
+
+	// A cypher written with one setting is decrypted with the other one
+	pub, priv, _ := SetKeys(rand.Reader)
+	cypher, err := pub.EncryptPoint([]byte{0x12, 0x34}, rand.Reader)
+	checkErr(err)
+	ShortPointParity = false
+	if m, err := priv.DecryptPoint(cypher, 16); err != nil || m.Int64() != 0x1234 {
+		t.Errorf("Decrypted %v (%v) instead of 0x1234", m, err)
+	}
+	sp := cypher.Data
+	sp[0] = SHORT_PARITY + 2
+	if _, err = pointFromShortBytes(sp[:]); !errors.Is(err, ErrInvalidPoint) {
+		t.Errorf("The first byte %d should be refused, got %v", sp[0], err)
+	}
+}
+
+// TestShortPointCompare sorts short forms with Compare and checks the order of their bytes
+func TestShortPointCompare(t *testing.T) {
+	sps := make([]ShortPoint, 50)
+	for i := range sps {
+		k, _ := rand.Int(rand.Reader, N)
+		sps[i] = shortOf(baseMult(k))
+	}
+	// Two points of the same abscissa only differ by their first byte
+	sps = append(sps, shortOf(baseMult(Big2).negC()), shortOf(baseMult(Big2)))
+	sort.Slice(sps, func(a, b int) bool { return sps[a].Compare(sps[b]) < 0 })
+	for i := 1; i < len(sps); i++ {
+		if bytes.Compare(sps[i-1].Bytes(), sps[i].Bytes()) > 0 {
+			t.Fatalf("% x is sorted before % x", sps[i-1], sps[i])
+		}
+	}
+
+	k := sort.Search(len(sps), func(i int) bool { return sps[i].Compare(sps[17]) >= 0 })
+	if sps[k] != sps[17] || sps[17].Compare(sps[17]) != 0 {
+		t.Errorf("The short form at 17 was found at %d", k)
+	}
+	b := sps[0].Bytes()
+	b[0] ^= 0xff
+	if b[0] == sps[0][0] {
+		t.Errorf("Bytes does not return a copy of the short form")
+	}
+}
+
+// TestSolver solves several discrete logarithms with the same solver and closes it
+func TestSolver(t *testing.T) {
+	sv, err := NewSolver(context.Background(), 4)
+	if err != nil {
+		t.Fatalf("Creation of the solver failed: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		x, _ := rand.Int(rand.Reader, new(big.Int).Lsh(Big1, 32))
+		pow, err := sv.DiscreteLog(context.Background(), baseMult(x))
+		if err != nil || pow.Cmp(x) != 0 {
+			t.Errorf("The solver gave %v instead of %v (%v)", pow, x, err)
+		}
+	}
+
+	pub, priv, _ := SetKeys(rand.Reader)
+	cypher, err := pub.EncryptPoint([]byte{1, 2, 3}, rand.Reader)
+	checkErr(err)
+	s := cypher.C.multB(priv[0])
+	m, err := decryptFromPoint(context.Background(), sv, PointFromShort(cypher.Data), s, "INTEGER")
+	if err != nil || !bytes.Equal(m, []byte{1, 2, 3}) {
+		t.Errorf("INTEGER point decrypted to % x (%v)", m, err)
+	}
+	if _, err = decryptFromPoint(context.Background(), sv, PointFromShort(cypher.Data), s, "BIGINT"); err == nil {
+		t.Errorf("A BIGINT point should not be decrypted")
+	}
+
+	if err = sv.Close(); err != nil {
+		t.Errorf("Closing the solver failed: %s", err)
+	}
+	if _, err = sv.DiscreteLog(context.Background(), G); err != ErrSolverClosed {
+		t.Errorf("Expected ErrSolverClosed from a closed solver, got %v", err)
+	}
+}
+
+// TestSolverCloseConcurrent closes a solver while several routines solve logarithms with it, which
+// the race detector checks with go test -race: each logarithm is either found or ErrSolverClosed
+func TestSolverCloseConcurrent(t *testing.T) {
+	sv, err := NewSolver(context.Background(), 2)
+	checkErr(err)
+	var wg sync.WaitGroup
+	var solved int32
+	errs := make(chan error, MAX_ROUTINES)
+	for k := 0; k < MAX_ROUTINES; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The routines go on a little once the solver is closed, as each call reads its state
+			closedCalls := 0
+			for x := int64(1); closedCalls < 10; x = x*7%65521 + 1 {
+				pow, err := sv.DiscreteLog(context.Background(), baseMult(big.NewInt(x)))
+				if err == ErrSolverClosed {
+					closedCalls++
+					continue
+				}
+				if err != nil || pow.Int64() != x {
+					errs <- fmt.Errorf("the solver gave %v instead of %d (%v)", pow, x, err)
+					return
+				}
+				atomic.AddInt32(&solved, 1)
+			}
+		}()
+	}
+	for atomic.LoadInt32(&solved) < 20 {
+		time.Sleep(time.Millisecond)
+	}
+	checkErr(sv.Close())
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestIdentityOperations checks the operators on points with the point at infinity
+func TestIdentityOperations(t *testing.T) {
+	a := baseMult(big.NewInt(11))
+	if s := addC(G, G.negC()); !s.IsIdentity() || !s.Equal(Identity) {
+		t.Errorf("G + (-G) gave %s instead of the identity", s)
+	}
+	for _, id := range []CPoint{Identity, {}} {
+		if s := addC(id, a); !s.Equal(a) {
+			t.Errorf("identity + a gave %s instead of %s", s, a)
+		}
+		if s := addC(a, id); !s.Equal(a) {
+			t.Errorf("a + identity gave %s instead of %s", s, a)
+		}
+		if s := id.doubleC(); !s.Equal(Identity) || s.x == nil {
+			t.Errorf("2⋅identity gave %s", s)
+		}
+		if s := id.mult(big.NewInt(5)); !s.Equal(Identity) {
+			t.Errorf("5⋅identity gave %s", s)
+		}
+		if s := id.negC(); !s.Equal(Identity) {
+			t.Errorf("-identity gave %s", s)
+		}
+	}
+	if s := a.subC(a); !s.IsIdentity() {
+		t.Errorf("a - a gave %s", s)
+	}
+	if s := addC(a, a); !s.Equal(a.doubleC()) || !s.Equal(baseMult(big.NewInt(22))) {
+		t.Errorf("a + a gave %s", s)
+	}
+}
+
+// TestDataPoint adds G to the data point of a cypher through DataPoint and SetDataPoint and
+// checks the value is incremented, then that points off the curve are refused
+func TestDataPoint(t *testing.T) {
+	pub, priv, _ := SetKeys(rand.Reader)
+	c, err := pub.EncryptPoint([]byte{0x02, 0x9a}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption as a point failed: %s", err)
+	}
+	p, err := c.DataPoint()
+	if err != nil {
+		t.Fatalf("Reading the data point failed: %s", err)
+	}
+	if err = c.SetDataPoint(addC(p, G)); err != nil {
+		t.Fatalf("Writing the data point failed: %s", err)
+	}
+	if v, err := priv.DecryptPoint(c, 16); err != nil || v.Int64() != 667 {
+		t.Errorf("The modified cypher was decrypted to %v (%v) instead of 667", v, err)
+	}
+	if q, err := c.DataPoint(); err != nil || !q.Equal(addC(p, G)) {
+		t.Errorf("The data point read back is %s (%v)", q, err)
+	}
+
+	data := c.Data
+	for _, q := range []CPoint{Identity, {new(big.Int).Set(G.x), big.NewInt(1)}} {
+		if err = c.SetDataPoint(q); err != ErrInvalidPoint || c.Data != data {
+			t.Errorf("Writing %s gave %v and changed the data: %v", q, err, c.Data != data)
+		}
+	}
+	for i := 1; i < SHORT_POINT_LENGTH; i++ {
+		c.Data[i] = 0xff
+	}
+	if q, err := c.DataPoint(); err == nil {
+		t.Errorf("An abscissa out of the field was read as the point %s", q)
+	}
+}
+
+// TestCheckShortPoint checks that the short forms of points round-trip, and that a short form
+// whose abscissa is truncated or whose sign is wrong is refused
+func TestCheckShortPoint(t *testing.T) {
+	for k := 0; k < 50; k++ {
+		a, _ := rand.Int(rand.Reader, N)
+		p := baseMult(a)
+		sp, err := checkedShortOf(p)
+		if err != nil {
+			t.Fatalf("The short form of %s was refused: %s", p, err)
+		}
+		if q := PointFromShort(sp); !q.Equal(p) {
+			t.Fatalf("The short form of %s gives %s", p, q)
+		}
+		if p.x.BitLen() <= 8*(SHORT_POINT_LENGTH-2) {
+			continue
+		}
+		// The leading byte of the abscissa is lost, as by an encoding on fewer bytes
+		truncated := sp
+		truncated[1] = 0
+		if err = checkShortPoint(p, truncated); err == nil {
+			t.Errorf("The truncated short form of %s was accepted", p)
+		}
+		flipped := sp
+		flipped[0] ^= 1
+		if err = checkShortPoint(p, flipped); err == nil {
+			t.Errorf("The short form of %s with the wrong sign was accepted", p)
+		}
+	}
+	if _, err := checkedShortOf(Identity); err == nil {
+		t.Errorf("The point at infinity has no short form")
+	}
+}
+
+// TestLoadCommands reads commands given by column names and checks their positions
+func TestLoadCommands(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("users", []string{"id", "name", "age", "city"}, []string{"BIGINT", "TEXT", "INTEGER", "TEXT"})
+	fdb.addTable("orders", []string{"num", "amount"}, []string{"BIGINT", "TEXT"})
+
+	name := t.TempDir() + "/commands.json"
+	checkErr(os.WriteFile(name, []byte(`{"users": {"city": 1, "age": 2}, "orders": {"amount": 1}}`), 0600))
+	commands, err := LoadCommands(name, db)
+	if err != nil {
+		t.Fatalf("Loading the commands failed: %s", err)
+	}
+	want := map[string][]byte{"users": {0, 0, 2, 1}, "orders": {0, 1}}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("Got the commands %v instead of %v", commands, want)
+	}
+
+	for _, config := range []string{`{"users": {"salary": 1}}`, `{"users": {"name": 3}}`, `{"users": [1, 2]}`} {
+		checkErr(os.WriteFile(name, []byte(config), 0600))
+		if _, err = LoadCommands(name, db); err == nil {
+			t.Errorf("The commands %s should be refused", config)
+		}
+	}
+	checkErr(os.WriteFile(name, []byte(`{"users": {"age": 2}, "ghosts": {"name": 1}}`), 0600))
+	if _, err = LoadCommands(name, db); err == nil || !strings.Contains(err.Error(), "ghosts") {
+		t.Errorf("The missing table should be named in the error, got %v", err)
+	}
+}
+
+// TestDecryptRow decrypts a row whose columns are encrypted with the hash function and as points
+func TestDecryptRow(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "name", "grade", "active", "bonus"}, []string{"BIGINT", "TEXT", "INTEGER", "BOOLEAN", "SMALLINT"},
+		[]driver.Value{int64(7), "Alice", int64(30), true, int64(5)})
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 1, 2, 2, 2}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+
+	r := keys.R[int64(7)]
+	enc := fdb.table("staff_encrypted").rows[0]
+	row := make(map[string][]byte)
+	colKeys := make(map[string]CPoint)
+	for j, col := range []string{"name", "grade", "active", "bonus"} {
+		row[col] = enc[j+1].([]byte)
+		colKeys[col] = baseMult(r).multB(keys.Priv[col][0])
+	}
+	values, err := DecryptRow(row, keys.ti, colKeys)
+	if err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	want := map[string]interface{}{"name": "Alice", "grade": int64(30), "active": true, "bonus": int64(5)}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("The row was decrypted to %v instead of %v", values, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = DecryptRowContext(ctx, row, keys.ti, colKeys); !errors.Is(err, context.Canceled) {
+		t.Errorf("A cancelled context should stop the decryption, got %v", err)
+	}
+
+	row["id"] = []byte{7}
+	if _, err = DecryptRow(row, keys.ti, colKeys); err == nil {
+		t.Errorf("An unencrypted column should be refused")
+	}
+}
+
+// TestDecryptRowOrdered encrypts a full row and decrypts it back into its values in the order of
+// the columns
+func TestDecryptRowOrdered(t *testing.T) {
+	db, fdb := newFakeDB(t)
+	fdb.addTable("staff", []string{"id", "name", "grade", "active", "rate", "note"}, []string{"BIGINT", "TEXT", "INTEGER", "BOOLEAN", "DOUBLE PRECISION", "TEXT"},
+		[]driver.Value{int64(7), "Alice", int64(30), true, 1.5, "part time"})
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 1, 2, 2, 0, 1}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+
+	r := keys.R[int64(7)]
+	colKeys := make(map[string]CPoint)
+	for _, col := range []string{"name", "grade", "active", "note"} {
+		colKeys[col] = baseMult(r).multB(keys.Priv[col][0])
+	}
+	cells := [][]byte{[]byte("7"), nil, nil, nil, []byte("1.5"), nil}
+	for j, v := range fdb.table("staff_encrypted").rows[0] {
+		if b, ok := v.([]byte); ok && keys.ti.commands[j] != 0 {
+			cells[j] = b
+		}
+	}
+	values, err := DecryptRowOrdered(cells, keys.ti, colKeys)
+	if err != nil {
+		t.Fatalf("Decryption failed: %s", err)
+	}
+	want := []interface{}{int64(7), "Alice", int64(30), true, 1.5, "part time"}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("The row was decrypted to %v instead of %v", values, want)
+	}
+	cells[4] = nil
+	if values, err = DecryptRowOrdered(cells, keys.ti, colKeys); err != nil || values[4] != nil {
+		t.Errorf("A NULL cell should give nil, got %v (%v)", values, err)
+	}
+
+	if _, err = DecryptRowOrdered(cells[:3], keys.ti, colKeys); err == nil {
+		t.Errorf("A row missing cells should be refused")
+	}
+	delete(colKeys, "grade")
+	if _, err = DecryptRowOrdered(cells, keys.ti, colKeys); err == nil {
+		t.Errorf("A row without the key of an encrypted column should be refused")
+	}
+}
+
+// TestSQLite encrypts a table of an SQLite database in memory and decrypts its rows
+func TestSQLite(t *testing.T) {
+	// The connections share the same database in memory
+	db, err := sql.Open("sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared")
+	checkErr(err)
+	defer db.Close()
+	for _, stmt := range []string{
+		"CREATE TABLE staff (id INTEGER, name VARCHAR(20), salary INTEGER, active BOOLEAN);",
+		"INSERT INTO staff VALUES (1, 'Alice', 30, TRUE), (2, 'Bob', 45, FALSE);",
+	} {
+		_, err = db.Exec(stmt)
+		checkErr(err)
+	}
+
+	keys, err := EncryptTable(db, db, "staff", []byte{0, 1, 2, 2}, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	if want := []string{"INTEGER", "VARCHAR(20)", "INTEGER", "BOOLEAN"}; !reflect.DeepEqual(keys.ti.colTypes, want) {
+		t.Errorf("Read the types %v instead of %v", keys.ti.colTypes, want)
+	}
+
+	rows, err := db.Query("SELECT id, name, salary, active FROM staff_encrypted;")
+	checkErr(err)
+	defer rows.Close()
+	want := map[int64]map[string]interface{}{
+		1: {"name": "Alice", "salary": int64(30), "active": true},
+		2: {"name": "Bob", "salary": int64(45), "active": false},
+	}
+	n := 0
+	for ; rows.Next(); n++ {
+		var id int64
+		var name, salary, active []byte
+		checkErr(rows.Scan(&id, &name, &salary, &active))
+		row := map[string][]byte{"name": name, "salary": salary, "active": active}
+		colKeys := make(map[string]CPoint)
+		for col := range row {
+			colKeys[col] = baseMult(keys.R[id]).multB(keys.Priv[col][0])
+		}
+		values, err := DecryptRow(row, keys.ti, colKeys)
+		if err != nil || !reflect.DeepEqual(values, want[id]) {
+			t.Errorf("Row %d decrypted to %v (%v)", id, values, err)
+		}
+	}
+	if n != 2 {
+		t.Errorf("%d rows encrypted instead of 2", n)
+	}
+}
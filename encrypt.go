@@ -3,16 +3,21 @@ package elgamalcrypto
 import (
 	"bytes"
 	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
-	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"math/big"
+	"os"
 	"strconv"
 	"strings"
-
-	"github.com/codahale/sss"
+	"time"
 )
 
 /*
@@ -34,16 +39,95 @@ type rowToEncrypt struct {
  *
  *********************************************************************************************************/
 
+// checkedReader wraps a random source so that its failures are reported with ErrRandomSource
+type checkedReader struct {
+	r io.Reader
+}
+
+func (cr checkedReader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(cr.r, p)
+	if err != nil {
+		return n, fmt.Errorf("%w: %v", ErrRandomSource, err)
+	}
+	return n, nil
+}
+
+// CheckRandom runs a health test on a random source: two blocks of 32 bytes are read, which must
+// be read entirely, must not be made of a repeated byte and must differ. It only detects the
+// sources that are obviously broken, like a reader failing or returning zeros, and cannot tell
+// whether the output of the source is actually unpredictable.
+func CheckRandom(random io.Reader) error {
+	var blocks [2][32]byte
+	for k := range blocks {
+		if _, err := io.ReadFull(random, blocks[k][:]); err != nil {
+			return fmt.Errorf("%w: %v", ErrRandomSource, err)
+		}
+		if bytes.Count(blocks[k][:], blocks[k][:1]) == len(blocks[k]) {
+			return fmt.Errorf("%w: it returned %d times the byte %#x", ErrRandomSource, len(blocks[k]), blocks[k][0])
+		}
+	}
+	if blocks[0] == blocks[1] {
+		return fmt.Errorf("%w: it returned the same block twice", ErrRandomSource)
+	}
+	return nil
+}
+
+// checkedRandom runs the health test on a random source and returns it wrapped in a checkedReader
+func checkedRandom(random io.Reader) (io.Reader, error) {
+	if err := CheckRandom(random); err != nil {
+		return nil, err
+	}
+	return checkedReader{random}, nil
+}
+
+// Number of zeros drawn in a row after which randScalarBelow reports a broken random source
+const MAX_ZERO_DRAWS = 8
+
+// randScalar returns a random r uniformly distributed between 1 and N-1, to be used as the
+// ephemeral key of an encryption or as a private key
+func randScalar(random io.Reader) (*big.Int, error) {
+	return randScalarBelow(random, N)
+}
+
+// randScalarBelow is randScalar for the order n of another curve. The zeros are rejected and
+// drawn again, instead of being replaced by a fixed value which would be twice as likely as the
+// others. A zero has a probability 1/n, so that MAX_ZERO_DRAWS of them in a row can only come
+// from a broken source, and an error wrapping ErrRandomSource is returned.
+func randScalarBelow(random io.Reader, n *big.Int) (*big.Int, error) {
+	for k := 0; k < MAX_ZERO_DRAWS; k++ {
+		r, err := rand.Int(random, n)
+		if err != nil {
+			return nil, err
+		}
+		if r.Sign() != 0 {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: it gave %d times a zero scalar", ErrRandomSource, MAX_ZERO_DRAWS)
+}
+
 // CreateKeys generates a key pair using the corresponding function of the elliptic library
+// An error wrapping ErrRandomSource is returned if random fails the health test of CheckRandom
+// or cannot be read.
 func CreateKeys(random io.Reader) (pub PublicKey, priv0 []byte, err error) {
+	return CreateKeysOn(myCurve, random)
+}
+
+// CreateKeysOn is CreateKeys on the given curve instead of the curve of the package. The keys
+// on another curve can only be used by the functions taking the curve from the public key, such as
+// the encryption with hash function, and by DecryptOn.
+func CreateKeysOn(curve elliptic.Curve, random io.Reader) (pub PublicKey, priv0 []byte, err error) {
+	if random, err = checkedRandom(random); err != nil {
+		return
+	}
 	var x, y *big.Int
-	priv0, x, y, err = elliptic.GenerateKey(myCurve, random)
+	priv0, x, y, err = elliptic.GenerateKey(curve, random)
 	if err != nil {
 		return
 	}
 
 	pub = PublicKey{
-		Curve: myCurve,
+		Curve: curve,
 		Y:     CPoint{x, y},
 	}
 	return
@@ -51,58 +135,83 @@ func CreateKeys(random io.Reader) (pub PublicKey, priv0 []byte, err error) {
 
 // SetKeys generates a key pair used by the ElGamal algorithm
 func SetKeys(random io.Reader) (pub PublicKey, priv PrivateKey, verifiers map[byte]CPoint) {
+	return setKeys(random, baseMultB)
+}
+
+// GenerateColumnKeys is SetKeys returning an error instead of panicking, which generates the keys
+// of a single column without database, see EncryptValue
+func GenerateColumnKeys(random io.Reader) (pub PublicKey, priv PrivateKey, verifiers map[byte]CPoint, err error) {
+	return generateKeys(random, baseMultB)
+}
 
-	pub, priv0, err := CreateKeys(random)
+// SetKeysOn is SetKeys on the given curve instead of the curve of the package, see CreateKeysOn.
+// The verifiers are computed on this curve.
+func SetKeysOn(curve elliptic.Curve, random io.Reader) (pub PublicKey, priv PrivateKey, verifiers map[byte]CPoint) {
+	pub, priv, verifiers, err := generateKeysOn(curve, random, func(a []byte) (r CPoint) {
+		r.x, r.y = curve.ScalarBaseMult(a)
+		return
+	})
 	checkErr(err)
+	return
+}
 
-	keyParts, err := sss.Split(3, 2, priv0)
+// setKeys is SetKeys with the function used to compute the verifiers as s_k⋅g
+func setKeys(random io.Reader, mult func([]byte) CPoint) (pub PublicKey, priv PrivateKey, verifiers map[byte]CPoint) {
+	pub, priv, verifiers, err := generateKeys(random, mult)
 	checkErr(err)
+	return
+}
+
+// generateKeys is setKeys returning an error
+func generateKeys(random io.Reader, mult func([]byte) CPoint) (pub PublicKey, priv PrivateKey, verifiers map[byte]CPoint, err error) {
+	return generateKeysOn(myCurve, random, mult)
+}
+
+// generateKeysOn is generateKeys on the given curve, mult computing the multiples of its base point
+func generateKeysOn(curve elliptic.Curve, random io.Reader, mult func([]byte) CPoint) (pub PublicKey, priv PrivateKey, verifiers map[byte]CPoint, err error) {
+	pub, priv0, err := CreateKeysOn(curve, random)
+	if err != nil {
+		return
+	}
+
+	// The shares are taken modulo the order of the curve, like those of ShareKeys, so that the key
+	// points of the holders are combined by Lagrange interpolation, see CombineColumnKeys. The
+	// random source passed the health test in CreateKeysOn.
+	keyParts, err := shareScalar(new(big.Int).SetBytes(priv0), curve.Params().N, KEY_THRESHOLD, 3, checkedReader{random})
+	if err != nil {
+		return
+	}
 	priv = [4][]byte{priv0, keyParts[1], keyParts[2], keyParts[3]}
 
 	verifiers = make(map[byte]CPoint)
 	for i, si := range keyParts {
-		verifiers[i] = baseMultB(si)
+		verifiers[i] = mult(si)
 	}
 	return
 }
 
-// SetTableKeys generates all the keys to encrypt a table of known dimensions
-// The variable returned RforEnc is made especially to allow the encryption process which is simpler
-// if the rows are indexed by their number rather than by their primary key.
-func SetTableKeys(db *sql.DB, ti TableInfo, random io.Reader) (pubs map[string]PublicKey, keys TableKeys, RforEnc []*big.Int) {
-	keys.ti = ti
-	var r *big.Int
-	var val interface{}
-	var err error
-	RforEnc = make([]*big.Int, ti.nRows)
-	primColumn, err := db.Query(fmt.Sprintf("SELECT %s FROM %s;", ti.colNames[PRIM_COL_NUMBER], ti.name))
-	checkErr(err)
-	keys.R = make(map[interface{}]*big.Int)
-	for i := uint64(0); i < ti.nRows; i++ {
-		primColumn.Next()
-		err = primColumn.Scan(&val)
-		checkErr(err)
-
-		r, err = rand.Int(random, N)
-		checkErr(err)
-
-		if r.Cmp(Big0) == 0 {
-			r = Big2
+// shareScalar shares the scalar s between holders key holders, any threshold of them being needed
+// to rebuild it: the share of index k, from 1 to holders, is the value at k modulo n of a random
+// polynomial of degree threshold-1 whose value at 0 is s.
+func shareScalar(s, n *big.Int, threshold, holders byte, random io.Reader) (map[byte][]byte, error) {
+	coeffs := []*big.Int{s}
+	for k := byte(1); k < threshold; k++ {
+		a, err := rand.Int(random, n)
+		if err != nil {
+			return nil, err
 		}
-		RforEnc[i] = r
-		keys.R[val] = r
+		coeffs = append(coeffs, a)
 	}
-
-	pubs = make(map[string]PublicKey)
-	keys.Priv = make(map[string]PrivateKey)
-	var colN string
-	for j := uint(0); j < ti.nCol; j++ {
-		if ti.commands[j] != 0 {
-			colN = ti.colNames[j]
-			pubs[colN], keys.Priv[colN], _ = SetKeys(random)
+	shares := make(map[byte][]byte, holders)
+	for num := 1; num <= int(holders); num++ {
+		// Horner's method for the value of the polynomial at num
+		x, v := big.NewInt(int64(num)), new(big.Int)
+		for k := len(coeffs) - 1; k >= 0; k-- {
+			v.Mul(v, x).Add(v, coeffs[k]).Mod(v, n)
 		}
+		shares[byte(num)] = v.Bytes()
 	}
-	return
+	return shares, nil
 }
 
 /*********************************************************************************************************
@@ -111,174 +220,884 @@ func SetTableKeys(db *sql.DB, ti TableInfo, random io.Reader) (pubs map[string]P
  *
  *********************************************************************************************************/
 
-// Encrypt a simple message under the form of a byte array with a c created only for this message.
-// The disadvantage is that, for messages longer than 512 bits, several different bytes will be
-// encoded using an XOR with the same byte of the checksum obtained by the algorithm.
-// It is therefore a basic function used to test one of the two types of encryption.
-func (pub *PublicKey) basicEncryptHash(msg []byte, random io.Reader) (cypher Cypher) {
-	r, err := rand.Int(random, N)
-	checkErr(err)
-	if r.Cmp(Big0) == 0 {
-		r = Big2
+// Encrypt encrypts a simple message under the form of a byte array with a r created only for this
+// message, by an XOR with the hash of the shared secret, the data being authenticated like the
+// cells of the tables, see sealHashData. The message must not be longer than the
+// BytesNumber bytes of the hash, whose bytes would otherwise be used twice, or an error wrapping
+// ErrMessageTooLong is returned: the longer values are encrypted with NewStreamEncrypter.
+// Like the other encryption methods of PublicKey, it has a value receiver, so that it can be
+// called on a public key taken from a map, such as the one returned by SetTableKeys.
+func (pub PublicKey) Encrypt(msg []byte, random io.Reader) (cypher Cypher, err error) {
+	if err = checkHashLength(len(msg)); err != nil {
+		return
+	}
+	return pub.encrypt(msg, random)
+}
+
+// encrypt is Encrypt without the limit of BytesNumber bytes, the bytes of the hash being reused
+// for the longer messages like in the cells of the tables, see hashData
+func (pub PublicKey) encrypt(msg []byte, random io.Reader) (cypher Cypher, err error) {
+	// The keys may be on another curve than the one of the package, see CreateKeysOn
+	r, err := randScalarBelow(random, curveOf(pub.Curve).Params().N)
+	if err != nil {
+		return
+	}
+	return pub.encryptHashWithR(msg, r)
+}
+
+// checkHashLength returns an error wrapping ErrMessageTooLong if a message of n bytes is longer
+// than the hash XORed with it by Encrypt and EncryptHashWithR
+func checkHashLength(n int) error {
+	if n > BytesNumber {
+		return fmt.Errorf("%w: %d bytes, more than the %d bytes of the hash, see NewStreamEncrypter", ErrMessageTooLong, n, BytesNumber)
+	}
+	return nil
+}
+
+// EncryptHashWithR encrypts msg with the hash function like Encrypt, but with the given r
+// instead of a random one, which must be between 1 and N-1. The messages encrypted with the same r
+// under several keys share the same C = r⋅G, so that they can be decrypted together with the sum
+// of the keys, or that their key points r⋅Y can be computed once by the key holders for all of
+// them. The caller is responsible for never reusing r under the same key. The message must not
+// be longer than BytesNumber bytes, like for Encrypt.
+func (pub PublicKey) EncryptHashWithR(msg []byte, r *big.Int) (cypher Cypher, err error) {
+	if err = checkHashLength(len(msg)); err != nil {
+		return
+	}
+	return pub.encryptHashWithR(msg, r)
+}
+
+// encryptHashWithR is EncryptHashWithR without the limit of BytesNumber bytes, see encrypt
+func (pub PublicKey) encryptHashWithR(msg []byte, r *big.Int) (cypher Cypher, err error) {
+	if err = checkMessageLength(len(msg)); err != nil {
+		return
+	}
+	params := curveOf(pub.Curve).Params()
+	if err = checkR(r, params.N); err != nil {
+		return
+	}
+	var C, s CPoint
+	C.x, C.y = params.ScalarBaseMult(r.Bytes()) // C = rG
+	s.x, s.y = params.ScalarMult(pub.Y.x, pub.Y.y, r.Bytes())
+	cypher = Cypher{C, sealHashData(msg, s)}
+	return
+}
+
+// EncryptPoint manages the encryption of a simple message under the form of a point on the curve
+// The message, read as a big endian integer, must fit on MAX_POINT_BYTES bytes, otherwise the
+// cypher could never be decrypted and an error is returned.
+func (pub PublicKey) EncryptPoint(msg []byte, random io.Reader) (CypherPoint, error) {
+	r, err := randScalar(random)
+	if err != nil {
+		return CypherPoint{}, err
+	}
+	return pub.EncryptPointWithR(msg, r)
+}
+
+// EncryptPointWithR encrypts msg as a point like EncryptPoint, but with the given r instead
+// of a random one, which must be between 1 and N-1. Two cyphers made with the same r under the
+// keys Y1 and Y2 share C, and the sum of their data points is the encryption of the sum of the
+// messages under Y1 + Y2: it is decrypted with the key C⋅(x1 + x2), or with the sum of the key
+// points r⋅Y1 + r⋅Y2 given by the key holders, see DecryptLinearCombination for the columns of
+// an encrypted table.
+func (pub PublicKey) EncryptPointWithR(msg []byte, r *big.Int) (CypherPoint, error) {
+	if err := checkPointRange(msg); err != nil {
+		return CypherPoint{}, err
+	}
+	if err := checkR(r, N); err != nil {
+		return CypherPoint{}, err
 	}
 	C := baseMult(r) // C = rG
 	s := pub.Y.mult(r)
+	/* message encryption */
+	d, err := pointData(msg, s)
+	if err != nil {
+		return CypherPoint{}, err
+	}
+	return CypherPoint{C, d}, nil
+}
+
+// pointBytesNumber gives the number of bytes on which the values of a column of the given type
+// are solved at decryption when they are encrypted as points. Only the types on 4 bytes are
+// accepted: the discrete logarithm of a BIGINT or a DOUBLE PRECISION, on 8 bytes, cannot be
+// computed, so such columns must be encrypted with the hash function.
+func pointBytesNumber(colType string) (uint64, error) {
+	switch colType {
+	case "INTEGER", "INT", "INT4", "SERIAL", "SERIAL4", "SMALLINT", "INT2", "REAL", "FLOAT4", "BOOLEAN", "BOOL":
+		return 4, nil
+	}
+	return 0, fmt.Errorf("%w: %s cannot be encrypted as a point, its values may take more than %d bytes", ErrUnsupportedColumnType, colType, MAX_POINT_BYTES)
+}
+
+// FeasiblePointEncryption reports whether the columns of type colType can be encrypted as points,
+// that is with the command 2, the discrete logarithm of their values being within reach of the
+// solvers at decryption. maxBits is then the number of bits searched for each value. EncryptTable
+// refuses to encrypt as points the columns for which ok is false, such as BIGINT or TEXT columns.
+func FeasiblePointEncryption(colType string) (maxBits uint64, ok bool) {
+	bytesNumber, err := pointBytesNumber(colType)
+	if err != nil {
+		return 0, false
+	}
+	return 8 * bytesNumber, true
+}
+
+// checkPointRange checks that a message encrypted as a point, read as a big endian integer,
+// is small enough for the discrete logarithm to be computed at decryption
+func checkPointRange(msg []byte) error {
+	if n := len(new(big.Int).SetBytes(msg).Bytes()); n > MAX_POINT_BYTES {
+		return fmt.Errorf("%w: the message takes %d bytes, more than the %d bytes that can be encrypted as a point", ErrPointOutOfRange, n, MAX_POINT_BYTES)
+	}
+	return nil
+}
+
+// hashData encodes the message m by an XOR with the hash of the shared secret s
+func hashData(m []byte, s CPoint) (d []byte) {
 	sHash := sha512.Sum512(append(s.x.Bytes(), s.y.Bytes()...))
-	d := make([]byte, len(msg))
-	for i, v := range msg {
-		d[i] = v ^ sHash[i%BytesNumber]
+	d = make([]byte, len(m))
+	for k, v := range m {
+		d[k] = v ^ sHash[k%BytesNumber]
 	}
-	cypher = Cypher{C, d}
 	return
 }
 
-// EncryptPoint manages the encryption of a simple message under the form of a point on the curve
-func (pub *PublicKey) basicEncryptPoint(msg []byte, random io.Reader) CypherPoint {
+// sealHashData encodes the message m like hashData and authenticates the result:
+// the cell is made of the header authHeader, the encoded data and an HMAC-SHA256 tag
+// computed over both with a key derived from s.
+func sealHashData(m []byte, s CPoint) []byte {
+	body := append(append([]byte{}, authHeader...), hashData(m, s)...)
+	return append(body, authTag(body, s)...)
+}
 
-	r, err := rand.Int(random, N)
-	checkErr(err)
+// authTag computes the HMAC-SHA256 tag of a hash encrypted cell
+func authTag(body []byte, s CPoint) []byte {
+	mac := newCellMac(s)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// newCellMac returns the HMAC-SHA256 computing the integrity tags with a key derived from s
+func newCellMac(s CPoint) hash.Hash {
+	key := sha256.Sum256(append([]byte("elgamal-cell-mac"), append(s.x.Bytes(), s.y.Bytes()...)...))
+	return hmac.New(sha256.New, key[:])
+}
+
+// keystream generates the bytes XORed with a streamed value: the block k of BytesNumber bytes
+// is the hash of the shared secret s followed by the counter k, so that no block is reused
+// whatever the length of the value, unlike hashData which repeats the hash of s.
+type keystream struct {
+	prefix  []byte
+	counter uint64
+	block   [BytesNumber]byte
+	pos     int
+}
+
+func newKeystream(s CPoint) *keystream {
+	prefix := append([]byte("elgamal-stream"), append(s.x.Bytes(), s.y.Bytes()...)...)
+	return &keystream{prefix: prefix, pos: BytesNumber}
+}
 
-	if r.Cmp(Big0) == 0 {
-		r = Big2
+// xor writes to dst the bytes of src XORed with the next bytes of the keystream
+func (ks *keystream) xor(dst, src []byte) {
+	var ctr [8]byte
+	for k, v := range src {
+		if ks.pos == BytesNumber {
+			binary.BigEndian.PutUint64(ctr[:], ks.counter)
+			ks.block = sha512.Sum512(append(append([]byte{}, ks.prefix...), ctr[:]...))
+			ks.counter++
+			ks.pos = 0
+		}
+		dst[k] = v ^ ks.block[ks.pos]
+		ks.pos++
+	}
+}
+
+// streamEncrypter is the io.WriteCloser returned by NewStreamEncrypter
+type streamEncrypter struct {
+	w   io.Writer
+	ks  *keystream
+	mac hash.Hash
+	buf []byte
+	err error
+}
+
+// NewStreamEncrypter encrypts a single large value, such as a TEXT or a BYTEA of several MB,
+// with r under the public key of its column, without holding it in memory: the value written to
+// the returned io.WriteCloser is encrypted by chunks with a counter based keystream and written
+// to w. Close writes the integrity tag computed over the whole stream, it does not close w.
+// The value is not limited by MaxMessageLength and is decrypted by NewStreamDecrypter with the
+// key r⋅Y, rebuilt by the key holders from r like the key of a cell.
+func NewStreamEncrypter(w io.Writer, pub PublicKey, r *big.Int) (io.WriteCloser, error) {
+	if err := checkR(r, N); err != nil {
+		return nil, err
+	}
+	if err := validatePoint(pub.Y); err != nil {
+		return nil, err
 	}
-	C := baseMult(r) // C = rG
 	s := pub.Y.mult(r)
-	/* message encryption */
-	d := addC(baseMultB(msg), s)
-	return CypherPoint{C, GetShortOf(d)}
+	se := &streamEncrypter{w: w, ks: newKeystream(s), mac: newCellMac(s), buf: make([]byte, streamChunkSize)}
+	se.mac.Write(streamHeader)
+	if _, err := w.Write(streamHeader); err != nil {
+		return nil, err
+	}
+	return se, nil
 }
 
-// encryptHash manages the encryption of the cells of a column in the case with hash function
-func encryptHash(cE chan interface{}, cI chan string, nRows uint64, pubY CPoint, RforEnc []*big.Int) {
-	var val interface{}
+func (se *streamEncrypter) Write(p []byte) (n int, err error) {
+	if se.err != nil {
+		return 0, se.err
+	}
+	for len(p) > 0 {
+		chunk := se.buf
+		if len(p) < len(chunk) {
+			chunk = chunk[:len(p)]
+		}
+		se.ks.xor(chunk, p[:len(chunk)])
+		se.mac.Write(chunk)
+		if _, se.err = se.w.Write(chunk); se.err != nil {
+			return n, se.err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (se *streamEncrypter) Close() error {
+	if se.err != nil {
+		return se.err
+	}
+	se.err = errors.New("write to a closed stream encrypter")
+	_, err := se.w.Write(se.mac.Sum(nil))
+	return err
+}
+
+// isAuthenticatedCell tells if a hash encrypted cell carries an integrity tag
+func isAuthenticatedCell(d []byte) bool {
+	return len(d) >= len(authHeader)+authTagLength && bytes.Equal(d[:len(authHeader)], authHeader)
+}
+
+// EncodeToPoint maps a value to the point value⋅g. The mapping is additive, the point of a sum
+// being the sum of the points, which is what the encryption as a point relies on: the encrypted
+// data is EncodeToPoint(m) + s, s being the shared secret. Going back to the value requires a
+// discrete logarithm, see DecodeFromPoint for the values that can be recovered in practice.
+func EncodeToPoint(value uint64) CPoint {
+	return baseMult(new(big.Int).SetUint64(value))
+}
+
+// pointData encodes the message m as the point m⋅g + s, s being the shared secret, in short form.
+// An error is returned if the short form does not give the point back, see checkedShortOf, as
+// the cell could then never be decrypted.
+func pointData(m []byte, s CPoint) (ShortPoint, error) {
+	return checkedShortOf(addC(baseMultB(m), s))
+}
+
+// pointCell returns the content of a point encrypted cell of the current version:
+// the header authHeader followed by the short form of the point
+func pointCell(sp ShortPoint) []byte {
+	return append(append([]byte{}, authHeader...), sp[:]...)
+}
+
+// compactCell returns the content of a point encrypted cell whose value has the compact encoding
+// of compactValue: the header compactHeader followed by the short form of the point
+func compactCell(sp ShortPoint) []byte {
+	return append(append([]byte{}, compactHeader...), sp[:]...)
+}
+
+// compactBytesNumber gives the number of bytes on which the values of a column of type colType
+// are solved at decryption when they have the compact encoding of compactValue, ok being false for
+// the types without compact encoding
+func compactBytesNumber(colType string) (bytesNumber uint64, ok bool) {
+	switch colType {
+	case "BOOLEAN", "BOOL":
+		return 1, true
+	case "SMALLINT", "INT2":
+		return 2, true
+	case "INTEGER", "INT", "INT4", "SERIAL", "SERIAL4":
+		return 4, true
+	}
+	return 0, false
+}
+
+// compactValue returns the compact encoding of the value val of a column of type colType, the
+// value itself as a big endian integer instead of its gob encoding: 0 or 1 for a boolean, and the
+// integer for the integers between 0 and the largest value of their type. The discrete logarithm
+// of the point of a boolean is then solved on a single byte, and the enumerations stored as small
+// integers on as many bytes as their values take. ok is false for the other values, such as the
+// negative integers, which keep the gob encoding.
+func compactValue(val interface{}, colType string) (m []byte, ok bool) {
+	bytesNumber, ok := compactBytesNumber(colType)
+	if !ok {
+		return nil, false
+	}
+	if colType == "BOOLEAN" || colType == "BOOL" {
+		b, err := boolOf(val)
+		if err != nil {
+			return nil, false
+		}
+		if b {
+			return []byte{1}, true
+		}
+		return []byte{0}, true
+	}
+	var n int64
+	switch v := val.(type) {
+	case int64:
+		n = v
+	case int32:
+		n = int64(v)
+	case int:
+		n = int64(v)
+	default:
+		return nil, false
+	}
+	if n < 0 || uint64(n) >= 1<<(8*bytesNumber) {
+		return nil, false
+	}
+	return big.NewInt(n).Bytes(), true
+}
+
+// EncryptColumn encrypts a slice of values held in memory, each of them with a fresh r.
+// The mode has the same meaning as the commands of EncryptTable: 1 for the encryption with
+// hash function and 2 for the encryption as a point on the curve. In the former case the Data of
+// each cypher is authenticated like the cells of the tables, see sealHashData, and in the latter
+// it contains the point in short form.
+// The r values are returned with the cyphers as they are needed by the key holders.
+// A nil value is refused with an error wrapping ErrNullValue.
+func (pub PublicKey) EncryptColumn(vals []interface{}, mode byte, random io.Reader) (cyphers []Cypher, rs []*big.Int, err error) {
+	if random, err = checkedRandom(random); err != nil {
+		return
+	}
+	if (mode != 1) && (mode != 2) {
+		return nil, nil, fmt.Errorf("invalid encryption mode %d", mode)
+	}
+	cyphers = make([]Cypher, len(vals))
+	rs = make([]*big.Int, len(vals))
 	var s CPoint
-	var d, m []byte
-	var sHash [sha512.Size]byte
-	for i := uint64(0); i < nRows; i++ {
-		s = pubY.mult(RforEnc[i])
-		sHash = sha512.Sum512(append(s.x.Bytes(), s.y.Bytes()...))
-		val = <-cE
-		m = GetBytes(val)
+	for i, val := range vals {
+		if val == nil {
+			return nil, nil, fmt.Errorf("value %d: %w cannot be encrypted", i, ErrNullValue)
+		}
+		rs[i], err = randScalar(random)
+		if err != nil {
+			return nil, nil, err
+		}
+		s = pub.Y.mult(rs[i])
+		cyphers[i].C = baseMult(rs[i])
+		m := GetBytes(val)
+		if mode == 1 {
+			if err = checkMessageLength(len(m)); err != nil {
+				return nil, nil, fmt.Errorf("value %d: %w", i, err)
+			}
+			cyphers[i].Data = sealHashData(m, s)
+		} else {
+			if err = checkPointRange(m); err != nil {
+				return nil, nil, fmt.Errorf("value %d: %w", i, err)
+			}
+			d, err := pointData(m, s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("value %d: %w", i, err)
+			}
+			cyphers[i].Data = d[:]
+		}
+	}
+	return
+}
 
-		d = make([]byte, len(m))
-		for k, v := range m {
-			d[k] = v ^ sHash[k%BytesNumber]
+// EncryptValue encrypts a single value under the public key of its column with the given r, and
+// returns the cell that EncryptTable would store in the encrypted table for this value. The mode
+// has the same meaning as the commands of EncryptTable: 1 for the encryption with hash function
+// and 2 for the encryption as a point, in which case the value must fit on MAX_POINT_BYTES bytes.
+// The cell is decrypted with the key r⋅Y, which the key holders can rebuild from r.
+func EncryptValue(pub PublicKey, v interface{}, mode byte, r *big.Int) ([]byte, error) {
+	if v == nil {
+		return nil, fmt.Errorf("%w cannot be encrypted", ErrNullValue)
+	}
+	if err := checkR(r, N); err != nil {
+		return nil, err
+	}
+	if err := validatePoint(pub.Y); err != nil {
+		return nil, err
+	}
+	m := GetBytes(v)
+	s := pub.Y.mult(r)
+	switch mode {
+	case 1:
+		if err := checkMessageLength(len(m)); err != nil {
+			return nil, err
+		}
+		return sealHashData(m, s), nil
+	case 2:
+		if err := checkPointRange(m); err != nil {
+			return nil, err
+		}
+		sp, err := pointData(m, s)
+		if err != nil {
+			return nil, err
 		}
-		cI <- fmt.Sprintf("decode('%x', 'hex')", d)
+		return pointCell(sp), nil
 	}
+	return nil, fmt.Errorf("invalid encryption mode %d", mode)
+}
+
+// RekeyCell transforms a cell of the given mode, encrypted with r under the public key oldPub,
+// into a cell of the same plaintext encrypted with r under newPub.
+// In point mode the shared secret is simply replaced using the additive homomorphism:
+// d' = d - r⋅Y_old + r⋅Y_new, the plaintext never being produced. In hash mode the data is
+// decrypted with the hash of r⋅Y_old then encrypted with the one of r⋅Y_new, so that the
+// plaintext is held in memory during the transformation, and a new integrity tag is computed.
+// The cells of any version are accepted and the result is always a cell of the current version.
+// In both modes whoever runs it knows r and can therefore compute r⋅Y_old and decrypt the cell:
+// it must be as trusted as the key holders, who hold the r values. The private keys are not needed.
+func RekeyCell(cell []byte, mode byte, r *big.Int, oldPub, newPub PublicKey) ([]byte, error) {
+	return reencryptCell(cell, mode, oldPub.Y.mult(r), newPub.Y.mult(r))
+}
+
+// reencryptCell transforms a cell of the given mode encrypted with the shared secret sOld into a
+// cell of the same plaintext encrypted with sNew, see RekeyCell
+func reencryptCell(cell []byte, mode byte, sOld, sNew CPoint) ([]byte, error) {
+	switch mode {
+	case 1:
+		d := cell
+		switch v := CellVersion(cell, 1); v {
+		case CELL_V1:
+		case CELL_V2:
+			body := cell[:len(cell)-authTagLength]
+			if !hmac.Equal(authTag(body, sOld), cell[len(body):]) {
+				return nil, ErrAuthentication
+			}
+			d = body[len(authHeader):]
+		default:
+			return nil, fmt.Errorf("unknown version %d of hash cell", v)
+		}
+		// hashData(d, sOld) is the plaintext, encrypted again with sNew
+		body := append(append([]byte{}, authHeader...), hashData(hashData(d, sOld), sNew)...)
+		return append(body, authTag(body, sNew)...), nil
+	case 2:
+		p, err := pointFromCell(cell)
+		if err != nil {
+			return nil, err
+		}
+		sp, err := checkedShortOf(addC(p.subC(sOld), sNew))
+		if err != nil {
+			return nil, err
+		}
+		if CellVersion(cell, 2) == CELL_COMPACT {
+			return compactCell(sp), nil
+		}
+		return pointCell(sp), nil
+	}
+	return nil, fmt.Errorf("invalid encryption mode %d", mode)
+}
+
+// RekeyColumn applies RekeyCell to all the cells of a column, the cell i having been encrypted with rs[i]
+func RekeyColumn(cells [][]byte, mode byte, rs []*big.Int, oldPub, newPub PublicKey) (rekeyed [][]byte, err error) {
+	if len(rs) != len(cells) {
+		return nil, fmt.Errorf("%d r values for %d cells", len(rs), len(cells))
+	}
+	rekeyed = make([][]byte, len(cells))
+	for i, cell := range cells {
+		if rekeyed[i], err = RekeyCell(cell, mode, rs[i], oldPub, newPub); err != nil {
+			return nil, fmt.Errorf("cell %d: %w", i, err)
+		}
+	}
+	return
+}
+
+// encryptHash manages the encryption of the cells of a column in the case with hash function
+// A value longer than MaxMessageLength once encoded is sent as the error instead of its cell,
+// see rowCollection.
+// The point C = r⋅g of a cell is not stored with it: its r value is kept in the table of keys, by
+// the primary key of the row, and copied by ExtractPart into the part of each key holder. A holder
+// thus gives r⋅s_k⋅g for the cell with GiveKeyPoint, the points of the holders are combined into
+// the secret r⋅Y by CombineColumnKeys, and the stored cell is decrypted with it alone.
+func encryptHash(cE chan interface{}, cI chan interface{}, pubY CPoint, RforEnc []*big.Int) {
+	var s CPoint
+	i := 0
+	for val := range cE {
+		m := GetBytes(val)
+		if err := checkMessageLength(len(m)); err != nil {
+			cI <- err
+			i++
+			continue
+		}
+		s = pubY.mult(RforEnc[i])
+		cI <- sealHashData(m, s)
+		i++
+	}
+	close(cI)
 }
 
 // encryptPoint deals with the encryption of the cells of a column in the case with possible calculations
-func encryptPoint(cE chan interface{}, cI chan string, nRows uint64, pubY CPoint, RforEnc []*big.Int) {
+// A value whose cell cannot be made by pointCellOf is sent as the error instead of its cell, see
+// rowCollection.
+func encryptPoint(cE chan interface{}, cI chan interface{}, pubY CPoint, RforEnc []*big.Int, compact bool, colType string) {
 	/*
 	 * s = r⋅Y = Xr⋅g
 	 * d = m⋅g + r⋅Y = (m + Xr)⋅g
 	 */
-	var val interface{}
-	var s CPoint
-	var d ShortPoint
-	var m []byte
-	for i := uint64(0); i < nRows; i++ {
-		s = pubY.mult(RforEnc[i])
-		val = <-cE
+	i := 0
+	for val := range cE {
+		cell, err := pointCellOf(val, pubY.mult(RforEnc[i]), compact, colType)
+		i++
+		if err != nil {
+			cI <- err
+			continue
+		}
+		cI <- cell
+	}
+	close(cI)
+}
+
+// pointCellOf returns the cell of the value val of a column of type colType encrypted as a point
+// with the shared secret s, with the compact encoding of compactValue if compact is set and the
+// value has one. An error is returned for a NULL value, for a point whose short form does not
+// give it back, see pointData, and for a value whose gob encoding is longer than the bytes on
+// which the values of the column are solved at decryption, see pointBytesNumber, as its cell
+// could never be decrypted.
+func pointCellOf(val interface{}, s CPoint, compact bool, colType string) ([]byte, error) {
+	if val == nil {
+		return nil, fmt.Errorf("%w cannot be encrypted", ErrNullValue)
+	}
+	// The column was accepted by FeasiblePointEncryption
+	bytesNumber, _ := pointBytesNumber(colType)
+	m, ok := compactValue(val, colType)
+	ok = compact && ok
+	if !ok {
 		m = GetBytes(val)
+		// The gob encoding of the value must be found back by the solver of the column
+		if n := len(new(big.Int).SetBytes(m).Bytes()); uint64(n) > bytesNumber {
+			return nil, fmt.Errorf("%w: the encoding of %v takes %d bytes, more than the %d bytes solved for the type %s, see CompactPoints", ErrPointOutOfRange, val, n, bytesNumber, colType)
+		}
+	}
+	sp, err := pointData(m, s)
+	switch {
+	case err != nil:
+		return nil, err
+	case ok:
+		return compactCell(sp), nil
+	}
+	return pointCell(sp), nil
+}
 
-		d = GetShortOf(addC(baseMultB(m), s))
-		cI <- fmt.Sprintf("decode('%x', 'hex')", d)
+// transferBinary copies the binary columns byte for byte. The values which are not bytes, which
+// the drivers do not give for these columns, are gob encoded like by transferBytea.
+func transferBinary(cE chan interface{}, cI chan interface{}) {
+	for val := range cE {
+		switch v := val.(type) {
+		case nil:
+			cI <- nil
+		case []byte:
+			cI <- v
+		default:
+			cI <- GetBytes(v)
+		}
 	}
+	close(cI)
 }
 
-// transferBytea
-func transferBytea(cE chan interface{}, cI chan string, nRows uint64) {
-	var val interface{}
-	var m []byte
-	for i := uint64(0); i < nRows; i++ {
-		val = <-cE
-		m = GetBytes(val)
-		cI <- fmt.Sprintf("decode('%x', 'hex')", m)
+// transferBytea copies the columns of other types as their gob encoding, see ByteaFallback
+func transferBytea(cE chan interface{}, cI chan interface{}) {
+	for val := range cE {
+		cI <- GetBytes(val)
 	}
-	return
+	close(cI)
 }
 
-// transferInt64
-func transferInt64(cE chan interface{}, cI chan string, nRows uint64) {
-	var val interface{}
-	for i := uint64(0); i < nRows; i++ {
-		val = <-cE
-		cI <- strconv.FormatInt(val.(int64), 10)
+// transferInt64 copies the integers on 8 bytes. The NULLs are copied as nil, and a value of
+// another type is sent as an error, which fails its row, see rowCollection.
+func transferInt64(cE chan interface{}, cI chan interface{}) {
+	for val := range cE {
+		switch v := val.(type) {
+		case nil:
+			cI <- nil
+		case int64:
+			cI <- v
+		default:
+			cI <- fmt.Errorf("cannot read a BIGINT from a value of type %T", val)
+		}
 	}
-	return
+	close(cI)
 }
 
-// transferInt32
-func transferInt32(cE chan interface{}, cI chan string, nRows uint64) {
-	var val interface{}
-	for i := uint64(0); i < nRows; i++ {
-		val = <-cE
-		cI <- strconv.Itoa(val.(int))
+// transferInt32 copies the integers on 4 bytes, which most drivers give as int64
+func transferInt32(cE chan interface{}, cI chan interface{}) {
+	for val := range cE {
+		switch v := val.(type) {
+		case nil:
+			cI <- nil
+		case int64:
+			cI <- v
+		case int:
+			cI <- int64(v)
+		case int32:
+			cI <- int64(v)
+		default:
+			cI <- fmt.Errorf("cannot read an INTEGER from a value of type %T", val)
+		}
 	}
-	return
+	close(cI)
 }
 
-// transferBool
-func transferBool(cE chan interface{}, cI chan string, nRows uint64) {
-	var val interface{}
-	for i := uint64(0); i < nRows; i++ {
-		val = <-cE
-		cI <- strings.ToUpper(strconv.FormatBool(val.(bool)))
+// boolOf converts a boolean read from the database to a bool. Depending on the driver and the
+// declared type of the column, booleans may come as bool, as integers (0/1) or as text ("t"/"f").
+func boolOf(val interface{}) (bool, error) {
+	switch v := val.(type) {
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	case int:
+		return v != 0, nil
+	case int32:
+		return v != 0, nil
+	case []byte:
+		return strconv.ParseBool(strings.TrimSpace(string(v)))
+	case string:
+		return strconv.ParseBool(strings.TrimSpace(v))
 	}
-	return
+	return false, fmt.Errorf("cannot read a boolean from a value of type %T", val)
 }
 
-// transferFloat32
-func transferFloat32(cE chan interface{}, cI chan string, nRows uint64) {
-	var val interface{}
-	for i := uint64(0); i < nRows; i++ {
-		val = <-cE
-		cI <- strconv.FormatFloat(val.(float64), 'f', -1, 32)
+// transferBool copies the booleans, see boolOf. The NULLs are copied as nil, and a value which is
+// not a boolean is sent as an error, which fails its row, see rowCollection.
+func transferBool(cE chan interface{}, cI chan interface{}) {
+	for val := range cE {
+		if val == nil {
+			cI <- nil
+			continue
+		}
+		b, err := boolOf(val)
+		if err != nil {
+			cI <- err
+			continue
+		}
+		cI <- b
 	}
-	return
+	close(cI)
 }
 
-// transferFloat64
-func transferFloat64(cE chan interface{}, cI chan string, nRows uint64) {
-	var val interface{}
-	for i := uint64(0); i < nRows; i++ {
-		val = <-cE
-		cI <- strconv.FormatFloat(val.(float64), 'f', -1, 64)
+// float32Of converts a REAL read from the database to a float32. Most drivers give them as
+// float64, which holds the float32 exactly when the database sent it in binary form. The values
+// given as text are rounded directly to a float32: rounding them to a float64 first could round
+// a decimal close to the middle of two float32 to the wrong one.
+func float32Of(val interface{}) (float32, error) {
+	switch v := val.(type) {
+	case float32:
+		return v, nil
+	case float64:
+		return float32(v), nil
+	case int64:
+		return float32(v), nil
+	case []byte:
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(v)), 32)
+		return float32(f), err
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 32)
+		return float32(f), err
 	}
-	return
+	return 0, fmt.Errorf("cannot read a REAL from a value of type %T", val)
+}
+
+// transferFloat32 copies the REAL columns as float32, which sqlLiteral writes with the shortest
+// decimal giving back the same float32. A malformed value is sent as an error, which fails its
+// row, see rowCollection.
+func transferFloat32(cE chan interface{}, cI chan interface{}) {
+	for val := range cE {
+		if val == nil {
+			cI <- nil
+			continue
+		}
+		f, err := float32Of(val)
+		if err != nil {
+			cI <- err
+			continue
+		}
+		cI <- f
+	}
+	close(cI)
 }
 
-// transferJson
-func transferJson(cE chan interface{}, cI chan string, nRows uint64) {
-	var val interface{}
-	for i := uint64(0); i < nRows; i++ {
-		val = <-cE
-		cI <- val.(string)
+// transferFloat64 copies the DOUBLE PRECISION columns, see transferInt64
+func transferFloat64(cE chan interface{}, cI chan interface{}) {
+	for val := range cE {
+		switch v := val.(type) {
+		case nil:
+			cI <- nil
+		case float64:
+			cI <- v
+		default:
+			cI <- fmt.Errorf("cannot read a DOUBLE PRECISION from a value of type %T", val)
+		}
 	}
-	return
+	close(cI)
 }
 
-// transferString
-func transferString(cE chan interface{}, cI chan string, nRows uint64) {
-	var val interface{}
-	for i := uint64(0); i < nRows; i++ {
-		val = <-cE
-		cI <- fmt.Sprintf("'%s'", val.(string))
+// transferJson copies the JSON columns as text, which the drivers may give as bytes, see
+// transferInt64 for the NULLs and the values of other types
+func transferJson(cE chan interface{}, cI chan interface{}) {
+	for val := range cE {
+		switch v := val.(type) {
+		case nil:
+			cI <- nil
+		case []byte:
+			cI <- string(v)
+		case string:
+			cI <- v
+		default:
+			cI <- fmt.Errorf("cannot read a JSON value from a value of type %T", val)
+		}
 	}
-	return
+	close(cI)
+}
+
+// transferString copies the text columns. The values are written as they are, including the
+// padding of the CHARACTER(n) columns, which therefore keeps its length. See transferInt64 for the
+// NULLs and the values of other types.
+func transferString(cE chan interface{}, cI chan interface{}) {
+	for val := range cE {
+		switch v := val.(type) {
+		case nil:
+			cI <- nil
+		case []byte:
+			cI <- string(v)
+		case string:
+			cI <- v
+		default:
+			cI <- fmt.Errorf("cannot read a text value from a value of type %T", val)
+		}
+	}
+	close(cI)
 }
 
-func transferNumeric(cE chan interface{}, cI chan string, nRows uint64, numType string) {
-	var val interface{}
-	//paramStr := numType[8 : len(numType) - 1]
-	for i := uint64(0); i < nRows; i++ {
-		val = <-cE
-		// TODO: improve to take into account the data on the precision
-		cI <- strconv.FormatFloat(val.(float64), 'f', -1, 64)
+// transferArray copies the arrays as their text, like {a,"b c",NULL}, which is the form in which
+// Postgres gives them and from which it converts them back to the type of the column. The text is
+// copied as it is, the quotes and the backslashes of the elements included, so that the array is
+// rebuilt element for element instead of being gob encoded like by transferBytea. The values of
+// the types defined by the user, such as the composite types, are copied the same way as their
+// text literal, like (1,"a b") or happy. See transferInt64 for the NULLs and the values of other
+// types.
+func transferArray(cE chan interface{}, cI chan interface{}) {
+	for val := range cE {
+		switch v := val.(type) {
+		case nil:
+			cI <- nil
+		case []byte:
+			cI <- string(v)
+		case string:
+			cI <- v
+		default:
+			cI <- fmt.Errorf("cannot read the text of an array or of a type defined by the user from a value of type %T", val)
+		}
 	}
-	return
+	close(cI)
+}
+
+// PK_PREFIX starts the primary keys encrypted by EncryptPrimaryKey, giving the version of their
+// format
+const PK_PREFIX = "pk1:"
+
+// Length of the synthetic tag starting the primary keys encrypted by EncryptPrimaryKey
+const pkTagLength = 16
+
+// EncryptPrimaryKey encrypts deterministically the value v of a primary key column with secret,
+// see EncryptOptions.PrimaryKeySecret. The result is PK_PREFIX followed by the hexadecimal form
+// of a tag, the HMAC of the value, and of the gob encoding of the value XORed with a keystream
+// derived from the secret and the tag. Equal values therefore give equal keys, which reveals
+// which rows share a key but allows the joins, while DecryptPrimaryKey gives the value back.
+// v must be given in the form the package reads it, see CompositeKey, such as an int64 for the
+// integer columns.
+func EncryptPrimaryKey(secret []byte, v interface{}) string {
+	m := GetBytes(v)
+	tag := pkTag(secret, m)
+	cell := make([]byte, pkTagLength+len(m))
+	copy(cell, tag)
+	newPKKeystream(secret, tag).xor(cell[pkTagLength:], m)
+	return PK_PREFIX + hex.EncodeToString(cell)
+}
+
+// pkTag returns the tag of the encrypted primary key of message m
+func pkTag(secret, m []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("elgamal-pk-tag"))
+	mac.Write(m)
+	return mac.Sum(nil)[:pkTagLength]
+}
+
+// newPKKeystream returns the keystream of the encrypted primary key of the given tag
+func newPKKeystream(secret, tag []byte) *keystream {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("elgamal-pk-stream"))
+	prefix := append([]byte("elgamal-pk"), append(mac.Sum(nil), tag...)...)
+	return &keystream{prefix: prefix, pos: BytesNumber}
+}
+
+// transferPrimaryKey returns the routine encrypting the primary key columns with secret, see
+// EncryptPrimaryKey
+func transferPrimaryKey(secret []byte) func(chan interface{}, chan interface{}) {
+	return func(cE chan interface{}, cI chan interface{}) {
+		for val := range cE {
+			cI <- EncryptPrimaryKey(secret, val)
+		}
+		close(cI)
+	}
+}
+
+// quoteString writes a string as a SQL literal, the single quotes being doubled
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// sqlLiteral writes a cell given by the encryption and transfer routines as a SQL literal of
+// the given dialect
+func sqlLiteral(dialect int, v interface{}) string {
+	switch c := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return hexLiteral(dialect, c)
+	case string:
+		return quoteString(c)
+	case bool:
+		return strings.ToUpper(strconv.FormatBool(c))
+	case int64:
+		return strconv.FormatInt(c, 10)
+	case float32:
+		return strconv.FormatFloat(float64(c), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(c, 'f', -1, 64)
+	}
+	panic(fmt.Sprintf("no SQL literal for a cell of type %T", v))
+}
+
+// sqlLiterals writes the cells of a row as SQL literals of the given dialect
+func sqlLiterals(dialect int, cells []interface{}) []string {
+	lits := make([]string, len(cells))
+	for j, c := range cells {
+		lits[j] = sqlLiteral(dialect, c)
+	}
+	return lits
+}
+
+// transferRaw copies the cells scanned as raw bytes, see rawValue, which are already the text
+// or the binary data written into the new table
+func transferRaw(cE chan interface{}, cI chan interface{}) {
+	for val := range cE {
+		cI <- val
+	}
+	close(cI)
+}
+
+// transferNumeric copies the exact decimals, see Numeric, as their text, which the databases
+// convert back to the type of the column. The values which are not decimals are copied as they are.
+func transferNumeric(cE chan interface{}, cI chan interface{}) {
+	for val := range cE {
+		if n, ok := val.(Numeric); ok {
+			cI <- n.String()
+		} else {
+			cI <- val
+		}
+	}
+	close(cI)
 }
 
 /*********************************************************************************************************
@@ -287,112 +1106,322 @@ func transferNumeric(cE chan interface{}, cI chan string, nRows uint64, numType
  *
  *********************************************************************************************************/
 
-// rowInsertion is the routine that handles the insertion of a row into the new database
-func rowInsertion(cIns []chan string, cEnd chan bool, nRows uint64, nColumns uint, db *sql.DB, newName string) {
-	var buffer bytes.Buffer
-	for i := uint64(0); i < nRows; i++ {
-		buffer.Reset()
-		for j := uint(0); j < nColumns; j++ {
-			if j > 0 {
-				buffer.WriteString(", ")
+// rowCollection is the routine that gathers the cells of each row from the encryption routines
+// and hands them to emit, until the routines close their channels. After a first failure of emit,
+// or a first cell given as an error by a routine, the remaining rows are only drained, so that the
+// other routines can finish, and the error is sent on cEnd.
+func rowCollection(cIns []chan interface{}, cEnd chan error, emit func(uint64, []interface{}) error) {
+	var err error
+	for i := uint64(0); len(cIns) > 0; i++ {
+		cells := make([]interface{}, len(cIns))
+		for j := range cIns {
+			cell, ok := <-cIns[j]
+			if !ok {
+				cEnd <- err
+				return
 			}
-			buffer.WriteString(<-cIns[j])
+			if e, isErr := cell.(error); isErr && err == nil {
+				err = fmt.Errorf("row %d: %w", i, e)
+			}
+			cells[j] = cell
+		}
+		if err == nil {
+			err = emit(i, cells)
 		}
-		_, err := db.Exec(fmt.Sprintf("INSERT INTO %s VALUES (%s);", newName, buffer.String()))
-		checkErr(err)
 	}
-	cEnd <- true
+	cEnd <- err
 }
 
-// EncryptTable deals with the encryption of the entire SQL table
-// The variable commands contains the list of instructions for each column with:
-// commands [j] == 0 -> we do not encrypt this column
-// commands [j] == 1 -> we encrypt this column without possible calculation, i.e. with hash function
-// commands [j] == 2 -> we encrypt this column with possible calculation, i.e. with d = m⋅g and use
-//  	of the Pollard algorithm
-func EncryptTable(dbInit, dbFinal *sql.DB, name string, commands []byte, random io.Reader) (keys TableKeys) {
-	ti := tableInfoFromDB(dbInit, name, commands...)
-	var err error
+// EncryptOptions gathers the optional settings of the encryption of a table.
+// The zero value corresponds to the default behaviour of EncryptTable.
+type EncryptOptions struct {
+	// ByteaFallback allows the unencrypted columns whose type is not recognized
+	// to be copied as gob encoded BYTEA instead of making the encryption fail.
+	ByteaFallback bool
+	// PrimaryKey gives the names of the columns forming the primary key of the table,
+	// which identifies the rows in the table of keys. By default it is the first column.
+	PrimaryKey []string
+	// Where, if not empty, restricts the encryption to the rows matching this SQL condition,
+	// like "tenant = $1 AND day >= $2". The values are given in WhereArgs and never written
+	// into the condition. The table of keys only contains the rows selected.
+	Where     string
+	WhereArgs []interface{}
+	// DestSchema and DestName, if not empty, give the schema and the name of the destination
+	// table, which are then quoted. By default the destination is the table name followed by
+	// _encrypted, in the schema searched by the database.
+	DestSchema string
+	DestName   string
+	// SkipFailedRows makes the encryption go on when the insertion of a row fails, instead of
+	// stopping at the first failure. The failures are then returned together as InsertErrors,
+	// while the table of keys still contains the r values of the rows skipped.
+	SkipFailedRows bool
+	// Copy streams the rows into the destination table with COPY ... FROM STDIN in a single
+	// transaction, instead of one INSERT per row, which is much faster for large tables. Only
+	// Postgres supports it, and it cannot be combined with SkipFailedRows.
+	Copy bool
+	// RowCount, if not zero, is the number of rows of the table known by the caller, or an
+	// estimate of it, used instead of counting the rows, which requires a full scan of the table
+	// before the encryption begins. It is only used to size the buffers: all the rows read are
+	// encrypted, whatever their number.
+	RowCount uint64
+	// BufferDepth is the number of cells buffered between the routine reading the table, the
+	// routines encrypting each column and the routine emitting the rows, DEFAULT_BUFFER_DEPTH if
+	// it is not positive. A deeper buffer lets the reading of the table go ahead of the
+	// encryption of the columns encrypted as points, which takes most of the time, at the cost
+	// of the memory of the cells buffered. See BenchmarkBufferDepth.
+	BufferDepth int
+	// R, if not nil, gives the r values of the rows by their keys in the table of keys, see
+	// CompositeKey, each between 1 and N-1. The rows found in R are encrypted with the r given
+	// and the others with a random r. Giving the R of the table of keys of another table with
+	// the same primary keys aligns the r values of the two tables, so that the cells of a row
+	// can be combined homomorphically across the tables, see EncryptPointWithR.
+	R map[interface{}]*big.Int
+	// PrimaryKeySecret, if not nil, makes the primary key columns be encrypted deterministically
+	// with this secret by EncryptPrimaryKey instead of being copied in clear. The same value always
+	// gives the same encrypted key, so that the tables encrypted with the same secret can still be
+	// joined on their keys. The map R of the table of keys, and R above, are then keyed by the
+	// encrypted keys, which are what the encrypted table holds: a row is found from its primary
+	// key in clear by EncryptPrimaryKey, and the key is decrypted by DecryptPrimaryKey.
+	PrimaryKeySecret []byte
+	// CompactPoints makes the booleans and the positive integers of the columns encrypted as
+	// points be encoded compactly, as their value itself instead of its gob encoding, see
+	// compactValue: the discrete logarithm of a boolean is then found on a single byte, and the
+	// integers up to the largest of their type can be encrypted, while without it the values whose
+	// gob encoding does not fit in the bytes searched, such as the integers from 64, are rejected
+	// with ErrPointOutOfRange. The cells are marked by CELL_COMPACT and decrypted
+	// like the others, but not by the versions of the package before them. The linear
+	// combinations of such cells are combinations of the values themselves, see
+	// DecryptLinearCombination. The values without compact encoding, such as the negative
+	// integers, keep the gob encoding in the same column, and their cells are refused in the
+	// combinations with ErrNotCompact.
+	CompactPoints bool
+	// Checkpoint, if not empty, is the file where the table of keys of the encryption is stored,
+	// see StockTableKeys, with the r values of all the rows, before the first row is inserted.
+	// An encryption interrupted, by a crash for instance, can then be resumed with Resume.
+	Checkpoint string
+	// Resume resumes the encryption of the table recorded in Checkpoint instead of starting it
+	// over: the encrypted table is kept, the rows it already holds, identified by their primary
+	// keys, are skipped, and the others are encrypted with the keys and the r values of the
+	// checkpoint, so that the table of keys returned decrypts the whole table. The rows added to
+	// the table since are encrypted with new r values, which are recorded in the checkpoint
+	// before their insertion. The options must be those of the encryption interrupted.
+	Resume bool
+	// RawBytes makes the cells be scanned as the bytes sent by the driver, sql.RawBytes, instead
+	// of the values the driver converts them to, which may lose precision: the unencrypted columns
+	// are copied as their text, which the database converts back to the type of the column, and
+	// the columns encrypted with the hash function hold the gob encoding of the text, which
+	// decodeValue reads back into the type of the column. The columns encrypted as points take the
+	// integer or the boolean of their text. The dates and times, which the drivers may give as
+	// time.Time, and the primary key encrypted with PrimaryKeySecret are read as usual.
+	RawBytes bool
+}
 
-	/* We create the destination table */
-	newName := fmt.Sprintf("%s_encrypted", name)
-	// The line below ensures that the arrival table does not already exist, but is a bit dangerous
-	_, err = dbFinal.Exec(fmt.Sprintf("DROP TABLE %s;", newName))
-	checkErr(err)
-	_, err = dbFinal.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);", newName, getColsString(ti)))
-	checkErr(err)
+// Number of cells buffered by default between the routines of the encryption, see BufferDepth
+const DEFAULT_BUFFER_DEPTH = 2
 
-	// We get the columns of the table
-	columns := make([]*sql.Rows, ti.nCol)
-	for j := uint(0); j < ti.nCol; j++ {
-		columns[j], err = dbInit.Query(fmt.Sprintf("SELECT %s FROM %s;", ti.colNames[j], name))
-		checkErr(err)
+// RowError is the failure of the insertion of a row, given by its index in the table
+type RowError struct {
+	Row uint64
+	Err error
+}
+
+func (e RowError) Error() string {
+	return fmt.Sprintf("row %d: %v", e.Row, e.Err)
+}
+
+// InsertErrors gathers the rows whose insertion failed when EncryptOptions.SkipFailedRows is set
+type InsertErrors []RowError
+
+func (errs InsertErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for k, e := range errs {
+		msgs[k] = e.Error()
+	}
+	return fmt.Sprintf("%d rows could not be inserted: %s", len(errs), strings.Join(msgs, "; "))
+}
+
+// bufferDepth returns the depth of the buffers of the encryption pipeline, see BufferDepth
+func (opts EncryptOptions) bufferDepth() int {
+	if opts.BufferDepth <= 0 {
+		return DEFAULT_BUFFER_DEPTH
 	}
+	return opts.BufferDepth
+}
+
+// destination returns the name of the table receiving the encryption of the table name
+func (opts EncryptOptions) destination(name string) string {
+	if opts.DestSchema == "" && opts.DestName == "" {
+		return fmt.Sprintf("%s_encrypted", name)
+	}
+	dest := opts.DestName
+	if dest == "" {
+		_, table := splitTableName(name)
+		dest = fmt.Sprintf("%s_encrypted", table)
+	}
+	if opts.DestSchema == "" {
+		return quoteIdent(dest)
+	}
+	return quoteIdent(opts.DestSchema) + "." + quoteIdent(dest)
+}
+
+// transferFunction returns the routine used to copy an unencrypted column of the given type
+// into the new table. An error is returned if the type is not supported, unless the bytea
+// fallback is allowed in which case the value is gob encoded.
+func transferFunction(colType string, byteaFallback bool) (func(chan interface{}, chan interface{}), error) {
+	switch colType {
+	case "BIGINT", "INT8", "BIGSERIAL", "SERIAL8":
+		return transferInt64, nil
+	case "INTEGER", "INT", "INT4", "SERIAL", "SERIAL4", "SMALLINT", "INT2":
+		return transferInt32, nil
+	case "BYTEA", "VARBIT", "BLOB":
+		return transferBinary, nil
+	case "BOOLEAN", "BOOL":
+		return transferBool, nil
+	case "DOUBLE PRECISION", "FLOAT8":
+		return transferFloat64, nil
+	case "REAL", "FLOAT4":
+		return transferFloat32, nil
+	case "TEXT", "UUID":
+		return transferString, nil
+	case "JSON":
+		return transferJson, nil
+	}
+	switch {
+	case isArrayType(colType), isUserDefinedType(colType):
+		return transferArray, nil
+	case strings.Contains(colType, "CHAR"):
+		return transferString, nil
+	case isNumericType(colType):
+		return transferNumeric, nil
+	case byteaFallback:
+		return transferBytea, nil
+	}
+	return nil, fmt.Errorf("%w: %s for an unencrypted column", ErrUnsupportedColumnType, colType)
+}
 
-	/* We create the table of keys used for the encryption */
-	pubs, keys, RforEnc := SetTableKeys(dbInit, ti, random)
+// createTableStatements returns the statements creating the table newName which receives the
+// encrypted table.
+func createTableStatements(ti TableInfo, newName string) []string {
+	return []string{
+		// The first statement ensures that the arrival table does not already exist, but is a bit dangerous
+		fmt.Sprintf("DROP TABLE IF EXISTS %s;", newName),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);", newName, getColsString(ti)),
+	}
+}
+
+// ColumnPlan describes what EncryptTable does with a column
+type ColumnPlan struct {
+	Name string
+	// Type is the type of the column in the source table and DestType in the encrypted table
+	Type     string
+	DestType string
+	// Mode is the command of the column: 0 to copy it, 1 to encrypt it with the hash function
+	// and 2 to encrypt it as a point
+	Mode byte
+}
+
+// EncryptionPlan describes what EncryptTable would do with a table, see Plan
+type EncryptionPlan struct {
+	Table   TableInfo
+	NewName string
+	Columns []ColumnPlan
+	// Statements are the statements creating the destination table
+	Statements []string
+	// PointCells is the number of cells encrypted as points, each of which requires a discrete
+	// logarithm to be decrypted
+	PointCells uint64
+}
 
-	/* We declare all the variables and launch the encryption and insertion routines */
-	lTail := 2
-	// cEnd is used to keep the main routine running until the last insertion is done
-	cEnd := make(chan bool)
-	// cEnc contains the channels that go from the main routine to the encryption routines
-	cEnc := make([]chan interface{}, ti.nCol)
-	// cIns contains the channels that go from the encryption routines to the insertion routine
-	cIns := make([]chan string, ti.nCol)
+// checkTransfers returns the transfer routines of the unencrypted columns of the table,
+// or an error if one of them has a type that cannot be copied or if the table has no column.
+// A table without rows is accepted, its encrypted table being empty.
+func checkTransfers(ti TableInfo, opts EncryptOptions) (transfers []func(chan interface{}, chan interface{}), err error) {
+	if ti.nCol == 0 {
+		return nil, fmt.Errorf("the table %s has no column", ti.name)
+	}
+	transfers = make([]func(chan interface{}, chan interface{}), ti.nCol)
 	for j := uint(0); j < ti.nCol; j++ {
-		cEnc[j] = make(chan interface{}, lTail)
-		cIns[j] = make(chan string, lTail)
-		checkErr(err)
-		switch commands[j] {
-		case 0:
-			// If we don't encrypt the data then we try to determine its type to be able to
-			// reinsert it in the new table
-			switch ti.colTypes[j] {
-			case "BIGINT", "INT8", "BIGSERIAL", "SERIAL8":
-				go transferInt64(cEnc[j], cIns[j], ti.nRows)
-			case "INTEGER", "INT", "INT4", "SERIAL", "SERIAL4", "SMALLINT", "INT2":
-				go transferInt32(cEnc[j], cIns[j], ti.nRows)
-			case "BYTEA", "VARBIT":
-				go transferBytea(cEnc[j], cIns[j], ti.nRows)
-			case "BOOLEAN", "BOOL":
-				go transferBool(cEnc[j], cIns[j], ti.nRows)
-			case "DOUBLE PRECISION", "FLOAT8":
-				go transferFloat64(cEnc[j], cIns[j], ti.nRows)
-			case "REAL", "FLOAT4":
-				go transferFloat32(cEnc[j], cIns[j], ti.nRows)
-			case "TEXT":
-				go transferString(cEnc[j], cIns[j], ti.nRows)
-			case "JSON":
-				go transferJson(cEnc[j], cIns[j], ti.nRows)
-			default:
-				if strings.Contains(ti.colTypes[j], "CHAR") {
-					go transferString(cEnc[j], cIns[j], ti.nRows)
-				} else if strings.Contains(ti.colTypes[j], "NUMERIC") || strings.Contains(ti.colTypes[j], "DECIMAL") {
-					go transferNumeric(cEnc[j], cIns[j], ti.nRows, ti.colTypes[j])
-				} else {
-					go transferBytea(cEnc[j], cIns[j], ti.nRows)
-				}
+		if ti.commands[j] == 2 {
+			if _, err = pointBytesNumber(ti.colTypes[j]); err != nil {
+				return nil, fmt.Errorf("column %s: %w", ti.colNames[j], err)
 			}
-		case 1:
-			go encryptHash(cEnc[j], cIns[j], ti.nRows, pubs[ti.colNames[j]].Y, RforEnc)
-		case 2:
-			go encryptPoint(cEnc[j], cIns[j], ti.nRows, pubs[ti.colNames[j]].Y, RforEnc)
-		default:
-			go encryptHash(cEnc[j], cIns[j], ti.nRows, pubs[ti.colNames[j]].Y, RforEnc)
 		}
+		if ti.pkSecret != nil && ti.isPrimaryKey(j) {
+			if ti.commands[j] != 0 {
+				return nil, fmt.Errorf("column %s: the primary key cannot be encrypted with a command when its secret is given", ti.colNames[j])
+			}
+			transfers[j] = transferPrimaryKey(ti.pkSecret)
+			continue
+		}
+		if ti.commands[j] != 0 {
+			continue
+		}
+		if ti.scansRaw(j) {
+			transfers[j] = transferRaw
+			continue
+		}
+		transfers[j], err = transferFunction(ti.colTypes[j], opts.ByteaFallback)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", ti.colNames[j], err)
+		}
+	}
+	return
+}
+
+// scansRaw tells if the column j is scanned as raw bytes, see EncryptOptions.RawBytes
+func (ti TableInfo) scansRaw(j uint) bool {
+	if !ti.rawBytes || (ti.pkSecret != nil && ti.isPrimaryKey(j)) {
+		return false
+	}
+	_, isTime := newValue(ti.colTypes[j]).(*time.Time)
+	return !isTime
+}
+
+// checkpoint is where the table of keys of an encryption is recorded, see EncryptOptions.Checkpoint
+type checkpoint struct {
+	// name is the file of the checkpoint, empty for none
+	name string
+	// keys, when the encryption is resumed, is the table of keys of the encryption interrupted,
+	// and done gives the keys of the rows already in the encrypted table
+	keys *TableKeys
+	done map[interface{}]bool
+}
+
+// record stores the table of keys in the file of the checkpoint, through a temporary file so
+// that a crash leaves the previous checkpoint whole
+func (cp checkpoint) record(keys TableKeys) error {
+	if cp.name == "" {
+		return nil
 	}
-	go rowInsertion(cIns, cEnd, ti.nRows, ti.nCol, dbFinal, newName)
-	var val interface{}
+	if err := keys.StockTableKeys(cp.name + ".tmp"); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	return os.Rename(cp.name+".tmp", cp.name)
+}
 
-	for i := uint64(0); i < ti.nRows; i++ {
-		for j := uint(0); j < ti.nCol; j++ {
-			columns[j].Next()
-			err = columns[j].Scan(&val)
-			checkErr(err)
-			cEnc[j] <- val
+// transferOne runs a transfer routine on a single value
+func transferOne(transfer func(chan interface{}, chan interface{}), val interface{}) interface{} {
+	cE := make(chan interface{}, 1)
+	cI := make(chan interface{}, 1)
+	cE <- val
+	close(cE)
+	transfer(cE, cI)
+	return <-cI
+}
+
+// publicPoints returns the points Y of the public keys of the encrypted columns of the table,
+// derived from the private keys of keys
+func publicPoints(ti TableInfo, keys TableKeys) (map[string]CPoint, error) {
+	pubYs := make(map[string]CPoint)
+	for j := uint(0); j < ti.nCol; j++ {
+		if ti.commands[j] == 0 {
+			continue
 		}
+		priv, ok := keys.Priv[ti.colNames[j]]
+		if !ok {
+			return nil, fmt.Errorf("no private key for the encrypted column %s", ti.colNames[j])
+		}
+		pubYs[ti.colNames[j]] = baseMultB(priv[0])
 	}
-	<-cEnd
-	return
+	return pubYs, nil
 }
@@ -0,0 +1,481 @@
+//go:build !nosql
+
+package elgamalcrypto
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/*
+ * This file contains a minimal database/sql driver which only understands the
+ * few queries issued by the package. It allows the functions working on SQL
+ * tables to be tested without a running Postgres server.
+ */
+
+// fakeTable is an in-memory SQL table
+type fakeTable struct {
+	cols  []string
+	types []string
+	rows  [][]driver.Value
+}
+
+// fakeDB is the in-memory database shared by all the connections opened on the same name
+type fakeDB struct {
+	mu     sync.Mutex
+	tables map[string]*fakeTable
+	execs  []string
+	// queries are the queries run, like execs for the statements
+	queries []string
+	// onQuery, if set, is called before each query and may change the tables directly
+	onQuery func(query string)
+	// failExec, if set, is called before each statement and may make it fail, and failQuery
+	// before each query
+	failExec  func(query string) error
+	failQuery func(query string) error
+}
+
+var fakeDBs = struct {
+	sync.Mutex
+	dbs map[string]*fakeDB
+	n   int
+}{dbs: make(map[string]*fakeDB)}
+
+func init() {
+	sql.Register("elgamalfake", fakeDriver{})
+}
+
+// newFakeDB opens a new empty in-memory database
+func newFakeDB(t testing.TB) (*sql.DB, *fakeDB) {
+	fakeDBs.Lock()
+	fakeDBs.n++
+	name := fmt.Sprintf("fake%d", fakeDBs.n)
+	fdb := &fakeDB{tables: make(map[string]*fakeTable)}
+	fakeDBs.dbs[name] = fdb
+	fakeDBs.Unlock()
+
+	db, err := sql.Open("elgamalfake", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, fdb
+}
+
+// addTable creates a table with the given columns, types and content
+func (fdb *fakeDB) addTable(name string, cols, types []string, rows ...[]driver.Value) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+	fdb.tables[name] = &fakeTable{cols: cols, types: types, rows: rows}
+}
+
+// table returns the table of the given name, or nil if it does not exist
+func (fdb *fakeDB) table(name string) *fakeTable {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+	return fdb.tables[name]
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBs.Lock()
+	defer fakeDBs.Unlock()
+	fdb, ok := fakeDBs.dbs[name]
+	if !ok {
+		return nil, fmt.Errorf("fake database %s does not exist", name)
+	}
+	return &fakeConn{fdb}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c, query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	c     *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+var (
+	reDrop   = regexp.MustCompile(`^DROP TABLE (IF EXISTS )?(\S+);$`)
+	reCreate = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\S+) \((.*)\);$`)
+	reInsert = regexp.MustCompile(`^INSERT INTO (\S+) VALUES \((.*)\);$`)
+	reOneRow = regexp.MustCompile(`^SELECT \* FROM (\S+) LIMIT 1;$`)
+	reCount  = regexp.MustCompile(`^SELECT COUNT \(\*\) FROM (\S+)(?: WHERE (\w+ = \$\d+(?: AND \w+ = \$\d+)*))?;$`)
+	reTypes  = regexp.MustCompile(`^SELECT column_name, data_type, character_maximum_length, udt_name FROM information_schema\.columns WHERE table_name = \$1( AND table_schema = (?:\$2|current_schema\(\)))?( ORDER BY ordinal_position)?;$`)
+	reSelect = regexp.MustCompile(`^SELECT (.+) FROM (\S+)(?: WHERE (\w+ = \$\d+(?: AND \w+ = \$\d+)*))?;$`)
+	reCond   = regexp.MustCompile(`(\w+) = \$(\d+)`)
+	reUpdate = regexp.MustCompile(`^UPDATE (\S+) SET (.+) WHERE (\w+ = \$\d+(?: AND \w+ = \$\d+)*);$`)
+	reCopy   = regexp.MustCompile(`^COPY (\S+) \((.*)\) FROM STDIN$`)
+	reAssign = regexp.MustCompile(`(\w+) = (decode\('[0-9a-f]*', 'hex'\))`)
+	reLength = regexp.MustCompile(`^(.*CHAR.*)\((\d+)\)$`)
+)
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	fdb := s.c.db
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+	if fdb.failExec != nil {
+		if err := fdb.failExec(s.query); err != nil {
+			return nil, err
+		}
+	}
+	fdb.execs = append(fdb.execs, s.query)
+
+	switch {
+	case reDrop.MatchString(s.query):
+		m := reDrop.FindStringSubmatch(s.query)
+		if _, ok := fdb.tables[m[2]]; !ok && m[1] == "" {
+			return nil, fmt.Errorf("table %s does not exist", m[2])
+		}
+		delete(fdb.tables, m[2])
+	case reCreate.MatchString(s.query):
+		m := reCreate.FindStringSubmatch(s.query)
+		if _, ok := fdb.tables[m[1]]; ok {
+			break
+		}
+		tab := new(fakeTable)
+		for _, def := range strings.Split(m[2], ", ") {
+			f := strings.SplitN(def, " ", 2)
+			tab.cols = append(tab.cols, f[0])
+			tab.types = append(tab.types, f[1])
+		}
+		fdb.tables[m[1]] = tab
+	case reInsert.MatchString(s.query):
+		m := reInsert.FindStringSubmatch(s.query)
+		tab, ok := fdb.tables[m[1]]
+		if !ok {
+			return nil, fmt.Errorf("table %s does not exist", m[1])
+		}
+		row, err := parseLiterals(m[2])
+		if err != nil {
+			return nil, err
+		}
+		if len(row) != len(tab.cols) {
+			return nil, fmt.Errorf("%d values for %d columns", len(row), len(tab.cols))
+		}
+		tab.rows = append(tab.rows, row)
+	case reCopy.MatchString(s.query):
+		// Like pq, each execution with values copies a row and the one without values ends the copy
+		m := reCopy.FindStringSubmatch(s.query)
+		tab, ok := fdb.tables[m[1]]
+		if !ok {
+			return nil, fmt.Errorf("table %s does not exist", m[1])
+		}
+		if len(args) == 0 {
+			break
+		}
+		quoted := make([]string, len(tab.cols))
+		for j, c := range tab.cols {
+			quoted[j] = `"` + c + `"`
+		}
+		if len(args) != len(tab.cols) || m[2] != strings.Join(quoted, ", ") {
+			return nil, fmt.Errorf("%d values for the columns %s", len(args), m[2])
+		}
+		tab.rows = append(tab.rows, append([]driver.Value{}, args...))
+	case reUpdate.MatchString(s.query):
+		m := reUpdate.FindStringSubmatch(s.query)
+		tab, ok := fdb.tables[m[1]]
+		if !ok {
+			return nil, fmt.Errorf("table %s does not exist", m[1])
+		}
+		rows, err := tab.filter(m[3], args)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range reAssign.FindAllStringSubmatch(m[2], -1) {
+			j := -1
+			for k, name := range tab.cols {
+				if name == a[1] {
+					j = k
+				}
+			}
+			if j < 0 {
+				return nil, fmt.Errorf("column %s does not exist", a[1])
+			}
+			v, err := parseLiterals(a[2])
+			if err != nil {
+				return nil, err
+			}
+			// The rows returned by filter share their values with the table
+			for _, row := range rows {
+				row[j] = v[0]
+			}
+		}
+		return driver.RowsAffected(len(rows)), nil
+	default:
+		return nil, fmt.Errorf("fake driver cannot execute %q", s.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	fdb := s.c.db
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+	fdb.queries = append(fdb.queries, s.query)
+	if fdb.failQuery != nil {
+		if err := fdb.failQuery(s.query); err != nil {
+			return nil, err
+		}
+	}
+	if fdb.onQuery != nil {
+		fdb.onQuery(s.query)
+	}
+
+	lookup := func(name string) (*fakeTable, error) {
+		tab, ok := fdb.tables[name]
+		if !ok {
+			return nil, fmt.Errorf("table %s does not exist", name)
+		}
+		return tab, nil
+	}
+
+	switch {
+	case reOneRow.MatchString(s.query):
+		tab, err := lookup(reOneRow.FindStringSubmatch(s.query)[1])
+		if err != nil {
+			return nil, err
+		}
+		rows := tab.rows
+		if len(rows) > 1 {
+			rows = rows[:1]
+		}
+		return &fakeRows{cols: tab.cols, rows: rows}, nil
+	case reCount.MatchString(s.query):
+		m := reCount.FindStringSubmatch(s.query)
+		tab, err := lookup(m[1])
+		if err != nil {
+			return nil, err
+		}
+		rows, err := tab.filter(m[2], args)
+		if err != nil {
+			return nil, err
+		}
+		return &fakeRows{cols: []string{"count"}, rows: [][]driver.Value{{int64(len(rows))}}}, nil
+	case reTypes.MatchString(s.query):
+		// Like Postgres, without schema the tables of the same name in every schema match,
+		// the current schema being the one of the tables named without schema, and without
+		// ORDER BY the columns come in no particular order (here alphabetical)
+		m := reTypes.FindStringSubmatch(s.query)
+		var names []string
+		for name := range fdb.tables {
+			if strings.Contains(m[1], "current_schema") {
+				if name == args[0] {
+					names = append(names, name)
+				}
+			} else if m[1] != "" {
+				if name == fmt.Sprintf("%s.%s", args[1], args[0]) {
+					names = append(names, name)
+				}
+			} else if name == args[0] || strings.HasSuffix(name, fmt.Sprintf(".%s", args[0])) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		res := &fakeRows{cols: []string{"column_name", "data_type", "character_maximum_length", "udt_name"}}
+		for _, name := range names {
+			tab := fdb.tables[name]
+			order := make([]int, len(tab.cols))
+			for j := range order {
+				order[j] = j
+			}
+			if m[2] == "" {
+				sort.Slice(order, func(a, b int) bool { return tab.cols[order[a]] < tab.cols[order[b]] })
+			}
+			for _, j := range order {
+				// The length of a type like CHARACTER(6) is returned apart, as Postgres does
+				typ, length := tab.types[j], driver.Value(nil)
+				if m := reLength.FindStringSubmatch(typ); m != nil {
+					typ = m[1]
+					length, _ = strconv.ParseInt(m[2], 10, 64)
+				}
+				// The arrays are described as Postgres does, by ARRAY and the name of their type,
+				// and the types defined by the user, given quoted, by USER-DEFINED and their name
+				dataType, udtName := strings.ToLower(typ), strings.ToLower(typ)
+				if strings.HasSuffix(typ, "[]") {
+					dataType, udtName = "ARRAY", "_"+strings.ToLower(strings.TrimSuffix(typ, "[]"))
+				} else if strings.HasPrefix(typ, `"`) {
+					dataType, udtName = "USER-DEFINED", strings.Trim(typ, `"`)
+				}
+				res.rows = append(res.rows, []driver.Value{tab.cols[j], dataType, length, udtName})
+			}
+		}
+		return res, nil
+	case reSelect.MatchString(s.query):
+		m := reSelect.FindStringSubmatch(s.query)
+		tab, err := lookup(m[2])
+		if err != nil {
+			return nil, err
+		}
+		cols := strings.Split(m[1], ", ")
+		idx := make([]int, len(cols))
+		for k, c := range cols {
+			idx[k] = -1
+			for j, name := range tab.cols {
+				if name == c {
+					idx[k] = j
+				}
+			}
+			if idx[k] < 0 {
+				return nil, fmt.Errorf("column %s does not exist", c)
+			}
+		}
+		rows, err := tab.filter(m[3], args)
+		if err != nil {
+			return nil, err
+		}
+		res := &fakeRows{cols: cols}
+		for _, row := range rows {
+			sel := make([]driver.Value, len(idx))
+			for k, j := range idx {
+				sel[k] = row[j]
+			}
+			res.rows = append(res.rows, sel)
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("fake driver cannot run %q", s.query)
+}
+
+// filter returns the rows of the table matching the conditions "col = $n" joined by AND
+func (tab *fakeTable) filter(conds string, args []driver.Value) ([][]driver.Value, error) {
+	// where associates the number of a column to the argument it must be equal to
+	where := make(map[int]driver.Value)
+	for _, cond := range reCond.FindAllStringSubmatch(conds, -1) {
+		j := -1
+		for k, name := range tab.cols {
+			if name == cond[1] {
+				j = k
+			}
+		}
+		n, _ := strconv.Atoi(cond[2])
+		if j < 0 || n < 1 || n > len(args) {
+			return nil, fmt.Errorf("invalid condition %s", cond[0])
+		}
+		where[j] = args[n-1]
+	}
+	var res [][]driver.Value
+rows:
+	for _, row := range tab.rows {
+		for j, v := range where {
+			if !reflect.DeepEqual(row[j], v) {
+				continue rows
+			}
+		}
+		res = append(res, row)
+	}
+	return res, nil
+}
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+	pos  int
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.pos])
+	r.pos++
+	return nil
+}
+
+// parseLiterals reads the comma separated SQL literals written by the package
+// in the INSERT statements
+func parseLiterals(s string) (vals []driver.Value, err error) {
+	for len(s) > 0 {
+		var v driver.Value
+		switch {
+		case strings.HasPrefix(s, "decode('"):
+			end := strings.Index(s, "', 'hex')")
+			if end < 0 {
+				return nil, errors.New("unterminated decode literal")
+			}
+			v, err = hex.DecodeString(s[len("decode('"):end])
+			if err != nil {
+				return nil, err
+			}
+			s = s[end+len("', 'hex')"):]
+		case strings.HasPrefix(s, "'"):
+			var str strings.Builder
+			i := 1
+			for {
+				if i >= len(s) {
+					return nil, errors.New("unterminated string literal")
+				}
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						str.WriteByte('\'')
+						i += 2
+						continue
+					}
+					break
+				}
+				str.WriteByte(s[i])
+				i++
+			}
+			v = str.String()
+			s = s[i+1:]
+		default:
+			end := strings.Index(s, ", ")
+			if end < 0 {
+				end = len(s)
+			}
+			tok := s[:end]
+			s = s[end:]
+			switch tok {
+			case "TRUE":
+				v = true
+			case "FALSE":
+				v = false
+			case "NULL":
+				v = nil
+			default:
+				if i, errI := strconv.ParseInt(tok, 10, 64); errI == nil {
+					v = i
+				} else if f, errF := strconv.ParseFloat(tok, 64); errF == nil {
+					v = f
+				} else {
+					return nil, fmt.Errorf("unknown literal %q", tok)
+				}
+			}
+		}
+		vals = append(vals, v)
+		s = strings.TrimPrefix(s, ", ")
+	}
+	return
+}
@@ -0,0 +1,291 @@
+package elgamalcrypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/******************************************************************************************************
+ *
+ * HTTP layer allowing a key holder to answer the decryption requests of the data buyers
+ *
+ ******************************************************************************************************/
+
+// maxKeyRequestSize bounds the size of the requests accepted by a KeyHolderHandler
+const maxKeyRequestSize = 1 << 20
+
+// KeyCell identifies a cell of the table in a request sent to a key holder.
+// Key is the key of the row as returned by CompositeKey.
+type KeyCell struct {
+	Column string
+	Key    interface{}
+}
+
+// KeyRequest is the request sent to a key holder, encoded with gob. Without coefficients it asks
+// for the key point of its only cell (GiveKeyPoint), otherwise for the key of the linear
+// combination of its cells with the coefficients of the same index (GiveKeyCalculation).
+type KeyRequest struct {
+	Cells  []KeyCell
+	Coeffs []*big.Int
+}
+
+// KeyResponse is the answer of a key holder, encoded with gob
+type KeyResponse struct {
+	KeyHolder byte
+	X, Y      *big.Int
+}
+
+// KeyHolderHandler is an http.Handler answering the requests of the data buyers with the
+// contributions of a key holder. It only accepts POST requests whose body is a KeyRequest.
+// Anyone gathering the contributions of KEY_THRESHOLD key holders can decrypt the cells asked, so
+// the requests must be authenticated: by Authorize, or else by the transport in front of the
+// handler, such as TLS with client certificates or a proxy checking the callers.
+type KeyHolderHandler struct {
+	keys PartTableKey
+	// Authorize, if not nil, is called on each request before it is read. The request is refused
+	// with the status 401 Unauthorized when it returns an error.
+	Authorize func(req *http.Request) error
+}
+
+// NewKeyHolderHandler returns the handler serving the partial keys of a key holder. It does not
+// authenticate the requests: Authorize must be set, unless the handler is only reachable through
+// an authenticated transport.
+func NewKeyHolderHandler(keys PartTableKey) *KeyHolderHandler {
+	return &KeyHolderHandler{keys: keys}
+}
+
+// ServeHTTP implements http.Handler
+func (h *KeyHolderHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST requests are accepted", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.Authorize != nil {
+		if err := h.Authorize(req); err != nil {
+			http.Error(w, fmt.Sprintf("unauthorized: %v", err), http.StatusUnauthorized)
+			return
+		}
+	}
+	var kr KeyRequest
+	if err := gob.NewDecoder(http.MaxBytesReader(w, req.Body, maxKeyRequestSize)).Decode(&kr); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	pt, err := h.answer(kr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var buf bytes.Buffer
+	checkErr(gob.NewEncoder(&buf).Encode(KeyResponse{h.keys.keyHolder, pt.x, pt.y}))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(buf.Bytes())
+}
+
+// answer checks a request against the keys held and computes the corresponding point
+func (h *KeyHolderHandler) answer(kr KeyRequest) (CPoint, error) {
+	coords := make([]coord, len(kr.Cells))
+	for k, cell := range kr.Cells {
+		if _, ok := h.keys.PrivPart[cell.Column]; !ok {
+			return CPoint{}, fmt.Errorf("unknown encrypted column %q", cell.Column)
+		}
+		if _, ok := h.keys.R[cell.Key]; !ok {
+			return CPoint{}, fmt.Errorf("unknown row %v", cell.Key)
+		}
+		coords[k] = coord{cell.Key, cell.Column}
+	}
+
+	if len(kr.Coeffs) == 0 {
+		if len(coords) != 1 {
+			return CPoint{}, fmt.Errorf("a key point is asked for exactly one cell, not %d", len(coords))
+		}
+		return h.keys.GiveKeyPoint(coords[0]), nil
+	}
+	if len(kr.Coeffs) != len(coords) {
+		return CPoint{}, fmt.Errorf("%d coefficients for %d cells", len(kr.Coeffs), len(coords))
+	}
+	coeffs := make(map[coord]*big.Int, len(coords))
+	for k, c := range coords {
+		if kr.Coeffs[k] == nil {
+			return CPoint{}, fmt.Errorf("missing coefficient for cell %d", k)
+		}
+		if _, ok := coeffs[c]; ok {
+			return CPoint{}, fmt.Errorf("cell %d is given twice", k)
+		}
+		coeffs[c] = kr.Coeffs[k]
+	}
+	return h.keys.GiveKeyCalculation(coeffs), nil
+}
+
+// KeyHolderClient is used by a data buyer to query the KeyHolderHandler of a key holder
+type KeyHolderClient struct {
+	URL string
+	// Client is the HTTP client used, http.DefaultClient if nil
+	Client *http.Client
+	// Header is added to each request, such as the Authorization checked by the Authorize of the
+	// KeyHolderHandler
+	Header http.Header
+}
+
+// KeyPoint asks the key holder for its contribution to the decryption key of the cell c,
+// see GiveKeyPoint. The number of the key holder is returned with the point.
+func (kc KeyHolderClient) KeyPoint(c Coord) (pt CPoint, keyHolder byte, err error) {
+	return kc.do(KeyRequest{Cells: []KeyCell{{c.j, c.i}}})
+}
+
+// KeyCalculation asks the key holder for its contribution to the decryption key of a
+// calculation, see GiveKeyCalculation. The number of the key holder is returned with the point.
+func (kc KeyHolderClient) KeyCalculation(coeffs map[Coord]*big.Int) (pt CPoint, keyHolder byte, err error) {
+	var kr KeyRequest
+	for c, v := range coeffs {
+		kr.Cells = append(kr.Cells, KeyCell{c.j, c.i})
+		kr.Coeffs = append(kr.Coeffs, v)
+	}
+	return kc.do(kr)
+}
+
+// ForCell returns the key holder answering KeyPoint for the cell c to GatherHolderPoints
+func (kc KeyHolderClient) ForCell(c Coord) HolderClient {
+	return HolderFunc(func(ctx context.Context) (CPoint, byte, error) {
+		return kc.doContext(ctx, KeyRequest{Cells: []KeyCell{{c.j, c.i}}})
+	})
+}
+
+// do sends a request to the key holder and reads its answer
+func (kc KeyHolderClient) do(kr KeyRequest) (pt CPoint, keyHolder byte, err error) {
+	return kc.doContext(context.Background(), kr)
+}
+
+// doContext is do with a context, whose cancellation abandons the request
+func (kc KeyHolderClient) doContext(ctx context.Context, kr KeyRequest) (pt CPoint, keyHolder byte, err error) {
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(kr); err != nil {
+		return
+	}
+	client := kc.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, kc.URL, &buf)
+	if err != nil {
+		return
+	}
+	for name, values := range kc.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("key holder answered %s: %s", resp.Status, bytes.TrimSpace(msg))
+		return
+	}
+	var kresp KeyResponse
+	if err = gob.NewDecoder(resp.Body).Decode(&kresp); err != nil {
+		return
+	}
+	if kresp.X == nil || kresp.Y == nil {
+		err = errors.New("key holder answered an incomplete point")
+		return
+	}
+	pt = CPoint{kresp.X, kresp.Y}
+	if !pt.IsIdentity() && !myCurve.Params().IsOnCurve(pt.x, pt.y) {
+		err = fmt.Errorf("key holder answered a point which is not on the curve: %w", ErrInvalidPoint)
+		return
+	}
+	return pt, kresp.KeyHolder, nil
+}
+
+/******************************************************************************************************
+ *
+ * Gathering of the key points of several key holders, some of which may be offline
+ *
+ ******************************************************************************************************/
+
+// HolderClient is a key holder queried by GatherHolderPoints for its contribution to a decryption
+// key, see KeyHolderClient.ForCell. The number of the key holder is returned with the point.
+type HolderClient interface {
+	KeyPart(ctx context.Context) (pt CPoint, keyHolder byte, err error)
+}
+
+// HolderFunc is a function used as a HolderClient
+type HolderFunc func(ctx context.Context) (CPoint, byte, error)
+
+// KeyPart implements HolderClient
+func (f HolderFunc) KeyPart(ctx context.Context) (CPoint, byte, error) {
+	return f(ctx)
+}
+
+// holderAnswer is the answer of the key holder of index k to GatherHolderPoints
+type holderAnswer struct {
+	k         int
+	pt        CPoint
+	keyHolder byte
+	err       error
+}
+
+// GatherHolderPoints queries the key holders concurrently and returns the points of the first
+// needed ones to answer, by their numbers, which calculateDecryptionKey combines into the key.
+// The holders which fail, answer an invalid point or the number of a holder which already
+// answered, or have not answered after timeout, are left out, and the requests still running are
+// then cancelled. Fewer than needed points are returned when the other holders failed, and an
+// error wrapping ErrTooFewHolders only when fewer than KEY_THRESHOLD holders answered, which do
+// not give the key. needed must be at least KEY_THRESHOLD.
+func GatherHolderPoints(holders []HolderClient, needed int, timeout time.Duration) (map[int]CPoint, error) {
+	if needed < KEY_THRESHOLD {
+		return nil, fmt.Errorf("%d key points asked for, %d are needed to rebuild a key", needed, KEY_THRESHOLD)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// The channel is buffered so that the holders answering late do not block their routine
+	answers := make(chan holderAnswer, len(holders))
+	for k, h := range holders {
+		go func(k int, h HolderClient) {
+			pt, keyHolder, err := h.KeyPart(ctx)
+			answers <- holderAnswer{k, pt, keyHolder, err}
+		}(k, h)
+	}
+
+	points := make(map[int]CPoint, needed)
+	var failures []string
+	pending := len(holders)
+collect:
+	for pending > 0 && len(points) < needed {
+		select {
+		case a := <-answers:
+			pending--
+			switch _, dup := points[int(a.keyHolder)]; {
+			case a.err != nil:
+			case dup:
+				a.err = fmt.Errorf("key holder %d already answered", a.keyHolder)
+			default:
+				a.err = validatePoint(a.pt)
+			}
+			if a.err != nil {
+				failures = append(failures, fmt.Sprintf("holder %d: %v", a.k, a.err))
+				continue
+			}
+			points[int(a.keyHolder)] = a.pt
+		case <-ctx.Done():
+			failures = append(failures, fmt.Sprintf("%d did not answer within %s", pending, timeout))
+			break collect
+		}
+	}
+	if len(points) < KEY_THRESHOLD {
+		return nil, fmt.Errorf("%w: %d of %d, %d are needed (%s)", ErrTooFewHolders, len(points), len(holders), KEY_THRESHOLD, strings.Join(failures, "; "))
+	}
+	return points, nil
+}
@@ -1,8 +1,19 @@
 package elgamalcrypto
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/elliptic"
+	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"os"
+	"strconv"
+	"time"
 )
 
 /*
@@ -64,18 +75,482 @@ func (c Cypher) StockCypher (name string) (err error) {
 }
 */
 
+// publicKeyJSON is the JSON form of a public key: the name of the curve and the point Y in
+// compressed form, hex encoded
+type publicKeyJSON struct {
+	Curve string `json:"curve"`
+	Y     string `json:"y"`
+}
+
+// MarshalJSON writes the public key as the name of its curve and its point Y in compressed form
+func (pub PublicKey) MarshalJSON() ([]byte, error) {
+	if err := validatePoint(pub.Y); err != nil {
+		return nil, err
+	}
+	return json.Marshal(publicKeyJSON{
+		Curve: myCurve.Params().Name,
+		Y:     hex.EncodeToString(elliptic.MarshalCompressed(myCurve, pub.Y.x, pub.Y.y)),
+	})
+}
+
+// UnmarshalJSON reads a public key written by MarshalJSON. The curve must be the one used by the
+// package and the point must be on it.
+func (pub *PublicKey) UnmarshalJSON(data []byte) error {
+	var pj publicKeyJSON
+	if err := json.Unmarshal(data, &pj); err != nil {
+		return err
+	}
+	if pj.Curve != myCurve.Params().Name {
+		return fmt.Errorf("unsupported curve %q, the keys are on %s", pj.Curve, myCurve.Params().Name)
+	}
+	b, err := hex.DecodeString(pj.Y)
+	if err != nil {
+		return err
+	}
+	x, y := elliptic.UnmarshalCompressed(myCurve, b)
+	if x == nil {
+		return ErrInvalidPoint
+	}
+	*pub = PublicKey{Curve: myCurve, Y: CPoint{x, y}}
+	return nil
+}
+
+// The files of keys start with keysFileMagic followed by the version of their format.
+// Version 1, without header, was the JSON encoding of TableKeys, in which the r values could
+// not be stored. Version 2 is the gob encoding of storedTableKeys. Version 3 is a stream of JSON
+// values, storedTableKeys without its rows followed by a storedRow for each row, so that the
+// files are written and read row by row, see EncodeTableKeys.
+var keysFileMagic = []byte("ECKEYS")
+
+const (
+	KEYS_FILE_V1      = 1
+	KEYS_FILE_V2      = 2
+	KEYS_FILE_V3      = 3
+	KEYS_FILE_VERSION = KEYS_FILE_V3
+)
+
+// storedTableKeys is the content of a file of keys of version 2, and without its rows the first
+// value of a file of version 3
+type storedTableKeys struct {
+	Name     string
+	NRows    uint64
+	ColNames []string
+	ColTypes []string
+	Commands []byte
+	PrimCols []uint
+	Rows     []storedR `json:"-"`
+	Priv     map[string]PrivateKey
+	Shares   map[string]map[byte][]byte
+	// MinCellVersion is the version of the cells required at decryption, see RequireCellVersion,
+	// 0 in the files written before it
+	MinCellVersion byte
+	// EncName and Dialect are the name of the encrypted table and the dialect of its database,
+	// empty and DIALECT_POSTGRES in the files written before them
+	EncName string
+	Dialect int
+	// CompactPoints, RawBytes and SecretPrimaryKey are the settings of the encryption applied to
+	// the rows appended by AppendRows, false in the files written before them
+	CompactPoints    bool
+	RawBytes         bool
+	SecretPrimaryKey bool
+}
+
+// storedR associates the key of a row to its r value
+type storedR struct {
+	Key interface{}
+	R   *big.Int
+}
+
+// storedRow is a row of a file of keys of version 3: its key, given by its Go type and its text,
+// and its r value in decimal, the numbers of JSON not holding the r values exactly
+type storedRow struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	R    string `json:"r"`
+}
+
+// Size of the buffers through which the files of keys are written and read
+const keysFileBuffer = 64 << 10
+
+// rowOf returns the row of a file of version 3 giving the r value of the key k
+func rowOf(k interface{}, r *big.Int) (row storedRow, err error) {
+	row.R = r.String()
+	switch v := k.(type) {
+	case int64:
+		row.Type, row.Key = "int64", strconv.FormatInt(v, 10)
+	case string:
+		row.Type, row.Key = "string", v
+	case float64:
+		row.Type, row.Key = "float64", strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		row.Type, row.Key = "bool", strconv.FormatBool(v)
+	case time.Time:
+		row.Type, row.Key = "time", v.Format(time.RFC3339Nano)
+	default:
+		err = fmt.Errorf("the key %v of type %T cannot be stored", k, k)
+	}
+	return
+}
+
+// entry returns the key and the r value of a row of a file of version 3
+func (row storedRow) entry() (k interface{}, r *big.Int, err error) {
+	r, ok := new(big.Int).SetString(row.R, 10)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid r value %q", row.R)
+	}
+	switch row.Type {
+	case "int64":
+		k, err = strconv.ParseInt(row.Key, 10, 64)
+	case "string":
+		k = row.Key
+	case "float64":
+		k, err = strconv.ParseFloat(row.Key, 64)
+	case "bool":
+		k, err = strconv.ParseBool(row.Key)
+	case "time":
+		k, err = time.Parse(time.RFC3339Nano, row.Key)
+	default:
+		err = fmt.Errorf("unknown type %q of key", row.Type)
+	}
+	return
+}
+
 // Fonction pour stocker un tableau de clés
 func (array TableKeys) StockTableKeys(name string) (err error) {
-	file, err := os.Create(name)
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	if err = array.EncodeTableKeys(file); err != nil {
+		file.Close()
+		return
+	}
+	return file.Close()
+}
+
+// EncodeTableKeys writes the table of keys to w in the format of the files of keys of the current
+// version. The rows are encoded one by one through a buffer, so that the memory used does not
+// grow with the number of rows beyond the table of keys itself.
+func (array TableKeys) EncodeTableKeys(w io.Writer) error {
+	bw := bufio.NewWriterSize(w, keysFileBuffer)
+	bw.Write(keysFileMagic)
+	bw.WriteByte(KEYS_FILE_VERSION)
+	enc := json.NewEncoder(bw)
+	header := storedTableKeys{
+		Name:     array.ti.name,
+		NRows:    array.ti.nRows,
+		ColNames: array.ti.colNames,
+		ColTypes: array.ti.colTypes,
+		Commands: array.ti.commands,
+		PrimCols: array.ti.primCols,
+		Priv:     array.Priv,
+		Shares:   array.Shares,
+
+		MinCellVersion: array.ti.minCellVersion,
+		EncName:        array.ti.encName,
+		Dialect:        array.ti.dialect,
+
+		CompactPoints:    array.ti.compactPoints,
+		RawBytes:         array.ti.rawBytes,
+		SecretPrimaryKey: array.ti.secretPrimaryKey,
+	}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	for k, r := range array.R {
+		row, err := rowOf(k, r)
+		if err != nil {
+			return err
+		}
+		if err = enc.Encode(row); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// LoadTableKeys reads a file of keys written by StockTableKeys, whatever its version.
+// The files of version 1 only contain the private keys: they are returned with an error.
+func LoadTableKeys(name string) (array TableKeys, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
 	defer file.Close()
+	return DecodeTableKeys(file)
+}
+
+// DecodeTableKeys reads from r a table of keys written by EncodeTableKeys or a file of keys of any
+// version, see LoadTableKeys. The files of version 3 are read row by row.
+func DecodeTableKeys(r io.Reader) (array TableKeys, err error) {
+	br := bufio.NewReaderSize(r, keysFileBuffer)
+	version := byte(KEYS_FILE_V1)
+	if head, _ := br.Peek(len(keysFileMagic) + 1); bytes.HasPrefix(head, keysFileMagic) && len(head) > len(keysFileMagic) {
+		version = head[len(keysFileMagic)]
+		br.Discard(len(head))
+	}
+
+	var stored storedTableKeys
+	switch version {
+	case KEYS_FILE_V1:
+		var old struct{ Priv map[string]PrivateKey }
+		if err = json.NewDecoder(br).Decode(&old); err != nil {
+			return
+		}
+		array.Priv = old.Priv
+		return array, errors.New("the files of keys of version 1 do not contain the r values")
+	case KEYS_FILE_V2:
+		if err = gob.NewDecoder(br).Decode(&stored); err != nil {
+			return
+		}
+		array.R = make(map[interface{}]*big.Int, len(stored.Rows))
+		for _, row := range stored.Rows {
+			array.R[row.Key] = row.R
+		}
+	case KEYS_FILE_V3:
+		dec := json.NewDecoder(br)
+		if err = dec.Decode(&stored); err != nil {
+			return
+		}
+		array.R = make(map[interface{}]*big.Int, stored.NRows)
+		for {
+			var row storedRow
+			if err = dec.Decode(&row); err == io.EOF {
+				break
+			} else if err != nil {
+				return TableKeys{}, err
+			}
+			k, r, err := row.entry()
+			if err != nil {
+				return TableKeys{}, err
+			}
+			array.R[k] = r
+		}
+	default:
+		return array, fmt.Errorf("unknown version %d of file of keys", version)
+	}
+	array.ti = TableInfo{
+		name:     stored.Name,
+		nRows:    stored.NRows,
+		nCol:     uint(len(stored.ColNames)),
+		colNames: stored.ColNames,
+		colTypes: stored.ColTypes,
+		commands: stored.Commands,
+		primCols: stored.PrimCols,
+
+		minCellVersion: stored.MinCellVersion,
+		encName:        stored.EncName,
+		dialect:        stored.Dialect,
+
+		compactPoints:    stored.CompactPoints,
+		rawBytes:         stored.RawBytes,
+		secretPrimaryKey: stored.SecretPrimaryKey,
+	}
+	array.Priv = stored.Priv
+	array.Shares = stored.Shares
+	return array, nil
+}
+
+// Version of the format of the manifests written by SaveManifest. The manifests of version 1 do
+// not record the oldest version of the cells accepted, and those of their tables are all accepted.
+const MANIFEST_VERSION = 2
+
+// Manifest describes an encrypted table for its decryption: its columns with their types and the
+// commands with which they were encrypted, its primary key, the curve of the keys and the version
+// of the format of the manifest. It holds no secret, unlike the table of keys, and is saved with
+// SaveManifest alongside the keys, so that the table can be decrypted once the source database is
+// gone, see Manifest.TableInfo.
+type Manifest struct {
+	Version    int              `json:"version"`
+	Curve      string           `json:"curve"`
+	Table      string           `json:"table"`
+	Rows       uint64           `json:"rows"`
+	Columns    []ManifestColumn `json:"columns"`
+	PrimaryKey []string         `json:"primary_key"`
+	// EncryptedTable is the name of the encrypted table, see TableInfo.EncryptedName, and Dialect
+	// the dialect of its database, postgres, sqlite or mysql, absent from the older manifests
+	EncryptedTable string `json:"encrypted_table,omitempty"`
+	Dialect        string `json:"dialect,omitempty"`
+	// MinCellVersion is the oldest version of the cells accepted at decryption, see
+	// TableInfo.RequireCellVersion
+	MinCellVersion byte `json:"min_cell_version"`
+}
+
+// ManifestColumn describes a column of an encrypted table in its Manifest
+type ManifestColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode byte   `json:"mode"`
+}
+
+// Manifest returns the manifest of the table encrypted with the keys, which EncryptTable gives
+// with them
+func (keys TableKeys) Manifest() Manifest {
+	m := Manifest{
+		Version:        MANIFEST_VERSION,
+		Curve:          myCurve.Params().Name,
+		Table:          keys.ti.name,
+		EncryptedTable: keys.ti.EncryptedName(),
+		Dialect:        dialectNames[keys.ti.dialect],
+		Rows:           keys.ti.nRows,
+		Columns:        make([]ManifestColumn, keys.ti.nCol),
+		PrimaryKey:     keys.ti.PrimaryKey(),
+		MinCellVersion: keys.ti.minCellVersion,
+	}
+	for j := range m.Columns {
+		m.Columns[j] = ManifestColumn{keys.ti.colNames[j], keys.ti.colTypes[j], keys.ti.commands[j]}
+	}
+	return m
+}
+
+// TableInfo returns the description of the table given by the manifest, which the decryption
+// functions such as DecryptRow or DecryptColumn take without querying the source database.
+// An error is returned if the manifest is of an unknown version, if its keys are on another
+// curve than the one of the package or if it is inconsistent. The description given by a manifest
+// of version 1 accepts the cells of any version.
+func (m Manifest) TableInfo() (ti TableInfo, err error) {
+	if m.Version != 1 && m.Version != MANIFEST_VERSION {
+		return ti, fmt.Errorf("unknown version %d of manifest", m.Version)
+	}
+	if m.Curve != myCurve.Params().Name {
+		return ti, fmt.Errorf("unsupported curve %q, the keys are on %s", m.Curve, myCurve.Params().Name)
+	}
+	if len(m.Columns) == 0 {
+		return ti, fmt.Errorf("the manifest of table %s has no column", m.Table)
+	}
+	ti = TableInfo{name: m.Table, nRows: m.Rows, nCol: uint(len(m.Columns)), encName: m.EncryptedTable}
+	if m.Version > 1 {
+		ti.minCellVersion = m.MinCellVersion
+	}
+	if m.Dialect != "" {
+		found := false
+		for d, name := range dialectNames {
+			if name == m.Dialect {
+				ti.dialect, found = d, true
+			}
+		}
+		if !found {
+			return TableInfo{}, fmt.Errorf("unknown dialect %q in the manifest of table %s", m.Dialect, m.Table)
+		}
+	}
+	for _, c := range m.Columns {
+		if c.Mode > 2 {
+			return TableInfo{}, fmt.Errorf("column %s of table %s: invalid command %d", c.Name, m.Table, c.Mode)
+		}
+		ti.colNames = append(ti.colNames, c.Name)
+		ti.colTypes = append(ti.colTypes, c.Type)
+		ti.commands = append(ti.commands, c.Mode)
+	}
+	if len(m.PrimaryKey) > 0 {
+		if err = ti.setPrimaryKey(m.PrimaryKey...); err != nil {
+			return TableInfo{}, err
+		}
+	}
+	return ti, nil
+}
+
+// SaveManifest writes the manifest m to the file name as JSON
+func SaveManifest(m Manifest, name string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+}
+
+// LoadManifest reads a manifest written by SaveManifest and checks it, see Manifest.TableInfo
+func LoadManifest(name string) (m Manifest, err error) {
+	data, err := os.ReadFile(name)
 	if err != nil {
 		return
 	}
-	jsonTemp, _ := json.Marshal(array)
-	_, err = file.Write(jsonTemp)
-	return
+	if err = json.Unmarshal(data, &m); err != nil {
+		return Manifest{}, fmt.Errorf("manifest %s: %v", name, err)
+	}
+	if _, err = m.TableInfo(); err != nil {
+		return Manifest{}, err
+	}
+	return m, nil
+}
+
+// Version of the format of the bundles of public keys made by PublicBundle
+const PUBLIC_BUNDLE_VERSION = 1
+
+// PublicBundle gathers what a data buyer needs to encrypt values like the cells of an encrypted
+// table, to build encrypted queries for instance, without contacting the seller again: the
+// Manifest of the table, with its curve and its columns, and the public key Y = priv[0]⋅g of each
+// encrypted column, in short form. It holds no secret and is serialized as JSON.
+type PublicBundle struct {
+	Version    int               `json:"version"`
+	Manifest   Manifest          `json:"manifest"`
+	PublicKeys map[string][]byte `json:"public_keys"`
+}
+
+// PublicBundle returns the bundle of the public keys of the table encrypted with the keys. An
+// error is returned if the private key of an encrypted column is missing.
+func (keys TableKeys) PublicBundle() (PublicBundle, error) {
+	b := PublicBundle{Version: PUBLIC_BUNDLE_VERSION, Manifest: keys.Manifest(), PublicKeys: make(map[string][]byte)}
+	for j, col := range keys.ti.colNames {
+		if keys.ti.commands[j] == 0 {
+			continue
+		}
+		priv, ok := keys.Priv[col]
+		if !ok || len(priv[0]) == 0 {
+			return PublicBundle{}, fmt.Errorf("the private key of column %s is missing", col)
+		}
+		sp, err := GetShortOf(baseMultB(priv[0]))
+		if err != nil {
+			return PublicBundle{}, err
+		}
+		b.PublicKeys[col] = sp.Bytes()
+	}
+	return b, nil
+}
+
+// PublicKey returns the public key of the encrypted column col given by the bundle, with which
+// EncryptValue encrypts a value like the cells of the column. An error is returned if the bundle
+// is of an unknown version or on another curve, if the column is not encrypted or if its key is
+// not a valid point.
+func (b PublicBundle) PublicKey(col string) (PublicKey, error) {
+	if b.Version != PUBLIC_BUNDLE_VERSION {
+		return PublicKey{}, fmt.Errorf("unknown version %d of bundle of public keys", b.Version)
+	}
+	if _, err := b.Manifest.TableInfo(); err != nil {
+		return PublicKey{}, err
+	}
+	data, ok := b.PublicKeys[col]
+	if !ok {
+		return PublicKey{}, fmt.Errorf("%w: %s in table %s", ErrNotEncryptedColumn, col, b.Manifest.Table)
+	}
+	y, err := pointFromShortBytes(data)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("public key of column %s: %w", col, err)
+	}
+	return PublicKey{Curve: myCurve, Y: y}, nil
 }
 
 func (array PartTableKey) StockSubKeyArray(name string) (err error) {
 	return
 }
+
+// SaveCalibration writes to the file name the calibration c of the solvers as JSON, so that the
+// next runs of the program can use it without measuring again, see LoadCalibration
+func SaveCalibration(c Calibration, name string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+}
+
+// LoadCalibration reads a calibration written by SaveCalibration and makes DiscreteLog use it
+func LoadCalibration(name string) (c Calibration, err error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &c); err != nil {
+		return
+	}
+	return c, UseCalibration(c)
+}
@@ -0,0 +1,193 @@
+package elgamalcrypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+/*********************************************************************************************
+ *
+ * Verification at runtime of the consistency of the package
+ *
+ *********************************************************************************************/
+
+// CheckError is the failure of one of the checks of SelfTest, given by its name
+type CheckError struct {
+	Check string
+	Err   error
+}
+
+func (e CheckError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Check, e.Err)
+}
+
+// SelfTestErrors gathers the checks which failed in SelfTest
+type SelfTestErrors []CheckError
+
+func (errs SelfTestErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for k, e := range errs {
+		msgs[k] = e.Error()
+	}
+	return fmt.Sprintf("%d checks of the self test failed: %s", len(errs), strings.Join(msgs, "; "))
+}
+
+// selfTestChecks are the checks run by SelfTest, in this order
+var selfTestChecks = []struct {
+	name  string
+	check func() error
+}{
+	{"curve", checkCurve},
+	{"keys", checkKeys},
+	{"short points", checkShortPoints},
+	{"secret sharing", checkSecretSharing},
+	{"discrete logarithm", checkDiscreteLog},
+}
+
+// SelfTest checks at runtime that the package works on the machine where it runs: the parameters
+// of the curve, the encryption and the decryption with a new pair of keys, the compression of the
+// points into their short form, the reconstruction of the keys shared between the key holders and
+// the computation of a small discrete logarithm. Unlike the tests of the package it ships in the
+// binary, so that operators can run it before trusting the package, at the start of a service
+// for instance. It takes a few milliseconds and draws its keys from crypto/rand. All the checks are
+// run, and those which failed are returned together as SelfTestErrors, nil meaning that they all
+// passed.
+func SelfTest() error {
+	var failures SelfTestErrors
+	for _, c := range selfTestChecks {
+		if err := runCheck(c.check); err != nil {
+			failures = append(failures, CheckError{c.name, err})
+		}
+	}
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+// runCheck runs a check of SelfTest, the panics of the functions which report their errors by
+// panicking, like PointFromShort, being returned as errors
+func runCheck(check func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return check()
+}
+
+// checkCurve checks that the curve has the parameters of the package and that g generates a group
+// of order N
+func checkCurve() error {
+	params := myCurve.Params()
+	if params.P.Cmp(P) != 0 || params.N.Cmp(N) != 0 {
+		return errors.New("the order of the field or of the curve is not the one of the package")
+	}
+	if !params.IsOnCurve(G.x, G.y) {
+		return errors.New("the base point is not on the curve")
+	}
+	if !baseMult(N).IsIdentity() {
+		return errors.New("N⋅g is not the point at infinity")
+	}
+	if !baseMult(new(big.Int).Sub(N, Big1)).equalC(G.negC()) {
+		return errors.New("(N-1)⋅g is not -g")
+	}
+	return nil
+}
+
+// checkKeys encrypts and decrypts a message with the hash function and a value as a point with a
+// new pair of keys
+func checkKeys() error {
+	pub, priv, _ := SetKeys(rand.Reader)
+	if err := validatePoint(pub.Y); err != nil {
+		return fmt.Errorf("public key: %w", err)
+	}
+	msg := []byte("elgamal self test")
+	cypher, err := pub.Encrypt(msg, rand.Reader)
+	if err != nil {
+		return err
+	}
+	if m, err := priv.Decrypt(cypher); err != nil || !bytes.Equal(m, msg) {
+		return fmt.Errorf("the message encrypted with the hash function was not decrypted (%v)", err)
+	}
+	point, err := pub.EncryptPoint([]byte{0x12, 0x34}, rand.Reader)
+	if err != nil {
+		return err
+	}
+	if v, err := priv.DecryptPoint(point, 16); err != nil || v.Uint64() != 0x1234 {
+		return fmt.Errorf("the value encrypted as a point was not decrypted (%v)", err)
+	}
+	return nil
+}
+
+// checkShortPoints compresses random points into their short form and decompresses them
+func checkShortPoints() error {
+	for k := 0; k < 4; k++ {
+		a, err := rand.Int(rand.Reader, N)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrRandomSource, err)
+		}
+		p := baseMult(a)
+		sp, err := GetShortOf(p)
+		if err != nil {
+			return err
+		}
+		if !PointFromShort(sp).equalC(p) {
+			return errors.New("a point is not found back from its short form")
+		}
+	}
+	return nil
+}
+
+// checkSecretSharing reconstructs the private key of SetKeys from each pair of its shares, and
+// combines the key points of two key holders of a key shared by ShareKeys
+func checkSecretSharing() error {
+	pub, priv, _ := SetKeys(rand.Reader)
+	for _, pair := range [][2]int{{1, 2}, {1, 3}, {2, 3}} {
+		subset := map[int][]byte{pair[0]: priv[pair[0]], pair[1]: priv[pair[1]]}
+		if new(big.Int).SetBytes(combineShares(subset)).Cmp(new(big.Int).SetBytes(priv[0])) != 0 {
+			return fmt.Errorf("the secret is not rebuilt from the shares %d and %d", pair[0], pair[1])
+		}
+	}
+
+	r := big.NewInt(0x5e1f7e57)
+	keys := TableKeys{R: map[interface{}]*big.Int{int64(1): r}, Priv: map[string]PrivateKey{"c": priv}}
+	shared, err := keys.ShareKeys(2, 3, rand.Reader)
+	if err != nil {
+		return err
+	}
+	keyParts := make(map[int]CPoint)
+	for _, num := range []byte{1, 3} {
+		part, err := shared.ExtractPart(num)
+		if err != nil {
+			return err
+		}
+		keyParts[int(num)] = baseMult(r).mult(part.PrivPart["c"])
+	}
+	s, err := CombineColumnKeys(map[string]map[int]CPoint{"c": keyParts})
+	if err != nil {
+		return err
+	}
+	return VerifyColumnKey(s["c"], r, pub)
+}
+
+// checkDiscreteLog solves the discrete logarithm of a random value on 2 bytes
+func checkDiscreteLog() error {
+	v, err := rand.Int(rand.Reader, big.NewInt(1<<16))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRandomSource, err)
+	}
+	x, err := DiscreteLogContext(context.Background(), baseMult(v), 2)
+	if err != nil {
+		return err
+	}
+	if x.Cmp(v) != 0 {
+		return fmt.Errorf("the discrete logarithm of %v⋅g was found to be %v", v, x)
+	}
+	return nil
+}
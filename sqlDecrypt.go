@@ -0,0 +1,255 @@
+//go:build !nosql
+
+package elgamalcrypto
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+/*********************************************************************************************
+ *
+ * Decryption of the cells read from the SQL databases, left out of the builds with the tag nosql
+ *
+ *********************************************************************************************/
+
+// DecyptoOne Data allows the decryption of a single data encoded in a table
+// We suppose that the row sent contains only the data
+// The decryption of a point is abandoned with the error of ctx when ctx is done.
+// The value of an unencrypted column is returned encoded like the decrypted values, so that
+// decodeValue gives it the type of its column in every case. An error is returned for a column
+// number out of the table or an unknown command.
+func DecryptOneData(ctx context.Context, row sql.Row, ti TableInfo, colNum int, keyParts map[int]CPoint) (result []byte, err error) {
+	if colNum < 0 || colNum >= int(ti.nCol) || colNum >= len(ti.commands) {
+		return nil, fmt.Errorf("column %d is not a column of table %s", colNum, ti.name)
+	}
+	var data []byte
+	switch ti.commands[colNum] {
+	case 0:
+		var v interface{}
+		if err = row.Scan(&v); err != nil {
+			return
+		}
+		return encodePlain(v, ti.colTypes[colNum])
+	case 1:
+		if err = row.Scan(&data); err != nil {
+			return
+		}
+		if err = ti.checkCellVersion(data, 1); err != nil {
+			return
+		}
+		result, err = decryptFromHash(data, calculateDecryptionKey(keyParts))
+	case 2:
+		if err = row.Scan(&data); err != nil {
+			return
+		}
+		if err = ti.checkCellVersion(data, 2); err != nil {
+			return
+		}
+		result, err = decryptPointCell(ctx, nil, data, calculateDecryptionKey(keyParts), ti.colTypes[colNum])
+	default:
+		err = fmt.Errorf("unknown command %d for column %s of table %s", ti.commands[colNum], ti.colNames[colNum], ti.name)
+	}
+	return
+}
+
+// DecryptColumn decrypts all the cells of the encrypted column colNum. Each row must contain the
+// values of the columns of the primary key, in the order of the table, followed by the cell, as
+// returned by SELECT id, col FROM table_encrypted. keyParts gives for the key of each row, see
+// CompositeKey, the key points of the key holders for the cell of the column.
+// The decryption key is reconstructed once per row and, for a column encrypted as points, the
+// table used to solve the discrete logarithms is built once for the whole column.
+// The results are given in the order of the rows.
+func DecryptColumn(ctx context.Context, rows *sql.Rows, ti TableInfo, colNum int, keyParts map[interface{}]map[int]CPoint) (results [][]byte, err error) {
+	if colNum < 0 || colNum >= int(ti.nCol) || ti.commands[colNum] == 0 {
+		return nil, fmt.Errorf("%w: column %d of table %s", ErrNotEncryptedColumn, colNum, ti.name)
+	}
+	var cs *Solver
+	if ti.commands[colNum] == 2 {
+		if cs, err = newColumnSolver(ctx, ti.colTypes[colNum]); err != nil {
+			return
+		}
+		defer cs.Close()
+	}
+
+	nPrim := len(ti.primaryKey())
+	vals := make([]interface{}, nPrim+1)
+	ptrs := make([]interface{}, nPrim+1)
+	for k := range vals {
+		ptrs[k] = &vals[k]
+	}
+	var data []byte
+	ptrs[nPrim] = &data
+	for rows.Next() {
+		if err = rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		key := ti.rowKey(vals[:nPrim])
+		parts, ok := keyParts[key]
+		if !ok {
+			return nil, fmt.Errorf("no key parts for the row %v", key)
+		}
+		sKey := calculateDecryptionKey(parts)
+
+		var m []byte
+		if err = ti.checkCellVersion(data, ti.commands[colNum]); err != nil {
+			return nil, fmt.Errorf("row %v: %w", key, err)
+		}
+		if cs == nil {
+			m, err = decryptFromHash(data, sKey)
+		} else {
+			m, err = decryptPointCell(ctx, cs, data, sKey, ti.colTypes[colNum])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("row %v: %w", key, err)
+		}
+		results = append(results, m)
+	}
+	return results, rows.Err()
+}
+
+// DecryptLinearCombination decrypts the linear combination Σ coeffs[c]⋅v_c of the values of cells
+// encrypted as points, given by their coordinates, see NewCoord, which may span several rows and
+// columns of the table. The points d_c = v_c⋅g + s_c of the cells are read from the encrypted
+// table of ti in db and combined with the same coefficients, then the key Σ coeffs[c]⋅s_c, rebuilt
+// from the points given by the key holders with GiveKeyCalculation, is subtracted and the discrete
+// logarithm of the result is solved. holderPoints gives the points of the key holders 1, 2, 3...
+// in this order, the holders which did not answer being left as the zero CPoint.
+// The cells must have the compact encoding of CompactPoints, whose messages are the values
+// themselves, so that the result is the combination of the values: an error wrapping ErrNotCompact
+// is returned for the other cells, such as the negative integers of a column encrypted with
+// CompactPoints. The combination must be positive and fit on the number of bytes of the types of
+// the columns, see compactBytesNumber, or ErrPointOutOfRange is returned. The encrypted table,
+// named by TableInfo.EncryptedName, is read in a single query.
+// A combination of many cells may exceed the width of the columns, see
+// DecryptLinearCombinationBits.
+func DecryptLinearCombination(db *sql.DB, ti TableInfo, coeffs map[Coord]*big.Int, holderPoints []CPoint) (*big.Int, error) {
+	keyParts := make(map[int]CPoint)
+	for k, pt := range holderPoints {
+		if pt.x != nil {
+			keyParts[k+1] = pt
+		}
+	}
+	return DecryptLinearCombinationContext(context.Background(), db, ti, coeffs, keyParts)
+}
+
+// DecryptLinearCombinationContext is DecryptLinearCombination with a context, the search being
+// abandoned with the error of ctx when ctx is done. keyParts gives the point of each key holder
+// by its number, like for CombineColumnKeys.
+func DecryptLinearCombinationContext(ctx context.Context, db *sql.DB, ti TableInfo, coeffs map[Coord]*big.Int, keyParts map[int]CPoint) (*big.Int, error) {
+	return DecryptLinearCombinationBits(ctx, db, ti, coeffs, keyParts, 0)
+}
+
+// DecryptLinearCombinationBits is DecryptLinearCombinationContext for a combination expected to fit on
+// maxBits bits instead of the width of the columns, such as the sum of many cells, which grows
+// beyond the width of each of them: the sum of 1000 cells needs 10 more bits. The discrete
+// logarithm is searched on maxBits rounded up to whole bytes, with the solver chosen for this
+// number of bytes, so that a wide combination takes much longer to solve, see chooseSolver.
+// A maxBits of 0 means the width of the columns.
+func DecryptLinearCombinationBits(ctx context.Context, db *sql.DB, ti TableInfo, coeffs map[Coord]*big.Int, keyParts map[int]CPoint, maxBits uint64) (*big.Int, error) {
+	if maxBits > KANGAROO_MAX_BYTES*8 {
+		return nil, fmt.Errorf("a combination on %d bits cannot be solved, the limit is %d bits", maxBits, KANGAROO_MAX_BYTES*8)
+	}
+	if len(coeffs) == 0 {
+		return nil, errors.New("no cell to combine")
+	}
+	s, err := CombineCalculationKeys(keyParts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The columns of the cells, which must be encrypted as points, are given by their numbers
+	colNums := make(map[string]int)
+	var bytesNumber uint64
+	for c := range coeffs {
+		if _, ok := colNums[c.j]; ok {
+			continue
+		}
+		j := -1
+		for k, name := range ti.colNames {
+			if name == c.j {
+				j = k
+			}
+		}
+		if j < 0 || ti.commands[j] != 2 {
+			return nil, fmt.Errorf("%w as points: %s in table %s", ErrNotEncryptedColumn, c.j, ti.name)
+		}
+		n, ok := compactBytesNumber(ti.colTypes[j])
+		if !ok {
+			return nil, fmt.Errorf("%w: %s has no compact encoding", ErrUnsupportedColumnType, ti.colTypes[j])
+		}
+		if n > bytesNumber {
+			bytesNumber = n
+		}
+		colNums[c.j] = j
+	}
+	cols := make([]string, 0, len(colNums))
+	for col := range colNums {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+
+	primNames := ti.columnNames(ti.primaryKey())
+	nPrim := len(primNames)
+	res, err := db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s;", strings.Join(append(primNames, cols...), ", "), ti.EncryptedName()))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	vals := make([]interface{}, nPrim+len(cols))
+	ptrs := make([]interface{}, len(vals))
+	for k := range vals {
+		ptrs[k] = &vals[k]
+	}
+	d := pointZero
+	found := 0
+	for res.Next() {
+		if err = res.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		key := ti.rowKey(vals[:nPrim])
+		for k, col := range cols {
+			coeff, ok := coeffs[coord{key, col}]
+			if !ok {
+				continue
+			}
+			found++
+			cell, ok := vals[nPrim+k].([]byte)
+			if !ok {
+				return nil, fmt.Errorf("row %v, column %s: the cell is not encrypted", key, col)
+			}
+			if CellVersion(cell, 2) != CELL_COMPACT {
+				return nil, fmt.Errorf("row %v, column %s: %w, see CompactPoints", key, col, ErrNotCompact)
+			}
+			p, err := pointFromCell(cell)
+			if err != nil {
+				return nil, fmt.Errorf("row %v, column %s: %w", key, col, err)
+			}
+			d = addC(d, p.mult(new(big.Int).Mod(coeff, N)))
+		}
+	}
+	if err = res.Err(); err != nil {
+		return nil, err
+	}
+	if found != len(coeffs) {
+		return nil, fmt.Errorf("%d of the %d cells were not found in the table", len(coeffs)-found, len(coeffs))
+	}
+
+	if maxBits > 0 {
+		bytesNumber = (maxBits + 7) / 8
+	}
+	return DiscreteLogContext(ctx, d.subC(s), bytesNumber)
+}
+
+// DecryptCalculatedDataColumn allows the data consumer to decrypt a data from a query
+// We suppose that the rows sent contains couples of primary keys - data
+
+func DecryptCalculatedDataColumn(rows *sql.Rows, ti TableInfo, colNum int, keyParts map[int]CPoint) (result []byte) {
+	// TODO
+	return
+}
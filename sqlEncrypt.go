@@ -0,0 +1,953 @@
+//go:build !nosql
+
+package elgamalcrypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"strings"
+)
+
+/*********************************************************************************************
+ *
+ * Encryption of the tables of the SQL databases, left out of the builds with the tag nosql
+ *
+ *********************************************************************************************/
+
+// SetTableKeys generates all the keys to encrypt a table of known dimensions
+// The variable returned RforEnc is made especially to allow the encryption process which is simpler
+// if the rows are indexed by their number rather than by their primary key.
+// A r value is generated for each row read, the number of rows of ti being only used as a hint,
+// and the number of rows of the table of keys is the number of rows actually read.
+// An error wrapping ErrDuplicatePrimaryKey is returned if two rows have the same primary key,
+// which could not identify their r values, see setTableKeys.
+func SetTableKeys(db *sql.DB, ti TableInfo, random io.Reader) (pubs map[string]PublicKey, keys TableKeys, RforEnc []*big.Int, err error) {
+	return setTableKeys(db, ti, random, nil)
+}
+
+// eachRowKey calls f with the key of each row of the table of ti, see CompositeKey, in the order
+// of the table. An error wrapping ErrDuplicatePrimaryKey is returned if the columns of the primary
+// key of ti have the same values in two rows, which is checked before the encryption creates its
+// destination table.
+func eachRowKey(db *sql.DB, ti TableInfo, f func(key interface{}) error) error {
+	primCols := ti.primaryKey()
+	vals := make([]interface{}, len(primCols))
+	ptrs := make([]interface{}, len(primCols))
+	for k := range vals {
+		ptrs[k] = &vals[k]
+	}
+	query, args := ti.selectRows(strings.Join(ti.columnNames(primCols), ", "))
+	primColumn, err := queryWithRetry(db, query, args...)
+	if err != nil {
+		return err
+	}
+	defer primColumn.Close()
+	seen := make(map[interface{}]bool)
+	for primColumn.Next() {
+		if err = primColumn.Scan(ptrs...); err != nil {
+			return err
+		}
+
+		if ti.pkSecret != nil {
+			for k, j := range primCols {
+				vals[k] = EncryptPrimaryKey(ti.pkSecret, canonicalValue(vals[k], ti.colTypes[j]))
+			}
+		}
+		key := ti.rowKey(vals)
+		if seen[key] {
+			return fmt.Errorf("%w: %v is the key of several rows in the columns %s of table %s", ErrDuplicatePrimaryKey, key, strings.Join(ti.columnNames(primCols), ", "), ti.name)
+		}
+		seen[key] = true
+		if err = f(key); err != nil {
+			return err
+		}
+	}
+	return primColumn.Err()
+}
+
+// setTableKeys is SetTableKeys where the rows whose key, see CompositeKey, is in given take its r
+// instead of a random one. An error wrapping ErrDuplicatePrimaryKey is returned if the columns of
+// the primary key of ti have the same values in two rows: the second r would otherwise replace the
+// first one in R, and the cells of the first row could no longer be decrypted.
+func setTableKeys(db *sql.DB, ti TableInfo, random io.Reader, given map[interface{}]*big.Int) (pubs map[string]PublicKey, keys TableKeys, RforEnc []*big.Int, err error) {
+	RforEnc = make([]*big.Int, 0, ti.nRows)
+	keys.R = make(map[interface{}]*big.Int)
+	err = eachRowKey(db, ti, func(key interface{}) (err error) {
+		r, ok := given[key]
+		if ok {
+			// The r given is copied so that the table of keys does not share it with the caller
+			r = new(big.Int).Set(r)
+		} else if r, err = randScalar(random); err != nil {
+			return
+		}
+		RforEnc = append(RforEnc, r)
+		keys.R[key] = r
+		keys.order = append(keys.order, key)
+		return
+	})
+	if err != nil {
+		return nil, TableKeys{}, nil, err
+	}
+	ti.nRows = uint64(len(RforEnc))
+	keys.ti = ti
+	keys.ti.secretPrimaryKey = ti.pkSecret != nil
+	keys.ti.pkSecret = nil
+
+	// The table of multiples of g, if enabled, is shared by the key generation of all the columns
+	mult := baseMultB
+	if BaseTableWindow > 0 {
+		mult = newBaseTable(BaseTableWindow).mult
+	}
+	pubs = make(map[string]PublicKey)
+	keys.Priv = make(map[string]PrivateKey)
+	var colN string
+	for j := uint(0); j < ti.nCol; j++ {
+		if ti.commands[j] != 0 {
+			colN = ti.colNames[j]
+			if pubs[colN], keys.Priv[colN], _, err = generateKeys(random, mult); err != nil {
+				return nil, TableKeys{}, nil, err
+			}
+		}
+	}
+	return
+}
+
+// rowInsertion returns the function inserting an encrypted row into the new table, its cells
+// being written as SQL literals of the given dialect. The insertions are retried according to
+// DBRetry, only when they are known not to have been executed.
+func rowInsertion(db *sql.DB, newName string, dialect int) func(uint64, []interface{}) error {
+	return func(i uint64, cells []interface{}) error {
+		_, err := insertWithRetry(db, fmt.Sprintf("INSERT INTO %s VALUES (%s);", newName, strings.Join(sqlLiterals(dialect, cells), ", ")))
+		return err
+	}
+}
+
+// rowCopy returns the function streaming the encrypted rows into the new table with
+// COPY ... FROM STDIN, the statement built by pq.CopyIn, which takes the cells as typed values
+// instead of SQL literals. The rows are sent in a transaction that the function end commits,
+// unless it is given the error of the encryption, in which case the copy is abandoned.
+// The columns are quoted, as pq.CopyIn does, so that a name which is a keyword is not read as it.
+func rowCopy(db *sql.DB, newName string, ti TableInfo) (emit func(uint64, []interface{}) error, end func(error) error, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	cols := make([]string, ti.nCol)
+	for j, c := range ti.colNames {
+		cols[j] = quoteIdent(c)
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf("COPY %s (%s) FROM STDIN", newName, strings.Join(cols, ", ")))
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	emit = func(i uint64, cells []interface{}) error {
+		_, err := stmt.Exec(cells...)
+		return err
+	}
+	end = func(err error) error {
+		// The copy is only flushed by an execution without values
+		if err == nil {
+			_, err = stmt.Exec()
+		}
+		if errClose := stmt.Close(); err == nil {
+			err = errClose
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+	return
+}
+
+// EncryptTable deals with the encryption of the entire SQL table
+// The variable commands contains the list of instructions for each column with:
+// commands [j] == 0 -> we do not encrypt this column
+// commands [j] == 1 -> we encrypt this column without possible calculation, i.e. with hash function
+// commands [j] == 2 -> we encrypt this column with possible calculation, i.e. with d = m⋅g and use
+// of the Pollard algorithm, which is only possible for the column types on 4 bytes (see pointBytesNumber)
+func EncryptTable(dbInit, dbFinal *sql.DB, name string, commands []byte, random io.Reader) (keys TableKeys, err error) {
+	return EncryptTableWithOptions(dbInit, dbFinal, name, commands, random, EncryptOptions{})
+}
+
+// EncryptTableWithOptions is the same as EncryptTable with the optional settings given by opts
+func EncryptTableWithOptions(dbInit, dbFinal *sql.DB, name string, commands []byte, random io.Reader, opts EncryptOptions) (keys TableKeys, err error) {
+	_, keys, err = encryptTable(dbInit, dbFinal, name, commands, random, opts)
+	return
+}
+
+// encryptTable is EncryptTableWithOptions which also returns the public keys of the encrypted
+// columns, by their names
+func encryptTable(dbInit, dbFinal *sql.DB, name string, commands []byte, random io.Reader, opts EncryptOptions) (pubs map[string]PublicKey, keys TableKeys, err error) {
+	if random, err = checkedRandom(random); err != nil {
+		return
+	}
+	var ti TableInfo
+	if opts.RowCount > 0 {
+		ti, err = describeTable(dbInit, name, commands...)
+		ti.nRows = opts.RowCount
+	} else {
+		ti, err = tableInfoFromDB(dbInit, name, commands...)
+	}
+	if err != nil {
+		return
+	}
+	// The encrypted table is written in the dialect of the destination database
+	ti.dialect = dialectOf(dbFinal)
+	if len(opts.PrimaryKey) > 0 {
+		if err = ti.setPrimaryKey(opts.PrimaryKey...); err != nil {
+			return
+		}
+		if uint(len(commands)) != ti.nCol {
+			// The default commands leave the columns of the primary key given in clear
+			ti.setDefaultCommands()
+		}
+	}
+	if opts.Where != "" && opts.RowCount > 0 {
+		ti.where, ti.whereArgs = opts.Where, opts.WhereArgs
+	} else if opts.Where != "" {
+		if err = ti.setWhere(dbInit, opts.Where, opts.WhereArgs...); err != nil {
+			return
+		}
+	}
+	if opts.Copy && ti.dialect != DIALECT_POSTGRES {
+		return nil, TableKeys{}, errors.New("COPY is only supported by Postgres")
+	}
+	if opts.Copy && opts.SkipFailedRows {
+		return nil, TableKeys{}, errors.New("the failed rows cannot be skipped with COPY")
+	}
+	if opts.PrimaryKeySecret != nil {
+		if len(opts.PrimaryKeySecret) == 0 {
+			return nil, TableKeys{}, errors.New("the secret of the primary keys is empty")
+		}
+		ti.pkSecret = opts.PrimaryKeySecret
+	}
+	ti.compactPoints = opts.CompactPoints
+	ti.rawBytes = opts.RawBytes
+	ti.minCellVersion = CELL_VERSION
+	ti.encName = opts.destination(name)
+	for k, r := range opts.R {
+		if err = checkR(r, N); err != nil {
+			return nil, TableKeys{}, fmt.Errorf("row %v: %w", k, err)
+		}
+	}
+	if opts.Resume && opts.Checkpoint == "" {
+		return nil, TableKeys{}, errors.New("the encryption cannot be resumed without its checkpoint")
+	}
+	if opts.Copy && opts.Checkpoint != "" {
+		return nil, TableKeys{}, errors.New("the encryption with COPY, which inserts all the rows at once, cannot be resumed")
+	}
+	// We check that every column can be handled before touching the destination database
+	transfers, err := checkTransfers(ti, opts)
+	if err != nil {
+		return
+	}
+
+	newName := ti.encName
+	cp := checkpoint{name: opts.Checkpoint}
+	given := opts.R
+	if opts.Resume {
+		if cp, err = resumeCheckpoint(dbFinal, ti, newName, opts.Checkpoint); err != nil {
+			return
+		}
+		given = cp.keys.R
+	} else {
+		// The duplicated primary keys are found before the destination table is created, so that
+		// an empty table is not left behind
+		if err = eachRowKey(dbInit, ti, func(interface{}) error { return nil }); err != nil {
+			return
+		}
+		/* We create the destination table */
+		for _, stmt := range createTableStatements(ti, newName) {
+			if _, err = execWithRetry(dbFinal, stmt); err != nil {
+				return
+			}
+		}
+	}
+
+	if opts.Copy {
+		copyRow, endCopy, err := rowCopy(dbFinal, newName, ti)
+		if err != nil {
+			return nil, TableKeys{}, err
+		}
+		pubs, keys, err = encryptRows(dbInit, ti, transfers, random, given, opts.bufferDepth(), cp, copyRow)
+		return pubs, keys, endCopy(err)
+	}
+	insert := rowInsertion(dbFinal, newName, ti.dialect)
+	if !opts.SkipFailedRows {
+		return encryptRows(dbInit, ti, transfers, random, given, opts.bufferDepth(), cp, insert)
+	}
+	var failures InsertErrors
+	pubs, keys, err = encryptRows(dbInit, ti, transfers, random, given, opts.bufferDepth(), cp, func(i uint64, cells []interface{}) error {
+		if err := insert(i, cells); err != nil {
+			failures = append(failures, RowError{i, err})
+		}
+		return nil
+	})
+	if err == nil && len(failures) > 0 {
+		err = failures
+	}
+	return
+}
+
+// Plan returns what EncryptTable would do with the table name for the given commands, without
+// touching the destination database. The error is the one EncryptTable would return before
+// creating the destination table.
+func Plan(db *sql.DB, name string, commands []byte) (plan EncryptionPlan, err error) {
+	ti, err := tableInfoFromDB(db, name, commands...)
+	if err != nil {
+		return
+	}
+	if _, err = checkTransfers(ti, EncryptOptions{}); err != nil {
+		return
+	}
+
+	plan.Table = ti
+	plan.NewName = EncryptOptions{}.destination(name)
+	plan.Statements = createTableStatements(ti, plan.NewName)
+	plan.Columns = make([]ColumnPlan, ti.nCol)
+	for j := uint(0); j < ti.nCol; j++ {
+		plan.Columns[j] = ColumnPlan{Name: ti.colNames[j], Type: ti.colTypes[j], DestType: ti.colTypes[j], Mode: ti.commands[j]}
+		if ti.commands[j] != 0 {
+			plan.Columns[j].DestType = binaryType(ti.dialect)
+		}
+		if ti.commands[j] == 2 {
+			plan.PointCells += ti.nRows
+		}
+	}
+	return
+}
+
+// EncryptTableStream encrypts the table like EncryptTable but, instead of inserting the rows into
+// a new table, it calls emit with the index of each encrypted row and its cells, written as SQL
+// literals of the dialect of db in the order of the columns. The encryption stops at the first
+// error returned by emit.
+func EncryptTableStream(db *sql.DB, name string, commands []byte, random io.Reader, emit func(rowIndex uint64, cells []string) error) (keys TableKeys, err error) {
+	if random, err = checkedRandom(random); err != nil {
+		return
+	}
+	ti, err := tableInfoFromDB(db, name, commands...)
+	if err != nil {
+		return
+	}
+	transfers, err := checkTransfers(ti, EncryptOptions{})
+	if err != nil {
+		return
+	}
+	_, keys, err = encryptRows(db, ti, transfers, random, nil, DEFAULT_BUFFER_DEPTH, checkpoint{}, func(i uint64, cells []interface{}) error {
+		return emit(i, sqlLiterals(ti.dialect, cells))
+	})
+	return
+}
+
+// OutputFormat is the format of the files written by EncryptTableToWriter
+type OutputFormat int
+
+// Formats of the files written by EncryptTableToWriter. Both are CSV, read by encoding/csv or by
+// COPY ... CSV of Postgres: OUTPUT_CSV gives a line with the names of the columns then one line
+// per row, OUTPUT_COLUMNS gives one line per column, its name followed by its cells in the order
+// of the rows.
+const (
+	OUTPUT_CSV OutputFormat = iota
+	OUTPUT_COLUMNS
+)
+
+// EncryptTableToWriter encrypts the table like EncryptTable but writes the encrypted rows to w
+// in the given format instead of a new table. The encrypted cells are written in hexadecimal,
+// the NULL cells as empty fields and the empty texts as "", which COPY ... CSV tells apart. A cell
+// of a type which has no field makes the function fail. The rows are written as they are encrypted with OUTPUT_CSV,
+// while OUTPUT_COLUMNS keeps the whole table in memory until the last row is encrypted.
+func EncryptTableToWriter(db *sql.DB, name string, commands []byte, random io.Reader, w io.Writer, format OutputFormat) (keys TableKeys, err error) {
+	if format != OUTPUT_CSV && format != OUTPUT_COLUMNS {
+		return keys, fmt.Errorf("unknown output format %d", format)
+	}
+	if random, err = checkedRandom(random); err != nil {
+		return
+	}
+	ti, err := tableInfoFromDB(db, name, commands...)
+	if err != nil {
+		return
+	}
+	transfers, err := checkTransfers(ti, EncryptOptions{})
+	if err != nil {
+		return
+	}
+
+	out := bufio.NewWriter(w)
+	columns := make([][]csvField, ti.nCol)
+	header := make([]csvField, ti.nCol)
+	for j := range columns {
+		header[j] = csvField{text: ti.colNames[j]}
+		columns[j] = []csvField{header[j]}
+	}
+	if format == OUTPUT_CSV {
+		if err = writeCSV(out, header); err != nil {
+			return
+		}
+	}
+	_, keys, err = encryptRows(db, ti, transfers, random, nil, DEFAULT_BUFFER_DEPTH, checkpoint{}, func(i uint64, cells []interface{}) error {
+		fields, err := csvFields(cells)
+		if err != nil {
+			return fmt.Errorf("row %d: %w", i, err)
+		}
+		if format == OUTPUT_CSV {
+			return writeCSV(out, fields)
+		}
+		for j, f := range fields {
+			columns[j] = append(columns[j], f)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if format == OUTPUT_COLUMNS {
+		for _, col := range columns {
+			if err = writeCSV(out, col); err != nil {
+				return
+			}
+		}
+	}
+	err = out.Flush()
+	return
+}
+
+// csvField is a field of the files written by EncryptTableToWriter, null for the NULL cells
+type csvField struct {
+	text string
+	null bool
+}
+
+// csvFields writes the cells of an encrypted row as fields of EncryptTableToWriter. An error is
+// returned for a cell of a type which has no SQL literal.
+func csvFields(cells []interface{}) ([]csvField, error) {
+	fields := make([]csvField, len(cells))
+	for j, c := range cells {
+		switch v := c.(type) {
+		case nil:
+			fields[j].null = true
+		case []byte:
+			fields[j].text = hex.EncodeToString(v)
+		case string:
+			fields[j].text = v
+		case bool, int64, float32, float64:
+			fields[j].text = sqlLiteral(DIALECT_POSTGRES, v)
+		default:
+			return nil, fmt.Errorf("column %d: no CSV field for a cell of type %T", j, v)
+		}
+	}
+	return fields, nil
+}
+
+// writeCSV writes a record of fields as a line of CSV, like encoding/csv except that the empty
+// texts are quoted, so that they are not read as NULL by COPY ... CSV
+func writeCSV(w *bufio.Writer, record []csvField) error {
+	for j, f := range record {
+		if j > 0 {
+			w.WriteByte(',')
+		}
+		switch {
+		case f.null:
+		case f.text == "" || f.text == `\.` || strings.ContainsAny(f.text, ",\"\r\n") || f.text[0] == ' ' || f.text[0] == '\t':
+			w.WriteByte('"')
+			w.WriteString(strings.ReplaceAll(f.text, `"`, `""`))
+			w.WriteByte('"')
+		default:
+			w.WriteString(f.text)
+		}
+	}
+	_, err := w.WriteString("\n")
+	return err
+}
+
+// resumeCheckpoint reads the checkpoint name of the encryption of the table of ti into newName,
+// and the keys of the rows already in newName. The checkpoint must be the one of the same table
+// and commands.
+func resumeCheckpoint(db *sql.DB, ti TableInfo, newName, name string) (cp checkpoint, err error) {
+	keys, err := LoadTableKeys(name)
+	if err != nil {
+		return cp, fmt.Errorf("checkpoint: %w", err)
+	}
+	if keys.ti.name != ti.name || !reflect.DeepEqual(keys.ti.colNames, ti.colNames) || !bytes.Equal(keys.ti.commands, ti.commands) {
+		return cp, fmt.Errorf("the checkpoint %s is not the one of the encryption of the table %s", name, ti.name)
+	}
+	primCols := ti.primaryKey()
+	vals := make([]interface{}, len(primCols))
+	ptrs := make([]interface{}, len(primCols))
+	for k := range vals {
+		ptrs[k] = &vals[k]
+	}
+	rows, err := queryWithRetry(db, fmt.Sprintf("SELECT %s FROM %s;", strings.Join(ti.columnNames(primCols), ", "), newName))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	cp = checkpoint{name: name, keys: &keys, done: make(map[interface{}]bool)}
+	for rows.Next() {
+		if err = rows.Scan(ptrs...); err != nil {
+			return
+		}
+		key := ti.rowKey(vals)
+		if _, ok := keys.R[key]; !ok {
+			return cp, fmt.Errorf("the row %v of the encrypted table is not in the checkpoint", key)
+		}
+		cp.done[key] = true
+	}
+	return cp, rows.Err()
+}
+
+// encryptRows is the pipeline shared by the encryption functions. Each column of the table is
+// read from db and handled by its own routine, which encrypts or transfers it, and the cells
+// of each row are then handed to emit in the order of the table. The channels between the
+// routines buffer depth cells. The public keys generated for the encrypted columns are returned
+// with the table of keys. The rows whose key is in given are encrypted with its r, see
+// EncryptOptions.R. The table of keys is recorded in the checkpoint cp before any row is emitted
+// and, when the encryption is resumed, the keys of cp are used and the rows it has done are
+// neither encrypted nor emitted, the others keeping their index in the table.
+func encryptRows(db *sql.DB, ti TableInfo, transfers []func(chan interface{}, chan interface{}), random io.Reader, given map[interface{}]*big.Int, depth int, cp checkpoint, emit func(uint64, []interface{}) error) (pubs map[string]PublicKey, keys TableKeys, err error) {
+	// We get the columns of the table
+	columns := make([]*sql.Rows, ti.nCol)
+	for j := uint(0); j < ti.nCol; j++ {
+		query, args := ti.selectRows(ti.colNames[j])
+		if columns[j], err = queryWithRetry(db, query, args...); err != nil {
+			for _, c := range columns[:j] {
+				c.Close()
+			}
+			return
+		}
+	}
+
+	/* We create the table of keys used for the encryption */
+	var RforEnc []*big.Int
+	pubs, keys, RforEnc, err = setTableKeys(db, ti, random, given)
+	if err != nil {
+		for _, c := range columns {
+			c.Close()
+		}
+		return
+	}
+	nRows := uint64(len(RforEnc))
+	var keep []bool
+	if cp.keys != nil {
+		keys.Priv = cp.keys.Priv
+		for col, priv := range keys.Priv {
+			pubs[col] = PublicKey{Curve: myCurve, Y: baseMultB(priv[0])}
+		}
+		// Only the rows not done are encrypted, with their r, and emitted with their index
+		keep = make([]bool, nRows)
+		var pending []uint64
+		var rs []*big.Int
+		for i, key := range keys.order {
+			if !cp.done[key] {
+				keep[i] = true
+				pending = append(pending, uint64(i))
+				rs = append(rs, RforEnc[i])
+			}
+		}
+		RforEnc = rs
+		emitAll := emit
+		emit = func(i uint64, cells []interface{}) error {
+			return emitAll(pending[i], cells)
+		}
+	}
+	if err = cp.record(keys); err != nil {
+		for _, c := range columns {
+			c.Close()
+		}
+		return
+	}
+
+	/* We declare all the variables and launch the encryption and insertion routines */
+	// cEnd is used to keep the main routine running until the last row is emitted
+	cEnd := make(chan error)
+	// cEnc contains the channels that go from the main routine to the encryption routines
+	cEnc := make([]chan interface{}, ti.nCol)
+	// cIns contains the channels that go from the encryption routines to the collection routine
+	cIns := make([]chan interface{}, ti.nCol)
+	for j := uint(0); j < ti.nCol; j++ {
+		cEnc[j] = make(chan interface{}, depth)
+		cIns[j] = make(chan interface{}, depth)
+		switch ti.commands[j] {
+		case 0:
+			go transfers[j](cEnc[j], cIns[j])
+		case 1:
+			go encryptHash(cEnc[j], cIns[j], pubs[ti.colNames[j]].Y, RforEnc)
+		case 2:
+			go encryptPoint(cEnc[j], cIns[j], pubs[ti.colNames[j]].Y, RforEnc, ti.compactPoints, ti.colTypes[j])
+		default:
+			go encryptHash(cEnc[j], cIns[j], pubs[ti.colNames[j]].Y, RforEnc)
+		}
+	}
+	go rowCollection(cIns, cEnd, emit)
+
+	// The rows are read as long as the columns give some, the routines being stopped by the
+	// closing of their channels. As the cells are encrypted with the r values in the order of
+	// the rows, a column giving a different number of rows than the others or than the query of
+	// the keys, for instance because the table changed in between, is an error.
+	readErr := readColumns(columns, ti, cEnc, nRows, keep)
+	for j := range cEnc {
+		close(cEnc[j])
+	}
+	err = <-cEnd
+	if readErr != nil {
+		err = readErr
+	}
+	return
+}
+
+// readColumns reads the rows of the columns and sends each cell, in the canonical form of the type
+// of its column or as the value of its raw bytes, see rawValue, to the channel of its column,
+// checking that the columns give the same number nRows of rows. Only complete rows are sent, and
+// only the rows i for which keep[i] is true when keep is not nil.
+func readColumns(columns []*sql.Rows, ti TableInfo, cEnc []chan interface{}, nRows uint64, keep []bool) error {
+	defer func() {
+		for _, c := range columns {
+			c.Close()
+		}
+	}()
+	row := make([]interface{}, len(columns))
+	raw := make([]sql.RawBytes, len(columns))
+	for i := uint64(0); ; i++ {
+		more := 0
+		for j, c := range columns {
+			if !c.Next() {
+				if err := c.Err(); err != nil {
+					return err
+				}
+				continue
+			}
+			more++
+			dest := interface{}(&row[j])
+			if ti.scansRaw(uint(j)) {
+				dest = &raw[j]
+			}
+			if err := c.Scan(dest); err != nil {
+				return err
+			}
+		}
+		switch {
+		case more == 0 && i == nRows:
+			return nil
+		case more == 0:
+			return fmt.Errorf("%d rows were read for %d r values, the table changed during the encryption", i, nRows)
+		case more < len(columns):
+			return fmt.Errorf("the columns have different numbers of rows after %d rows, the table changed during the encryption", i)
+		case i == nRows:
+			return fmt.Errorf("more than the %d rows with a r value were read, the table changed during the encryption", nRows)
+		}
+		if keep != nil && !keep[i] {
+			continue
+		}
+		for j := range cEnc {
+			if !ti.scansRaw(uint(j)) {
+				cEnc[j] <- canonicalValue(row[j], ti.colTypes[j])
+				continue
+			}
+			// The raw bytes are only valid until the next row of the column is read
+			v, err := rawValue(raw[j], ti.colTypes[j], ti.commands[j])
+			if err != nil {
+				return fmt.Errorf("column %s, row %d: %v", ti.colNames[j], i, err)
+			}
+			cEnc[j] <- v
+		}
+	}
+}
+
+// rawValue returns the value of a cell of type colType scanned as raw bytes, see
+// EncryptOptions.RawBytes: a copy of the bytes for the binary data, the integer or the boolean
+// of the text, see plainValue, for the columns encrypted as points, and the text otherwise.
+func rawValue(b []byte, colType string, command byte) (interface{}, error) {
+	switch {
+	case b == nil:
+		return nil, nil
+	case command == 2:
+		return plainValue(b, colType)
+	case colType == "BYTEA" || colType == "BLOB":
+		return append([]byte(nil), b...), nil
+	}
+	return string(b), nil
+}
+
+// AppendRows encrypts the rows of the source table whose primary keys are given in newPrimaryKeys
+// and appends them to the encrypted table, which must have been created by EncryptTable.
+// A fresh r is generated for each new row and added to keys.R, while the public keys of the
+// columns are the ones derived from keys.Priv, so that the whole table stays consistent.
+// If the primary key is made of several columns, each element of newPrimaryKeys is a
+// []interface{} with the values of these columns. The encrypted table is the one named by ti,
+// or else by keys, see TableInfo.EncryptedName. The rows are encrypted with the settings of
+// EncryptTable recorded in keys, such as CompactPoints, and a NULL value in an encrypted column is
+// refused with an error wrapping ErrNullValue. The primary keys of a table encrypted with
+// PrimaryKeySecret are appended with AppendRowsWithOptions, the secret not being kept in keys.
+func AppendRows(dbSource, dbEnc *sql.DB, ti TableInfo, keys TableKeys, newPrimaryKeys []interface{}, random io.Reader) error {
+	return AppendRowsWithOptions(dbSource, dbEnc, ti, keys, newPrimaryKeys, random, EncryptOptions{})
+}
+
+// AppendRowsWithOptions is AppendRows for a table encrypted with PrimaryKeySecret, which opts must
+// give again, or with ByteaFallback. The other options are not read, the settings of the
+// encryption being those recorded in keys. The primary keys in newPrimaryKeys are the values of
+// the source table, and the keys of the new rows in keys.R those encrypted with the secret.
+func AppendRowsWithOptions(dbSource, dbEnc *sql.DB, ti TableInfo, keys TableKeys, newPrimaryKeys []interface{}, random io.Reader, opts EncryptOptions) error {
+	random, err := checkedRandom(random)
+	if err != nil {
+		return err
+	}
+	if keys.ti.secretPrimaryKey && len(opts.PrimaryKeySecret) == 0 {
+		return errors.New("the primary keys of the table are encrypted with a secret, which must be given")
+	}
+	ti.dialect = dialectOf(dbEnc)
+	ti.compactPoints, ti.rawBytes = keys.ti.compactPoints, keys.ti.rawBytes
+	if keys.ti.secretPrimaryKey {
+		ti.pkSecret = opts.PrimaryKeySecret
+	}
+	transfers, err := checkTransfers(ti, opts)
+	if err != nil {
+		return err
+	}
+
+	pubYs, err := publicPoints(ti, keys)
+	if err != nil {
+		return err
+	}
+
+	primCols := ti.primaryKey()
+	primNames := ti.columnNames(primCols)
+	conditions := make([]string, len(primNames))
+	for k, c := range primNames {
+		conditions[k] = fmt.Sprintf("%s = $%d", c, k+1)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s;", strings.Join(ti.colNames, ", "), ti.name, strings.Join(conditions, " AND "))
+	insert := rowInsertion(dbEnc, encryptedName(ti, keys), ti.dialect)
+	vals := make([]interface{}, ti.nCol)
+	raw := make([]sql.RawBytes, ti.nCol)
+	ptrs := make([]interface{}, ti.nCol)
+	for j := range vals {
+		ptrs[j] = &vals[j]
+		if ti.scansRaw(uint(j)) {
+			ptrs[j] = &raw[j]
+		}
+	}
+
+	for _, pk := range newPrimaryKeys {
+		pkVals := []interface{}{pk}
+		if len(primNames) > 1 {
+			tuple, ok := pk.([]interface{})
+			if !ok || len(tuple) != len(primNames) {
+				return fmt.Errorf("the primary key %v does not have the %d values of columns %s", pk, len(primNames), strings.Join(primNames, ", "))
+			}
+			pkVals = tuple
+		}
+		keyVals := pkVals
+		if ti.pkSecret != nil {
+			keyVals = make([]interface{}, len(pkVals))
+			for k, j := range primCols {
+				keyVals[k] = EncryptPrimaryKey(ti.pkSecret, canonicalValue(pkVals[k], ti.colTypes[j]))
+			}
+		}
+		rowKey := ti.rowKey(keyVals)
+		if _, exists := keys.R[rowKey]; exists {
+			return fmt.Errorf("the row of primary key %v is already encrypted", pk)
+		}
+		if err = scanRow(dbSource, query, pkVals, ptrs); err != nil {
+			return fmt.Errorf("row of primary key %v: %v", pk, err)
+		}
+
+		r, err := randScalar(random)
+		if err != nil {
+			return err
+		}
+
+		cells := make([]interface{}, ti.nCol)
+		for j := uint(0); j < ti.nCol; j++ {
+			if ti.scansRaw(j) {
+				if vals[j], err = rawValue(raw[j], ti.colTypes[j], ti.commands[j]); err != nil {
+					return fmt.Errorf("row of primary key %v, column %s: %v", pk, ti.colNames[j], err)
+				}
+			} else {
+				vals[j] = canonicalValue(vals[j], ti.colTypes[j])
+			}
+			if ti.commands[j] != 0 && vals[j] == nil {
+				return fmt.Errorf("row of primary key %v, column %s: %w cannot be encrypted", pk, ti.colNames[j], ErrNullValue)
+			}
+			switch ti.commands[j] {
+			case 0:
+				cells[j] = transferOne(transfers[j], vals[j])
+			case 2:
+				cells[j], err = pointCellOf(vals[j], pubYs[ti.colNames[j]].mult(r), ti.compactPoints, ti.colTypes[j])
+				if err != nil {
+					return fmt.Errorf("row of primary key %v, column %s: %w", pk, ti.colNames[j], err)
+				}
+			default:
+				m := GetBytes(vals[j])
+				if err = checkMessageLength(len(m)); err != nil {
+					return fmt.Errorf("row of primary key %v, column %s: %w", pk, ti.colNames[j], err)
+				}
+				cells[j] = sealHashData(m, pubYs[ti.colNames[j]].mult(r))
+			}
+			if err, ok := cells[j].(error); ok {
+				return fmt.Errorf("row of primary key %v, column %s: %w", pk, ti.colNames[j], err)
+			}
+		}
+		if err = insert(0, cells); err != nil {
+			return fmt.Errorf("row of primary key %v: %v", pk, err)
+		}
+		keys.R[rowKey] = r
+	}
+	return nil
+}
+
+// scanRow scans into ptrs the single row given by query with args. The rows are read with Query,
+// Row.Scan not accepting the sql.RawBytes of the columns scanned raw.
+func scanRow(db *sql.DB, query string, args []interface{}, ptrs []interface{}) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	return rows.Scan(ptrs...)
+}
+
+// encryptedName returns the name of the encrypted table of ti, the one recorded in keys when ti
+// does not come from the encryption, as the descriptions read from the source database
+func encryptedName(ti TableInfo, keys TableKeys) string {
+	if ti.encName == "" {
+		return keys.ti.EncryptedName()
+	}
+	return ti.EncryptedName()
+}
+
+// ReblindTable encrypts again all the cells of the encrypted table created by EncryptTable with
+// fresh r values, without changing their plaintexts nor the public keys of the columns. Each cell
+// goes from the shared secret r_old⋅Y to r_new⋅Y like in RekeyCell: the points are shifted by
+// (r_new - r_old)⋅Y and the hash encrypted data is XORed with the hashes of both secrets.
+// The rows are updated in a single transaction. The table of keys returned holds the new r
+// values, without which the cells can no longer be decrypted, while keys is left unchanged.
+// The encrypted table is the one named by ti, or else by keys, see TableInfo.EncryptedName.
+func ReblindTable(dbEnc *sql.DB, ti TableInfo, keys TableKeys, random io.Reader) (newKeys TableKeys, err error) {
+	if random, err = checkedRandom(random); err != nil {
+		return
+	}
+	ti.dialect = dialectOf(dbEnc)
+	pubYs, err := publicPoints(ti, keys)
+	if err != nil {
+		return
+	}
+	name := encryptedName(ti, keys)
+
+	// The rows are read before being updated, so that no query stays open during the updates
+	var rows [][]interface{}
+	res, err := dbEnc.Query(fmt.Sprintf("SELECT %s FROM %s;", strings.Join(ti.colNames, ", "), name))
+	if err != nil {
+		return
+	}
+	for res.Next() {
+		vals := make([]interface{}, ti.nCol)
+		ptrs := make([]interface{}, ti.nCol)
+		for j := range vals {
+			ptrs[j] = &vals[j]
+		}
+		if err = res.Scan(ptrs...); err != nil {
+			res.Close()
+			return
+		}
+		rows = append(rows, vals)
+	}
+	res.Close()
+	if err = res.Err(); err != nil {
+		return
+	}
+
+	primCols := ti.primaryKey()
+	conditions := make([]string, len(primCols))
+	for k, c := range ti.columnNames(primCols) {
+		conditions[k] = fmt.Sprintf("%s = $%d", c, k+1)
+	}
+	tx, err := dbEnc.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	newKeys = TableKeys{ti: keys.ti, Priv: keys.Priv, R: make(map[interface{}]*big.Int, len(keys.R))}
+	for _, vals := range rows {
+		pkVals := make([]interface{}, len(primCols))
+		for k, j := range primCols {
+			pkVals[k] = vals[j]
+		}
+		rowKey := ti.rowKey(pkVals)
+		rOld, ok := keys.R[rowKey]
+		if !ok {
+			return TableKeys{}, fmt.Errorf("no r for the row %v", rowKey)
+		}
+		r, err := randScalar(random)
+		if err != nil {
+			return TableKeys{}, err
+		}
+
+		var sets []string
+		for j := uint(0); j < ti.nCol; j++ {
+			if ti.commands[j] == 0 {
+				continue
+			}
+			cell, ok := vals[j].([]byte)
+			if !ok {
+				return TableKeys{}, fmt.Errorf("row %v: the cell of column %s is not binary", rowKey, ti.colNames[j])
+			}
+			Y := pubYs[ti.colNames[j]]
+			mode := ti.commands[j]
+			if mode != 2 {
+				mode = 1
+			}
+			if cell, err = reencryptCell(cell, mode, Y.mult(rOld), Y.mult(r)); err != nil {
+				return TableKeys{}, fmt.Errorf("row %v, column %s: %v", rowKey, ti.colNames[j], err)
+			}
+			sets = append(sets, fmt.Sprintf("%s = %s", ti.colNames[j], hexLiteral(ti.dialect, cell)))
+		}
+		if len(sets) > 0 {
+			update := fmt.Sprintf("UPDATE %s SET %s WHERE %s;", name, strings.Join(sets, ", "), strings.Join(conditions, " AND "))
+			if _, err = tx.Exec(update, pkVals...); err != nil {
+				return TableKeys{}, fmt.Errorf("row %v: %v", rowKey, err)
+			}
+		}
+		newKeys.R[rowKey] = r
+	}
+	if err = tx.Commit(); err != nil {
+		return TableKeys{}, err
+	}
+	return newKeys, nil
+}
+
+// EncryptDatabase will encrypt all the tables of a database
+// The public keys of the encrypted columns, needed to build encrypted queries, are returned
+// by table and by column next to the tables of keys.
+// It stops at the first table whose encryption fails.
+func EncryptDatabase(dbSource, dbDest *sql.DB, tableNames []string, commands map[string][]byte) (keysDB map[string]TableKeys, pubsDB map[string]map[string]PublicKey, err error) {
+	keysDB = make(map[string]TableKeys)
+	pubsDB = make(map[string]map[string]PublicKey)
+	for _, name := range tableNames {
+		pubsDB[name], keysDB[name], err = encryptTable(dbSource, dbDest, name, commands[name], rand.Reader, EncryptOptions{})
+		if err != nil {
+			return keysDB, pubsDB, fmt.Errorf("table %s: %v", name, err)
+		}
+	}
+	return keysDB, pubsDB, nil
+}
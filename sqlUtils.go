@@ -0,0 +1,319 @@
+//go:build !nosql
+
+package elgamalcrypto
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*********************************************************************************************
+ *
+ * Access to the SQL databases, left out of the builds with the tag nosql
+ *
+ *********************************************************************************************/
+
+// setWhere restricts the rows of the table to the ones matching the condition where, whose
+// placeholders $1, $2... are bound to args, and counts them
+func (ti *TableInfo) setWhere(db *sql.DB, where string, args ...interface{}) error {
+	ti.where, ti.whereArgs = where, args
+	return ti.countRows(db)
+}
+
+// countRows sets the number of rows of the table to the number of rows selected
+func (ti *TableInfo) countRows(db *sql.DB) error {
+	query, qArgs := ti.selectRows("COUNT (*)")
+	return withRetry(func() error {
+		return db.QueryRow(query, qArgs...).Scan(&ti.nRows)
+	})
+}
+
+// tableInfoFromDB describes the table name of db and counts its rows, see describeTable
+func tableInfoFromDB(db *sql.DB, name string, comm ...byte) (ti TableInfo, err error) {
+	if ti, err = describeTable(db, name, comm...); err != nil {
+		return
+	}
+	err = ti.countRows(db)
+	return
+}
+
+// describeTable is tableInfoFromDB without the number of rows, whose count requires a full scan
+// of the table. The errors of the database, such as for a table which does not exist, are returned.
+func describeTable(db *sql.DB, name string, comm ...byte) (ti TableInfo, err error) {
+	ti.name = name
+	ti.dialect = dialectOf(db)
+	ti.primCols = []uint{PRIM_COL_NUMBER}
+	/* We get the dimensions of the table and the names of the columns */
+	oneRow, err := queryWithRetry(db, fmt.Sprintf("SELECT * FROM %s LIMIT 1;", name))
+	if err != nil {
+		return
+	}
+	ti.colNames, err = oneRow.Columns()
+	oneRow.Close()
+	if err != nil {
+		return
+	}
+	ti.nCol = uint(len(ti.colNames))
+
+	/* We get the data types in the columns */
+	// The types are matched with the columns by name, so that they are aligned
+	// with the order of colNames whatever the order of the rows
+	var types map[string]string
+	if ti.dialect == DIALECT_SQLITE {
+		types, err = sqliteColumnTypes(db, name)
+	} else {
+		types, err = postgresColumnTypes(db, name)
+	}
+	if err != nil {
+		return
+	}
+	ti.colTypes = make([]string, ti.nCol)
+	for j, c := range ti.colNames {
+		var ok bool
+		if ti.colTypes[j], ok = types[c]; !ok {
+			return ti, fmt.Errorf("no type found for column %s of table %s", c, name)
+		}
+	}
+
+	if (ti.nCol > 0) && (uint(len(comm)) != ti.nCol) {
+		ti.setDefaultCommands()
+	} else {
+		ti.commands = comm
+	}
+	return
+}
+
+// setDefaultCommands sets the commands used when none are given: everything is encrypted without
+// calculation except the columns of the primary key, the first column if it was not set, see
+// setPrimaryKey. It must be called again once the primary key is set.
+func (ti *TableInfo) setDefaultCommands() {
+	ti.commands = make([]byte, ti.nCol)
+	for j := uint(0); j < ti.nCol; j++ {
+		if !ti.isPrimaryKey(j) {
+			ti.commands[j] = 1
+		}
+	}
+}
+
+// postgresColumnTypes returns the types of the columns of the table name by their names, read
+// from the information schema. The information schema only gives ARRAY as the type of the
+// arrays, and USER-DEFINED as the one of the composite types and the enumerations: their types
+// are then found from the name of the type in the database, which for an array is the name of
+// the type of its elements preceded by an underscore. The name of a type defined by the user is
+// quoted, see isUserDefinedType, so that it keeps its case in the encrypted table.
+func postgresColumnTypes(db *sql.DB, name string) (map[string]string, error) {
+	// The schema is needed to avoid mixing tables of the same name, a table without schema being
+	// the one of the current schema, first in the search path
+	schema, table := splitTableName(name)
+	query := "SELECT column_name, data_type, character_maximum_length, udt_name FROM information_schema.columns WHERE table_name = $1"
+	args := []interface{}{table}
+	if schema != "" {
+		query += " AND table_schema = $2"
+		args = append(args, schema)
+	} else {
+		query += " AND table_schema = current_schema()"
+	}
+	rowsColTypes, err := queryWithRetry(db, query+" ORDER BY ordinal_position;", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rowsColTypes.Close()
+	types := make(map[string]string)
+	var colName, colType, udtName string
+	var colLength sql.NullInt64
+	for rowsColTypes.Next() {
+		if err = rowsColTypes.Scan(&colName, &colType, &colLength, &udtName); err != nil {
+			return nil, err
+		}
+		switch colType = strings.ToUpper(colType); colType {
+		case "ARRAY":
+			colType = strings.ToUpper(strings.TrimPrefix(udtName, "_")) + "[]"
+		case "USER-DEFINED":
+			colType = quoteIdent(udtName)
+		}
+		types[colName] = colType
+		// The declared length of the character types is kept so that the copied columns
+		// are created with the same length, CHARACTER alone meaning CHARACTER(1)
+		if colLength.Valid {
+			types[colName] += fmt.Sprintf("(%d)", colLength.Int64)
+		}
+	}
+	return types, rowsColTypes.Err()
+}
+
+// sqliteColumnTypes returns the types of the columns of the table name by their names, as they
+// are declared in the table, which includes their length
+func sqliteColumnTypes(db *sql.DB, name string) (map[string]string, error) {
+	schema, table := splitTableName(name)
+	pragma := "PRAGMA table_info"
+	if schema != "" {
+		pragma = fmt.Sprintf("PRAGMA %s.table_info", quoteIdent(schema))
+	}
+	rowsColTypes, err := queryWithRetry(db, fmt.Sprintf("%s(%s);", pragma, quoteIdent(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rowsColTypes.Close()
+	types := make(map[string]string)
+	var cid, notNull, pk int
+	var colName, colType string
+	var dflt interface{}
+	for rowsColTypes.Next() {
+		if err = rowsColTypes.Scan(&cid, &colName, &colType, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		types[colName] = strings.ToUpper(colType)
+	}
+	return types, rowsColTypes.Err()
+}
+
+// dialectOf returns the dialect of SQL spoken by the database db, found from the type of its
+// driver. The databases which are not recognized are supposed to speak the one of Postgres.
+func dialectOf(db *sql.DB) int {
+	if strings.Contains(strings.ToLower(fmt.Sprintf("%T", db.Driver())), "sqlite") {
+		return DIALECT_SQLITE
+	}
+	return DIALECT_POSTGRES
+}
+
+// RetryPolicy tells how the operations of EncryptTable on the databases are retried after a
+// transient error, such as a lost connection: an operation is run at most MaxAttempts times, the
+// wait before each new attempt starting at Backoff and doubling after each failure. The other
+// errors, such as a syntax error or a missing table, are returned at once.
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+// DBRetry is the retry policy of the queries reading the source table and of the statements
+// creating and filling the encrypted table. A MaxAttempts of 1 disables the retries. An insertion
+// failing on a lost connection may have been executed by the server nonetheless, so it is only
+// retried when the error shows that it was not, see isUnexecuted.
+var DBRetry = RetryPolicy{MaxAttempts: 3, Backoff: 100 * time.Millisecond}
+
+// isTransient tells if the error of a database operation may disappear by running it again: a
+// connection unusable or lost, or the Postgres errors of the classes 08 (connection exception),
+// 53 (insufficient resources) and 57P (operator intervention).
+func isTransient(err error) bool {
+	var netErr net.Error
+	var state interface{ SQLState() string }
+	switch {
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &netErr):
+		return true
+	case errors.As(err, &state):
+		code := state.SQLState()
+		return strings.HasPrefix(code, "08") || strings.HasPrefix(code, "53") || strings.HasPrefix(code, "57P")
+	}
+	return false
+}
+
+// isUnexecuted tells if a statement which failed with err is known not to have been executed, so
+// that running it again cannot apply it twice: the driver refused it before sending it with
+// driver.ErrBadConn, or the server answered with a transient error, having rolled the statement
+// back. A connection lost while waiting for the answer leaves the statement in doubt.
+func isUnexecuted(err error) bool {
+	var state interface{ SQLState() string }
+	return errors.Is(err, driver.ErrBadConn) || errors.As(err, &state) && isTransient(err)
+}
+
+// withRetry runs op according to DBRetry until it succeeds or fails with an error that is not
+// transient, and returns its last error
+func withRetry(op func() error) error {
+	return retryWhile(isTransient, op)
+}
+
+// retryWhile runs op according to DBRetry until it succeeds or fails with an error for which
+// retryable is false, and returns its last error
+func retryWhile(retryable func(error) bool, op func() error) (err error) {
+	wait := DBRetry.Backoff
+	for attempt := 1; ; attempt++ {
+		if err = op(); err == nil || attempt >= DBRetry.MaxAttempts || !retryable(err) {
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// queryWithRetry is db.Query retried according to DBRetry
+func queryWithRetry(db *sql.DB, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	err = withRetry(func() (err error) {
+		rows, err = db.Query(query, args...)
+		return
+	})
+	return
+}
+
+// execWithRetry is db.Exec retried according to DBRetry
+func execWithRetry(db *sql.DB, query string, args ...interface{}) (res sql.Result, err error) {
+	err = withRetry(func() (err error) {
+		res, err = db.Exec(query, args...)
+		return
+	})
+	return
+}
+
+// insertWithRetry is db.Exec retried according to DBRetry for a statement which must not be
+// executed twice, such as an insertion: only the errors for which isUnexecuted is true are retried
+func insertWithRetry(db *sql.DB, query string, args ...interface{}) (res sql.Result, err error) {
+	err = retryWhile(isUnexecuted, func() (err error) {
+		res, err = db.Exec(query, args...)
+		return
+	})
+	return
+}
+
+// LoadCommands reads the commands of EncryptDatabase from the JSON file name, which gives for
+// each table the command of its columns by their names, like {"users": {"name": 1, "age": 2}}.
+// The commands are put in the order of the columns of the tables found in db, the columns
+// which are not named being copied without encryption. An error is returned if a named table or
+// column does not exist or if a command is not 0, 1 or 2.
+func LoadCommands(name string, db *sql.DB) (commands map[string][]byte, err error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return
+	}
+	var config map[string]map[string]byte
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("file of commands %s: %v", name, err)
+	}
+
+	commands = make(map[string][]byte, len(config))
+	for table, cols := range config {
+		ti, err := tableInfoFromDB(db, table)
+		if err != nil {
+			return nil, fmt.Errorf("file of commands %s, table %s: %w", name, table, err)
+		}
+		index := make(map[string]int, ti.nCol)
+		for j, c := range ti.colNames {
+			index[c] = j
+		}
+		commands[table] = make([]byte, ti.nCol)
+		// The columns are sorted so that the error does not depend on the order of the map
+		names := make([]string, 0, len(cols))
+		for c := range cols {
+			names = append(names, c)
+		}
+		sort.Strings(names)
+		for _, c := range names {
+			j, ok := index[c]
+			if !ok {
+				return nil, fmt.Errorf("table %s has no column %s", table, c)
+			}
+			if cols[c] > 2 {
+				return nil, fmt.Errorf("column %s of table %s: invalid command %d", c, table, cols[c])
+			}
+			commands[table][j] = cols[c]
+		}
+	}
+	return commands, nil
+}
@@ -3,14 +3,15 @@ package elgamalcrypto
 import (
 	"bytes"
 	"crypto/elliptic"
+	"crypto/sha256"
 	"crypto/sha512"
-	"database/sql"
 	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"math"
 	"math/big"
+	"strconv"
 	"strings"
 )
 
@@ -51,6 +52,7 @@ type PublicKey struct {
 // PrivateKey can be seen as a first degree polynomial whose four values are known.
 // The first one, at zero, is the one used for encryption, and the three others
 // at 1, 2 and 3 allow to retrieve the first one by interpolating two of them.
+// The values are taken modulo the order N of the curve.
 type PrivateKey [4][]byte
 
 // TableInfo allows to keep all the useful information on a given SQL table
@@ -61,6 +63,31 @@ type TableInfo struct {
 	colNames []string
 	colTypes []string
 	commands []byte
+	// primCols contains the numbers of the columns forming the primary key,
+	// PRIM_COL_NUMBER alone if it is empty
+	primCols []uint
+	// where, if not empty, is the condition selecting the rows of the table which are
+	// encrypted, its placeholders $1, $2... being bound to whereArgs
+	where     string
+	whereArgs []interface{}
+	// pkSecret, if not nil, is the secret with which the primary key columns are encrypted by
+	// EncryptPrimaryKey during the encryption of the table. It is not kept in the table of keys.
+	pkSecret []byte
+	// secretPrimaryKey tells that the primary key columns were encrypted with pkSecret, which is
+	// given again to AppendRowsWithOptions
+	secretPrimaryKey bool
+	// compactPoints makes the encryption as points use the compact encoding of compactValue
+	compactPoints bool
+	// rawBytes makes the columns be scanned as raw bytes, see EncryptOptions.RawBytes and scansRaw
+	rawBytes bool
+	// dialect is the dialect of SQL of the database receiving the encrypted table, see dialectOf
+	dialect int
+	// minCellVersion is the oldest version of the cells accepted at decryption, see
+	// RequireCellVersion, 0 accepting all of them
+	minCellVersion byte
+	// encName is the name of the encrypted table as written in the statements, schema included,
+	// see EncryptedName, the empty string standing for the default name_encrypted
+	encName string
 }
 
 // ArrayKeys contains all the keys allowing the decryption of a table.
@@ -70,6 +97,12 @@ type TableKeys struct {
 	ti   TableInfo
 	R    map[interface{}]*big.Int
 	Priv map[string]PrivateKey
+	// Shares, when it is not nil, contains by column and by share index the shares of a
+	// sharing of the keys between more than three key holders, see ShareKeys
+	Shares map[string]map[byte][]byte
+	// order gives the keys of the rows in the order in which they were encrypted, see
+	// EncryptedRows. It is not stored in the files of keys.
+	order []interface{}
 }
 
 // PartArrayKey describes the array of keys held by one of the key holders with respect
@@ -83,6 +116,324 @@ type PartTableKey struct {
 	PrivPart  map[string]*big.Int // les s_j,k
 }
 
+// Zeroize overwrites with zeros the private key and its shares, which can no longer be used
+// afterwards. It is meant to be deferred after SetKeys once the key is no longer needed.
+// Only the bytes held by priv are erased: the copies made by the functions which used the key,
+// the big.Int derived from it, or the copies made by the runtime when the garbage collector moves
+// or frees memory, are out of its reach, so that it reduces the exposure of the key in memory
+// without guaranteeing that no copy is left.
+func (priv *PrivateKey) Zeroize() {
+	for _, share := range priv {
+		zeroizeBytes(share)
+	}
+}
+
+// Zeroize overwrites with zeros the share of the private keys and the r values of the part of a
+// key holder, which can no longer be used afterwards. Like PrivateKey.Zeroize, it cannot reach
+// the copies made elsewhere.
+func (keys PartTableKey) Zeroize() {
+	for _, s := range keys.PrivPart {
+		zeroizeInt(s)
+	}
+	for _, r := range keys.R {
+		zeroizeInt(r)
+	}
+}
+
+// zeroizeBytes overwrites b with zeros
+func zeroizeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// zeroizeInt overwrites with zeros the words backing x and sets it to 0
+func zeroizeInt(x *big.Int) {
+	if x == nil {
+		return
+	}
+	words := x.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	x.SetInt64(0)
+}
+
+// Name returns the name of the table
+func (ti TableInfo) Name() string {
+	return ti.name
+}
+
+// ColumnNames returns the names of the columns of the table, in their order
+func (ti TableInfo) ColumnNames() []string {
+	return append([]string{}, ti.colNames...)
+}
+
+// ColumnTypes returns the SQL types of the columns of the table, in the order of ColumnNames
+func (ti TableInfo) ColumnTypes() []string {
+	return append([]string{}, ti.colTypes...)
+}
+
+// Commands returns the command with which each column was encrypted, in the order of ColumnNames:
+// 0 for a column left in clear, 1 for the encryption with hash function and 2 for the
+// encryption as a point
+func (ti TableInfo) Commands() []byte {
+	return append([]byte{}, ti.commands...)
+}
+
+// PrimaryKey returns the names of the columns forming the primary key of the table
+func (ti TableInfo) PrimaryKey() []string {
+	return ti.columnNames(ti.primaryKey())
+}
+
+// Info returns the description of the table the keys were generated for, which is given to the
+// decryption functions such as DecryptColumn
+func (keys TableKeys) Info() TableInfo {
+	return keys.ti
+}
+
+// ColumnModes returns the command with which each column of the table was encrypted, by name,
+// see Commands, so that the decryption of each column can be chosen: the columns of mode 1 are
+// decrypted with the hash function, those of mode 2 by a discrete logarithm, see Solver, and those
+// of mode 0 are read in clear.
+func (keys TableKeys) ColumnModes() map[string]byte {
+	modes := make(map[string]byte, len(keys.ti.colNames))
+	for j, name := range keys.ti.colNames {
+		modes[name] = keys.ti.commands[j]
+	}
+	return modes
+}
+
+// EncryptedName returns the name of the encrypted table, with its schema and quoted as it is
+// written in the statements, which the decryption functions query: the destination given by
+// EncryptOptions, or name_encrypted by default.
+func (ti TableInfo) EncryptedName() string {
+	if ti.encName == "" {
+		return EncryptOptions{}.destination(ti.name)
+	}
+	return ti.encName
+}
+
+// RequireCellVersion makes the decryption functions taking ti refuse the cells of a version older
+// than v, see CellVersion, with an error wrapping ErrCellDowngrade. The tables encrypted by the
+// current version of the package require CELL_V2, which is recorded in their files of keys, while
+// the tables of keys of older versions accept the cells of version 1 until this is called.
+func (ti *TableInfo) RequireCellVersion(v byte) {
+	ti.minCellVersion = v
+}
+
+// checkCellVersion checks that cell, encrypted with the command mode, is not of a version older
+// than the one required for the table, see RequireCellVersion. The commands other than 2 are
+// those of the encryption with hash function.
+func (ti TableInfo) checkCellVersion(cell []byte, mode byte) error {
+	if mode != 2 {
+		mode = 1
+	}
+	if v := CellVersion(cell, mode); v != 0 && v < ti.minCellVersion {
+		return fmt.Errorf("%w: version %d instead of %d", ErrCellDowngrade, v, ti.minCellVersion)
+	}
+	return nil
+}
+
+// primaryKey returns the numbers of the columns forming the primary key of the table
+func (ti TableInfo) primaryKey() []uint {
+	if len(ti.primCols) == 0 {
+		return []uint{PRIM_COL_NUMBER}
+	}
+	return ti.primCols
+}
+
+// isPrimaryKey tells if the column j is one of the columns of the primary key
+func (ti TableInfo) isPrimaryKey(j uint) bool {
+	for _, p := range ti.primaryKey() {
+		if p == j {
+			return true
+		}
+	}
+	return false
+}
+
+// columnNames returns the names of the columns of the given numbers
+func (ti TableInfo) columnNames(cols []uint) []string {
+	names := make([]string, len(cols))
+	for k, j := range cols {
+		names[k] = ti.colNames[j]
+	}
+	return names
+}
+
+// setPrimaryKey designates the columns, given by their names, forming the primary key of the table
+func (ti *TableInfo) setPrimaryKey(cols ...string) error {
+	primCols := make([]uint, len(cols))
+	for k, c := range cols {
+		found := false
+		for j := uint(0); j < ti.nCol; j++ {
+			if ti.colNames[j] == c {
+				primCols[k], found = j, true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("the primary key column %s does not exist in table %s", c, ti.name)
+		}
+	}
+	ti.primCols = primCols
+	return nil
+}
+
+// selectRows returns the query selecting the expressions cols in the rows of the table,
+// restricted by its condition if any, and the arguments to run it with
+func (ti TableInfo) selectRows(cols string) (string, []interface{}) {
+	if ti.where == "" {
+		return fmt.Sprintf("SELECT %s FROM %s;", cols, ti.name), nil
+	}
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s;", cols, ti.name, ti.where), ti.whereArgs
+}
+
+// CompositeKey returns the key of a row in the map R of a table of keys, from the values of its
+// primary key columns given in the order of the primary key. A single value is used as it is,
+// while several values are encoded deterministically into a string. The values of a UUID column
+// must be given as their canonical string, in lower case with hyphens, as the package stores them.
+func CompositeKey(vals ...interface{}) interface{} {
+	if len(vals) == 1 {
+		return vals[0]
+	}
+	parts := make([]string, len(vals))
+	for k, v := range vals {
+		parts[k] = strconv.Quote(fmt.Sprintf("%T:%v", v, v))
+	}
+	return "(" + strings.Join(parts, ",") + ")"
+}
+
+// rowKey returns the key of a row in the map R from the values of its primary key columns, in the
+// canonical form of their types, see canonicalValue
+func (ti TableInfo) rowKey(pkVals []interface{}) interface{} {
+	primCols := ti.primaryKey()
+	vals := make([]interface{}, len(pkVals))
+	for k, v := range pkVals {
+		vals[k] = v
+		if k < len(primCols) && int(primCols[k]) < len(ti.colTypes) {
+			vals[k] = canonicalValue(v, ti.colTypes[primCols[k]])
+		}
+		// The decimals are compared by their text, Numeric holding a pointer
+		if n, ok := vals[k].(Numeric); ok {
+			vals[k] = n.String()
+		}
+	}
+	return CompositeKey(vals...)
+}
+
+// canonicalValue returns the value v read from a column of type colType in the form used by the
+// package whatever the driver. The UUIDs, which the drivers give as text or as 16 bytes, are
+// given as their canonical string, in lower case with hyphens, so that they can be used as keys
+// of the map R and are encrypted and copied the same way. The other values are left unchanged.
+func canonicalValue(v interface{}, colType string) interface{} {
+	if isNumericType(colType) {
+		if n, err := numericOf(v); err == nil {
+			return n
+		}
+		return v
+	}
+	if colType != "UUID" {
+		return v
+	}
+	var b []byte
+	switch u := v.(type) {
+	case string:
+		b = []byte(u)
+	case []byte:
+		b = u
+	case [16]byte:
+		b = u[:]
+	default:
+		return v
+	}
+	if len(b) == 16 {
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	}
+	return strings.ToLower(strings.Trim(string(b), "{}"))
+}
+
+// Numeric is the exact value of a NUMERIC or DECIMAL cell, Unscaled⋅10^-Scale, which is the
+// canonical form of these columns: the values given by the drivers as text, like "-12.340", are
+// kept digit for digit, trailing zeros included, instead of being rounded to a float64. The
+// cells encrypted with the hash function hold the gob encoding of the Numeric, which decodeValue
+// gives back. The special values NaN and Infinity are not supported.
+type Numeric struct {
+	Unscaled *big.Int
+	Scale    int32
+}
+
+// isNumericType tells if the columns of type colType hold exact decimals
+func isNumericType(colType string) bool {
+	return !isArrayType(colType) && (strings.Contains(colType, "NUMERIC") || strings.Contains(colType, "DECIMAL"))
+}
+
+// isArrayType tells if the columns of type colType hold arrays, declared like TEXT[], INTEGER[3]
+// or INTEGER ARRAY
+func isArrayType(colType string) bool {
+	return strings.HasSuffix(colType, "]") || strings.Contains(colType, "ARRAY")
+}
+
+// isUserDefinedType tells if colType is a composite type, an enumeration or another type defined
+// in the database, whose name is quoted by postgresColumnTypes
+func isUserDefinedType(colType string) bool {
+	return strings.HasPrefix(colType, `"`)
+}
+
+// ParseNumeric reads a decimal written like "-12.340", without exponent
+func ParseNumeric(s string) (Numeric, error) {
+	digits := strings.TrimPrefix(strings.TrimPrefix(s, "+"), "-")
+	intPart, fracPart := digits, ""
+	if k := strings.IndexByte(digits, '.'); k >= 0 {
+		intPart, fracPart = digits[:k], digits[k+1:]
+	}
+	if intPart+fracPart == "" || strings.Trim(intPart+fracPart, "0123456789") != "" {
+		return Numeric{}, fmt.Errorf("invalid decimal %q", s)
+	}
+	unscaled, _ := new(big.Int).SetString(intPart+fracPart, 10)
+	if strings.HasPrefix(s, "-") {
+		unscaled.Neg(unscaled)
+	}
+	return Numeric{Unscaled: unscaled, Scale: int32(len(fracPart))}, nil
+}
+
+// String writes the decimal with Scale digits after the point
+func (n Numeric) String() string {
+	if n.Unscaled == nil {
+		return "0"
+	}
+	digits := new(big.Int).Abs(n.Unscaled).String()
+	if n.Scale > 0 {
+		if pad := int(n.Scale) + 1 - len(digits); pad > 0 {
+			digits = strings.Repeat("0", pad) + digits
+		}
+		digits = digits[:len(digits)-int(n.Scale)] + "." + digits[len(digits)-int(n.Scale):]
+	}
+	if n.Unscaled.Sign() < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+// numericOf returns the Numeric of a NUMERIC cell given by a driver as text, or as a float64 by
+// the drivers which do not keep the decimals, such as the one of SQLite
+func numericOf(v interface{}) (Numeric, error) {
+	switch n := v.(type) {
+	case Numeric:
+		return n, nil
+	case []byte:
+		return ParseNumeric(string(n))
+	case string:
+		return ParseNumeric(n)
+	case float64:
+		return ParseNumeric(strconv.FormatFloat(n, 'f', -1, 64))
+	case int64:
+		return Numeric{Unscaled: big.NewInt(n)}, nil
+	}
+	return Numeric{}, fmt.Errorf("no decimal for a value of type %T", v)
+}
+
 // coord is a type that corresponds to coordinates in a SQL table in their most convenient form.
 // i corresponds to the primary key, which will identify the line, and j is the name of the column,
 // which can be more convenient to manipulate than its number in the case of queries.
@@ -92,6 +443,16 @@ type coord struct {
 	j string
 }
 
+// Coord is the exported name of coord, so that the callers can declare the coordinates given by
+// NewCoord and the maps of coefficients of DecryptLinearCombination and GiveKeyCalculation
+type Coord = coord
+
+// NewCoord returns the coordinates of the cell of column col in the row whose primary key
+// is given by the values of its columns
+func NewCoord(col string, primaryKey ...interface{}) Coord {
+	return coord{CompositeKey(primaryKey...), col}
+}
+
 /*********************************************************************************************
  *
  * Definition of the variables and constants (global to the package)
@@ -104,25 +465,164 @@ const (
 	ADMIN        = 3
 )
 
+// Number of key holders whose contributions are needed to rebuild a decryption key
+const KEY_THRESHOLD = 2
+
 // This value describes the length in bytes of the representation of a point of the curve in short form
 // It must be changed if the curve is modified.
 const SHORT_POINT_LENGTH = 29
 
-// Indicates that the column that will serve as primary key is the first
+// Indicates that the column that will serve as primary key is the first,
+// unless other columns are given in the options of the encryption
 const PRIM_COL_NUMBER = 0
 
+// Maximum number of bytes of a message encrypted as a point on the curve. Beyond it, the
+// discrete logarithm needed to decrypt the message cannot be computed in practice.
+const MAX_POINT_BYTES = 6
+
+// Maximum number of bytes of the values searched by the kangaroo algorithm, whose number of
+// jumps 2^(4⋅bytesNumber) is counted on 64 bits
+const KANGAROO_MAX_BYTES = 8
+
 // Maximum number of routines that we launch on the algorithms or the level of parallelization is variable
 const MAX_ROUTINES = 4
 
 // Number of bits of each encoded message (imposed by the hash algorithm)
 const BytesNumber = sha512.Size // = 64
 
+// Format versions of the encrypted cells. A versioned cell starts with CELL_MAGIC followed by
+// its version. The cells of version 1, written before the versioning, have no header: the hash
+// encrypted ones are the bare XORed data and the point ones the 29 bytes of the short form.
+// Version 2 adds an integrity tag to the hash encrypted cells. The large values encrypted by
+// NewStreamEncrypter start with CELL_MAGIC followed by CELL_STREAM, and the point cells whose
+// value has the compact encoding of compactValue with CELL_MAGIC followed by CELL_COMPACT.
+const (
+	CELL_MAGIC   = 0xEC
+	CELL_V1      = 1
+	CELL_V2      = 2
+	CELL_VERSION = CELL_V2 // version of the cells written by the package
+	CELL_STREAM  = 0x53
+	CELL_COMPACT = 0x43
+)
+
+// authHeader starts the cells of the current version. The hash encrypted ones are followed by
+// an integrity tag of authTagLength bytes.
+var authHeader = []byte{CELL_MAGIC, CELL_VERSION}
+
+const authTagLength = sha256.Size
+
+// streamHeader starts the values encrypted by NewStreamEncrypter, which are read and written by
+// chunks of streamChunkSize bytes
+var streamHeader = []byte{CELL_MAGIC, CELL_STREAM}
+
+const streamChunkSize = 32 << 10
+
+// compactHeader starts the point cells whose value has the compact encoding, see CompactPoints
+var compactHeader = []byte{CELL_MAGIC, CELL_COMPACT}
+
+// ErrPointOutOfRange is returned when the discrete logarithm of a point is not in the range searched,
+// or when a value is too large to be encrypted as a point
+var ErrPointOutOfRange = errors.New("the point does not encode a value in the range searched")
+
+// ErrSolverClosed is returned when a discrete logarithm is asked to a closed Solver
+var ErrSolverClosed = errors.New("the solver is closed")
+
+// ErrRandomSource is wrapped by the errors due to a random source that cannot be used
+var ErrRandomSource = errors.New("the random source is not usable")
+
+// ErrInvalidPoint is returned when a point received is not on the curve
+var ErrInvalidPoint = errors.New("the point is not on the curve")
+
+// ErrDiscreteLogNotFound is returned when an algorithm stops without finding a discrete logarithm
+// which may exist, as the rho algorithm of Pollard on a collision that gives no solution
+var ErrDiscreteLogNotFound = errors.New("the discrete logarithm was not found")
+
+// ErrWrongDiscreteLog is returned when the discrete logarithm found for a point does not give the
+// point back, which reveals a defect of the solver rather than of the cell
+var ErrWrongDiscreteLog = errors.New("the discrete logarithm found does not give the point back")
+
+// ErrInvalidShareIndex is wrapped by the errors due to the number of a key holder which does not
+// correspond to a share of the private keys
+var ErrInvalidShareIndex = errors.New("invalid share index")
+
+// ErrUnsupportedColumnType is wrapped by the errors due to a column whose type cannot be
+// encrypted, or copied, as asked
+var ErrUnsupportedColumnType = errors.New("unsupported column type")
+
+// ErrNotEncryptedColumn is wrapped by the errors due to a column which is not encrypted in the way
+// the operation needs
+var ErrNotEncryptedColumn = errors.New("the column is not encrypted")
+
+// ErrNotCompact is wrapped by the errors due to a point cell without the compact encoding of
+// CompactPoints where the values themselves are needed, such as in a linear combination, the
+// combinations of the gob encodings of the values not being those of the values
+var ErrNotCompact = errors.New("the cell does not have the compact encoding")
+
+// ErrCellDowngrade is wrapped by the errors due to a cell of a version older than the one required
+// for its table, such as a cell of version 2 stripped of its header and its tag to pass for a cell
+// of version 1, whose content is not authenticated, see RequireCellVersion
+var ErrCellDowngrade = errors.New("the cell is of a version older than the one of its table")
+
+// ErrNullValue is wrapped by the errors due to a NULL value where a value is needed
+var ErrNullValue = errors.New("NULL value")
+
+// ErrDuplicatePrimaryKey is wrapped by the errors due to a primary key whose values are not unique
+// in the table, which cannot identify the rows in the table of keys
+var ErrDuplicatePrimaryKey = errors.New("duplicate primary key")
+
+// ErrLegacyShares is wrapped by the errors of ExtractPart on a private key whose shares were made
+// byte by byte in GF(256) by the versions of SetKeys before the shares modulo N: the key points
+// of such shares cannot be combined by CombineColumnKeys. The keys must be shared again by
+// ShareKeys, whose shares are used instead.
+var ErrLegacyShares = errors.New("the shares of the key are not taken modulo the order of the curve")
+
+// ErrTooFewHolders is wrapped by the errors due to fewer than KEY_THRESHOLD key holders answering
+// a request for their key points, see GatherHolderPoints
+var ErrTooFewHolders = errors.New("too few key holders answered")
+
+// ErrAuthentication is returned when the integrity tag of an encrypted cell does not match its content
+var ErrAuthentication = errors.New("the encrypted data failed authentication")
+
+// ErrKeyMismatch is returned when a decryption key, or a key point given by a key holder, does not
+// match the public key of its column
+var ErrKeyMismatch = errors.New("the key does not match the public key")
+
+// ErrMessageTooLong is wrapped by the errors due to a message longer than MaxMessageLength
+var ErrMessageTooLong = errors.New("the message is too long")
+
+// MaxMessageLength is the maximum length in bytes of the messages encrypted with the hash
+// function, and of the data decrypted with it, which guards against the allocation of huge cells
+// for a multi-megabyte value. 0 removes the limit.
+var MaxMessageLength = 1 << 20
+
+// checkMessageLength returns an error wrapping ErrMessageTooLong if a message of n bytes is
+// longer than MaxMessageLength
+func checkMessageLength(n int) error {
+	if MaxMessageLength > 0 && n > MaxMessageLength {
+		return fmt.Errorf("%w: %d bytes, more than the %d bytes allowed", ErrMessageTooLong, n, MaxMessageLength)
+	}
+	return nil
+}
+
+// checkR returns an error if r, used to encrypt, is not between 1 and n-1, n being the order of
+// the curve
+func checkR(r, n *big.Int) error {
+	if r == nil || r.Sign() <= 0 || r.Cmp(n) >= 0 {
+		return errors.New("r must be between 1 and the order of the curve")
+	}
+	return nil
+}
+
 // Elliptic curve used
 var myCurve = elliptic.P224()
 var P = myCurve.Params().P
 var N = myCurve.Params().N
 var G = CPoint{myCurve.Params().Gx, myCurve.Params().Gy}
-var pointZero = G.subC(G)
+
+// Identity is the point at infinity, the neutral element of the curve, represented by the
+// coordinates (0,0) like in elliptic. The operators below also accept it with nil coordinates.
+var Identity = CPoint{new(big.Int), new(big.Int)}
+var pointZero = Identity
 var Big0 = big.NewInt(0)
 var Big1 = big.NewInt(1)
 var Big2 = big.NewInt(2)
@@ -142,12 +642,29 @@ func checkErr(err error) {
 	}
 }
 
+// curveOf returns the curve of a key, the curve of the package if it has none
+func curveOf(curve elliptic.Curve) elliptic.Curve {
+	if curve == nil {
+		return myCurve
+	}
+	return curve
+}
+
 // checkPoint checks the validity of a point of type CPoint
 // and panics if it is not on the curve
 func checkPoint(p CPoint) {
-	if !(myCurve.Params()).IsOnCurve(p.x, p.y) {
-		panic(errors.New("A point is not on the curve."))
+	checkErr(validatePoint(p))
+}
+
+// validatePoint returns ErrInvalidPoint if p is not a point of the curve. It must be called on
+// every point received from outside before multiplying it by a secret scalar, since the
+// multiples of a point chosen off the curve may leak information on the scalar.
+// The point at infinity is not accepted either.
+func validatePoint(p CPoint) error {
+	if p.x == nil || p.y == nil || !(myCurve.Params()).IsOnCurve(p.x, p.y) {
+		return ErrInvalidPoint
 	}
+	return nil
 }
 
 /*********************************************************************************************
@@ -163,7 +680,11 @@ func (pt CPoint) String() string {
 // baseMult is an intermediate to simplify the writing and avoid
 // passing through ScalarBaseMult of elliptic, with a scalar in input
 // in the form of * big.Int
+// A negative scalar is taken modulo N, like in mult.
 func baseMult(a *big.Int) (r CPoint) {
+	if a.Sign() < 0 {
+		a = new(big.Int).Mod(a, N)
+	}
 	r.x, r.y = (myCurve.Params()).ScalarBaseMult(a.Bytes())
 	return
 }
@@ -176,32 +697,110 @@ func baseMultB(a []byte) (r CPoint) {
 	return
 }
 
+// BaseTableWindow is the width in bits of the windows of the table of multiples of g built by
+// SetTableKeys to compute the verifiers of all the columns. 0 disables the table.
+// The P224 implementation of the standard library already uses its own precomputed table, so
+// that the table only pays off with a curve relying on the generic code of elliptic.CurveParams.
+var BaseTableWindow uint = 0
+
+// baseTable contains the multiples of g needed to compute k⋅g with one addition per window of
+// w bits of k: pts[i][d-1] = d⋅2^(w⋅i)⋅g
+type baseTable struct {
+	w   uint
+	pts [][]CPoint
+}
+
+// newBaseTable precomputes the table of multiples of g for windows of w bits
+func newBaseTable(w uint) *baseTable {
+	bt := &baseTable{w: w}
+	nWin := (uint(N.BitLen()) + w - 1) / w
+	bt.pts = make([][]CPoint, nWin)
+	base := G
+	for i := range bt.pts {
+		bt.pts[i] = make([]CPoint, 1<<w-1)
+		bt.pts[i][0] = base
+		for d := 1; d < len(bt.pts[i]); d++ {
+			bt.pts[i][d] = addC(bt.pts[i][d-1], base)
+		}
+		base = addC(bt.pts[i][len(bt.pts[i])-1], base)
+	}
+	return bt
+}
+
+// mult computes k⋅g, k being given in big endian like for baseMultB
+func (bt *baseTable) mult(a []byte) CPoint {
+	k := new(big.Int).SetBytes(a)
+	if k.BitLen() > N.BitLen() {
+		k.Mod(k, N)
+	}
+	r := pointZero
+	mask := big.NewInt(1<<bt.w - 1)
+	d := new(big.Int)
+	for i := range bt.pts {
+		d.Rsh(k, uint(i)*bt.w).And(d, mask)
+		if d.Sign() != 0 {
+			r = addC(r, bt.pts[i][d.Int64()-1])
+		}
+	}
+	return r
+}
+
 // mult is an intermediate to simplify the writing and avoid
 // passing through ScalarBaseMult of elliptic, with a scalar in input
 // in the form of * big.Int
+// The scalar is reduced modulo N, so that a negative scalar gives the opposite multiple instead of
+// losing its sign in Bytes.
 func (p CPoint) mult(a *big.Int) (r CPoint) {
-	r.x, r.y = (myCurve.Params()).ScalarMult(p.x, p.y, a.Bytes())
-	return
+	if a.Sign() < 0 || a.Cmp(N) >= 0 {
+		a = new(big.Int).Mod(a, N)
+	}
+	return p.multB(a.Bytes())
 }
 
 // mult is an intermediate to simplify the writing and avoid
 // passing through ScalarBaseMult of elliptic, with a scalar in input
 // in the form of [] byte
+// Any multiple of the identity is the identity.
 func (p CPoint) multB(a []byte) (r CPoint) {
+	if p.IsIdentity() {
+		return Identity
+	}
 	r.x, r.y = (myCurve.Params()).ScalarMult(p.x, p.y, a)
 	return
 }
 
 // addC is an intermediate to simplify the writing and avoid
 // passing through Add of elliptic
+// Adding the identity leaves a point unchanged, and the sum of two opposite points is the identity.
 func addC(p, q CPoint) (r CPoint) {
+	switch {
+	case p.IsIdentity():
+		return q.normalized()
+	case q.IsIdentity():
+		return p
+	case p.x.Cmp(q.x) == 0 && p.y.Cmp(q.y) != 0:
+		return Identity
+	}
 	r.x, r.y = (myCurve.Params()).Add(p.x, p.y, q.x, q.y)
 	return
 }
 
-// negC gives the opposite of a point on an elliptic curve
+// normalized returns p, the identity being given with the coordinates (0,0)
+func (p CPoint) normalized() CPoint {
+	if p.IsIdentity() {
+		return Identity
+	}
+	return p
+}
+
+// negC gives the opposite of a point on an elliptic curve.
+// The ordinate is kept in [0;p[ so that the result is still accepted by elliptic.
+// The opposite of the identity is the identity.
 func (p CPoint) negC() (r CPoint) {
-	r.x, r.y = p.x, new(big.Int).Neg(p.y)
+	if p.IsIdentity() {
+		return Identity
+	}
+	r.x, r.y = p.x, new(big.Int).Mod(new(big.Int).Sub(P, p.y), P)
 	return
 }
 
@@ -214,12 +813,65 @@ func (p CPoint) subC(q CPoint) CPoint {
 // equal is a method on points of an elliptic curve to
 // check their equality
 func (this CPoint) equalC(p CPoint) bool {
-	return (this.x.Cmp(p.x) == 0) && (this.y.Cmp(p.y) == 0)
+	return this.Equal(p)
+}
+
+// coordOrZero returns the coordinate c, a nil coordinate standing for 0
+func coordOrZero(c *big.Int) *big.Int {
+	if c == nil {
+		return Big0
+	}
+	return c
+}
+
+// Equal checks whether p and q are the same point of the curve.
+// The point at infinity may be given either as (0,0) or with nil coordinates.
+func (p CPoint) Equal(q CPoint) bool {
+	return coordOrZero(p.x).Cmp(coordOrZero(q.x)) == 0 && coordOrZero(p.y).Cmp(coordOrZero(q.y)) == 0
+}
+
+// IsIdentity checks whether p is the point at infinity, the neutral element of the curve
+func (p CPoint) IsIdentity() bool {
+	return coordOrZero(p.x).Sign() == 0 && coordOrZero(p.y).Sign() == 0
+}
+
+// Equal checks whether two cyphers have the same random point and the same data
+func (c Cypher) Equal(d Cypher) bool {
+	return c.C.Equal(d.C) && bytes.Equal(c.Data, d.Data)
+}
+
+// Equal checks whether two point cyphers have the same random point and the same data
+func (c CypherPoint) Equal(d CypherPoint) bool {
+	return c.C.Equal(d.C) && c.Data == d.Data
+}
+
+// DataPoint returns the point m.G + r.Y held in short form in Data, for the homomorphic
+// operations. An error is returned if Data does not represent a point of the curve.
+func (c CypherPoint) DataPoint() (CPoint, error) {
+	return pointFromShortBytes(c.Data[:])
+}
+
+// SetDataPoint stores p in short form in Data. The cypher is not modified if p is not a point
+// of the curve, the point at infinity included since it has no short form.
+func (c *CypherPoint) SetDataPoint(p CPoint) error {
+	if err := validatePoint(p); err != nil {
+		return err
+	}
+	sp, err := GetShortOf(p)
+	if err != nil {
+		return err
+	}
+	c.Data = sp
+	return nil
 }
 
 // double is an intermediate to simplify the writing and avoid
 // passing through Double of elliptic
+// The double of the identity is the identity.
 func (p CPoint) doubleC() (r CPoint) {
+	if p.IsIdentity() {
+		return Identity
+	}
 	r.x, r.y = (myCurve.Params()).Double(p.x, p.y)
 	return
 }
@@ -237,26 +889,121 @@ func (p CPoint) doubleC() (r CPoint) {
  *		| 1 if y >= p/2
  * Indeed, for a given x we find at most two points whose ordinates are
  * y and (p - y), because they have the same square modulo p.
+ * When ShortPointParity is set, f(y) is 2 plus the parity of y instead, as in the compressed form
+ * of elliptic.MarshalCompressed: y and (p - y) never have the same parity since p is odd.
+ * The first byte thus tells which of the two forms a short point has, and the points are read
+ * in their own form whatever the setting.
  *
  *
  ***********************************************************************************************/
 
-// GetShortOf returns the minimal representation of a point of an elliptic curve
-func GetShortOf(p CPoint) (sp ShortPoint) {
-	var middle = new(big.Int).Div(P, Big2)
-	if p.y.Cmp(middle) >= 0 {
-		sp[0] = 1
-	} else {
-		sp[0] = 0
+// ShortPointParity makes the short form store 2 plus the parity of the ordinate instead of its
+// position relatively to p/2, so that a ShortPoint is the compressed form of
+// elliptic.MarshalCompressed. It only selects the form of the points written: the first byte of
+// a short form, 0 or 1 in one form and 2 or 3 in the other, records the form used, so that the
+// cells written with either setting are read with any of them.
+var ShortPointParity = false
+
+// SHORT_PARITY is the first byte of the short forms with the parity of the ordinate, for an even one
+const SHORT_PARITY = 2
+
+// signOf returns the byte f(y) stored first in the short form of a point, in the form with the
+// parity of the ordinate if parity is set
+func signOf(y *big.Int, parity bool) byte {
+	if parity {
+		return SHORT_PARITY + byte(y.Bit(0))
+	}
+	if y.Cmp(new(big.Int).Div(P, Big2)) >= 0 {
+		return 1
+	}
+	return 0
+}
+
+// withSign returns, from one of the two ordinates y and p - y of an abscissa, the one whose
+// byte f is sign, in the form that sign records
+func withSign(y *big.Int, sign byte) *big.Int {
+	if signOf(y, sign >= SHORT_PARITY) != sign {
+		return y.Sub(P, y)
+	}
+	return y
+}
+
+// GetShortOf returns the minimal representation of a point of an elliptic curve, in the form
+// selected by ShortPointParity
+// An error is returned if the abscissa of the point is not in the field of the curve, in which
+// case it may not fit in the short form.
+func GetShortOf(p CPoint) (sp ShortPoint, err error) {
+	return shortForm(p, ShortPointParity)
+}
+
+// shortForm is GetShortOf in the form with the parity of the ordinate if parity is set
+func shortForm(p CPoint, parity bool) (sp ShortPoint, err error) {
+	x, y := coordOrZero(p.x), coordOrZero(p.y)
+	if x.Sign() < 0 || x.Cmp(P) >= 0 {
+		return sp, fmt.Errorf("the abscissa %x is not in the field of the curve", x)
 	}
-	temp := p.x.Bytes()
+	temp := x.Bytes()
 	lx := len(temp)
+	if lx > SHORT_POINT_LENGTH-1 {
+		return sp, fmt.Errorf("the abscissa takes %d bytes, more than the %d of the short form", lx, SHORT_POINT_LENGTH-1)
+	}
+	sp[0] = signOf(y, parity)
 	for i := 1; i <= lx; i++ {
 		sp[SHORT_POINT_LENGTH-i] = temp[lx-i]
 	}
 	return
 }
 
+// checkShortPoint checks that the short form sp gives the point p back, as PointFromShort decodes
+// it: its abscissa must be the one of p, and its sign must select the ordinate of p and not the
+// opposite one. A short form truncated, or whose sign does not tell the two ordinates apart, is
+// thus caught when it is written instead of when it is decrypted. The square root computed by
+// PointFromShort, which costs as much as dozens of multiplications of points, is not needed as
+// the point is checked to be on the curve.
+func checkShortPoint(p CPoint, sp ShortPoint) error {
+	if err := validatePoint(p); err != nil {
+		return err
+	}
+	if x := new(big.Int).SetBytes(sp[1:]); x.Cmp(p.x) != 0 {
+		return fmt.Errorf("the short form gives the abscissa %x instead of %x", x, p.x)
+	}
+	parity := sp[0] >= SHORT_PARITY
+	if signOf(p.y, parity) != sp[0] || signOf(new(big.Int).Sub(P, p.y), parity) == sp[0] {
+		return fmt.Errorf("the sign %d of the short form does not give the ordinate %x", sp[0], p.y)
+	}
+	return nil
+}
+
+// checkedShortOf is GetShortOf followed by checkShortPoint, for the points stored in the cells
+func checkedShortOf(p CPoint) (ShortPoint, error) {
+	sp, err := GetShortOf(p)
+	if err != nil {
+		return sp, err
+	}
+	return sp, checkShortPoint(p, sp)
+}
+
+// shortOf is GetShortOf for the points computed by the package, which are always on the curve.
+// It always gives the form with the position of the ordinate, so that the tables keyed by it do
+// not depend on ShortPointParity.
+func shortOf(p CPoint) ShortPoint {
+	sp, err := shortForm(p, false)
+	checkErr(err)
+	return sp
+}
+
+// Bytes returns a copy of the bytes of the short form
+func (sp ShortPoint) Bytes() []byte {
+	return append([]byte{}, sp[:]...)
+}
+
+// Compare returns -1, 0 or +1 as sp is lower than, equal to or greater than sp2 in the
+// lexicographical order of their bytes, the order of bytes.Compare, so that the short forms can
+// be sorted and searched by dichotomy
+func (sp ShortPoint) Compare(sp2 ShortPoint) int {
+	return bytes.Compare(sp[:], sp2[:])
+}
+
 // YFromX gives the positive ordinate of the point of the curve corresponding to the abscissa x
 // It returns an error if this point does not exist.
 // We recall that the curve formula is y^2 = x^3 - 3*x + b
@@ -271,7 +1018,7 @@ func YFromX(x *big.Int) (y *big.Int, err error) {
 
 	ok := y.ModSqrt(y, P)
 	if ok == nil {
-		err = errors.New("L'abscisse x ne correspond pas à un point de la courbe.")
+		err = fmt.Errorf("%w: no point of the curve has the abscissa %s", ErrInvalidPoint, x)
 	}
 	return
 }
@@ -283,26 +1030,33 @@ func PointFromShort(sp ShortPoint) (p CPoint) {
 	p.x = new(big.Int).SetBytes(sp[1:SHORT_POINT_LENGTH])
 	p.y, err = YFromX(p.x)
 	checkErr(err)
-	var middle = new(big.Int).Div(P, Big2)
-	if (p.y.Cmp(middle) < 0) && (sp[0] == 1) {
-		p.y.Sub(P, p.y)
-	} else if (p.y.Cmp(middle) >= 0) && (sp[0] == 0) {
-		p.y.Sub(P, p.y)
-	}
+	p.y = withSign(p.y, sp[0])
 	return
 }
 
 // PointFromBytes is the equivalent of PointFromShort but taking bytes as input
 func PointFromBytes(sp []byte) (p CPoint) {
-	var err error
-	p.x = new(big.Int).SetBytes(sp[1:SHORT_POINT_LENGTH])
-	p.y, err = YFromX(p.x)
+	p, err := pointFromShortBytes(sp)
 	checkErr(err)
-	var middle = new(big.Int).Div(P, Big2)
-	if (p.y.Cmp(middle) < 0) && (sp[0] == 1) {
-		p.y.Sub(P, p.y)
-	} else if (p.y.Cmp(middle) >= 0) && (sp[0] == 0) {
-		p.y.Sub(P, p.y)
+	return
+}
+
+// pointFromShortBytes is PointFromBytes returning an error instead of panicking when the bytes
+// do not represent a point of the curve
+func pointFromShortBytes(sp []byte) (p CPoint, err error) {
+	if len(sp) != SHORT_POINT_LENGTH {
+		return p, fmt.Errorf("a point takes %d bytes in short form, not %d", SHORT_POINT_LENGTH, len(sp))
+	}
+	if sp[0] > SHORT_PARITY+1 {
+		return p, fmt.Errorf("%w: the short form starts with %d instead of 0 to %d", ErrInvalidPoint, sp[0], SHORT_PARITY+1)
+	}
+	p.x = new(big.Int).SetBytes(sp[1:SHORT_POINT_LENGTH])
+	if p.y, err = YFromX(p.x); err != nil {
+		return CPoint{}, err
+	}
+	p.y = withSign(p.y, sp[0])
+	if err = validatePoint(p); err != nil {
+		return CPoint{}, err
 	}
 	return
 }
@@ -313,42 +1067,77 @@ func PointFromBytes(sp []byte) (p CPoint) {
  *
  *********************************************************************************************/
 
-func tableInfoFromDB(db *sql.DB, name string, comm ...byte) (ti TableInfo) {
-	ti.name = name
-	/* We get the dimensions of the table and the names of the columns */
-	oneRow, err := db.Query(fmt.Sprintf("SELECT * FROM %s LIMIT 1;", name))
-	checkErr(err)
-	ti.colNames, _ = oneRow.Columns()
-	ti.nCol = uint(len(ti.colNames))
-	err = db.QueryRow(fmt.Sprintf("SELECT COUNT (*) FROM %s;", name)).Scan(&ti.nRows)
-	checkErr(err)
+// Dialects of SQL spoken by the databases supported. The databases of DIALECT_MYSQL are not yet
+// recognized by dialectOf, only the literals and the binary type of this dialect are written.
+const (
+	DIALECT_POSTGRES = iota
+	DIALECT_SQLITE
+	DIALECT_MYSQL
+)
 
-	/* We get the data types in the columns */
-	ti.colTypes = make([]string, ti.nCol)
-	rowsColTypes, err := db.Query(fmt.Sprintf("SELECT data_type FROM information_schema.columns WHERE table_name = '%s';", name))
-	checkErr(err)
-	for j := 0; rowsColTypes.Next(); j++ {
-		err = rowsColTypes.Scan(&ti.colTypes[j])
-		ti.colTypes[j] = strings.ToUpper(ti.colTypes[j])
-		checkErr(err)
-	}
+// dialectNames are the names of the dialects in the manifests, see Manifest
+var dialectNames = map[int]string{DIALECT_POSTGRES: "postgres", DIALECT_SQLITE: "sqlite", DIALECT_MYSQL: "mysql"}
 
-	if (ti.nCol > 0) && (uint(len(comm)) != ti.nCol) {
-		ti.commands = make([]byte, ti.nCol)
+// binaryType returns the type of the binary columns, which receive the encrypted cells
+func binaryType(dialect int) string {
+	switch dialect {
+	case DIALECT_SQLITE:
+		return "BLOB"
+	case DIALECT_MYSQL:
+		return "LONGBLOB"
+	}
+	return "BYTEA"
+}
 
-		// If no instructions then we encrypt everything without calculation except the first column which
-		// is supposed to be the primary key column
+// hexLiteral writes the bytes b as a SQL literal of the given dialect, in hexadecimal so that
+// no byte has to be escaped: decode('...', 'hex') for Postgres and x'...' for SQLite and MySQL.
+// All the binary values written in the SQL statements go through it.
+func hexLiteral(dialect int, b []byte) string {
+	switch dialect {
+	case DIALECT_SQLITE, DIALECT_MYSQL:
+		return fmt.Sprintf("x'%x'", b)
+	}
+	return fmt.Sprintf("decode('%x', 'hex')", b)
+}
 
-		ti.commands[0] = 0
-		for j := uint(0); j < ti.nCol; j++ {
-			ti.commands[j] = 1
+// splitTableName separates the optional schema of a table name, as in schema.table, from the
+// name of the table itself. Quoted identifiers keep their case and may contain dots, while
+// unquoted ones are folded to lower case as Postgres does.
+func splitTableName(name string) (schema, table string) {
+	var parts []string
+	var buffer bytes.Buffer
+	quoted := false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case (c == '"') && quoted && (i+1 < len(name)) && (name[i+1] == '"'):
+			buffer.WriteByte('"')
+			i++
+		case c == '"':
+			quoted = !quoted
+		case (c == '.') && !quoted:
+			parts = append(parts, buffer.String())
+			buffer.Reset()
+		case !quoted && ('A' <= c) && (c <= 'Z'):
+			buffer.WriteByte(c + 'a' - 'A')
+		default:
+			buffer.WriteByte(c)
 		}
-	} else {
-		ti.commands = comm
+	}
+	parts = append(parts, buffer.String())
+	table = parts[len(parts)-1]
+	if len(parts) > 1 {
+		schema = parts[len(parts)-2]
 	}
 	return
 }
 
+// quoteIdent writes an identifier between double quotes, the double quotes it contains being
+// doubled, so that it keeps its case and cannot be read as anything else
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
 // getCols returns the list of columns with names and types for the construction of the new table
 func getColsString(ti TableInfo) string {
 	// We use a buffer, which is more efficient for concatenating strings than the use of the + operator between string variables
@@ -359,10 +1148,14 @@ func getColsString(ti TableInfo) string {
 		}
 		buffer.WriteString(ti.colNames[j])
 		buffer.WriteString(" ")
-		if ti.commands[j] == 0 {
+		if ti.commands[j] == 0 && ti.pkSecret != nil && ti.isPrimaryKey(j) {
+			// The primary keys encrypted by EncryptPrimaryKey are text, whatever their type
+			buffer.WriteString("TEXT")
+		} else if ti.commands[j] == 0 {
 			buffer.WriteString(ti.colTypes[j])
 		} else {
-			buffer.WriteString("BYTEA DEFAULT NULL")
+			buffer.WriteString(binaryType(ti.dialect))
+			buffer.WriteString(" DEFAULT NULL")
 		}
 	}
 	return buffer.String()